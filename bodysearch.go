@@ -0,0 +1,421 @@
+package puppy
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+Structured body search
+
+JSON and XML bodies are flattened into key/value pairs so that they can be searched
+like headers. The key of each pair is a normalized path to a value in the body and
+the value is the value at that path:
+
+	JSON: $.user.role, $.items[0].id, $['key with spaces']
+	XML:  /html[1]/body[1]/div[2], /root[1]/item[1]/@id
+
+Objects, arrays and elements with children are included so that searches can check
+if a path is present. When a key is compared with StrIs, the key is treated as a
+JSONPath or XPath expression which may use wildcards (*) and recursive descent
+(.. in JSONPath, // in XPath).
+*/
+
+var jsonPathIdentRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Matches any single step of a normalized JSON path
+const jsonPathAnyStep = `(?:\.[A-Za-z_][A-Za-z0-9_]*|\['(?:[^'\\]|\\.)*'\]|\[[0-9]+\])`
+
+// Returns the normalized JSON path step for an object key
+func jsonPathName(name string) string {
+	if jsonPathIdentRegexp.MatchString(name) {
+		return "." + name
+	}
+	name = strings.Replace(name, `\`, `\\`, -1)
+	name = strings.Replace(name, `'`, `\'`, -1)
+	return "['" + name + "']"
+}
+
+// Returns the value of a parsed JSON value as a string. Objects and arrays are JSON encoded.
+func jsonPairValue(val interface{}) string {
+	switch v := val.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	case nil:
+		return "null"
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return ""
+		}
+		return string(b)
+	}
+}
+
+func appendJSONPairs(pairs []*PairValue, path string, val interface{}) []*PairValue {
+	pairs = append(pairs, &PairValue{key: path, value: jsonPairValue(val)})
+	switch v := val.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			pairs = appendJSONPairs(pairs, path+jsonPathName(key), v[key])
+		}
+	case []interface{}:
+		for i, elem := range v {
+			pairs = appendJSONPairs(pairs, path+"["+strconv.Itoa(i)+"]", elem)
+		}
+	}
+	return pairs
+}
+
+// Returns a pair for every value in a JSON document keyed by its normalized JSON path
+func jsonBodyPairs(body []byte) ([]*PairValue, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var val interface{}
+	if err := dec.Decode(&val); err != nil {
+		return nil, fmt.Errorf("body is not valid JSON: %s", err.Error())
+	}
+	if dec.More() {
+		return nil, errors.New("body is not valid JSON: unexpected data after value")
+	}
+	return appendJSONPairs(nil, "$", val), nil
+}
+
+// Returns the pairs for a JSON body or no pairs if the body is not valid JSON
+func jsonPairsOrEmpty(body []byte) []*PairValue {
+	pairs, err := jsonBodyPairs(body)
+	if err != nil {
+		return make([]*PairValue, 0)
+	}
+	return pairs
+}
+
+// Converts a JSONPath expression into a regular expression that matches the normalized paths it selects. Supports names, indices, quoted names, wildcards and recursive descent. Expressions that don't start with $ are relative to the root.
+func jsonPathToRegexp(path string) (string, error) {
+	if strings.HasPrefix(path, "$") {
+		path = path[1:]
+	} else if !strings.HasPrefix(path, "[") && !strings.HasPrefix(path, ".") {
+		path = "." + path
+	}
+
+	var sb strings.Builder
+	sb.WriteString(`^\$`)
+	for len(path) > 0 {
+		if strings.HasPrefix(path, "..") {
+			sb.WriteString(jsonPathAnyStep + "*")
+			path = path[1:]
+			if strings.HasPrefix(path, ".[") {
+				path = path[1:]
+			}
+			continue
+		}
+
+		switch path[0] {
+		case '.':
+			path = path[1:]
+			end := strings.IndexAny(path, ".[")
+			if end < 0 {
+				end = len(path)
+			}
+			name := path[:end]
+			path = path[end:]
+			if name == "" {
+				return "", errors.New("invalid JSONPath: missing name after .")
+			}
+			if name == "*" {
+				sb.WriteString(jsonPathAnyStep)
+			} else {
+				sb.WriteString(regexp.QuoteMeta(jsonPathName(name)))
+			}
+		case '[':
+			end, name, err := jsonPathBracket(path)
+			if err != nil {
+				return "", err
+			}
+			path = path[end:]
+			sb.WriteString(name)
+		default:
+			return "", fmt.Errorf("invalid JSONPath: unexpected character %q", path[0])
+		}
+	}
+	sb.WriteString("$")
+	return sb.String(), nil
+}
+
+// Parses a bracketed JSONPath step at the start of path. Returns the length of the step and a regular expression that matches it.
+func jsonPathBracket(path string) (int, string, error) {
+	if len(path) > 1 && (path[1] == '\'' || path[1] == '"') {
+		quote := path[1]
+		var name strings.Builder
+		for i := 2; i < len(path); i++ {
+			switch path[i] {
+			case '\\':
+				if i+1 < len(path) {
+					name.WriteByte(path[i+1])
+					i++
+				}
+			case quote:
+				if i+1 >= len(path) || path[i+1] != ']' {
+					return 0, "", errors.New("invalid JSONPath: expected ] after quoted name")
+				}
+				return i + 2, regexp.QuoteMeta(jsonPathName(name.String())), nil
+			default:
+				name.WriteByte(path[i])
+			}
+		}
+		return 0, "", errors.New("invalid JSONPath: unterminated quoted name")
+	}
+
+	end := strings.IndexByte(path, ']')
+	if end < 0 {
+		return 0, "", errors.New("invalid JSONPath: missing ]")
+	}
+	inner := path[1:end]
+	if inner == "*" {
+		return end + 1, jsonPathAnyStep, nil
+	}
+	if _, err := strconv.Atoi(inner); err != nil {
+		return 0, "", fmt.Errorf("invalid JSONPath: unsupported index %q", inner)
+	}
+	return end + 1, regexp.QuoteMeta("[" + inner + "]"), nil
+}
+
+// Returns whether a body looks like XML or HTML based on its content type or its first character
+func isXMLBody(header http.Header, body []byte) bool {
+	ctype := strings.ToLower(header.Get("Content-Type"))
+	if strings.Contains(ctype, "xml") || strings.Contains(ctype, "html") {
+		return true
+	}
+	return bytes.HasPrefix(bytes.TrimSpace(body), []byte("<"))
+}
+
+type xmlPairFrame struct {
+	path     string
+	pair     *PairValue
+	text     strings.Builder
+	children map[string]int
+}
+
+// Returns a pair for every element and attribute in an XML or HTML document keyed by its normalized XPath. The value of an element is its text content.
+func xmlBodyPairs(body []byte) ([]*PairValue, error) {
+	dec := xml.NewDecoder(bytes.NewReader(body))
+	dec.Strict = false
+	dec.AutoClose = xml.HTMLAutoClose
+	dec.Entity = xml.HTMLEntity
+
+	pairs := make([]*PairValue, 0)
+	root := &xmlPairFrame{children: make(map[string]int)}
+	stack := []*xmlPairFrame{root}
+
+	closeFrame := func() {
+		frame := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		text := frame.text.String()
+		frame.pair.value = strings.TrimSpace(text)
+		stack[len(stack)-1].text.WriteString(text)
+	}
+
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			if len(pairs) == 0 {
+				return nil, fmt.Errorf("body is not valid XML: %s", err.Error())
+			}
+			// Keep whatever could be parsed from malformed documents
+			break
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			parent := stack[len(stack)-1]
+			name := t.Name.Local
+			parent.children[name]++
+			path := parent.path + "/" + name + "[" + strconv.Itoa(parent.children[name]) + "]"
+			frame := &xmlPairFrame{
+				path:     path,
+				pair:     &PairValue{key: path},
+				children: make(map[string]int),
+			}
+			pairs = append(pairs, frame.pair)
+			for _, attr := range t.Attr {
+				pairs = append(pairs, &PairValue{key: path + "/@" + attr.Name.Local, value: attr.Value})
+			}
+			stack = append(stack, frame)
+		case xml.EndElement:
+			if len(stack) > 1 {
+				closeFrame()
+			}
+		case xml.CharData:
+			stack[len(stack)-1].text.Write(t)
+		}
+	}
+
+	for len(stack) > 1 {
+		closeFrame()
+	}
+	return pairs, nil
+}
+
+// Returns the pairs for an XML or HTML body or no pairs if the body is not XML
+func xmlPairsOrEmpty(header http.Header, body []byte) []*PairValue {
+	if !isXMLBody(header, body) {
+		return make([]*PairValue, 0)
+	}
+	pairs, err := xmlBodyPairs(body)
+	if err != nil {
+		return make([]*PairValue, 0)
+	}
+	return pairs
+}
+
+// Converts an XPath expression into a regular expression that matches the normalized paths it selects. Supports names, positions, wildcards, attributes and the descendant axis (//). Expressions that don't start with / are relative to the root.
+func xpathToRegexp(path string) (string, error) {
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	path = strings.TrimSuffix(path, "/text()")
+
+	var sb strings.Builder
+	sb.WriteString("^")
+	for len(path) > 0 {
+		if strings.HasPrefix(path, "//") {
+			sb.WriteString(`(?:/[^/]+)*/`)
+			path = path[2:]
+		} else if path[0] == '/' {
+			sb.WriteString("/")
+			path = path[1:]
+		} else {
+			return "", fmt.Errorf("invalid XPath: unexpected character %q", path[0])
+		}
+
+		end := strings.IndexByte(path, '/')
+		if end < 0 {
+			end = len(path)
+		}
+		step := path[:end]
+		path = path[end:]
+
+		stepRegexp, err := xpathStepToRegexp(step)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(stepRegexp)
+	}
+	sb.WriteString("$")
+	return sb.String(), nil
+}
+
+func xpathStepToRegexp(step string) (string, error) {
+	if step == "" {
+		return "", errors.New("invalid XPath: empty step")
+	}
+
+	if strings.HasPrefix(step, "@") {
+		name := step[1:]
+		if name == "*" {
+			return `@[^/]+`, nil
+		}
+		if name == "" || strings.ContainsAny(name, "[]") {
+			return "", fmt.Errorf("invalid XPath: invalid attribute %q", step)
+		}
+		return "@" + regexp.QuoteMeta(name), nil
+	}
+
+	name := step
+	position := `[0-9]+`
+	if i := strings.IndexByte(step, '['); i >= 0 {
+		if !strings.HasSuffix(step, "]") {
+			return "", fmt.Errorf("invalid XPath: missing ] in %q", step)
+		}
+		name = step[:i]
+		position = step[i+1 : len(step)-1]
+		if _, err := strconv.Atoi(position); err != nil {
+			return "", fmt.Errorf("invalid XPath: unsupported predicate %q", position)
+		}
+	}
+
+	if name == "" {
+		return "", fmt.Errorf("invalid XPath: missing name in %q", step)
+	}
+	nameRegexp := regexp.QuoteMeta(name)
+	if name == "*" {
+		nameRegexp = `[^/@\[]+`
+	}
+	return nameRegexp + `\[` + position + `\]`, nil
+}
+
+// Returns a pair for every part of a multipart body keyed by its form name
+func multipartBodyPairs(header http.Header, body []byte) ([]*PairValue, error) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing content type: %s", err.Error())
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return nil, errors.New("body is not multipart")
+	}
+
+	pairs := make([]*PairValue, 0)
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("error parsing multipart body: %s", err.Error())
+		}
+
+		content, err := ioutil.ReadAll(part)
+		if err != nil {
+			return nil, fmt.Errorf("error reading multipart body: %s", err.Error())
+		}
+		pairs = append(pairs, &PairValue{key: part.FormName(), value: string(content)})
+	}
+	return pairs, nil
+}
+
+// Returns the comparer and value to use to compare the key of a structured body field. Keys compared with StrIs are treated as JSONPath or XPath expressions.
+func structuredKeyComparer(field SearchField, cmp StrComparer, key string) (StrComparer, string, error) {
+	if cmp != StrIs {
+		return cmp, key, nil
+	}
+
+	switch field {
+	case FieldRequestJSON, FieldResponseJSON, FieldBothJSON:
+		keyRegexp, err := jsonPathToRegexp(key)
+		if err != nil {
+			return 0, "", err
+		}
+		return StrContainsRegexp, keyRegexp, nil
+	case FieldRequestXML, FieldResponseXML, FieldBothXML:
+		keyRegexp, err := xpathToRegexp(key)
+		if err != nil {
+			return 0, "", err
+		}
+		return StrContainsRegexp, keyRegexp, nil
+	default:
+		return cmp, key, nil
+	}
+}
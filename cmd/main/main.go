@@ -7,8 +7,10 @@ import (
 	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -66,6 +68,33 @@ func parseListenString(lstr string) (*listenArg, error) {
 	return argStruct, nil
 }
 
+// Creates a unix socket with the given permissions. The socket is created without any permissions for other users so that it is never accessible with a less restrictive mode.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	var l net.Listener
+	var err error
+	withUmask(0077, func() {
+		l, err = net.Listen("unix", path)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Returns whether a listener only accepts connections from the local machine
+func isLoopback(l net.Listener) bool {
+	host, _, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
 func unixAddr() string {
 	return fmt.Sprintf("%s/proxy.%d.%d.sock", os.TempDir(), os.Getpid(), time.Now().UnixNano())
 }
@@ -98,6 +127,12 @@ func main() {
 	msgListenStr := flag.String("msglisten", "", "Listener for the message handler. Examples: \"tcp::8080\", \"tcp:127.0.0.1:8080\", \"unix:/tmp/foobar\"")
 	autoListen := flag.Bool("msgauto", false, "Automatically pick and open a unix or tcp socket for the message listener")
 	debugFlag := flag.Bool("dbg", false, "Enable debug logging")
+	tokenFlag := flag.String("msgtoken", "", "Require clients of the message listener to authenticate with this token")
+	tokenFile := flag.String("msgtokenfile", "", "Read the message listener auth token from a file")
+	tlsCert := flag.String("msgtlscert", "", "PEM certificate used to serve tcp message listeners over TLS. Requires `-msgtlskey`")
+	tlsKey := flag.String("msgtlskey", "", "PEM private key for the certificate given with `-msgtlscert`")
+	sockModeStr := flag.String("msgsockmode", "0600", "Permissions of unix sockets created for the message listener")
+	rpcListenStr := flag.String("rpclisten", "", "Address to serve the message commands on using JSON-RPC over HTTP and WebSocket. Example: \"127.0.0.1:8081\"")
 	flag.Parse()
 
 	if *debugFlag {
@@ -118,6 +153,28 @@ func main() {
 		quitErr("only one of listener address or `--msgauto` can be used")
 	}
 
+	authToken := *tokenFlag
+	if *tokenFile != "" {
+		if authToken != "" {
+			quitErr("only one of `-msgtoken` and `-msgtokenfile` can be used")
+		}
+		tokenBytes, err := ioutil.ReadFile(*tokenFile)
+		checkErr(err)
+		authToken = strings.TrimSpace(string(tokenBytes))
+		if authToken == "" {
+			quitErr("auth token file is empty")
+		}
+	}
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		quitErr("`-msgtlscert` and `-msgtlskey` must be used together")
+	}
+
+	sockMode, err := strconv.ParseUint(*sockModeStr, 8, 32)
+	if err != nil {
+		quitErr("invalid unix socket mode: " + *sockModeStr)
+	}
+
 	// Create the message listener
 	var listenStr string
 	if *msgListenStr != "" {
@@ -129,7 +186,7 @@ func main() {
 			checkErr(err)
 		} else if msgAddr.Type == "unix" {
 			var err error
-			mln, err = net.Listen("unix", msgAddr.Addr)
+			mln, err = listenUnix(msgAddr.Addr, os.FileMode(sockMode))
 			checkErr(err)
 		} else {
 			quitErr("unsupported listener type:" + msgAddr.Type)
@@ -137,7 +194,7 @@ func main() {
 		listenStr = fmt.Sprintf("%s:%s", msgAddr.Type, msgAddr.Addr)
 	} else {
 		fpath := unixAddr()
-		ulisten, err := net.Listen("unix", fpath)
+		ulisten, err := listenUnix(fpath, os.FileMode(sockMode))
 		if err == nil {
 			mln = ulisten
 			listenStr = fmt.Sprintf("unix:%s", fpath)
@@ -151,12 +208,49 @@ func main() {
 		}
 	}
 
+	if mln.Addr().Network() == "tcp" {
+		if *tlsCert != "" {
+			tlsListener, err := puppy.TLSMessageListener(mln, *tlsCert, *tlsKey)
+			checkErr(err)
+			mln = tlsListener
+		}
+		if authToken == "" && !isLoopback(mln) {
+			os.Stderr.WriteString("warning: the message listener accepts connections from the network without authentication\n")
+		}
+	} else if *tlsCert != "" && *rpcListenStr == "" {
+		quitErr("TLS can only be used with tcp message listeners")
+	}
+
+	// Create the JSON-RPC listener
+	var rpcln net.Listener
+	if *rpcListenStr != "" {
+		var err error
+		rpcln, err = net.Listen("tcp", *rpcListenStr)
+		checkErr(err)
+		if authToken == "" && !isLoopback(rpcln) {
+			os.Stderr.WriteString("warning: the JSON-RPC listener accepts connections from the network without authentication\n")
+		}
+		if *tlsCert != "" {
+			rpcln, err = puppy.TLSMessageListener(rpcln, *tlsCert, *tlsKey)
+			checkErr(err)
+		}
+	}
+
 	// Set up the intercepting proxy
 	iproxy := puppy.NewInterceptingProxy(logger)
 	iproxy.AddHTTPHandler("puppy", puppy.CreateWebUIHandler())
 
 	// Create a message server and have it serve for the iproxy
 	mserv := puppy.NewProxyMessageListener(logger, iproxy)
+	mserv.SetAuthToken(authToken)
+	if rpcln != nil {
+		mserv.AddCapability("jsonrpc")
+		// Requests made to the host name that the listener was given are not a DNS rebinding attack
+		if host, _, err := net.SplitHostPort(*rpcListenStr); err == nil && host != "" {
+			mserv.AllowRPCHost(host)
+		}
+		go http.Serve(rpcln, mserv)
+	}
 	logger.Print(logBanner)
 	fmt.Println(listenStr)
 	mserv.Serve(mln) // serve until killed
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+// Platforms other than unix don't have a umask. Runs f without changing the permissions of the files it creates
+func withUmask(mask int, f func()) {
+	f()
+}
@@ -0,0 +1,12 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+// Runs f with the process's umask set to mask so that files f creates are never more permissive than mask allows
+func withUmask(mask int, f func()) {
+	oldMask := syscall.Umask(mask)
+	defer syscall.Umask(oldMask)
+	f()
+}
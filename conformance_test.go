@@ -0,0 +1,57 @@
+package puppy_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"puppy"
+	"puppy/storagetest"
+)
+
+func TestSQLiteStorageConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) puppy.MessageStorage {
+		ms, err := puppy.InMemoryStorage(puppy.NullLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ms
+	})
+}
+
+// Runs the conformance tests against a datafile so that the WAL mode connections used by files are tested
+func TestSQLiteFileStorageConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) puppy.MessageStorage {
+		ms, err := puppy.OpenSQLiteStorage(filepath.Join(t.TempDir(), "test.db"), puppy.NullLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ms
+	})
+}
+
+func TestJSONLStorageConformance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "puppytest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	i := 0
+	storagetest.Run(t, func(t *testing.T) puppy.MessageStorage {
+		i++
+		ms, err := puppy.OpenJSONLStorage(filepath.Join(dir, fmt.Sprintf("test%d.jsonl", i)), puppy.NullLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ms
+	})
+}
+
+func TestBoundedMemoryStorageConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) puppy.MessageStorage {
+		return puppy.NewBoundedMemoryStorage(0, 0)
+	})
+}
@@ -0,0 +1,249 @@
+package puppy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+Describe
+
+The describe command lists the commands that a listener handles along with JSON Schemas of their messages, the
+version of the protocol that the listener speaks and the capabilities it supports. Clients can include their
+ProtocolVersion in any message and messages from clients that are newer than the listener are rejected.
+*/
+
+// The version of the message protocol spoken by MessageListener
+const MessageProtocolVersion = 1
+
+// The oldest protocol version that clients can use
+const MinMessageProtocolVersion = 1
+
+type describeMessage struct {
+	// Only describe these commands. Every command is described if it is empty
+	Commands []string
+}
+
+type commandDescription struct {
+	Name string
+	// A JSON Schema of the command's message. Omitted if the listener does not know the fields of the message
+	Schema map[string]interface{} `json:",omitempty"`
+}
+
+type describeResult struct {
+	Success            bool
+	ProtocolVersion    int
+	MinProtocolVersion int
+	Capabilities       []string
+	Commands           []*commandDescription
+}
+
+func (l *MessageListener) describeHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
+	mreq := describeMessage{}
+	if err := json.Unmarshal(b, &mreq); err != nil {
+		ErrorResponse(c, fmt.Sprintf("error parsing message: %s", err.Error()))
+		return
+	}
+
+	names := make([]string, 0)
+	if len(mreq.Commands) > 0 {
+		for _, name := range mreq.Commands {
+			name = strings.ToLower(name)
+			if _, ok := l.handlers[name]; !ok {
+				ErrorResponse(c, fmt.Sprintf("unknown command: %s", name))
+				return
+			}
+			names = append(names, name)
+		}
+	} else {
+		for name := range l.handlers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	result := &describeResult{
+		Success:            true,
+		ProtocolVersion:    MessageProtocolVersion,
+		MinProtocolVersion: MinMessageProtocolVersion,
+		Capabilities:       l.capabilities,
+		Commands:           make([]*commandDescription, 0, len(names)),
+	}
+	for _, name := range names {
+		desc := &commandDescription{Name: name}
+		if t, ok := l.messages[name]; ok {
+			desc.Schema = messageSchema(t)
+		}
+		result.Commands = append(result.Commands, desc)
+	}
+	MessageResponse(c, result)
+}
+
+/*
+JSON Schemas
+*/
+
+// A field of a struct as it appears in JSON
+type jsonField struct {
+	name  string
+	index []int
+	typ   reflect.Type
+}
+
+// Returns the fields of a struct that are encoded to JSON, including the fields of embedded structs
+func jsonFields(t reflect.Type) []*jsonField {
+	fields := make([]*jsonField, 0)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+
+		ft := f.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			for _, embedded := range jsonFields(ft) {
+				embedded.index = append([]int{i}, embedded.index...)
+				fields = append(fields, embedded)
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			// Unexported
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, &jsonField{name: name, index: []int{i}, typ: f.Type})
+	}
+	return fields
+}
+
+// Returns the names of the JSON fields of a message type
+func messageFieldNames(t reflect.Type) []string {
+	names := make([]string, 0)
+	if t.Kind() != reflect.Struct {
+		return names
+	}
+	for _, f := range jsonFields(t) {
+		names = append(names, f.name)
+	}
+	return names
+}
+
+// Types that can also be given as a text query
+var textQueryTypes = map[reflect.Type]bool{
+	reflect.TypeOf(StrQueryExpr{}):    true,
+	reflect.TypeOf(StrMessageQuery{}): true,
+}
+
+// Builds a JSON Schema, keeping the definitions of named structs so that recursive types can be described
+type schemaBuilder struct {
+	definitions map[string]interface{}
+}
+
+// Returns a JSON Schema for the messages of a command with the given message type
+func messageSchema(t reflect.Type) map[string]interface{} {
+	sb := &schemaBuilder{definitions: make(map[string]interface{})}
+	properties := sb.properties(reflect.TypeOf(commandData{}))
+	if t.Kind() == reflect.Struct {
+		for name, prop := range sb.properties(t) {
+			properties[name] = prop
+		}
+	}
+
+	schema := map[string]interface{}{
+		"$schema":              "http://json-schema.org/draft-07/schema#",
+		"type":                 "object",
+		"properties":           properties,
+		"required":             []string{"Command"},
+		"additionalProperties": false,
+	}
+	if len(sb.definitions) > 0 {
+		schema["definitions"] = sb.definitions
+	}
+	return schema
+}
+
+// Returns the schemas of the fields of a struct
+func (sb *schemaBuilder) properties(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	for _, f := range jsonFields(t) {
+		properties[f.name] = sb.schema(f.typ)
+	}
+	return properties
+}
+
+// Returns the schema of a type
+func (sb *schemaBuilder) schema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t {
+	case reflect.TypeOf(json.RawMessage{}):
+		return map[string]interface{}{}
+	case reflect.TypeOf(time.Time{}):
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	if textQueryTypes[t] && sb.definitions[t.Name()] == nil {
+		// Define the type before describing it so that references to it inside of itself don't recurse
+		sb.definitions[t.Name()] = map[string]interface{}{}
+		sb.definitions[t.Name()] = map[string]interface{}{
+			"anyOf": []interface{}{
+				map[string]interface{}{"type": "string", "description": "a text query"},
+				sb.structuralSchema(t),
+			},
+		}
+	}
+	if textQueryTypes[t] {
+		return map[string]interface{}{"$ref": "#/definitions/" + t.Name()}
+	}
+	return sb.structuralSchema(t)
+}
+
+// Returns the schema of a type based on its kind
+func (sb *schemaBuilder) structuralSchema(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]interface{}{"type": "array", "items": sb.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": sb.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" || textQueryTypes[t] {
+			return map[string]interface{}{"type": "object", "properties": sb.properties(t)}
+		}
+		if _, ok := sb.definitions[t.Name()]; !ok {
+			sb.definitions[t.Name()] = map[string]interface{}{}
+			sb.definitions[t.Name()] = map[string]interface{}{"type": "object", "properties": sb.properties(t)}
+		}
+		return map[string]interface{}{"$ref": "#/definitions/" + t.Name()}
+	default:
+		// Interfaces can hold any value
+		return map[string]interface{}{}
+	}
+}
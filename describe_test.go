@@ -0,0 +1,95 @@
+package puppy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+)
+
+// Handles a message and returns the first message written in response
+func handleTestMessage(t *testing.T, l *MessageListener, message string) []byte {
+	t.Helper()
+	var response []byte
+	conn := newRPCConn(func(m []byte) {
+		if response == nil {
+			response = m
+		}
+	})
+	conn.Close()
+	if err := l.Handle([]byte(message), conn); err != nil {
+		b, _ := json.Marshal(&errorMessage{Reason: err.Error()})
+		return b
+	}
+	return response
+}
+
+func TestDescribe(t *testing.T) {
+	l := NewProxyMessageListener(log.New(ioutil.Discard, "", 0), NewInterceptingProxy(nil))
+
+	result := &describeResult{}
+	testErr(t, json.Unmarshal(handleTestMessage(t, l, `{"Command": "describe"}`), result))
+	if !result.Success || result.ProtocolVersion != MessageProtocolVersion || len(result.Capabilities) == 0 {
+		t.Fatalf("incorrect describe result: %+v", result)
+	}
+	commands := make(map[string]*commandDescription)
+	for _, desc := range result.Commands {
+		commands[desc.Name] = desc
+	}
+	for _, name := range []string{"ping", "describe", "storagequery", "subscribequery"} {
+		if commands[name] == nil || commands[name].Schema == nil {
+			t.Errorf("command %s was not described", name)
+		}
+	}
+
+	schema := commands["storagequery"].Schema
+	properties := schema["properties"].(map[string]interface{})
+	if properties["MaxResults"].(map[string]interface{})["type"] != "integer" {
+		t.Errorf("incorrect schema for MaxResults: %v", properties["MaxResults"])
+	}
+	if properties["Expr"].(map[string]interface{})["$ref"] != "#/definitions/StrQueryExpr" {
+		t.Errorf("incorrect schema for Expr: %v", properties["Expr"])
+	}
+	if properties["CommandId"] == nil || schema["additionalProperties"] != false {
+		t.Errorf("schema does not include the common fields or allows other fields: %v", schema)
+	}
+	if _, ok := schema["definitions"].(map[string]interface{})["StrQueryExpr"]; !ok {
+		t.Errorf("StrQueryExpr was not defined: %v", schema["definitions"])
+	}
+
+	result = &describeResult{}
+	testErr(t, json.Unmarshal(handleTestMessage(t, l, `{"Command": "describe", "Commands": ["Ping"]}`), result))
+	if len(result.Commands) != 1 || result.Commands[0].Name != "ping" {
+		t.Errorf("describe did not only describe the given command: %+v", result.Commands)
+	}
+}
+
+func TestMessageFieldChecks(t *testing.T) {
+	l := NewProxyMessageListener(log.New(ioutil.Discard, "", 0), NewInterceptingProxy(nil))
+	errorFor := func(message string) string {
+		t.Helper()
+		result := &errorMessage{}
+		testErr(t, json.Unmarshal(handleTestMessage(t, l, message), result))
+		return result.Reason
+	}
+
+	if reason := errorFor(`{"Command": "ping", "CommandId": 1, "protocolversion": 1}`); reason != "" {
+		t.Errorf("message with only common fields failed: %s", reason)
+	}
+	if reason := errorFor(`{"Command": "storagequery", "Storage": 1, "MaxResult": 10}`); !strings.Contains(reason, "MaxResult") {
+		t.Errorf("message with an unknown field did not return an error: %s", reason)
+	}
+	if reason := errorFor(`{"Command": "describe", "Commands": ["nosuchcommand"]}`); !strings.Contains(reason, "nosuchcommand") {
+		t.Errorf("describing an unknown command did not return an error: %s", reason)
+	}
+	if reason := errorFor(`{"Command": "ping", "ProtocolVersion": 1000}`); !strings.Contains(reason, "not supported") {
+		t.Errorf("message with a newer protocol version did not return an error: %s", reason)
+	}
+
+	// Commands added without a message type accept any fields
+	l.AddHandler("custom", pingHandler)
+	if reason := errorFor(`{"Command": "custom", "Anything": true}`); reason != "" {
+		t.Errorf("command without a message type rejected a field: %s", reason)
+	}
+}
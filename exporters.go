@@ -0,0 +1,134 @@
+package puppy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+Exporters for sharing history with other tools
+*/
+
+// ExportHAR writes the given requests to w as an HTTP Archive. Timings are included for requests that have them.
+func ExportHAR(w io.Writer, reqs []*ProxyRequest) error {
+	var har harFile
+	har.Log.Version = "1.2"
+	har.Log.Creator = &harCreator{Name: "puppy", Version: "1.0"}
+	har.Log.Entries = make([]harEntry, 0, len(reqs))
+	for _, req := range reqs {
+		har.Log.Entries = append(har.Log.Entries, requestToHAREntry(req))
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(&har); err != nil {
+		return fmt.Errorf("error writing HAR file: %s", err.Error())
+	}
+	return nil
+}
+
+func harHeaders(header http.Header) []harNameValue {
+	ret := make([]harNameValue, 0, len(header))
+	for k, vs := range header {
+		for _, v := range vs {
+			ret = append(ret, harNameValue{Name: k, Value: v})
+		}
+	}
+	return ret
+}
+
+func harCookies(cookies []*http.Cookie) []harNameValue {
+	ret := make([]harNameValue, 0, len(cookies))
+	for _, c := range cookies {
+		ret = append(ret, harNameValue{Name: c.Name, Value: c.Value})
+	}
+	return ret
+}
+
+// Converts a time.Duration to milliseconds using -1 for timings that were not measured
+func harMilliseconds(d time.Duration) float64 {
+	if d == 0 {
+		return -1
+	}
+	return float64(d) / float64(time.Millisecond)
+}
+
+func requestToHAREntry(req *ProxyRequest) harEntry {
+	entry := harEntry{
+		StartedDateTime: req.StartDatetime.Format(time.RFC3339Nano),
+		Request: harRequest{
+			Method:      req.Method,
+			URL:         req.DestURL().String(),
+			HTTPVersion: fmt.Sprintf("HTTP/%d.%d", req.ProtoMajor, req.ProtoMinor),
+			Headers:     harHeaders(req.Header),
+			QueryString: pairsToHAR(pairValuesFromURLQuery(req.URL.Query())),
+			Cookies:     harCookies(req.Cookies()),
+			HeadersSize: -1,
+			BodySize:    len(req.BodyBytes()),
+		},
+		Response: harResponse{
+			Headers:     make([]harNameValue, 0),
+			Cookies:     make([]harNameValue, 0),
+			HeadersSize: -1,
+		},
+	}
+
+	if req.EndDatetime.After(req.StartDatetime) {
+		entry.Time = float64(req.EndDatetime.Sub(req.StartDatetime)) / float64(time.Millisecond)
+	}
+
+	if len(req.BodyBytes()) > 0 {
+		entry.Request.PostData = &harPostData{
+			MimeType: req.Header.Get("Content-Type"),
+			Text:     string(req.BodyBytes()),
+		}
+	}
+
+	if rsp := req.ServerResponse; rsp != nil {
+		body := rsp.BodyBytes()
+		entry.Response.Status = rsp.StatusCode
+		entry.Response.StatusText = strings.TrimSpace(strings.TrimPrefix(rsp.Status, fmt.Sprintf("%d", rsp.StatusCode)))
+		entry.Response.HTTPVersion = fmt.Sprintf("HTTP/%d.%d", rsp.ProtoMajor, rsp.ProtoMinor)
+		entry.Response.Headers = harHeaders(rsp.Header)
+		entry.Response.Cookies = harCookies(rsp.Cookies())
+		entry.Response.RedirectURL = rsp.Header.Get("Location")
+		entry.Response.BodySize = len(body)
+		entry.Response.Content.Size = len(body)
+		entry.Response.Content.MimeType = rsp.Header.Get("Content-Type")
+		if utf8.Valid(body) {
+			entry.Response.Content.Text = string(body)
+		} else {
+			entry.Response.Content.Text = base64.StdEncoding.EncodeToString(body)
+			entry.Response.Content.Encoding = "base64"
+		}
+	}
+
+	if req.Timings != (RequestTimings{}) {
+		t := req.Timings
+		entry.Timings = &harTimings{
+			Blocked: -1,
+			DNS:     harMilliseconds(t.DNS),
+			Connect: harMilliseconds(t.Connect + t.ProxyConnect + t.TLSHandshake),
+			Send:    0,
+			Wait:    float64(t.TimeToFirstByte) / float64(time.Millisecond),
+			Receive: float64(t.Transfer) / float64(time.Millisecond),
+			SSL:     harMilliseconds(t.TLSHandshake),
+		}
+	}
+
+	return entry
+}
+
+func pairsToHAR(pairs []*PairValue) []harNameValue {
+	ret := make([]harNameValue, 0, len(pairs))
+	for _, p := range pairs {
+		ret = append(ret, harNameValue{Name: p.key, Value: p.value})
+	}
+	return ret
+}
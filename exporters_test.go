@@ -0,0 +1,46 @@
+package puppy
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestExportHAR(t *testing.T) {
+	req := testReq()
+	req.StartDatetime = time.Unix(0, 1500000000000000000)
+	req.EndDatetime = req.StartDatetime.Add(150 * time.Millisecond)
+	req.Timings = RequestTimings{
+		DNS:             5 * time.Millisecond,
+		Connect:         10 * time.Millisecond,
+		TLSHandshake:    20 * time.Millisecond,
+		TimeToFirstByte: 100 * time.Millisecond,
+		Transfer:        15 * time.Millisecond,
+	}
+
+	buf := new(bytes.Buffer)
+	testErr(t, ExportHAR(buf, []*ProxyRequest{req}))
+
+	storage := testStorage()
+	defer storage.Close()
+	result, err := ImportHAR(storage, buf)
+	testErr(t, err)
+	if len(result.Imported) != 1 || len(result.Errors) != 0 {
+		t.Fatalf("expected 1 imported item and no errors, got %d and %d", len(result.Imported), len(result.Errors))
+	}
+
+	got, err := storage.LoadRequest(result.Imported[0].DbId)
+	testErr(t, err)
+	if string(got.BodyBytes()) != "foo=baz" || got.Header.Get("Foo") != "Bar" {
+		t.Errorf("request was not exported correctly")
+	}
+	if got.ServerResponse == nil || string(got.ServerResponse.BodyBytes()) != "BBBB" {
+		t.Errorf("response was not exported correctly")
+	}
+	if !got.StartDatetime.Equal(req.StartDatetime) || !got.EndDatetime.Equal(req.EndDatetime) {
+		t.Errorf("incorrect times: %s-%s", got.StartDatetime, got.EndDatetime)
+	}
+	if got.Timings != req.Timings {
+		t.Errorf("incorrect timings: %+v", got.Timings)
+	}
+}
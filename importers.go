@@ -0,0 +1,608 @@
+package puppy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Importers for history exported by other tools
+*/
+
+// ImportError describes a single item from an export that could not be imported
+type ImportError struct {
+	// Index of the item in the export
+	Index int
+	// Why the item could not be imported
+	Reason string
+}
+
+func (e *ImportError) Error() string {
+	return fmt.Sprintf("item %d: %s", e.Index, e.Reason)
+}
+
+// ImportResult contains the results of importing an export into a MessageStorage
+type ImportResult struct {
+	// Requests which were successfully saved
+	Imported []*ProxyRequest
+	// Errors for items which could not be imported
+	Errors []*ImportError
+}
+
+func (r *ImportResult) addError(index int, format string, args ...interface{}) {
+	r.Errors = append(r.Errors, &ImportError{Index: index, Reason: fmt.Sprintf(format, args...)})
+}
+
+/*
+Burp Suite "Save items" XML
+*/
+
+type burpItems struct {
+	XMLName xml.Name   `xml:"items"`
+	Items   []burpItem `xml:"item"`
+}
+
+type burpItem struct {
+	Time     string       `xml:"time"`
+	URL      string       `xml:"url"`
+	Host     string       `xml:"host"`
+	Port     string       `xml:"port"`
+	Protocol string       `xml:"protocol"`
+	Request  burpMessage  `xml:"request"`
+	Response *burpMessage `xml:"response"`
+}
+
+type burpMessage struct {
+	Base64 bool   `xml:"base64,attr"`
+	Data   string `xml:",chardata"`
+}
+
+func (m *burpMessage) bytes() ([]byte, error) {
+	if m.Base64 {
+		return base64.StdEncoding.DecodeString(strings.TrimSpace(m.Data))
+	}
+	return []byte(m.Data), nil
+}
+
+// The format Burp uses for the <time> element, ie "Mon Oct 02 12:34:56 EDT 2017"
+const burpTimeFormat = "Mon Jan 02 15:04:05 MST 2006"
+
+// Offsets in seconds east of UTC of the zone abbreviations that Burp writes in the <time> element. time.Parse only
+// knows the offsets of the local zone's abbreviations and gives any other abbreviation an offset of zero.
+var burpZoneOffsets = map[string]int{
+	"UTC":  0,
+	"GMT":  0,
+	"WET":  0,
+	"WEST": 1 * 3600,
+	"BST":  1 * 3600,
+	"CET":  1 * 3600,
+	"CEST": 2 * 3600,
+	"EET":  2 * 3600,
+	"EEST": 3 * 3600,
+	"MSK":  3 * 3600,
+	"IST":  5*3600 + 1800,
+	"SGT":  8 * 3600,
+	"HKT":  8 * 3600,
+	"AWST": 8 * 3600,
+	"JST":  9 * 3600,
+	"KST":  9 * 3600,
+	"ACST": 9*3600 + 1800,
+	"ACDT": 10*3600 + 1800,
+	"AEST": 10 * 3600,
+	"AEDT": 11 * 3600,
+	"NZST": 12 * 3600,
+	"NZDT": 13 * 3600,
+	"HST":  -10 * 3600,
+	"AKST": -9 * 3600,
+	"AKDT": -8 * 3600,
+	"PST":  -8 * 3600,
+	"PDT":  -7 * 3600,
+	"MST":  -7 * 3600,
+	"MDT":  -6 * 3600,
+	"CST":  -6 * 3600,
+	"CDT":  -5 * 3600,
+	"EST":  -5 * 3600,
+	"EDT":  -4 * 3600,
+}
+
+// Parses the time of a Burp item. Returns an error if the time zone abbreviation is not known.
+func parseBurpTime(value string) (time.Time, error) {
+	t, err := time.Parse(burpTimeFormat, value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	zone, _ := t.Zone()
+	offset, ok := burpZoneOffsets[zone]
+	if !ok {
+		return time.Time{}, fmt.Errorf("unknown time zone: %s", zone)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.FixedZone(zone, offset)), nil
+}
+
+// ImportBurpXML reads items exported from Burp Suite using "Save items" and saves them to the given storage. Errors with individual items are returned in the result and do not stop the import.
+func ImportBurpXML(ms MessageStorage, r io.Reader) (*ImportResult, error) {
+	var items burpItems
+	if err := xml.NewDecoder(r).Decode(&items); err != nil {
+		return nil, fmt.Errorf("error parsing burp export: %s", err.Error())
+	}
+
+	result := &ImportResult{
+		Imported: make([]*ProxyRequest, 0),
+		Errors:   make([]*ImportError, 0),
+	}
+	for i, item := range items.Items {
+		req, err := burpItemToRequest(&item)
+		if err != nil {
+			result.addError(i, "%s", err.Error())
+			continue
+		}
+
+		if err := SaveNewRequest(ms, req); err != nil {
+			result.addError(i, "error saving request: %s", err.Error())
+			continue
+		}
+		result.Imported = append(result.Imported, req)
+	}
+	return result, nil
+}
+
+func burpItemToRequest(item *burpItem) (*ProxyRequest, error) {
+	useTLS := strings.ToLower(item.Protocol) == "https"
+	port, err := strconv.Atoi(strings.TrimSpace(item.Port))
+	if err != nil {
+		return nil, fmt.Errorf("invalid port: %s", item.Port)
+	}
+
+	host := strings.TrimSpace(item.Host)
+	if host == "" {
+		// Older exports leave the host blank, fall back to the URL
+		u, err := url.Parse(item.URL)
+		if err != nil {
+			return nil, fmt.Errorf("item has no host and an invalid url: %s", err.Error())
+		}
+		host = u.Hostname()
+	}
+
+	reqBytes, err := item.Request.bytes()
+	if err != nil {
+		return nil, fmt.Errorf("error decoding request: %s", err.Error())
+	}
+
+	req, err := ProxyRequestFromBytes(reqBytes, host, port, useTLS)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing request: %s", err.Error())
+	}
+
+	if item.Time != "" {
+		t, err := parseBurpTime(strings.TrimSpace(item.Time))
+		if err != nil {
+			return nil, fmt.Errorf("invalid time: %s", err.Error())
+		}
+		req.StartDatetime = t
+		req.EndDatetime = t
+	}
+
+	if item.Response != nil && strings.TrimSpace(item.Response.Data) != "" {
+		rspBytes, err := item.Response.bytes()
+		if err != nil {
+			return nil, fmt.Errorf("error decoding response: %s", err.Error())
+		}
+		rsp, err := ProxyResponseFromBytes(rspBytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing response: %s", err.Error())
+		}
+		req.ServerResponse = rsp
+	}
+
+	return req, nil
+}
+
+/*
+HAR (HTTP Archive) exports such as the ones created by ZAP's "Export Messages to HAR"
+*/
+
+type harFile struct {
+	Log struct {
+		Version string      `json:"version,omitempty"`
+		Creator *harCreator `json:"creator,omitempty"`
+		Entries []harEntry  `json:"entries"`
+	} `json:"log"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Timings         *harTimings `json:"timings,omitempty"`
+}
+
+// Timings in milliseconds. A value of -1 means the timing does not apply. Connect includes the time spent on the TLS handshake.
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	Cookies     []harNameValue `json:"cookies"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Headers     []harNameValue `json:"headers"`
+	Cookies     []harNameValue `json:"cookies"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// ImportHAR reads entries from an HTTP Archive (such as one exported by ZAP) and saves them to the given storage. Errors with individual entries are returned in the result and do not stop the import.
+func ImportHAR(ms MessageStorage, r io.Reader) (*ImportResult, error) {
+	var har harFile
+	if err := json.NewDecoder(r).Decode(&har); err != nil {
+		return nil, fmt.Errorf("error parsing HAR file: %s", err.Error())
+	}
+
+	result := &ImportResult{
+		Imported: make([]*ProxyRequest, 0),
+		Errors:   make([]*ImportError, 0),
+	}
+	for i, entry := range har.Log.Entries {
+		req, err := harEntryToRequest(&entry)
+		if err != nil {
+			result.addError(i, "%s", err.Error())
+			continue
+		}
+
+		if err := SaveNewRequest(ms, req); err != nil {
+			result.addError(i, "error saving request: %s", err.Error())
+			continue
+		}
+		result.Imported = append(result.Imported, req)
+	}
+	return result, nil
+}
+
+// HAR versions may be HTTP/2 which can't be parsed as an HTTP/1.x message
+func harProto(version string) string {
+	if strings.ToUpper(version) == "HTTP/1.0" {
+		return "HTTP/1.0"
+	}
+	return "HTTP/1.1"
+}
+
+// Write headers to the buffer skipping HTTP/2 pseudo-headers and any headers describing the encoding of the body
+func writeHARHeaders(buf *bytes.Buffer, headers []harNameValue, bodyLen int) {
+	for _, h := range headers {
+		lname := strings.ToLower(h.Name)
+		if strings.HasPrefix(lname, ":") ||
+			lname == "content-length" ||
+			lname == "transfer-encoding" ||
+			lname == "content-encoding" {
+			continue
+		}
+		buf.Write([]byte(h.Name))
+		buf.Write([]byte(": "))
+		buf.Write([]byte(h.Value))
+		buf.Write([]byte("\r\n"))
+	}
+	buf.Write([]byte("Content-Length: "))
+	buf.Write([]byte(strconv.Itoa(bodyLen)))
+	buf.Write([]byte("\r\n\r\n"))
+}
+
+func harEntryToRequest(entry *harEntry) (*ProxyRequest, error) {
+	u, err := url.Parse(entry.Request.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %s", err.Error())
+	}
+
+	useTLS := u.Scheme == "https" || u.Scheme == "wss"
+	host := u.Hostname()
+	if host == "" {
+		return nil, fmt.Errorf("url is missing a host: %s", entry.Request.URL)
+	}
+
+	var port int
+	if u.Port() != "" {
+		port, err = strconv.Atoi(u.Port())
+		if err != nil {
+			return nil, fmt.Errorf("invalid port: %s", u.Port())
+		}
+	} else if useTLS {
+		port = 443
+	} else {
+		port = 80
+	}
+
+	var reqBody []byte
+	if entry.Request.PostData != nil {
+		reqBody = []byte(entry.Request.PostData.Text)
+	}
+
+	hasHost := false
+	for _, h := range entry.Request.Headers {
+		if strings.ToLower(h.Name) == "host" {
+			hasHost = true
+		}
+	}
+
+	reqBuf := new(bytes.Buffer)
+	reqBuf.Write([]byte(fmt.Sprintf("%s %s %s\r\n", entry.Request.Method, u.RequestURI(), harProto(entry.Request.HTTPVersion))))
+	if !hasHost {
+		reqBuf.Write([]byte(fmt.Sprintf("Host: %s\r\n", u.Host)))
+	}
+	writeHARHeaders(reqBuf, entry.Request.Headers, len(reqBody))
+	reqBuf.Write(reqBody)
+
+	req, err := ProxyRequestFromBytes(reqBuf.Bytes(), host, port, useTLS)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing request: %s", err.Error())
+	}
+
+	if entry.StartedDateTime != "" {
+		t, err := time.Parse(time.RFC3339Nano, entry.StartedDateTime)
+		if err != nil {
+			return nil, fmt.Errorf("invalid start time: %s", err.Error())
+		}
+		req.StartDatetime = t
+		req.EndDatetime = t.Add(time.Duration(entry.Time * float64(time.Millisecond)))
+	}
+
+	if entry.Timings != nil {
+		req.Timings = harTimingsToRequestTimings(entry.Timings)
+	}
+
+	// A status of 0 means no response was received
+	if entry.Response.Status > 0 {
+		rspBody := []byte(entry.Response.Content.Text)
+		if entry.Response.Content.Encoding == "base64" {
+			rspBody, err = base64.StdEncoding.DecodeString(entry.Response.Content.Text)
+			if err != nil {
+				return nil, fmt.Errorf("error decoding response body: %s", err.Error())
+			}
+		}
+
+		rspBuf := new(bytes.Buffer)
+		rspBuf.Write([]byte(fmt.Sprintf("%s %03d %s\r\n", harProto(entry.Response.HTTPVersion), entry.Response.Status, entry.Response.StatusText)))
+		writeHARHeaders(rspBuf, entry.Response.Headers, len(rspBody))
+		rspBuf.Write(rspBody)
+
+		rsp, err := ProxyResponseFromBytes(rspBuf.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("error parsing response: %s", err.Error())
+		}
+		req.ServerResponse = rsp
+	}
+
+	return req, nil
+}
+
+// Converts a HAR duration in milliseconds to a time.Duration treating unavailable (negative) timings as zero
+func harDuration(ms float64) time.Duration {
+	if ms < 0 {
+		return 0
+	}
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+func harTimingsToRequestTimings(timings *harTimings) RequestTimings {
+	ret := RequestTimings{
+		DNS:             harDuration(timings.DNS),
+		Connect:         harDuration(timings.Connect),
+		TLSHandshake:    harDuration(timings.SSL),
+		TimeToFirstByte: harDuration(timings.Wait),
+		Transfer:        harDuration(timings.Receive),
+	}
+	// HAR includes the TLS handshake in the connect time
+	if ret.Connect >= ret.TLSHandshake {
+		ret.Connect -= ret.TLSHandshake
+	}
+	return ret
+}
+
+/*
+ZAP XML exports of the messages in a session, as returned by the XML API's core/view/messages view
+*/
+
+type zapMessages struct {
+	XMLName  xml.Name     `xml:"messages"`
+	Messages []zapMessage `xml:"message"`
+}
+
+type zapMessage struct {
+	// Milliseconds since the epoch when the request was sent
+	Timestamp string `xml:"timestamp"`
+	// Milliseconds it took to receive the response
+	RTT            string `xml:"rtt"`
+	RequestHeader  string `xml:"requestHeader"`
+	RequestBody    string `xml:"requestBody"`
+	ResponseHeader string `xml:"responseHeader"`
+	ResponseBody   string `xml:"responseBody"`
+}
+
+// ImportZAPXML reads messages exported from ZAP as XML and saves them to the given storage. Errors with individual messages are returned in the result and do not stop the import.
+func ImportZAPXML(ms MessageStorage, r io.Reader) (*ImportResult, error) {
+	var messages zapMessages
+	if err := xml.NewDecoder(r).Decode(&messages); err != nil {
+		return nil, fmt.Errorf("error parsing ZAP export: %s", err.Error())
+	}
+
+	result := &ImportResult{
+		Imported: make([]*ProxyRequest, 0),
+		Errors:   make([]*ImportError, 0),
+	}
+	for i, msg := range messages.Messages {
+		req, err := zapMessageToRequest(&msg)
+		if err != nil {
+			result.addError(i, "%s", err.Error())
+			continue
+		}
+
+		if err := SaveNewRequest(ms, req); err != nil {
+			result.addError(i, "error saving request: %s", err.Error())
+			continue
+		}
+		result.Imported = append(result.Imported, req)
+	}
+	return result, nil
+}
+
+// Splits a ZAP header block into its first line and its headers. XML parsing turns the CRLF line endings into LF so either is accepted.
+func parseZAPHeader(header string) (string, []harNameValue, error) {
+	lines := strings.Split(strings.Replace(strings.TrimSpace(header), "\r\n", "\n", -1), "\n")
+	if lines[0] == "" {
+		return "", nil, errors.New("header is empty")
+	}
+
+	headers := make([]harNameValue, 0, len(lines)-1)
+	for _, line := range lines[1:] {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return "", nil, fmt.Errorf("invalid header line: %s", line)
+		}
+		headers = append(headers, harNameValue{Name: strings.TrimSpace(parts[0]), Value: strings.TrimSpace(parts[1])})
+	}
+	return strings.TrimRight(lines[0], "\r"), headers, nil
+}
+
+// Parses a number of milliseconds from a ZAP export
+func zapMillis(value string) (int64, error) {
+	return strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+}
+
+func zapMessageToRequest(msg *zapMessage) (*ProxyRequest, error) {
+	requestLine, headers, err := parseZAPHeader(msg.RequestHeader)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing request header: %s", err.Error())
+	}
+	parts := strings.Split(requestLine, " ")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid request line: %s", requestLine)
+	}
+
+	// ZAP stores the absolute URL of the request in the request line
+	u, err := url.Parse(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %s", err.Error())
+	}
+	host := u.Hostname()
+	if host == "" {
+		return nil, fmt.Errorf("url is missing a host: %s", parts[1])
+	}
+	useTLS := u.Scheme == "https" || u.Scheme == "wss"
+	var port int
+	if u.Port() != "" {
+		port, err = strconv.Atoi(u.Port())
+		if err != nil {
+			return nil, fmt.Errorf("invalid port: %s", u.Port())
+		}
+	} else if useTLS {
+		port = 443
+	} else {
+		port = 80
+	}
+
+	reqBody := []byte(msg.RequestBody)
+	reqBuf := new(bytes.Buffer)
+	reqBuf.Write([]byte(fmt.Sprintf("%s %s %s\r\n", parts[0], u.RequestURI(), harProto(parts[2]))))
+	writeHARHeaders(reqBuf, headers, len(reqBody))
+	reqBuf.Write(reqBody)
+
+	req, err := ProxyRequestFromBytes(reqBuf.Bytes(), host, port, useTLS)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing request: %s", err.Error())
+	}
+
+	if msg.Timestamp != "" {
+		start, err := zapMillis(msg.Timestamp)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp: %s", msg.Timestamp)
+		}
+		req.StartDatetime = time.Unix(0, start*int64(time.Millisecond))
+		req.EndDatetime = req.StartDatetime
+		if msg.RTT != "" {
+			rtt, err := zapMillis(msg.RTT)
+			if err != nil {
+				return nil, fmt.Errorf("invalid rtt: %s", msg.RTT)
+			}
+			req.EndDatetime = req.StartDatetime.Add(time.Duration(rtt) * time.Millisecond)
+		}
+	}
+
+	// Messages that did not get a response have an empty response header
+	if strings.TrimSpace(msg.ResponseHeader) != "" {
+		statusLine, headers, err := parseZAPHeader(msg.ResponseHeader)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing response header: %s", err.Error())
+		}
+		rspBody := []byte(msg.ResponseBody)
+		rspBuf := new(bytes.Buffer)
+		statusParts := strings.SplitN(statusLine, " ", 2)
+		if len(statusParts) != 2 {
+			return nil, fmt.Errorf("invalid status line: %s", statusLine)
+		}
+		rspBuf.Write([]byte(fmt.Sprintf("%s %s\r\n", harProto(statusParts[0]), statusParts[1])))
+		writeHARHeaders(rspBuf, headers, len(rspBody))
+		rspBuf.Write(rspBody)
+
+		rsp, err := ProxyResponseFromBytes(rspBuf.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("error parsing response: %s", err.Error())
+		}
+		req.ServerResponse = rsp
+	}
+
+	return req, nil
+}
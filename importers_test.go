@@ -0,0 +1,205 @@
+package puppy
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImportBurpXML(t *testing.T) {
+	storage := testStorage()
+	defer storage.Close()
+
+	reqData := base64.StdEncoding.EncodeToString([]byte("GET /foo?a=b HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	rspData := base64.StdEncoding.EncodeToString([]byte("HTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\nBBBB"))
+	export := `<?xml version="1.0"?>
+<items burpVersion="1.7.27">
+  <item>
+    <time>Mon Oct 02 12:34:56 UTC 2017</time>
+    <url><![CDATA[https://example.com:8443/foo?a=b]]></url>
+    <host ip="127.0.0.1">example.com</host>
+    <port>8443</port>
+    <protocol>https</protocol>
+    <request base64="true"><![CDATA[` + reqData + `]]></request>
+    <response base64="true"><![CDATA[` + rspData + `]]></response>
+  </item>
+  <item>
+    <host>example.com</host>
+    <port>notaport</port>
+    <protocol>http</protocol>
+    <request base64="true"><![CDATA[` + reqData + `]]></request>
+  </item>
+</items>`
+
+	result, err := ImportBurpXML(storage, strings.NewReader(export))
+	testErr(t, err)
+
+	if len(result.Imported) != 1 || len(result.Errors) != 1 {
+		t.Fatalf("expected 1 imported item and 1 error, got %d and %d", len(result.Imported), len(result.Errors))
+	}
+	if result.Errors[0].Index != 1 {
+		t.Errorf("expected error for item 1, got item %d", result.Errors[0].Index)
+	}
+
+	req, err := storage.LoadRequest(result.Imported[0].DbId)
+	testErr(t, err)
+	if req.DestHost != "example.com" || req.DestPort != 8443 || !req.DestUseTLS {
+		t.Errorf("incorrect destination: %s:%d tls=%t", req.DestHost, req.DestPort, req.DestUseTLS)
+	}
+	if req.StartDatetime.Year() != 2017 {
+		t.Errorf("timestamp was not imported, got %s", req.StartDatetime)
+	}
+	if req.ServerResponse == nil || string(req.ServerResponse.BodyBytes()) != "BBBB" {
+		t.Errorf("response was not imported")
+	}
+}
+
+func TestImportBurpInvalidTime(t *testing.T) {
+	storage := testStorage()
+	defer storage.Close()
+
+	reqData := base64.StdEncoding.EncodeToString([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	export := `<items>
+  <item>
+    <time>Mon Oct 02 12:34:56 XYZ 2017</time>
+    <host>example.com</host>
+    <port>80</port>
+    <protocol>http</protocol>
+    <request base64="true"><![CDATA[` + reqData + `]]></request>
+  </item>
+</items>`
+
+	// Items aren't saved without their time
+	result, err := ImportBurpXML(storage, strings.NewReader(export))
+	testErr(t, err)
+	if len(result.Imported) != 0 || len(result.Errors) != 1 || !strings.Contains(result.Errors[0].Reason, "XYZ") {
+		t.Errorf("item with an invalid time did not return an error: %+v", result.Errors)
+	}
+}
+
+func TestParseBurpTime(t *testing.T) {
+	expected := time.Date(2017, 10, 2, 16, 34, 56, 0, time.UTC)
+	for _, value := range []string{"Mon Oct 02 16:34:56 UTC 2017", "Mon Oct 02 12:34:56 EDT 2017", "Mon Oct 02 18:34:56 CEST 2017", "Mon Oct 02 22:04:56 IST 2017"} {
+		parsed, err := parseBurpTime(value)
+		testErr(t, err)
+		if !parsed.Equal(expected) {
+			t.Errorf("incorrect time for %q: %s", value, parsed.UTC())
+		}
+	}
+
+	if _, err := parseBurpTime("Mon Oct 02 12:34:56 XYZ 2017"); err == nil {
+		t.Errorf("time with an unknown zone was parsed")
+	}
+}
+
+func TestImportHAR(t *testing.T) {
+	storage := testStorage()
+	defer storage.Close()
+
+	export := `{"log": {"entries": [{
+		"startedDateTime": "2017-10-02T12:34:56.000Z",
+		"time": 150,
+		"request": {
+			"method": "POST",
+			"url": "http://example.com/login",
+			"httpVersion": "HTTP/2",
+			"headers": [{"name": ":authority", "value": "example.com"}, {"name": "Foo", "value": "Bar"}],
+			"postData": {"mimeType": "application/x-www-form-urlencoded", "text": "user=admin"}
+		},
+		"response": {
+			"status": 302,
+			"statusText": "Found",
+			"httpVersion": "HTTP/2",
+			"headers": [{"name": "Location", "value": "/"}],
+			"content": {"text": "QkJCQg==", "encoding": "base64"}
+		}
+	}]}}`
+
+	result, err := ImportHAR(storage, strings.NewReader(export))
+	testErr(t, err)
+	if len(result.Imported) != 1 || len(result.Errors) != 0 {
+		t.Fatalf("expected 1 imported item and no errors, got %d and %d", len(result.Imported), len(result.Errors))
+	}
+
+	req, err := storage.LoadRequest(result.Imported[0].DbId)
+	testErr(t, err)
+	if req.DestHost != "example.com" || req.DestPort != 80 || req.DestUseTLS {
+		t.Errorf("incorrect destination: %s:%d tls=%t", req.DestHost, req.DestPort, req.DestUseTLS)
+	}
+	if string(req.BodyBytes()) != "user=admin" || req.Header.Get("Foo") != "Bar" {
+		t.Errorf("request was not imported correctly")
+	}
+	if req.EndDatetime.Sub(req.StartDatetime).Nanoseconds() != 150000000 {
+		t.Errorf("incorrect duration: %s", req.EndDatetime.Sub(req.StartDatetime))
+	}
+	if req.ServerResponse == nil || req.ServerResponse.StatusCode != 302 || string(req.ServerResponse.BodyBytes()) != "BBBB" {
+		t.Errorf("response was not imported correctly")
+	}
+}
+
+func TestImportZAPXML(t *testing.T) {
+	storage := testStorage()
+	defer storage.Close()
+
+	export := `<?xml version="1.0" encoding="UTF-8"?>
+<messages type="list">
+  <message type="set">
+    <id>1</id>
+    <timestamp>1506947696000</timestamp>
+    <rtt>150</rtt>
+    <requestHeader>POST https://example.com:8443/login?a=b HTTP/1.1&#13;
+Host: example.com:8443&#13;
+Content-Length: 10&#13;
+Foo: Bar&#13;
+&#13;
+</requestHeader>
+    <requestBody>user=admin</requestBody>
+    <responseHeader>HTTP/1.1 302 Found
+Location: /
+</responseHeader>
+    <responseBody>BBBB</responseBody>
+  </message>
+  <message type="set">
+    <id>2</id>
+    <timestamp>1506947696000</timestamp>
+    <requestHeader>GET http://example.com/ HTTP/1.1
+Host: example.com
+</requestHeader>
+    <requestBody></requestBody>
+    <responseHeader></responseHeader>
+    <responseBody></responseBody>
+  </message>
+  <message type="set">
+    <timestamp>soon</timestamp>
+    <requestHeader>GET http://example.com/ HTTP/1.1</requestHeader>
+  </message>
+</messages>`
+
+	result, err := ImportZAPXML(storage, strings.NewReader(export))
+	testErr(t, err)
+	if len(result.Imported) != 2 || len(result.Errors) != 1 || result.Errors[0].Index != 2 {
+		t.Fatalf("expected 2 imported messages and an error for message 2, got %d and %+v", len(result.Imported), result.Errors)
+	}
+
+	req, err := storage.LoadRequest(result.Imported[0].DbId)
+	testErr(t, err)
+	if req.DestHost != "example.com" || req.DestPort != 8443 || !req.DestUseTLS {
+		t.Errorf("incorrect destination: %s:%d tls=%t", req.DestHost, req.DestPort, req.DestUseTLS)
+	}
+	if req.Method != "POST" || req.URL.Path != "/login" || req.URL.RawQuery != "a=b" || string(req.BodyBytes()) != "user=admin" || req.Header.Get("Foo") != "Bar" {
+		t.Errorf("request was not imported correctly: %s", req.FullMessage())
+	}
+	if !req.StartDatetime.Equal(time.Unix(1506947696, 0)) || req.EndDatetime.Sub(req.StartDatetime) != 150*time.Millisecond {
+		t.Errorf("incorrect times: %s-%s", req.StartDatetime, req.EndDatetime)
+	}
+	if req.ServerResponse == nil || req.ServerResponse.StatusCode != 302 || string(req.ServerResponse.BodyBytes()) != "BBBB" {
+		t.Errorf("response was not imported correctly")
+	}
+
+	req, err = storage.LoadRequest(result.Imported[1].DbId)
+	testErr(t, err)
+	if req.DestPort != 80 || req.DestUseTLS || req.ServerResponse != nil {
+		t.Errorf("message without a response was not imported correctly: %s:%d tls=%t", req.DestHost, req.DestPort, req.DestUseTLS)
+	}
+}
@@ -0,0 +1,1125 @@
+package puppy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+JSONL Storage
+
+JSONLStorage is a MessageStorage which appends a JSON record to a log file for every change. The log is replayed
+when the storage is opened to build an in-memory index of where the most recent version of each record can be found.
+Updates append a new version of the record and deletes append a tombstone record. Compact rewrites the log with only
+the most recent version of each record.
+*/
+
+// Record types used in the log
+const (
+	jsonlRequest   = "request"
+	jsonlResponse  = "response"
+	jsonlWSMessage = "wsmessage"
+	jsonlQuery     = "query"
+	jsonlPlugin    = "plugin"
+)
+
+// A single line in the log
+type jsonlRecord struct {
+	Type    string
+	Id      string
+	Deleted bool `json:"Deleted,omitempty"`
+
+	// Requests
+	DestHost    string   `json:"DestHost,omitempty"`
+	DestPort    int      `json:"DestPort,omitempty"`
+	UseTLS      bool     `json:"UseTLS,omitempty"`
+	Method      string   `json:"Method,omitempty"`
+	Path        string   `json:"Path,omitempty"`
+	Tags        []string `json:"Tags,omitempty"`
+	StartTime   int64    `json:"StartTime,omitempty"`
+	EndTime     int64    `json:"EndTime,omitempty"`
+	ResponseId  string   `json:"ResponseId,omitempty"`
+	UnmangledId string   `json:"UnmangledId,omitempty"`
+	Note        string   `json:"Note,omitempty"`
+	Highlight   string   `json:"Highlight,omitempty"`
+	Reviewed    bool     `json:"Reviewed,omitempty"`
+
+	Timings *RequestTimings `json:"Timings,omitempty"`
+
+	// Responses
+	StatusCode int `json:"StatusCode,omitempty"`
+
+	// Websocket messages
+	ParentId  string `json:"ParentId,omitempty"`
+	IsBinary  bool   `json:"IsBinary,omitempty"`
+	ToServer  bool   `json:"ToServer,omitempty"`
+	Timestamp int64  `json:"Timestamp,omitempty"`
+
+	// The full message. Stored as text if it is valid UTF-8 so that the log can be read and searched with other tools, otherwise stored base64 encoded.
+	Message string `json:"Message,omitempty"`
+	Base64  bool   `json:"Base64,omitempty"`
+
+	// Saved queries. Expr is set if the query was saved as an expression
+	Query       StrMessageQuery `json:"Query,omitempty"`
+	Expr        *StrQueryExpr   `json:"Expr,omitempty"`
+	Description string          `json:"Description,omitempty"`
+	Folder      string          `json:"Folder,omitempty"`
+
+	// Plugin values
+	Value string `json:"Value,omitempty"`
+}
+
+func (rec *jsonlRecord) setMessage(msg []byte) {
+	if utf8.Valid(msg) {
+		rec.Message = string(msg)
+		rec.Base64 = false
+	} else {
+		rec.Message = base64.StdEncoding.EncodeToString(msg)
+		rec.Base64 = true
+	}
+}
+
+func (rec *jsonlRecord) message() ([]byte, error) {
+	if rec.Base64 {
+		return base64.StdEncoding.DecodeString(rec.Message)
+	}
+	return []byte(rec.Message), nil
+}
+
+// The location of the most recent version of a record in the log along with the fields needed to follow references without reading the record
+type jsonlEntry struct {
+	offset int64
+	length int
+
+	responseId  string
+	unmangledId string
+	parentId    string
+	startTime   int64
+}
+
+type JSONLStorage struct {
+	fname           string
+	file            *os.File
+	size            int64
+	mtx             sync.Mutex
+	logger          *log.Logger
+	storageWatchers []StorageWatcher
+
+	// Maps record type to record id to the entry for the most recent version of the record
+	index map[string]map[string]*jsonlEntry
+	// Maps request id to the ids of the websocket messages that belong to it
+	requestWS map[string]map[string]bool
+	// The largest id that has been used for each type of message
+	lastId map[string]int64
+	// Number of records in the log which have been superseded
+	dead int
+}
+
+// OpenJSONLStorage opens a log file or creates it if it doesn't exist and replays it to build the index
+func OpenJSONLStorage(fname string, logger *log.Logger) (*JSONLStorage, error) {
+	f, err := os.OpenFile(fname, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	ms := &JSONLStorage{
+		fname:           fname,
+		file:            f,
+		logger:          logger,
+		storageWatchers: make([]StorageWatcher, 0),
+	}
+
+	if err := ms.replay(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return ms, nil
+}
+
+func (ms *JSONLStorage) resetIndex() {
+	ms.index = map[string]map[string]*jsonlEntry{
+		jsonlRequest:   make(map[string]*jsonlEntry),
+		jsonlResponse:  make(map[string]*jsonlEntry),
+		jsonlWSMessage: make(map[string]*jsonlEntry),
+		jsonlQuery:     make(map[string]*jsonlEntry),
+		jsonlPlugin:    make(map[string]*jsonlEntry),
+	}
+	ms.requestWS = make(map[string]map[string]bool)
+	ms.lastId = make(map[string]int64)
+	ms.size = 0
+	ms.dead = 0
+}
+
+func (ms *JSONLStorage) replay() error {
+	ms.resetIndex()
+
+	if _, err := ms.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(ms.file)
+
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				// The last write was interrupted, drop the partial record
+				ms.logger.Printf("Dropping incomplete record at the end of %s", ms.fname)
+				if err := ms.file.Truncate(ms.size); err != nil {
+					return fmt.Errorf("error truncating incomplete record: %s", err.Error())
+				}
+			}
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("error reading log: %s", err.Error())
+		}
+
+		rec := &jsonlRecord{}
+		if err := json.Unmarshal(line, rec); err != nil {
+			return fmt.Errorf("error parsing record at offset %d: %s", ms.size, err.Error())
+		}
+		if err := ms.indexRecord(rec, ms.size, len(line)); err != nil {
+			return fmt.Errorf("error parsing record at offset %d: %s", ms.size, err.Error())
+		}
+		ms.size += int64(len(line))
+	}
+}
+
+// Updates the index to point to a record that was written to the log
+func (ms *JSONLStorage) indexRecord(rec *jsonlRecord, offset int64, length int) error {
+	entries, ok := ms.index[rec.Type]
+	if !ok {
+		return fmt.Errorf("invalid record type: %s", rec.Type)
+	}
+
+	if rec.Type == jsonlRequest || rec.Type == jsonlResponse || rec.Type == jsonlWSMessage {
+		id, err := strconv.ParseInt(rec.Id, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid id: %s", rec.Id)
+		}
+		if id > ms.lastId[rec.Type] {
+			ms.lastId[rec.Type] = id
+		}
+	}
+
+	if old, ok := entries[rec.Id]; ok {
+		ms.dead++
+		if rec.Type == jsonlWSMessage && old.parentId != "" {
+			delete(ms.requestWS[old.parentId], rec.Id)
+		}
+	}
+
+	if rec.Deleted {
+		delete(entries, rec.Id)
+		ms.dead++
+		return nil
+	}
+
+	if rec.Type == jsonlWSMessage && rec.ParentId != "" {
+		if ms.requestWS[rec.ParentId] == nil {
+			ms.requestWS[rec.ParentId] = make(map[string]bool)
+		}
+		ms.requestWS[rec.ParentId][rec.Id] = true
+	}
+
+	entries[rec.Id] = &jsonlEntry{
+		offset:      offset,
+		length:      length,
+		responseId:  rec.ResponseId,
+		unmangledId: rec.UnmangledId,
+		parentId:    rec.ParentId,
+		startTime:   rec.StartTime,
+	}
+	return nil
+}
+
+func (ms *JSONLStorage) nextId(recType string) string {
+	ms.lastId[recType]++
+	return strconv.FormatInt(ms.lastId[recType], 10)
+}
+
+// Appends a record to the end of the log and updates the index
+func (ms *JSONLStorage) writeRecord(rec *jsonlRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("error marshaling record: %s", err.Error())
+	}
+	line = append(line, '\n')
+
+	if _, err := ms.file.WriteAt(line, ms.size); err != nil {
+		return fmt.Errorf("error writing record to log: %s", err.Error())
+	}
+	offset := ms.size
+	ms.size += int64(len(line))
+	return ms.indexRecord(rec, offset, len(line))
+}
+
+func (ms *JSONLStorage) readRecord(entry *jsonlEntry) (*jsonlRecord, error) {
+	line := make([]byte, entry.length)
+	if _, err := ms.file.ReadAt(line, entry.offset); err != nil {
+		return nil, fmt.Errorf("error reading record from log: %s", err.Error())
+	}
+
+	rec := &jsonlRecord{}
+	if err := json.Unmarshal(line, rec); err != nil {
+		return nil, fmt.Errorf("error parsing record at offset %d: %s", entry.offset, err.Error())
+	}
+	return rec, nil
+}
+
+func (ms *JSONLStorage) Close() {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	ms.file.Close()
+}
+
+// Compact rewrites the log so that it only contains the most recent version of each record
+func (ms *JSONLStorage) Compact() error {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+
+	tmpName := ms.fname + ".compact"
+	tmp, err := os.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("error creating compacted log: %s", err.Error())
+	}
+
+	if err := ms.writeCompacted(tmp); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+
+	if err := os.Rename(tmpName, ms.fname); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return fmt.Errorf("error replacing log with compacted log: %s", err.Error())
+	}
+
+	ms.file.Close()
+	ms.file = tmp
+	return ms.replay()
+}
+
+type jsonlEntrySort []*jsonlEntry
+
+func (es jsonlEntrySort) Len() int {
+	return len(es)
+}
+
+func (es jsonlEntrySort) Swap(i int, j int) {
+	es[i], es[j] = es[j], es[i]
+}
+
+func (es jsonlEntrySort) Less(i int, j int) bool {
+	return es[i].offset < es[j].offset
+}
+
+func (ms *JSONLStorage) writeCompacted(w *os.File) error {
+	entries := make([]*jsonlEntry, 0)
+	for _, recEntries := range ms.index {
+		for _, entry := range recEntries {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Sort(jsonlEntrySort(entries))
+
+	bw := bufio.NewWriter(w)
+	for _, entry := range entries {
+		line := make([]byte, entry.length)
+		if _, err := ms.file.ReadAt(line, entry.offset); err != nil {
+			return fmt.Errorf("error reading record from log: %s", err.Error())
+		}
+		if _, err := bw.Write(line); err != nil {
+			return fmt.Errorf("error writing compacted log: %s", err.Error())
+		}
+	}
+
+	// Keep a tombstone for the last id used for each message type so that ids are not reused
+	for _, recType := range []string{jsonlRequest, jsonlResponse, jsonlWSMessage} {
+		lastId := strconv.FormatInt(ms.lastId[recType], 10)
+		if _, ok := ms.index[recType][lastId]; ms.lastId[recType] > 0 && !ok {
+			line, err := json.Marshal(&jsonlRecord{Type: recType, Id: lastId, Deleted: true})
+			if err != nil {
+				return err
+			}
+			bw.Write(append(line, '\n'))
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("error writing compacted log: %s", err.Error())
+	}
+	if err := w.Sync(); err != nil {
+		return fmt.Errorf("error writing compacted log: %s", err.Error())
+	}
+	return nil
+}
+
+/*
+Requests
+*/
+
+func (ms *JSONLStorage) SaveNewRequest(req *ProxyRequest) error {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	if err := ms.writeRequest(req, ms.nextId(jsonlRequest)); err != nil {
+		return err
+	}
+	for _, watcher := range ms.storageWatchers {
+		watcher.NewRequestSaved(ms, req)
+	}
+	return nil
+}
+
+func (ms *JSONLStorage) UpdateRequest(req *ProxyRequest) error {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	if req.DbId == "" {
+		return fmt.Errorf("Request must be saved to datafile before it can be updated")
+	}
+	if _, ok := ms.index[jsonlRequest][req.DbId]; !ok {
+		return fmt.Errorf("Request with id %s does not exist", req.DbId)
+	}
+	if err := ms.writeRequest(req, req.DbId); err != nil {
+		return err
+	}
+	for _, watcher := range ms.storageWatchers {
+		watcher.RequestUpdated(ms, req)
+	}
+	return nil
+}
+
+func (ms *JSONLStorage) writeRequest(req *ProxyRequest, reqid string) error {
+	rec := &jsonlRecord{
+		Type:      jsonlRequest,
+		Id:        reqid,
+		DestHost:  req.DestHost,
+		DestPort:  req.DestPort,
+		UseTLS:    req.DestUseTLS,
+		Method:    req.Method,
+		Path:      req.HTTPPath(),
+		Tags:      req.Tags(),
+		StartTime: req.StartDatetime.UnixNano(),
+		EndTime:   req.EndDatetime.UnixNano(),
+		Note:      req.Note,
+		Highlight: req.Highlight,
+		Reviewed:  req.Reviewed,
+	}
+	if req.Timings != (RequestTimings{}) {
+		timings := req.Timings
+		rec.Timings = &timings
+	}
+
+	if req.ServerResponse != nil {
+		if req.ServerResponse.DbId == "" {
+			return errors.New("response has not been saved yet, cannot save request")
+		}
+		rec.ResponseId = req.ServerResponse.DbId
+	}
+
+	if req.Unmangled != nil {
+		if req.Unmangled.DbId == "" {
+			return errors.New("unmangled request has not been saved yet, cannot save request")
+		}
+		rec.UnmangledId = req.Unmangled.DbId
+	}
+
+	rec.setMessage(req.FullMessage())
+	if err := ms.writeRecord(rec); err != nil {
+		return err
+	}
+	req.DbId = reqid
+	return nil
+}
+
+func (ms *JSONLStorage) LoadRequest(reqid string) (*ProxyRequest, error) {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	return ms.loadRequest(reqid)
+}
+
+func (ms *JSONLStorage) loadRequest(reqid string) (*ProxyRequest, error) {
+	entry, ok := ms.index[jsonlRequest][reqid]
+	if !ok {
+		return nil, fmt.Errorf("Request with id %s does not exist", reqid)
+	}
+
+	rec, err := ms.readRecord(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := rec.message()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode request (id=%s): %s", reqid, err.Error())
+	}
+
+	req, err := ProxyRequestFromBytes(msg, rec.DestHost, rec.DestPort, rec.UseTLS)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create request (id=%s) from data in log: %s", reqid, err.Error())
+	}
+	req.DbId = reqid
+	req.StartDatetime = time.Unix(0, rec.StartTime)
+	req.EndDatetime = time.Unix(0, rec.EndTime)
+	req.Note = rec.Note
+	req.Highlight = rec.Highlight
+	req.Reviewed = rec.Reviewed
+	if rec.Timings != nil {
+		req.Timings = *rec.Timings
+	}
+	for _, tag := range rec.Tags {
+		req.AddTag(tag)
+	}
+
+	if rec.UnmangledId != "" {
+		unmangledReq, err := ms.loadRequest(rec.UnmangledId)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load unmangled request for reqid=%s: %s", reqid, err.Error())
+		}
+		req.Unmangled = unmangledReq
+	}
+
+	if rec.ResponseId != "" {
+		rsp, err := ms.loadResponse(rec.ResponseId)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load response for reqid=%s: %s", reqid, err.Error())
+		}
+		req.ServerResponse = rsp
+	}
+
+	messages := make([]*ProxyWSMessage, 0)
+	for wsmid := range ms.requestWS[reqid] {
+		wsm, err := ms.loadWSMessage(wsmid)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load websocket messages for reqid=%s: %s", reqid, err.Error())
+		}
+		messages = append(messages, wsm)
+	}
+	sort.Sort(WSSort(messages))
+	req.WSMessages = messages
+
+	return req, nil
+}
+
+func (ms *JSONLStorage) LoadUnmangledRequest(reqid string) (*ProxyRequest, error) {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	entry, ok := ms.index[jsonlRequest][reqid]
+	if !ok || entry.unmangledId == "" {
+		return nil, fmt.Errorf("request has no unmangled version")
+	}
+	return ms.loadRequest(entry.unmangledId)
+}
+
+func (ms *JSONLStorage) DeleteRequest(reqid string) error {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	if _, ok := ms.index[jsonlRequest][reqid]; !ok {
+		// Nothing to delete, don't write a tombstone or notify watchers
+		return nil
+	}
+	if err := ms.deleteRequest(reqid); err != nil {
+		return err
+	}
+	for _, watcher := range ms.storageWatchers {
+		watcher.RequestDeleted(ms, reqid)
+	}
+	return nil
+}
+
+func (ms *JSONLStorage) deleteRequest(reqid string) error {
+	entry, ok := ms.index[jsonlRequest][reqid]
+	if !ok {
+		return nil
+	}
+
+	if entry.unmangledId != "" {
+		if err := ms.deleteRequest(entry.unmangledId); err != nil {
+			return err
+		}
+	}
+
+	if entry.responseId != "" {
+		if err := ms.deleteResponse(entry.responseId); err != nil {
+			return err
+		}
+	}
+
+	// Deleting a message also writes tombstones for its unmangled versions
+	for wsmid := range ms.requestWS[reqid] {
+		if err := ms.deleteWSMessage(wsmid); err != nil {
+			return err
+		}
+	}
+	delete(ms.requestWS, reqid)
+
+	return ms.writeRecord(&jsonlRecord{Type: jsonlRequest, Id: reqid, Deleted: true})
+}
+
+/*
+Responses
+*/
+
+func (ms *JSONLStorage) SaveNewResponse(rsp *ProxyResponse) error {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	if err := ms.writeResponse(rsp, ms.nextId(jsonlResponse)); err != nil {
+		return err
+	}
+	for _, watcher := range ms.storageWatchers {
+		watcher.NewResponseSaved(ms, rsp)
+	}
+	return nil
+}
+
+func (ms *JSONLStorage) UpdateResponse(rsp *ProxyResponse) error {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	if rsp.DbId == "" {
+		return fmt.Errorf("Response must be saved to datafile before it can be updated")
+	}
+	if _, ok := ms.index[jsonlResponse][rsp.DbId]; !ok {
+		return fmt.Errorf("Response with id %s does not exist", rsp.DbId)
+	}
+	if err := ms.writeResponse(rsp, rsp.DbId); err != nil {
+		return err
+	}
+	for _, watcher := range ms.storageWatchers {
+		watcher.ResponseUpdated(ms, rsp)
+	}
+	return nil
+}
+
+func (ms *JSONLStorage) writeResponse(rsp *ProxyResponse, rspid string) error {
+	rec := &jsonlRecord{
+		Type:       jsonlResponse,
+		Id:         rspid,
+		StatusCode: rsp.StatusCode,
+	}
+
+	if rsp.Unmangled != nil {
+		if rsp.Unmangled.DbId == "" {
+			return errors.New("unmangled response has not been saved yet, cannot save response")
+		}
+		rec.UnmangledId = rsp.Unmangled.DbId
+	}
+
+	rec.setMessage(rsp.FullMessage())
+	if err := ms.writeRecord(rec); err != nil {
+		return err
+	}
+	rsp.DbId = rspid
+	return nil
+}
+
+func (ms *JSONLStorage) LoadResponse(rspid string) (*ProxyResponse, error) {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	return ms.loadResponse(rspid)
+}
+
+func (ms *JSONLStorage) loadResponse(rspid string) (*ProxyResponse, error) {
+	entry, ok := ms.index[jsonlResponse][rspid]
+	if !ok {
+		return nil, fmt.Errorf("Response with id %s does not exist", rspid)
+	}
+
+	rec, err := ms.readRecord(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := rec.message()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode response (id=%s): %s", rspid, err.Error())
+	}
+
+	rsp, err := ProxyResponseFromBytes(msg)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create response (id=%s) from data in log: %s", rspid, err.Error())
+	}
+	rsp.DbId = rspid
+
+	if rec.UnmangledId != "" {
+		unmangledRsp, err := ms.loadResponse(rec.UnmangledId)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load unmangled response for rspid=%s: %s", rspid, err.Error())
+		}
+		rsp.Unmangled = unmangledRsp
+	}
+
+	return rsp, nil
+}
+
+func (ms *JSONLStorage) LoadUnmangledResponse(rspid string) (*ProxyResponse, error) {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	entry, ok := ms.index[jsonlResponse][rspid]
+	if !ok || entry.unmangledId == "" {
+		return nil, fmt.Errorf("response has no unmangled version")
+	}
+	return ms.loadResponse(entry.unmangledId)
+}
+
+func (ms *JSONLStorage) DeleteResponse(rspid string) error {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	if err := ms.deleteResponse(rspid); err != nil {
+		return err
+	}
+	for _, watcher := range ms.storageWatchers {
+		watcher.ResponseDeleted(ms, rspid)
+	}
+	return nil
+}
+
+func (ms *JSONLStorage) deleteResponse(rspid string) error {
+	entry, ok := ms.index[jsonlResponse][rspid]
+	if !ok {
+		return nil
+	}
+
+	if entry.unmangledId != "" {
+		if err := ms.deleteResponse(entry.unmangledId); err != nil {
+			return err
+		}
+	}
+
+	return ms.writeRecord(&jsonlRecord{Type: jsonlResponse, Id: rspid, Deleted: true})
+}
+
+/*
+Websocket messages
+*/
+
+func (ms *JSONLStorage) SaveNewWSMessage(req *ProxyRequest, wsm *ProxyWSMessage) error {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	if err := ms.writeWSMessage(req, wsm, ms.nextId(jsonlWSMessage)); err != nil {
+		return err
+	}
+	for _, watcher := range ms.storageWatchers {
+		watcher.NewWSMessageSaved(ms, req, wsm)
+	}
+	return nil
+}
+
+func (ms *JSONLStorage) UpdateWSMessage(req *ProxyRequest, wsm *ProxyWSMessage) error {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	if wsm.DbId == "" {
+		return fmt.Errorf("Websocket message must be saved to datafile before it can be updated")
+	}
+	if _, ok := ms.index[jsonlWSMessage][wsm.DbId]; !ok {
+		return fmt.Errorf("Message with id %s does not exist", wsm.DbId)
+	}
+	if err := ms.writeWSMessage(req, wsm, wsm.DbId); err != nil {
+		return err
+	}
+	for _, watcher := range ms.storageWatchers {
+		watcher.WSMessageUpdated(ms, req, wsm)
+	}
+	return nil
+}
+
+func (ms *JSONLStorage) writeWSMessage(req *ProxyRequest, wsm *ProxyWSMessage, wsmid string) error {
+	rec := &jsonlRecord{
+		Type:      jsonlWSMessage,
+		Id:        wsmid,
+		IsBinary:  wsm.Type == websocket.BinaryMessage,
+		ToServer:  wsm.Direction == ToServer,
+		Timestamp: wsm.Timestamp.UnixNano(),
+	}
+
+	if req != nil {
+		if req.DbId == "" {
+			return errors.New("request has not been saved yet, cannot save websocket message")
+		}
+		rec.ParentId = req.DbId
+	}
+
+	if wsm.Unmangled != nil {
+		if wsm.Unmangled.DbId == "" {
+			return errors.New("unmangled websocket message has not been saved yet, cannot save websocket message")
+		}
+		rec.UnmangledId = wsm.Unmangled.DbId
+	}
+
+	rec.setMessage(wsm.Message)
+	if err := ms.writeRecord(rec); err != nil {
+		return err
+	}
+	wsm.DbId = wsmid
+	return nil
+}
+
+func (ms *JSONLStorage) LoadWSMessage(wsmid string) (*ProxyWSMessage, error) {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	return ms.loadWSMessage(wsmid)
+}
+
+func (ms *JSONLStorage) loadWSMessage(wsmid string) (*ProxyWSMessage, error) {
+	entry, ok := ms.index[jsonlWSMessage][wsmid]
+	if !ok {
+		return nil, fmt.Errorf("Message with id %s does not exist", wsmid)
+	}
+
+	rec, err := ms.readRecord(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := rec.message()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode websocket message (id=%s): %s", wsmid, err.Error())
+	}
+
+	mtype := websocket.TextMessage
+	if rec.IsBinary {
+		mtype = websocket.BinaryMessage
+	}
+	direction := ToClient
+	if rec.ToServer {
+		direction = ToServer
+	}
+
+	wsm, err := NewProxyWSMessage(mtype, msg, direction)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create websocket message from data in log: %s", err.Error())
+	}
+	wsm.DbId = wsmid
+	wsm.Timestamp = time.Unix(0, rec.Timestamp)
+
+	if rec.UnmangledId != "" {
+		unmangledWsm, err := ms.loadWSMessage(rec.UnmangledId)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load unmangled websocket message for wsmid=%s: %s", wsmid, err.Error())
+		}
+		wsm.Unmangled = unmangledWsm
+	}
+
+	return wsm, nil
+}
+
+func (ms *JSONLStorage) LoadUnmangledWSMessage(wsmid string) (*ProxyWSMessage, error) {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	entry, ok := ms.index[jsonlWSMessage][wsmid]
+	if !ok || entry.unmangledId == "" {
+		return nil, fmt.Errorf("message has no unmangled version")
+	}
+	return ms.loadWSMessage(entry.unmangledId)
+}
+
+func (ms *JSONLStorage) DeleteWSMessage(wsmid string) error {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	if err := ms.deleteWSMessage(wsmid); err != nil {
+		return err
+	}
+	for _, watcher := range ms.storageWatchers {
+		watcher.WSMessageDeleted(ms, wsmid)
+	}
+	return nil
+}
+
+func (ms *JSONLStorage) deleteWSMessage(wsmid string) error {
+	entry, ok := ms.index[jsonlWSMessage][wsmid]
+	if !ok {
+		return nil
+	}
+
+	if entry.unmangledId != "" {
+		if err := ms.deleteWSMessage(entry.unmangledId); err != nil {
+			return err
+		}
+	}
+
+	return ms.writeRecord(&jsonlRecord{Type: jsonlWSMessage, Id: wsmid, Deleted: true})
+}
+
+/*
+Searching
+*/
+
+type jsonlIdSort []string
+
+func (ids jsonlIdSort) Len() int {
+	return len(ids)
+}
+
+func (ids jsonlIdSort) Swap(i int, j int) {
+	ids[i], ids[j] = ids[j], ids[i]
+}
+
+func (ids jsonlIdSort) Less(i int, j int) bool {
+	a, _ := strconv.ParseInt(ids[i], 10, 64)
+	b, _ := strconv.ParseInt(ids[j], 10, 64)
+	return a < b
+}
+
+func (ms *JSONLStorage) RequestKeys() ([]string, error) {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	keys := make([]string, 0, len(ms.index[jsonlRequest]))
+	for reqid := range ms.index[jsonlRequest] {
+		keys = append(keys, reqid)
+	}
+	sort.Sort(jsonlIdSort(keys))
+	return keys, nil
+}
+
+func (ms *JSONLStorage) Search(limit int64, args ...interface{}) ([]*ProxyRequest, error) {
+	// Create the checker before locking the storage since it may need to load saved queries
+	checker, err := NewStorageRequestChecker(ms, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+
+	// Check for `id is`
+	if len(args) == 3 {
+		field, ok := args[0].(SearchField)
+		if ok && field == FieldId {
+			comparer, ok := args[1].(StrComparer)
+			if ok && comparer == StrIs {
+				reqid, ok := args[2].(string)
+				if ok {
+					req, err := ms.loadRequest(reqid)
+					if err != nil {
+						return nil, err
+					}
+					return []*ProxyRequest{req}, nil
+				}
+			}
+		}
+	}
+
+	return ms.checkRequests(limit, checker)
+}
+
+func (ms *JSONLStorage) CheckRequests(limit int64, checker RequestChecker) ([]*ProxyRequest, error) {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	return ms.checkRequests(limit, checker)
+}
+
+func (ms *JSONLStorage) RequestStats(query MessageQuery, group StatsGroup) ([]*RequestStats, error) {
+	return checkRequestStats(ms, query, group)
+}
+
+func (ms *JSONLStorage) checkRequests(limit int64, checker RequestChecker) ([]*ProxyRequest, error) {
+	// Check the most recent requests first
+	keys := make([]string, 0, len(ms.index[jsonlRequest]))
+	for reqid := range ms.index[jsonlRequest] {
+		keys = append(keys, reqid)
+	}
+	entries := ms.index[jsonlRequest]
+	sort.SliceStable(keys, func(i int, j int) bool {
+		return entries[keys[i]].startTime > entries[keys[j]].startTime
+	})
+
+	results := make([]*ProxyRequest, 0)
+	for _, reqid := range keys {
+		req, err := ms.loadRequest(reqid)
+		if err != nil {
+			return nil, errors.New("error creating request: " + err.Error())
+		}
+
+		if checker(req) {
+			results = append(results, req)
+			if limit > 0 && int64(len(results)) >= limit {
+				break
+			}
+		}
+	}
+	return results, nil
+}
+
+/*
+Saved queries
+*/
+
+func (ms *JSONLStorage) AllSavedQueries() ([]*SavedQuery, error) {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+
+	names := make([]string, 0, len(ms.index[jsonlQuery]))
+	for name := range ms.index[jsonlQuery] {
+		names = append(names, name)
+	}
+	entries := ms.index[jsonlQuery]
+	sort.Slice(names, func(i int, j int) bool {
+		return entries[names[i]].offset < entries[names[j]].offset
+	})
+
+	savedQueries := make([]*SavedQuery, 0, len(names))
+	for _, name := range names {
+		sq, err := ms.loadSavedQuery(name)
+		if err != nil {
+			return nil, err
+		}
+		savedQueries = append(savedQueries, sq)
+	}
+	return savedQueries, nil
+}
+
+func (ms *JSONLStorage) SaveQuery(name string, query MessageQuery) error {
+	return ms.SaveSavedQuery(&SavedQuery{Name: name, Query: query})
+}
+
+func (ms *JSONLStorage) SaveQueryExpr(name string, expr *QueryExpr) error {
+	if expr == nil {
+		return errors.New("query expression is required")
+	}
+	return ms.SaveSavedQuery(&SavedQuery{Name: name, Expr: expr})
+}
+
+func (ms *JSONLStorage) SaveSavedQuery(sq *SavedQuery) error {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+
+	strQuery, strExpr, err := savedQueryForSaving(sq)
+	if err != nil {
+		return err
+	}
+
+	// Delete the old version first so the query is listed with the most recently saved queries
+	if _, ok := ms.index[jsonlQuery][sq.Name]; ok {
+		if err := ms.writeRecord(&jsonlRecord{Type: jsonlQuery, Id: sq.Name, Deleted: true}); err != nil {
+			return err
+		}
+	}
+	err = ms.writeRecord(&jsonlRecord{
+		Type:        jsonlQuery,
+		Id:          sq.Name,
+		Query:       strQuery,
+		Expr:        strExpr,
+		Description: sq.Description,
+		Folder:      sq.Folder,
+	})
+	if err != nil {
+		return err
+	}
+	notifyQueryWatchers(ms.storageWatchers, ms, sq.Name, false)
+	return nil
+}
+
+func (ms *JSONLStorage) LoadQuery(name string) (MessageQuery, error) {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	sq, err := ms.loadSavedQuery(name)
+	if err != nil {
+		return nil, err
+	}
+	return savedMessageQuery(sq)
+}
+
+func (ms *JSONLStorage) LoadQueryExpr(name string) (*QueryExpr, error) {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	sq, err := ms.loadSavedQuery(name)
+	if err != nil {
+		return nil, err
+	}
+	return sq.Expr, nil
+}
+
+func (ms *JSONLStorage) LoadSavedQuery(name string) (*SavedQuery, error) {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	return ms.loadSavedQuery(name)
+}
+
+func (ms *JSONLStorage) loadSavedQuery(name string) (*SavedQuery, error) {
+	entry, ok := ms.index[jsonlQuery][name]
+	if !ok {
+		return nil, fmt.Errorf("context with name %s does not exist", name)
+	}
+
+	rec, err := ms.readRecord(entry)
+	if err != nil {
+		return nil, err
+	}
+	sq, err := savedQueryFromStr(name, rec.Query, rec.Expr)
+	if err != nil {
+		return nil, err
+	}
+	sq.Description = rec.Description
+	sq.Folder = rec.Folder
+	return sq, nil
+}
+
+func (ms *JSONLStorage) DeleteQuery(name string) error {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	if _, ok := ms.index[jsonlQuery][name]; !ok {
+		return nil
+	}
+	if err := ms.writeRecord(&jsonlRecord{Type: jsonlQuery, Id: name, Deleted: true}); err != nil {
+		return err
+	}
+	notifyQueryWatchers(ms.storageWatchers, ms, name, true)
+	return nil
+}
+
+/*
+Watchers and plugin values
+*/
+
+func (ms *JSONLStorage) Watch(watcher StorageWatcher) error {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	ms.storageWatchers = append(ms.storageWatchers, watcher)
+	return nil
+}
+
+func (ms *JSONLStorage) EndWatch(watcher StorageWatcher) error {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	var newWatched = make([]StorageWatcher, 0)
+	for _, testWatcher := range ms.storageWatchers {
+		if testWatcher != watcher {
+			newWatched = append(newWatched, testWatcher)
+		}
+	}
+	ms.storageWatchers = newWatched
+	return nil
+}
+
+func (ms *JSONLStorage) SetPluginValue(key string, value string) error {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	return ms.writeRecord(&jsonlRecord{Type: jsonlPlugin, Id: key, Value: value})
+}
+
+func (ms *JSONLStorage) GetPluginValue(key string) (string, error) {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	entry, ok := ms.index[jsonlPlugin][key]
+	if !ok {
+		return "", fmt.Errorf("plugin data with key %s does not exist", key)
+	}
+
+	rec, err := ms.readRecord(entry)
+	if err != nil {
+		return "", err
+	}
+	return rec.Value, nil
+}
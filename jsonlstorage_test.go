@@ -0,0 +1,147 @@
+package puppy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func testJSONLStorage(t *testing.T) (*JSONLStorage, string, func()) {
+	dir, err := ioutil.TempDir("", "puppytest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fname := filepath.Join(dir, "test.jsonl")
+	storage, err := OpenJSONLStorage(fname, NullLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage, fname, func() {
+		storage.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestJSONLReplay(t *testing.T) {
+	storage, fname, cleanup := testJSONLStorage(t)
+	defer cleanup()
+
+	req1 := testReq()
+	req1.AddTag("foo")
+	testErr(t, SaveNewRequest(storage, req1))
+	req2 := testReq()
+	testErr(t, SaveNewRequest(storage, req2))
+
+	req1.AddTag("bar")
+	testErr(t, UpdateRequest(storage, req1))
+	testErr(t, storage.DeleteRequest(req2.DbId))
+	testErr(t, storage.SetPluginValue("foo", "bar"))
+	storage.Close()
+
+	storage, err := OpenJSONLStorage(fname, NullLogger())
+	testErr(t, err)
+
+	keys, err := storage.RequestKeys()
+	testErr(t, err)
+	checkTags(t, keys, []string{req1.DbId})
+
+	req, err := storage.LoadRequest(req1.DbId)
+	testErr(t, err)
+	tags := req.Tags()
+	sort.Strings(tags)
+	checkTags(t, tags, []string{"bar", "foo"})
+	if req.ServerResponse == nil || string(req.ServerResponse.BodyBytes()) != "BBBB" {
+		t.Errorf("response was not loaded")
+	}
+
+	if _, err := storage.LoadResponse(req2.ServerResponse.DbId); err == nil {
+		t.Errorf("response of deleted request was not deleted")
+	}
+
+	value, err := storage.GetPluginValue("foo")
+	testErr(t, err)
+	if value != "bar" {
+		t.Errorf("incorrect plugin value: %s", value)
+	}
+}
+
+func TestJSONLCompact(t *testing.T) {
+	storage, fname, cleanup := testJSONLStorage(t)
+	defer cleanup()
+
+	ids := make([]string, 0)
+	for i := 0; i < 5; i++ {
+		req := testReq()
+		testErr(t, SaveNewRequest(storage, req))
+		ids = append(ids, req.DbId)
+	}
+	for _, reqid := range ids[2:] {
+		testErr(t, storage.DeleteRequest(reqid))
+	}
+
+	before, err := os.Stat(fname)
+	testErr(t, err)
+	testErr(t, storage.Compact())
+	after, err := os.Stat(fname)
+	testErr(t, err)
+	if after.Size() >= before.Size() {
+		t.Errorf("log was not compacted: %d >= %d", after.Size(), before.Size())
+	}
+
+	keys, err := storage.RequestKeys()
+	testErr(t, err)
+	checkTags(t, keys, ids[:2])
+
+	// Ids of deleted requests are not reused after compacting
+	req := testReq()
+	testErr(t, SaveNewRequest(storage, req))
+	if req.DbId != "6" {
+		t.Errorf("expected new request to have id 6, got %s", req.DbId)
+	}
+}
+
+func TestJSONLDeleteRequest(t *testing.T) {
+	storage, fname, cleanup := testJSONLStorage(t)
+	defer cleanup()
+	watcher := &deleteWatcher{}
+	testErr(t, storage.Watch(watcher))
+
+	req := testReq()
+	testErr(t, SaveNewRequest(storage, req))
+	wsm, err := NewProxyWSMessage(websocket.TextMessage, []byte("mangled"), ToServer)
+	testErr(t, err)
+	wsm.Unmangled, err = NewProxyWSMessage(websocket.TextMessage, []byte("original"), ToServer)
+	testErr(t, err)
+	testErr(t, SaveNewWSMessage(storage, req, wsm))
+
+	loaded, err := storage.LoadRequest(req.DbId)
+	testErr(t, err)
+	if len(loaded.WSMessages) != 1 || loaded.WSMessages[0].Unmangled == nil {
+		t.Errorf("websocket messages were not loaded with the request")
+	}
+
+	testErr(t, storage.DeleteRequest(req.DbId))
+	before, err := os.Stat(fname)
+	testErr(t, err)
+
+	// Deleting a request that does not exist leaves the log and watchers alone
+	testErr(t, storage.DeleteRequest(req.DbId))
+	after, err := os.Stat(fname)
+	testErr(t, err)
+	if after.Size() != before.Size() {
+		t.Errorf("deleting a request that does not exist wrote to the log")
+	}
+	checkTags(t, watcher.deleted, []string{req.DbId})
+	storage.Close()
+
+	// The unmangled message is deleted along with the message it belongs to
+	storage, err = OpenJSONLStorage(fname, NullLogger())
+	testErr(t, err)
+	if _, err := storage.LoadWSMessage(wsm.Unmangled.DbId); err == nil {
+		t.Errorf("unmangled websocket message of deleted request was not deleted")
+	}
+}
@@ -0,0 +1,667 @@
+package puppy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+JSON-RPC
+
+The commands of a MessageListener can also be called using JSON-RPC 2.0 over a WebSocket or plain HTTP POST
+requests by serving the listener with an http.Server. Each command added with AddHandler is a method that takes
+the fields of the command's message as its params object. A response with Success set to false is returned as a
+JSON-RPC error with the Reason as its message and any other response is returned as the result.
+
+Over a WebSocket, commands that keep running after their first response (intercept, watchstorage, subscribequery)
+become streams identified by the id of the call that started them. Pushed events are sent as notifications with
+the event type as the method and the message, with a Stream field, as the params. Any other messages written by
+a stream are sent as "message" notifications. Messages are sent to a stream by calling "send" with the Stream id
+and the Message to send, and the CommandId of the message is set to the id of the "send" call.
+
+Plain HTTP POST requests accept a single call or a batch. Streams end as soon as they have responded and events
+are not delivered.
+
+If the listener has an auth token, it can be given as a bearer token in the Authorization header, as the "token"
+query parameter, as the AuthToken param of each call, or over a WebSocket by calling "auth" with the AuthToken.
+Listeners without an auth token only accept requests whose Host is an IP address, localhost or a host added with
+AllowRPCHost so that pages on other sites can't reach the listener by rebinding their domain to its address.
+*/
+
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcCommandError   = -32000
+	rpcAuthError      = -32001
+
+	// The largest request body accepted over HTTP
+	rpcMaxBody = 64 * 1024 * 1024
+)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Id      json.RawMessage `json:"id,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+	Id      json.RawMessage `json:"id"`
+}
+
+type rpcNotification struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+}
+
+type rpcSendParams struct {
+	Stream  json.RawMessage
+	Message json.RawMessage
+}
+
+func newRPCError(id json.RawMessage, code int, message string) *rpcResponse {
+	return &rpcResponse{
+		JSONRPC: "2.0",
+		Error:   &rpcError{Code: code, Message: message},
+		Id:      rpcId(id),
+	}
+}
+
+// Returns the id to include in a response. Responses to requests with an invalid id have a null id
+func rpcId(id json.RawMessage) json.RawMessage {
+	if len(id) == 0 {
+		return json.RawMessage("null")
+	}
+	return id
+}
+
+// Returns the key used to look up a stream by the id of the call that started it
+func rpcIdKey(id json.RawMessage) string {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, id); err != nil {
+		return string(id)
+	}
+	return buf.String()
+}
+
+// Checks the fields of a call and returns an error response if it is not valid
+func (call *rpcRequest) validate() *rpcResponse {
+	if call.JSONRPC != "2.0" {
+		return newRPCError(call.Id, rpcInvalidRequest, "jsonrpc must be \"2.0\"")
+	}
+	if call.Method == "" {
+		return newRPCError(call.Id, rpcInvalidRequest, "method is required")
+	}
+	if len(call.Id) > 0 && call.Id[0] != '"' && call.Id[0] != '-' && (call.Id[0] < '0' || call.Id[0] > '9') && string(call.Id) != "null" {
+		return newRPCError(nil, rpcInvalidRequest, "id must be a string or number")
+	}
+	return nil
+}
+
+// Returns whether a call expects a response
+func (call *rpcRequest) expectsResponse() bool {
+	return len(call.Id) > 0
+}
+
+// Returns the fields of a call's params
+func (call *rpcRequest) paramFields() (map[string]json.RawMessage, error) {
+	fields := make(map[string]json.RawMessage)
+	params := bytes.TrimSpace(call.Params)
+	if len(params) == 0 || string(params) == "null" {
+		return fields, nil
+	}
+	if params[0] != '{' {
+		return nil, fmt.Errorf("params must be an object")
+	}
+	if err := json.Unmarshal(params, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// Returns the message for the command a call runs
+func (call *rpcRequest) commandMessage() ([]byte, error) {
+	fields, err := call.paramFields()
+	if err != nil {
+		return nil, err
+	}
+	method, err := json.Marshal(call.Method)
+	if err != nil {
+		return nil, err
+	}
+	fields["Command"] = method
+	delete(fields, "CommandId")
+	return json.Marshal(fields)
+}
+
+// Returns the auth token in a call's params
+func (call *rpcRequest) authToken() string {
+	fields, err := call.paramFields()
+	if err != nil {
+		return ""
+	}
+	var token string
+	json.Unmarshal(fields["AuthToken"], &token)
+	return token
+}
+
+// Returns a response to a call from the first message that its command wrote
+func rpcResponseFromMessage(id json.RawMessage, message []byte) *rpcResponse {
+	var result errorMessage
+	if err := json.Unmarshal(message, &result); err == nil && !result.Success && result.Reason != "" {
+		return newRPCError(id, rpcCommandError, result.Reason)
+	}
+	return &rpcResponse{
+		JSONRPC: "2.0",
+		Result:  json.RawMessage(bytes.TrimSpace(message)),
+		Id:      rpcId(id),
+	}
+}
+
+// Returns the type of a pushed event, or an empty string if the message is not an event
+func messageEvent(message []byte) string {
+	var data struct {
+		Event string
+	}
+	json.Unmarshal(message, &data)
+	return data.Event
+}
+
+/*
+JSON-RPC connection
+
+An rpcConn is passed to message handlers in place of a network connection. Messages written by the handler are
+passed to a callback and data written to the input is read by the handler.
+*/
+
+type rpcAddr struct{}
+
+func (rpcAddr) Network() string { return "jsonrpc" }
+func (rpcAddr) String() string  { return "jsonrpc" }
+
+type rpcConn struct {
+	in  *io.PipeReader
+	inw *io.PipeWriter
+
+	mtx       sync.Mutex
+	buf       []byte
+	onMessage func([]byte)
+}
+
+func newRPCConn(onMessage func([]byte)) *rpcConn {
+	in, inw := io.Pipe()
+	return &rpcConn{
+		in:        in,
+		inw:       inw,
+		onMessage: onMessage,
+	}
+}
+
+func (c *rpcConn) Read(b []byte) (int, error) {
+	return c.in.Read(b)
+}
+
+// Passes each complete message that is written to the callback
+func (c *rpcConn) Write(b []byte) (int, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.buf = append(c.buf, b...)
+	for {
+		i := bytes.IndexByte(c.buf, '\n')
+		if i < 0 {
+			break
+		}
+		msg := make([]byte, i)
+		copy(msg, c.buf[:i])
+		c.buf = c.buf[i+1:]
+		c.onMessage(msg)
+	}
+	return len(b), nil
+}
+
+// Ends the input to the handler
+func (c *rpcConn) Close() error {
+	return c.inw.Close()
+}
+
+func (c *rpcConn) LocalAddr() net.Addr                { return rpcAddr{} }
+func (c *rpcConn) RemoteAddr() net.Addr               { return rpcAddr{} }
+func (c *rpcConn) SetDeadline(t time.Time) error      { return nil }
+func (c *rpcConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *rpcConn) SetWriteDeadline(t time.Time) error { return nil }
+
+/*
+HTTP transport
+*/
+
+// ServeHTTP serves the listener's commands using JSON-RPC 2.0 over WebSocket connections and HTTP POST requests
+func (l *MessageListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if l.authToken == "" && !l.allowedHost(r.Host) {
+		http.Error(w, "host is not allowed", http.StatusForbidden)
+		return
+	}
+
+	if websocket.IsWebSocketUpgrade(r) {
+		l.serveRPCWebSocket(w, r)
+		return
+	}
+
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "JSON-RPC requests must use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	// Requiring a JSON content type prevents other sites from making requests without a CORS preflight
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+		http.Error(w, "content type must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, rpcMaxBody+1))
+	if err != nil {
+		http.Error(w, "error reading request body", http.StatusBadRequest)
+		return
+	}
+	if len(body) > rpcMaxBody {
+		http.Error(w, "request body is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	authenticated := l.authToken == "" || l.validToken(requestToken(r))
+	var ret interface{}
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var calls []json.RawMessage
+		if err := json.Unmarshal(body, &calls); err != nil {
+			ret = newRPCError(nil, rpcParseError, err.Error())
+		} else if len(calls) == 0 {
+			ret = newRPCError(nil, rpcInvalidRequest, "batch is empty")
+		} else {
+			responses := make([]*rpcResponse, 0, len(calls))
+			for _, callData := range calls {
+				if rsp := l.httpRPCCall(callData, authenticated); rsp != nil {
+					responses = append(responses, rsp)
+				}
+			}
+			if len(responses) > 0 {
+				ret = responses
+			}
+		}
+	} else if rsp := l.httpRPCCall(body, authenticated); rsp != nil {
+		ret = rsp
+	}
+
+	if ret == nil {
+		// Only notifications were sent
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ret)
+}
+
+// AllowRPCHost allows JSON-RPC requests made to the given host name when the listener does not have an auth token
+func (l *MessageListener) AllowRPCHost(host string) {
+	l.rpcHosts = append(l.rpcHosts, strings.ToLower(host))
+}
+
+// Returns whether requests with the given Host header can be served without an auth token. A domain name can
+// be rebound to any address, so only IP addresses, localhost and the hosts added with AllowRPCHost are allowed.
+func (l *MessageListener) allowedHost(hostport string) bool {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	host = strings.ToLower(strings.TrimSuffix(strings.Trim(host, "[]"), "."))
+	if host == "localhost" || net.ParseIP(host) != nil {
+		return true
+	}
+	for _, allowed := range l.rpcHosts {
+		if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the auth token given in the Authorization header or query of a request
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.URL.Query().Get("token")
+}
+
+// Runs a call made with an HTTP request. Returns nil if the call is a notification
+func (l *MessageListener) httpRPCCall(callData []byte, authenticated bool) *rpcResponse {
+	call := &rpcRequest{}
+	if err := json.Unmarshal(callData, call); err != nil {
+		return newRPCError(nil, rpcParseError, err.Error())
+	}
+	if rsp := call.validate(); rsp != nil {
+		return rsp
+	}
+
+	rsp := l.runRPCCall(call, authenticated, func(message []byte) *rpcResponse {
+		var first []byte
+		conn := newRPCConn(func(m []byte) {
+			// Events can't be delivered over HTTP
+			if first == nil && messageEvent(m) == "" {
+				first = m
+			}
+		})
+		// Commands can't read any more messages over HTTP so streams end after they respond
+		conn.Close()
+		if err := l.Handle(message, conn); err != nil {
+			return newRPCError(call.Id, rpcInvalidParams, err.Error())
+		}
+
+		conn.mtx.Lock()
+		defer conn.mtx.Unlock()
+		if first == nil {
+			return newRPCError(call.Id, rpcCommandError, "command did not send a response")
+		}
+		return rpcResponseFromMessage(call.Id, first)
+	})
+	if !call.expectsResponse() {
+		return nil
+	}
+	return rsp
+}
+
+// Checks authentication and params for a call and runs it with the given function. Returns the response to the call.
+func (l *MessageListener) runRPCCall(call *rpcRequest, authenticated bool, run func([]byte) *rpcResponse) *rpcResponse {
+	if !authenticated {
+		token := call.authToken()
+		if token == "" {
+			return newRPCError(call.Id, rpcAuthError, "authentication required")
+		}
+		if !l.validToken(token) {
+			return newRPCError(call.Id, rpcAuthError, "invalid auth token")
+		}
+	}
+
+	if _, ok := l.handlers[strings.ToLower(call.Method)]; !ok {
+		return newRPCError(call.Id, rpcMethodNotFound, fmt.Sprintf("unknown method: %s", call.Method))
+	}
+	message, err := call.commandMessage()
+	if err != nil {
+		return newRPCError(call.Id, rpcInvalidParams, err.Error())
+	}
+	if call.authToken() == "" {
+		l.Logger.Printf("> rpc %s\n", message)
+	} else {
+		l.Logger.Printf("> rpc %s command with auth token\n", call.Method)
+	}
+	return run(message)
+}
+
+/*
+WebSocket transport
+*/
+
+// A JSON-RPC session over a WebSocket connection
+type rpcSession struct {
+	l  *MessageListener
+	ws *websocket.Conn
+
+	// Held while writing to the WebSocket
+	writeMtx sync.Mutex
+
+	mtx           sync.Mutex
+	authenticated bool
+	// Commands that are still running, keyed by the id of the call that started them
+	streams map[string]*rpcConn
+	// Waits for running commands to return when the session ends
+	running sync.WaitGroup
+}
+
+func (l *MessageListener) serveRPCWebSocket(w http.ResponseWriter, r *http.Request) {
+	authenticated := l.authToken == "" || l.validToken(requestToken(r))
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			// Pages on other sites can only connect if they have the auth token
+			return l.authToken != "" || sameOrigin(r)
+		},
+	}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		l.Logger.Println("error upgrading JSON-RPC connection:", err)
+		return
+	}
+
+	session := &rpcSession{
+		l:             l,
+		ws:            ws,
+		authenticated: authenticated,
+		streams:       make(map[string]*rpcConn),
+	}
+	session.serve()
+}
+
+// Returns whether a WebSocket request comes from a page served by the same host
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// Reads calls until the connection is closed then ends all of the session's streams
+func (s *rpcSession) serve() {
+	defer func() {
+		s.ws.Close()
+		s.mtx.Lock()
+		for _, conn := range s.streams {
+			conn.Close()
+		}
+		s.mtx.Unlock()
+		s.running.Wait()
+	}()
+
+	for {
+		_, data, err := s.ws.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		call := &rpcRequest{}
+		data = bytes.TrimSpace(data)
+		if len(data) > 0 && data[0] == '[' {
+			s.write(newRPCError(nil, rpcInvalidRequest, "batches are only supported over HTTP"))
+			continue
+		}
+		if err := json.Unmarshal(data, call); err != nil {
+			s.write(newRPCError(nil, rpcParseError, err.Error()))
+			continue
+		}
+		if rsp := call.validate(); rsp != nil {
+			s.write(rsp)
+			continue
+		}
+
+		switch strings.ToLower(call.Method) {
+		case "auth":
+			s.respond(call, s.auth(call))
+		case "send":
+			// Sending can block until the stream reads the message
+			s.running.Add(1)
+			go func() {
+				defer s.running.Done()
+				s.respond(call, s.send(call))
+			}()
+		default:
+			s.mtx.Lock()
+			authenticated := s.authenticated
+			s.mtx.Unlock()
+			s.running.Add(1)
+			go func() {
+				defer s.running.Done()
+				rsp := s.l.runRPCCall(call, authenticated, func(message []byte) *rpcResponse {
+					return s.runStream(call, message)
+				})
+				if rsp != nil {
+					s.respond(call, rsp)
+				}
+			}()
+		}
+	}
+}
+
+// Writes a message to the WebSocket
+func (s *rpcSession) write(m interface{}) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		panic(err)
+	}
+	s.writeMtx.Lock()
+	defer s.writeMtx.Unlock()
+	s.ws.WriteMessage(websocket.TextMessage, b)
+}
+
+// Writes a response to a call unless the call is a notification
+func (s *rpcSession) respond(call *rpcRequest, rsp *rpcResponse) {
+	if call.expectsResponse() {
+		s.write(rsp)
+	}
+}
+
+// Writes a notification with a message from a stream as its params
+func (s *rpcSession) notify(method string, stream json.RawMessage, message []byte) {
+	params := message
+	if len(stream) > 0 {
+		params = addMessageFields(message, `"Stream":`+rpcIdKey(stream))
+	}
+	s.write(&rpcNotification{
+		JSONRPC: "2.0",
+		Method:  method,
+		Params:  json.RawMessage(params),
+	})
+}
+
+// Authenticates the session using the AuthToken param of a call
+func (s *rpcSession) auth(call *rpcRequest) *rpcResponse {
+	if s.l.authToken != "" && !s.l.validToken(call.authToken()) {
+		return newRPCError(call.Id, rpcAuthError, "invalid auth token")
+	}
+	s.mtx.Lock()
+	s.authenticated = true
+	s.mtx.Unlock()
+	return rpcResponseFromMessage(call.Id, []byte(`{"Success":true}`))
+}
+
+// Sends a message to a running stream
+func (s *rpcSession) send(call *rpcRequest) *rpcResponse {
+	s.mtx.Lock()
+	authenticated := s.authenticated
+	s.mtx.Unlock()
+	if !authenticated && !s.l.validToken(call.authToken()) {
+		return newRPCError(call.Id, rpcAuthError, "authentication required")
+	}
+
+	params := &rpcSendParams{}
+	if err := json.Unmarshal(call.Params, params); err != nil {
+		return newRPCError(call.Id, rpcInvalidParams, err.Error())
+	}
+	if len(params.Stream) == 0 || len(params.Message) == 0 {
+		return newRPCError(call.Id, rpcInvalidParams, "Stream and Message are required")
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(params.Message, &fields); err != nil {
+		return newRPCError(call.Id, rpcInvalidParams, "Message must be an object")
+	}
+	delete(fields, "CommandId")
+	if call.expectsResponse() {
+		fields["CommandId"] = call.Id
+	}
+	message, err := json.Marshal(fields)
+	if err != nil {
+		return newRPCError(call.Id, rpcInvalidParams, err.Error())
+	}
+
+	s.mtx.Lock()
+	conn, ok := s.streams[rpcIdKey(params.Stream)]
+	s.mtx.Unlock()
+	if !ok {
+		return newRPCError(call.Id, rpcInvalidParams, fmt.Sprintf("stream %s does not exist", params.Stream))
+	}
+	if _, err := conn.inw.Write(append(message, '\n')); err != nil {
+		return newRPCError(call.Id, rpcCommandError, "stream has ended")
+	}
+	return rpcResponseFromMessage(call.Id, []byte(`{"Success":true}`))
+}
+
+// Runs a command as a stream. The first message the command writes is the response to the call and the rest are sent as notifications. Returns nil if the command responded.
+func (s *rpcSession) runStream(call *rpcRequest, message []byte) *rpcResponse {
+	responded := false
+	conn := newRPCConn(func(m []byte) {
+		if event := messageEvent(m); event != "" {
+			s.notify(event, call.Id, m)
+		} else if !responded {
+			responded = true
+			s.respond(call, rpcResponseFromMessage(call.Id, m))
+		} else {
+			s.notify("message", call.Id, m)
+		}
+	})
+	defer conn.Close()
+
+	if call.expectsResponse() {
+		key := rpcIdKey(call.Id)
+		s.mtx.Lock()
+		if _, ok := s.streams[key]; ok {
+			s.mtx.Unlock()
+			return newRPCError(call.Id, rpcInvalidRequest, fmt.Sprintf("a command with id %s is still running", key))
+		}
+		s.streams[key] = conn
+		s.mtx.Unlock()
+		defer func() {
+			s.mtx.Lock()
+			delete(s.streams, key)
+			s.mtx.Unlock()
+		}()
+	} else {
+		// Notifications can't be sent any more messages
+		conn.Close()
+	}
+
+	if err := s.l.Handle(message, conn); err != nil {
+		return newRPCError(call.Id, rpcInvalidParams, err.Error())
+	}
+
+	conn.mtx.Lock()
+	defer conn.mtx.Unlock()
+	if !responded {
+		return newRPCError(call.Id, rpcCommandError, "command did not send a response")
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package puppy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+type testRPCMessage struct {
+	Id     json.RawMessage
+	Method string
+	Result json.RawMessage
+	Error  *rpcError
+	Params json.RawMessage
+}
+
+func postRPC(t *testing.T, url string, body string) []byte {
+	t.Helper()
+	rsp, err := http.Post(url, "application/json", strings.NewReader(body))
+	testErr(t, err)
+	defer rsp.Body.Close()
+	data, err := ioutil.ReadAll(rsp.Body)
+	testErr(t, err)
+	return data
+}
+
+func TestRPCOverHTTP(t *testing.T) {
+	iproxy := NewInterceptingProxy(nil)
+	mserv := NewProxyMessageListener(log.New(ioutil.Discard, "", 0), iproxy)
+	server := httptest.NewServer(mserv)
+	defer server.Close()
+
+	msg := &testRPCMessage{}
+	testErr(t, json.Unmarshal(postRPC(t, server.URL, `{"jsonrpc": "2.0", "method": "ping", "id": 1}`), msg))
+	if string(msg.Id) != "1" || msg.Error != nil || !bytes.Contains(msg.Result, []byte(`"Success":true`)) {
+		t.Errorf("incorrect response to ping: %+v", msg)
+	}
+
+	batch := []*testRPCMessage{}
+	testErr(t, json.Unmarshal(postRPC(t, server.URL, `[
+		{"jsonrpc": "2.0", "method": "nosuchcommand", "id": "a"},
+		{"jsonrpc": "2.0", "method": "ping"},
+		{"jsonrpc": "2.0", "method": "closestorage", "params": {}, "id": "b"}
+	]`), &batch))
+	if len(batch) != 2 {
+		t.Fatalf("incorrect number of responses to a batch: %d", len(batch))
+	}
+	if batch[0].Error == nil || batch[0].Error.Code != rpcMethodNotFound {
+		t.Errorf("unknown method did not return an error: %+v", batch[0])
+	}
+	if batch[1].Error == nil || batch[1].Error.Code != rpcCommandError {
+		t.Errorf("failed command did not return an error: %+v", batch[1])
+	}
+
+	// Requests must be JSON so that other sites can't submit them with a form
+	rsp, err := http.Post(server.URL, "text/plain", strings.NewReader(`{"jsonrpc": "2.0", "method": "ping", "id": 1}`))
+	testErr(t, err)
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("request without a JSON content type was accepted: %d", rsp.StatusCode)
+	}
+
+	mserv.SetAuthToken("secret")
+	testErr(t, json.Unmarshal(postRPC(t, server.URL, `{"jsonrpc": "2.0", "method": "ping", "id": 1}`), msg))
+	if msg.Error == nil || msg.Error.Code != rpcAuthError {
+		t.Errorf("call was run without authentication: %+v", msg)
+	}
+	msg = &testRPCMessage{}
+	testErr(t, json.Unmarshal(postRPC(t, server.URL+"?token=secret", `{"jsonrpc": "2.0", "method": "ping", "id": 1}`), msg))
+	if msg.Error != nil {
+		t.Errorf("call with the auth token failed: %+v", msg.Error)
+	}
+}
+
+func TestRPCOverWebSocket(t *testing.T) {
+	storage := NewBoundedMemoryStorage(0, 0)
+	defer storage.Close()
+	iproxy := NewInterceptingProxy(nil)
+	storageId := iproxy.AddMessageStorage(storage, "test")
+	mserv := NewProxyMessageListener(log.New(ioutil.Discard, "", 0), iproxy)
+	server := httptest.NewServer(mserv)
+	defer server.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	testErr(t, err)
+	defer ws.Close()
+	read := func() *testRPCMessage {
+		t.Helper()
+		msg := &testRPCMessage{}
+		testErr(t, ws.ReadJSON(msg))
+		return msg
+	}
+
+	testErr(t, ws.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc": "2.0", "method": "subscribequery", "params": {"Query": [[["path", "is", "/a"]]]}, "id": "sub"}`)))
+	if msg := read(); string(msg.Id) != `"sub"` || msg.Error != nil {
+		t.Fatalf("incorrect response to subscribequery: %+v", msg)
+	}
+
+	testErr(t, SaveNewRequest(storage, siteMapReq(t, "GET", "/a", "", 0)))
+	msg := read()
+	if msg.Method != "queryupdate" {
+		t.Fatalf("event was not sent as a notification: %+v", msg)
+	}
+	update := &struct {
+		Stream         string
+		SubscriptionId int
+		StorageId      int
+	}{}
+	testErr(t, json.Unmarshal(msg.Params, update))
+	if update.Stream != "sub" || update.StorageId != storageId {
+		t.Errorf("incorrect notification params: %s", msg.Params)
+	}
+
+	// Messages can be sent to the stream
+	testErr(t, ws.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc": "2.0", "method": "send", "params": {"Stream": "sub", "Message": {"Command": "unsubscribe", "Id": 1}}, "id": 2}`)))
+	gotResult, gotMessage := false, false
+	for !gotResult || !gotMessage {
+		msg := read()
+		if string(msg.Id) == "2" {
+			gotResult = true
+			if msg.Error != nil {
+				t.Errorf("send failed: %+v", msg.Error)
+			}
+		} else if msg.Method == "message" {
+			gotMessage = true
+			if !bytes.Contains(msg.Params, []byte(`"CommandId":2`)) || !bytes.Contains(msg.Params, []byte(`"Success":true`)) {
+				t.Errorf("incorrect reply from the stream: %s", msg.Params)
+			}
+		} else {
+			t.Fatalf("unexpected message: %+v", msg)
+		}
+	}
+
+	testErr(t, ws.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc": "2.0", "method": "send", "params": {"Stream": "nosuchstream", "Message": {}}, "id": 3}`)))
+	if msg := read(); msg.Error == nil || msg.Error.Code != rpcInvalidParams {
+		t.Errorf("sending to a stream that does not exist did not fail: %+v", msg)
+	}
+}
+
+func TestRPCHostCheck(t *testing.T) {
+	mserv := NewProxyMessageListener(log.New(ioutil.Discard, "", 0), NewInterceptingProxy(nil))
+	server := httptest.NewServer(mserv)
+	defer server.Close()
+
+	statusFor := func(host string) int {
+		t.Helper()
+		req, err := http.NewRequest("POST", server.URL, strings.NewReader(`{"jsonrpc": "2.0", "method": "ping", "id": 1}`))
+		testErr(t, err)
+		req.Host = host
+		req.Header.Set("Content-Type", "application/json")
+		rsp, err := http.DefaultClient.Do(req)
+		testErr(t, err)
+		rsp.Body.Close()
+		return rsp.StatusCode
+	}
+
+	for _, host := range []string{"127.0.0.1:8081", "[::1]:8081", "localhost", "LOCALHOST:8081", "192.168.1.2"} {
+		if status := statusFor(host); status != http.StatusOK {
+			t.Errorf("request to %s was rejected: %d", host, status)
+		}
+	}
+
+	// A page on another site could rebind its domain to the listener's address
+	if status := statusFor("attacker.example:8081"); status != http.StatusForbidden {
+		t.Errorf("request to another host was accepted: %d", status)
+	}
+	mserv.AllowRPCHost("proxy.example")
+	if status := statusFor("proxy.example:8081"); status != http.StatusOK {
+		t.Errorf("request to an allowed host was rejected: %d", status)
+	}
+
+	// Listeners with an auth token authenticate each call instead of checking the host
+	mserv.SetAuthToken("secret")
+	if status := statusFor("attacker.example:8081"); status != http.StatusOK {
+		t.Errorf("request to another host was rejected by a listener with an auth token: %d", status)
+	}
+}
@@ -0,0 +1,865 @@
+package puppy
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+Bounded in-memory storage
+
+BoundedMemoryStorage keeps messages in memory without using SQLite. The number of requests and the total size of the
+stored messages can be capped. When a cap is exceeded, the oldest requests are evicted along with their responses,
+unmangled versions, and websocket messages. Watchers are notified of evicted requests with RequestDeleted.
+*/
+
+type memRequest struct {
+	msg        []byte
+	destHost   string
+	destPort   int
+	destUseTLS bool
+	start      time.Time
+	end        time.Time
+	tags       []string
+	note       string
+	highlight  string
+	reviewed   bool
+	timings    RequestTimings
+
+	responseId  string
+	unmangledId string
+}
+
+type memResponse struct {
+	msg         []byte
+	unmangledId string
+}
+
+type memWSMessage struct {
+	msg       []byte
+	mtype     int
+	direction int
+	timestamp time.Time
+
+	parentId    string
+	unmangledId string
+}
+
+// A saved query. expr is set if the query was saved as an expression
+type memSavedQuery struct {
+	query       StrMessageQuery
+	expr        *StrQueryExpr
+	description string
+	folder      string
+}
+
+type BoundedMemoryStorage struct {
+	mtx             sync.Mutex
+	storageWatchers []StorageWatcher
+
+	// Maximum number of requests and total size of stored messages in bytes. Zero means no limit. Unmangled versions
+	// of requests do not count towards the request limit.
+	maxRequests int
+	maxBytes    int64
+
+	requests   map[string]*memRequest
+	responses  map[string]*memResponse
+	wsMessages map[string]*memWSMessage
+	size       int64
+
+	// Request ids in the order they were saved and their elements in that list. Requests are evicted from the front.
+	order     *list.List
+	orderElem map[string]*list.Element
+	// Ids of the websocket messages of each request
+	requestWS map[string]map[string]bool
+	// Maps the id of an unmangled request to the id of the request it is the unmangled version of
+	unmangledOf map[string]string
+
+	lastReqId int64
+	lastRspId int64
+	lastWSId  int64
+
+	queries      map[string]*memSavedQuery
+	queryOrder   []string
+	pluginValues map[string]string
+}
+
+// NewBoundedMemoryStorage creates an in-memory storage that holds at most maxRequests requests and maxBytes bytes of messages. A limit of zero disables that limit.
+func NewBoundedMemoryStorage(maxRequests int, maxBytes int64) *BoundedMemoryStorage {
+	return &BoundedMemoryStorage{
+		storageWatchers: make([]StorageWatcher, 0),
+		maxRequests:     maxRequests,
+		maxBytes:        maxBytes,
+		requests:        make(map[string]*memRequest),
+		responses:       make(map[string]*memResponse),
+		wsMessages:      make(map[string]*memWSMessage),
+		order:           list.New(),
+		orderElem:       make(map[string]*list.Element),
+		requestWS:       make(map[string]map[string]bool),
+		unmangledOf:     make(map[string]string),
+		queries:         make(map[string]*memSavedQuery),
+		queryOrder:      make([]string, 0),
+		pluginValues:    make(map[string]string),
+	}
+}
+
+func (ms *BoundedMemoryStorage) Close() {
+}
+
+// Size returns the number of requests in the storage and the total size of the stored messages in bytes
+func (ms *BoundedMemoryStorage) Size() (int, int64) {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	return len(ms.requests), ms.size
+}
+
+// Evicts the oldest requests until the storage is within its limits. The most recently saved request and its unmangled versions are never evicted.
+func (ms *BoundedMemoryStorage) evict() {
+	// Unmangled versions are saved before the request they belong to, so they are the newest request while they are being saved
+	protected := ms.newestChain()
+	for (ms.maxRequests > 0 && len(ms.requests)-len(ms.unmangledOf) > ms.maxRequests) || (ms.maxBytes > 0 && ms.size > ms.maxBytes) {
+		reqid := ms.oldestEvictable(protected)
+		if reqid == "" {
+			break
+		}
+
+		ms.deleteRequest(reqid)
+		for _, watcher := range ms.storageWatchers {
+			watcher.RequestDeleted(ms, reqid)
+		}
+	}
+}
+
+// Returns the ids of the most recently saved request and its unmangled versions
+func (ms *BoundedMemoryStorage) newestChain() map[string]bool {
+	chain := make(map[string]bool)
+	if ms.order.Len() == 0 {
+		return chain
+	}
+	for reqid := ms.order.Back().Value.(string); reqid != "" && !chain[reqid]; {
+		mreq, ok := ms.requests[reqid]
+		if !ok {
+			break
+		}
+		chain[reqid] = true
+		reqid = mreq.unmangledId
+	}
+	return chain
+}
+
+// Returns the id of the oldest request that can be evicted, or an empty string if no request can be evicted
+func (ms *BoundedMemoryStorage) oldestEvictable(protected map[string]bool) string {
+	for e := ms.order.Front(); e != nil; e = e.Next() {
+		reqid := e.Value.(string)
+		if _, ok := ms.unmangledOf[reqid]; ok {
+			// Unmangled versions are evicted with the request they belong to
+			continue
+		}
+		if protected[reqid] {
+			continue
+		}
+		return reqid
+	}
+	return ""
+}
+
+/*
+Requests
+*/
+
+func (ms *BoundedMemoryStorage) SaveNewRequest(req *ProxyRequest) error {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	ms.lastReqId++
+	reqid := strconv.FormatInt(ms.lastReqId, 10)
+	if err := ms.storeRequest(req, reqid); err != nil {
+		return err
+	}
+	ms.orderElem[reqid] = ms.order.PushBack(reqid)
+	for _, watcher := range ms.storageWatchers {
+		watcher.NewRequestSaved(ms, req)
+	}
+	ms.evict()
+	return nil
+}
+
+func (ms *BoundedMemoryStorage) UpdateRequest(req *ProxyRequest) error {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	if req.DbId == "" {
+		return fmt.Errorf("Request must be saved to datafile before it can be updated")
+	}
+	if _, ok := ms.requests[req.DbId]; !ok {
+		return fmt.Errorf("Request with id %s does not exist", req.DbId)
+	}
+	if err := ms.storeRequest(req, req.DbId); err != nil {
+		return err
+	}
+	for _, watcher := range ms.storageWatchers {
+		watcher.RequestUpdated(ms, req)
+	}
+	ms.evict()
+	return nil
+}
+
+func (ms *BoundedMemoryStorage) storeRequest(req *ProxyRequest, reqid string) error {
+	mreq := &memRequest{
+		msg:        req.FullMessage(),
+		destHost:   req.DestHost,
+		destPort:   req.DestPort,
+		destUseTLS: req.DestUseTLS,
+		start:      req.StartDatetime,
+		end:        req.EndDatetime,
+		tags:       req.Tags(),
+		note:       req.Note,
+		highlight:  req.Highlight,
+		reviewed:   req.Reviewed,
+		timings:    req.Timings,
+	}
+
+	if req.ServerResponse != nil {
+		if req.ServerResponse.DbId == "" {
+			return errors.New("response has not been saved yet, cannot save request")
+		}
+		mreq.responseId = req.ServerResponse.DbId
+	}
+
+	if req.Unmangled != nil {
+		if req.Unmangled.DbId == "" {
+			return errors.New("unmangled request has not been saved yet, cannot save request")
+		}
+		mreq.unmangledId = req.Unmangled.DbId
+	}
+
+	if old, ok := ms.requests[reqid]; ok {
+		ms.size -= int64(len(old.msg))
+		if old.unmangledId != "" {
+			delete(ms.unmangledOf, old.unmangledId)
+		}
+	}
+	if mreq.unmangledId != "" {
+		ms.unmangledOf[mreq.unmangledId] = reqid
+	}
+
+	ms.requests[reqid] = mreq
+	ms.size += int64(len(mreq.msg))
+	req.DbId = reqid
+	return nil
+}
+
+func (ms *BoundedMemoryStorage) LoadRequest(reqid string) (*ProxyRequest, error) {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	return ms.loadRequest(reqid)
+}
+
+func (ms *BoundedMemoryStorage) loadRequest(reqid string) (*ProxyRequest, error) {
+	mreq, ok := ms.requests[reqid]
+	if !ok {
+		return nil, fmt.Errorf("Request with id %s does not exist", reqid)
+	}
+
+	req, err := ProxyRequestFromBytes(mreq.msg, mreq.destHost, mreq.destPort, mreq.destUseTLS)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create request (id=%s): %s", reqid, err.Error())
+	}
+	req.DbId = reqid
+	req.StartDatetime = mreq.start
+	req.EndDatetime = mreq.end
+	req.Note = mreq.note
+	req.Highlight = mreq.highlight
+	req.Reviewed = mreq.reviewed
+	req.Timings = mreq.timings
+	for _, tag := range mreq.tags {
+		req.AddTag(tag)
+	}
+
+	if mreq.unmangledId != "" {
+		unmangledReq, err := ms.loadRequest(mreq.unmangledId)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load unmangled request for reqid=%s: %s", reqid, err.Error())
+		}
+		req.Unmangled = unmangledReq
+	}
+
+	if mreq.responseId != "" {
+		rsp, err := ms.loadResponse(mreq.responseId)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load response for reqid=%s: %s", reqid, err.Error())
+		}
+		req.ServerResponse = rsp
+	}
+
+	messages := make([]*ProxyWSMessage, 0)
+	for wsmid, mwsm := range ms.wsMessages {
+		if mwsm.parentId != reqid {
+			continue
+		}
+		wsm, err := ms.loadWSMessage(wsmid)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load websocket messages for reqid=%s: %s", reqid, err.Error())
+		}
+		messages = append(messages, wsm)
+	}
+	sort.Sort(WSSort(messages))
+	req.WSMessages = messages
+
+	return req, nil
+}
+
+func (ms *BoundedMemoryStorage) LoadUnmangledRequest(reqid string) (*ProxyRequest, error) {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	mreq, ok := ms.requests[reqid]
+	if !ok || mreq.unmangledId == "" {
+		return nil, fmt.Errorf("request has no unmangled version")
+	}
+	return ms.loadRequest(mreq.unmangledId)
+}
+
+func (ms *BoundedMemoryStorage) DeleteRequest(reqid string) error {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	ms.deleteRequest(reqid)
+	for _, watcher := range ms.storageWatchers {
+		watcher.RequestDeleted(ms, reqid)
+	}
+	return nil
+}
+
+func (ms *BoundedMemoryStorage) deleteRequest(reqid string) {
+	mreq, ok := ms.requests[reqid]
+	if !ok {
+		return
+	}
+
+	if mreq.unmangledId != "" {
+		delete(ms.unmangledOf, mreq.unmangledId)
+		ms.deleteRequest(mreq.unmangledId)
+	}
+
+	if mreq.responseId != "" {
+		ms.deleteResponse(mreq.responseId)
+	}
+
+	// Deleting a message also deletes its unmangled version
+	for wsmid := range ms.requestWS[reqid] {
+		ms.deleteWSMessage(wsmid)
+	}
+	delete(ms.requestWS, reqid)
+
+	ms.size -= int64(len(mreq.msg))
+	delete(ms.requests, reqid)
+	if e, ok := ms.orderElem[reqid]; ok {
+		ms.order.Remove(e)
+		delete(ms.orderElem, reqid)
+	}
+}
+
+/*
+Responses
+*/
+
+func (ms *BoundedMemoryStorage) SaveNewResponse(rsp *ProxyResponse) error {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	ms.lastRspId++
+	if err := ms.storeResponse(rsp, strconv.FormatInt(ms.lastRspId, 10)); err != nil {
+		return err
+	}
+	for _, watcher := range ms.storageWatchers {
+		watcher.NewResponseSaved(ms, rsp)
+	}
+	return nil
+}
+
+func (ms *BoundedMemoryStorage) UpdateResponse(rsp *ProxyResponse) error {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	if rsp.DbId == "" {
+		return fmt.Errorf("Response must be saved to datafile before it can be updated")
+	}
+	if _, ok := ms.responses[rsp.DbId]; !ok {
+		return fmt.Errorf("Response with id %s does not exist", rsp.DbId)
+	}
+	if err := ms.storeResponse(rsp, rsp.DbId); err != nil {
+		return err
+	}
+	for _, watcher := range ms.storageWatchers {
+		watcher.ResponseUpdated(ms, rsp)
+	}
+	ms.evict()
+	return nil
+}
+
+func (ms *BoundedMemoryStorage) storeResponse(rsp *ProxyResponse, rspid string) error {
+	mrsp := &memResponse{
+		msg: rsp.FullMessage(),
+	}
+
+	if rsp.Unmangled != nil {
+		if rsp.Unmangled.DbId == "" {
+			return errors.New("unmangled response has not been saved yet, cannot save response")
+		}
+		mrsp.unmangledId = rsp.Unmangled.DbId
+	}
+
+	if old, ok := ms.responses[rspid]; ok {
+		ms.size -= int64(len(old.msg))
+	}
+	ms.responses[rspid] = mrsp
+	ms.size += int64(len(mrsp.msg))
+	rsp.DbId = rspid
+	return nil
+}
+
+func (ms *BoundedMemoryStorage) LoadResponse(rspid string) (*ProxyResponse, error) {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	return ms.loadResponse(rspid)
+}
+
+func (ms *BoundedMemoryStorage) loadResponse(rspid string) (*ProxyResponse, error) {
+	mrsp, ok := ms.responses[rspid]
+	if !ok {
+		return nil, fmt.Errorf("Response with id %s does not exist", rspid)
+	}
+
+	rsp, err := ProxyResponseFromBytes(mrsp.msg)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create response (id=%s): %s", rspid, err.Error())
+	}
+	rsp.DbId = rspid
+
+	if mrsp.unmangledId != "" {
+		unmangledRsp, err := ms.loadResponse(mrsp.unmangledId)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load unmangled response for rspid=%s: %s", rspid, err.Error())
+		}
+		rsp.Unmangled = unmangledRsp
+	}
+
+	return rsp, nil
+}
+
+func (ms *BoundedMemoryStorage) LoadUnmangledResponse(rspid string) (*ProxyResponse, error) {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	mrsp, ok := ms.responses[rspid]
+	if !ok || mrsp.unmangledId == "" {
+		return nil, fmt.Errorf("response has no unmangled version")
+	}
+	return ms.loadResponse(mrsp.unmangledId)
+}
+
+func (ms *BoundedMemoryStorage) DeleteResponse(rspid string) error {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	ms.deleteResponse(rspid)
+	for _, watcher := range ms.storageWatchers {
+		watcher.ResponseDeleted(ms, rspid)
+	}
+	return nil
+}
+
+func (ms *BoundedMemoryStorage) deleteResponse(rspid string) {
+	mrsp, ok := ms.responses[rspid]
+	if !ok {
+		return
+	}
+	if mrsp.unmangledId != "" {
+		ms.deleteResponse(mrsp.unmangledId)
+	}
+	ms.size -= int64(len(mrsp.msg))
+	delete(ms.responses, rspid)
+}
+
+/*
+Websocket messages
+*/
+
+func (ms *BoundedMemoryStorage) SaveNewWSMessage(req *ProxyRequest, wsm *ProxyWSMessage) error {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	ms.lastWSId++
+	if err := ms.storeWSMessage(req, wsm, strconv.FormatInt(ms.lastWSId, 10)); err != nil {
+		return err
+	}
+	for _, watcher := range ms.storageWatchers {
+		watcher.NewWSMessageSaved(ms, req, wsm)
+	}
+	ms.evict()
+	return nil
+}
+
+func (ms *BoundedMemoryStorage) UpdateWSMessage(req *ProxyRequest, wsm *ProxyWSMessage) error {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	if wsm.DbId == "" {
+		return fmt.Errorf("Websocket message must be saved to datafile before it can be updated")
+	}
+	if _, ok := ms.wsMessages[wsm.DbId]; !ok {
+		return fmt.Errorf("Message with id %s does not exist", wsm.DbId)
+	}
+	if err := ms.storeWSMessage(req, wsm, wsm.DbId); err != nil {
+		return err
+	}
+	for _, watcher := range ms.storageWatchers {
+		watcher.WSMessageUpdated(ms, req, wsm)
+	}
+	ms.evict()
+	return nil
+}
+
+func (ms *BoundedMemoryStorage) storeWSMessage(req *ProxyRequest, wsm *ProxyWSMessage, wsmid string) error {
+	mwsm := &memWSMessage{
+		msg:       append([]byte(nil), wsm.Message...),
+		mtype:     wsm.Type,
+		direction: wsm.Direction,
+		timestamp: wsm.Timestamp,
+	}
+
+	if req != nil {
+		if req.DbId == "" {
+			return errors.New("request has not been saved yet, cannot save websocket message")
+		}
+		mwsm.parentId = req.DbId
+	}
+
+	if wsm.Unmangled != nil {
+		if wsm.Unmangled.DbId == "" {
+			return errors.New("unmangled websocket message has not been saved yet, cannot save websocket message")
+		}
+		mwsm.unmangledId = wsm.Unmangled.DbId
+	}
+
+	if old, ok := ms.wsMessages[wsmid]; ok {
+		ms.size -= int64(len(old.msg))
+		if old.parentId != "" {
+			delete(ms.requestWS[old.parentId], wsmid)
+		}
+	}
+	if mwsm.parentId != "" {
+		if ms.requestWS[mwsm.parentId] == nil {
+			ms.requestWS[mwsm.parentId] = make(map[string]bool)
+		}
+		ms.requestWS[mwsm.parentId][wsmid] = true
+	}
+	ms.wsMessages[wsmid] = mwsm
+	ms.size += int64(len(mwsm.msg))
+	wsm.DbId = wsmid
+	return nil
+}
+
+func (ms *BoundedMemoryStorage) LoadWSMessage(wsmid string) (*ProxyWSMessage, error) {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	return ms.loadWSMessage(wsmid)
+}
+
+func (ms *BoundedMemoryStorage) loadWSMessage(wsmid string) (*ProxyWSMessage, error) {
+	mwsm, ok := ms.wsMessages[wsmid]
+	if !ok {
+		return nil, fmt.Errorf("Message with id %s does not exist", wsmid)
+	}
+
+	mtype := mwsm.mtype
+	if mtype != websocket.BinaryMessage {
+		mtype = websocket.TextMessage
+	}
+	wsm, err := NewProxyWSMessage(mtype, append([]byte(nil), mwsm.msg...), mwsm.direction)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create websocket message: %s", err.Error())
+	}
+	wsm.DbId = wsmid
+	wsm.Timestamp = mwsm.timestamp
+
+	if mwsm.unmangledId != "" {
+		unmangledWsm, err := ms.loadWSMessage(mwsm.unmangledId)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load unmangled websocket message for wsmid=%s: %s", wsmid, err.Error())
+		}
+		wsm.Unmangled = unmangledWsm
+	}
+
+	return wsm, nil
+}
+
+func (ms *BoundedMemoryStorage) LoadUnmangledWSMessage(wsmid string) (*ProxyWSMessage, error) {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	mwsm, ok := ms.wsMessages[wsmid]
+	if !ok || mwsm.unmangledId == "" {
+		return nil, fmt.Errorf("message has no unmangled version")
+	}
+	return ms.loadWSMessage(mwsm.unmangledId)
+}
+
+func (ms *BoundedMemoryStorage) DeleteWSMessage(wsmid string) error {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	ms.deleteWSMessage(wsmid)
+	for _, watcher := range ms.storageWatchers {
+		watcher.WSMessageDeleted(ms, wsmid)
+	}
+	return nil
+}
+
+func (ms *BoundedMemoryStorage) deleteWSMessage(wsmid string) {
+	mwsm, ok := ms.wsMessages[wsmid]
+	if !ok {
+		return
+	}
+	if mwsm.unmangledId != "" {
+		ms.deleteWSMessage(mwsm.unmangledId)
+	}
+	if mwsm.parentId != "" {
+		delete(ms.requestWS[mwsm.parentId], wsmid)
+	}
+	ms.size -= int64(len(mwsm.msg))
+	delete(ms.wsMessages, wsmid)
+}
+
+/*
+Searching
+*/
+
+func (ms *BoundedMemoryStorage) RequestKeys() ([]string, error) {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	keys := make([]string, 0, len(ms.requests))
+	for reqid := range ms.requests {
+		keys = append(keys, reqid)
+	}
+	sort.Sort(jsonlIdSort(keys))
+	return keys, nil
+}
+
+func (ms *BoundedMemoryStorage) Search(limit int64, args ...interface{}) ([]*ProxyRequest, error) {
+	// Create the checker before locking the storage since it may need to load saved queries
+	checker, err := NewStorageRequestChecker(ms, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+
+	// Check for `id is`
+	if len(args) == 3 {
+		field, ok := args[0].(SearchField)
+		if ok && field == FieldId {
+			comparer, ok := args[1].(StrComparer)
+			if ok && comparer == StrIs {
+				reqid, ok := args[2].(string)
+				if ok {
+					req, err := ms.loadRequest(reqid)
+					if err != nil {
+						return nil, err
+					}
+					return []*ProxyRequest{req}, nil
+				}
+			}
+		}
+	}
+
+	return ms.checkRequests(limit, checker)
+}
+
+func (ms *BoundedMemoryStorage) CheckRequests(limit int64, checker RequestChecker) ([]*ProxyRequest, error) {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	return ms.checkRequests(limit, checker)
+}
+
+func (ms *BoundedMemoryStorage) RequestStats(query MessageQuery, group StatsGroup) ([]*RequestStats, error) {
+	return checkRequestStats(ms, query, group)
+}
+
+func (ms *BoundedMemoryStorage) checkRequests(limit int64, checker RequestChecker) ([]*ProxyRequest, error) {
+	// Check the most recent requests first
+	keys := make([]string, 0, len(ms.requests))
+	for reqid := range ms.requests {
+		keys = append(keys, reqid)
+	}
+	sort.SliceStable(keys, func(i int, j int) bool {
+		return ms.requests[keys[i]].start.After(ms.requests[keys[j]].start)
+	})
+
+	results := make([]*ProxyRequest, 0)
+	for _, reqid := range keys {
+		req, err := ms.loadRequest(reqid)
+		if err != nil {
+			return nil, errors.New("error creating request: " + err.Error())
+		}
+
+		if checker(req) {
+			results = append(results, req)
+			if limit > 0 && int64(len(results)) >= limit {
+				break
+			}
+		}
+	}
+	return results, nil
+}
+
+/*
+Saved queries
+*/
+
+func (ms *BoundedMemoryStorage) AllSavedQueries() ([]*SavedQuery, error) {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	savedQueries := make([]*SavedQuery, 0, len(ms.queryOrder))
+	for _, name := range ms.queryOrder {
+		sq, err := ms.loadSavedQuery(name)
+		if err != nil {
+			return nil, err
+		}
+		savedQueries = append(savedQueries, sq)
+	}
+	return savedQueries, nil
+}
+
+func (ms *BoundedMemoryStorage) SaveQuery(name string, query MessageQuery) error {
+	return ms.SaveSavedQuery(&SavedQuery{Name: name, Query: query})
+}
+
+func (ms *BoundedMemoryStorage) SaveQueryExpr(name string, expr *QueryExpr) error {
+	if expr == nil {
+		return errors.New("query expression is required")
+	}
+	return ms.SaveSavedQuery(&SavedQuery{Name: name, Expr: expr})
+}
+
+func (ms *BoundedMemoryStorage) SaveSavedQuery(sq *SavedQuery) error {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+
+	strQuery, strExpr, err := savedQueryForSaving(sq)
+	if err != nil {
+		return err
+	}
+	ms.deleteQuery(sq.Name)
+	ms.queries[sq.Name] = &memSavedQuery{
+		query:       strQuery,
+		expr:        strExpr,
+		description: sq.Description,
+		folder:      sq.Folder,
+	}
+	ms.queryOrder = append(ms.queryOrder, sq.Name)
+	notifyQueryWatchers(ms.storageWatchers, ms, sq.Name, false)
+	return nil
+}
+
+func (ms *BoundedMemoryStorage) LoadQuery(name string) (MessageQuery, error) {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	sq, err := ms.loadSavedQuery(name)
+	if err != nil {
+		return nil, err
+	}
+	return savedMessageQuery(sq)
+}
+
+func (ms *BoundedMemoryStorage) LoadQueryExpr(name string) (*QueryExpr, error) {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	sq, err := ms.loadSavedQuery(name)
+	if err != nil {
+		return nil, err
+	}
+	return sq.Expr, nil
+}
+
+func (ms *BoundedMemoryStorage) LoadSavedQuery(name string) (*SavedQuery, error) {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	return ms.loadSavedQuery(name)
+}
+
+func (ms *BoundedMemoryStorage) loadSavedQuery(name string) (*SavedQuery, error) {
+	msq, ok := ms.queries[name]
+	if !ok {
+		return nil, fmt.Errorf("context with name %s does not exist", name)
+	}
+	sq, err := savedQueryFromStr(name, msq.query, msq.expr)
+	if err != nil {
+		return nil, err
+	}
+	sq.Description = msq.description
+	sq.Folder = msq.folder
+	return sq, nil
+}
+
+func (ms *BoundedMemoryStorage) DeleteQuery(name string) error {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	if ms.deleteQuery(name) {
+		notifyQueryWatchers(ms.storageWatchers, ms, name, true)
+	}
+	return nil
+}
+
+// Removes a query and returns whether it existed
+func (ms *BoundedMemoryStorage) deleteQuery(name string) bool {
+	if _, ok := ms.queries[name]; !ok {
+		return false
+	}
+	delete(ms.queries, name)
+	for i, n := range ms.queryOrder {
+		if n == name {
+			ms.queryOrder = append(ms.queryOrder[:i], ms.queryOrder[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+/*
+Watchers and plugin values
+*/
+
+func (ms *BoundedMemoryStorage) Watch(watcher StorageWatcher) error {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	ms.storageWatchers = append(ms.storageWatchers, watcher)
+	return nil
+}
+
+func (ms *BoundedMemoryStorage) EndWatch(watcher StorageWatcher) error {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	var newWatched = make([]StorageWatcher, 0)
+	for _, testWatcher := range ms.storageWatchers {
+		if testWatcher != watcher {
+			newWatched = append(newWatched, testWatcher)
+		}
+	}
+	ms.storageWatchers = newWatched
+	return nil
+}
+
+func (ms *BoundedMemoryStorage) SetPluginValue(key string, value string) error {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	ms.pluginValues[key] = value
+	return nil
+}
+
+func (ms *BoundedMemoryStorage) GetPluginValue(key string) (string, error) {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	value, ok := ms.pluginValues[key]
+	if !ok {
+		return "", fmt.Errorf("plugin data with key %s does not exist", key)
+	}
+	return value, nil
+}
@@ -0,0 +1,133 @@
+package puppy
+
+import (
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+type deleteWatcher struct {
+	deleted []string
+}
+
+func (w *deleteWatcher) NewRequestSaved(ms MessageStorage, req *ProxyRequest) {}
+func (w *deleteWatcher) RequestUpdated(ms MessageStorage, req *ProxyRequest)  {}
+func (w *deleteWatcher) RequestDeleted(ms MessageStorage, DbId string) {
+	w.deleted = append(w.deleted, DbId)
+}
+func (w *deleteWatcher) NewResponseSaved(ms MessageStorage, rsp *ProxyResponse) {}
+func (w *deleteWatcher) ResponseUpdated(ms MessageStorage, rsp *ProxyResponse)  {}
+func (w *deleteWatcher) ResponseDeleted(ms MessageStorage, DbId string)         {}
+func (w *deleteWatcher) NewWSMessageSaved(ms MessageStorage, req *ProxyRequest, wsm *ProxyWSMessage) {
+}
+func (w *deleteWatcher) WSMessageUpdated(ms MessageStorage, req *ProxyRequest, wsm *ProxyWSMessage) {}
+func (w *deleteWatcher) WSMessageDeleted(ms MessageStorage, DbId string)                            {}
+
+func TestBoundedMemoryEvictCount(t *testing.T) {
+	storage := NewBoundedMemoryStorage(3, 0)
+	watcher := &deleteWatcher{}
+	testErr(t, storage.Watch(watcher))
+
+	ids := make([]string, 0)
+	for i := 0; i < 5; i++ {
+		req := testReq()
+		req.Unmangled = testReq()
+		testErr(t, SaveNewRequest(storage, req))
+		ids = append(ids, req.DbId)
+	}
+
+	// Unmangled versions are evicted along with their request and do not count as evictions of their own
+	checkTags(t, watcher.deleted, ids[:2])
+	keys, err := storage.RequestKeys()
+	testErr(t, err)
+	if len(keys) != 6 {
+		t.Errorf("incorrect number of requests after eviction: %d", len(keys))
+	}
+	for _, reqid := range ids[:2] {
+		if _, err := storage.LoadRequest(reqid); err == nil {
+			t.Errorf("request %s was not evicted", reqid)
+		}
+	}
+	req, err := storage.LoadRequest(ids[4])
+	testErr(t, err)
+	if req.Unmangled == nil || req.ServerResponse == nil {
+		t.Errorf("newest request was not loaded correctly")
+	}
+}
+
+func TestBoundedMemoryEvictBytes(t *testing.T) {
+	reqSize := int64(len(testReq().FullMessage()) + len(testReq().ServerResponse.FullMessage()))
+	storage := NewBoundedMemoryStorage(0, reqSize*2)
+	watcher := &deleteWatcher{}
+	testErr(t, storage.Watch(watcher))
+
+	ids := make([]string, 0)
+	for i := 0; i < 4; i++ {
+		req := testReq()
+		testErr(t, SaveNewRequest(storage, req))
+		ids = append(ids, req.DbId)
+	}
+	checkTags(t, watcher.deleted, ids[:2])
+
+	count, size := storage.Size()
+	if count != 2 || size != reqSize*2 {
+		t.Errorf("incorrect storage size after eviction: %d requests, %d bytes", count, size)
+	}
+
+	// The most recent request is kept even if it is larger than the limit
+	storage = NewBoundedMemoryStorage(0, 1)
+	req := testReq()
+	testErr(t, SaveNewRequest(storage, req))
+	if _, err := storage.LoadRequest(req.DbId); err != nil {
+		t.Errorf("most recent request was evicted")
+	}
+}
+
+func TestBoundedMemoryEvictUnmangled(t *testing.T) {
+	reqSize := int64(len(testReq().FullMessage()) + len(testReq().ServerResponse.FullMessage()))
+	storage := NewBoundedMemoryStorage(0, reqSize)
+
+	for i := 0; i < 4; i++ {
+		req := testReq()
+		req.Unmangled = testReq()
+		testErr(t, SaveNewRequest(storage, req))
+
+		// The request that was just saved can't be evicted while its unmangled version is saved
+		if _, err := storage.LoadRequest(req.DbId); err != nil {
+			t.Fatalf("request %d was evicted when it was saved", i)
+		}
+		if _, err := storage.LoadUnmangledRequest(req.DbId); err != nil {
+			t.Fatalf("unmangled version of request %d was evicted when it was saved", i)
+		}
+		testErr(t, UpdateRequest(storage, req))
+	}
+
+	if count, _ := storage.Size(); count != 2 {
+		t.Errorf("older requests were not evicted: %d requests stored", count)
+	}
+}
+
+func TestBoundedMemoryEvictWSMessages(t *testing.T) {
+	reqSize := int64(len(testReq().FullMessage()) + len(testReq().ServerResponse.FullMessage()))
+	storage := NewBoundedMemoryStorage(1, 0)
+
+	req := testReq()
+	testErr(t, SaveNewRequest(storage, req))
+	wsm, err := NewProxyWSMessage(websocket.TextMessage, []byte("mangled"), ToServer)
+	testErr(t, err)
+	wsm.Unmangled, err = NewProxyWSMessage(websocket.TextMessage, []byte("original"), ToServer)
+	testErr(t, err)
+	testErr(t, SaveNewWSMessage(storage, req, wsm))
+
+	// The unmangled message is evicted with the message it belongs to
+	testErr(t, SaveNewRequest(storage, testReq()))
+	if _, err := storage.LoadWSMessage(wsm.DbId); err == nil {
+		t.Errorf("websocket message was not evicted")
+	}
+	if _, err := storage.LoadWSMessage(wsm.Unmangled.DbId); err == nil {
+		t.Errorf("unmangled websocket message was not evicted")
+	}
+	if count, size := storage.Size(); count != 1 || size != reqSize {
+		t.Errorf("incorrect storage size after eviction: %d requests, %d bytes", count, size)
+	}
+}
@@ -2,11 +2,17 @@ package puppy
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"reflect"
+	"sort"
 	"strings"
 )
 
@@ -20,12 +26,23 @@ type MessageHandler func(message []byte, conn net.Conn, logger *log.Logger, ipro
 // A listener that handles reading JSON messages and sending them to the correct handler
 type MessageListener struct {
 	handlers map[string]MessageHandler
-	iproxy   *InterceptingProxy
-	Logger   *log.Logger
+	// The message types of commands added with AddCommand
+	messages     map[string]reflect.Type
+	capabilities []string
+	iproxy       *InterceptingProxy
+	Logger       *log.Logger
+	authToken    string
+	// Host names that JSON-RPC requests can be made to without an auth token
+	rpcHosts []string
 }
 
 type commandData struct {
-	Command string
+	Command   string
+	AuthToken string
+	// An optional value chosen by the client that is included in every response to the command
+	CommandId json.RawMessage
+	// The version of the protocol that the client uses. Messages from clients using a newer version than the listener are rejected
+	ProtocolVersion int
 }
 
 type errorMessage struct {
@@ -36,28 +53,113 @@ type errorMessage struct {
 // NewMessageListener creates a new message listener associated with the given intercepting proxy
 func NewMessageListener(l *log.Logger, iproxy *InterceptingProxy) *MessageListener {
 	m := &MessageListener{
-		handlers: make(map[string]MessageHandler),
-		iproxy:   iproxy,
-		Logger:   l,
+		handlers:     make(map[string]MessageHandler),
+		messages:     make(map[string]reflect.Type),
+		capabilities: []string{"auth", "commandids", "events", "strictfields"},
+		iproxy:       iproxy,
+		Logger:       l,
 	}
+	m.AddCommand("describe", m.describeHandler, describeMessage{})
 	return m
 }
 
+// SetAuthToken requires clients to authenticate with the given token before any commands are run. A connection is authenticated by sending an "auth" command with the token as its AuthToken, or each message can include the token as its AuthToken. An empty token disables authentication.
+func (l *MessageListener) SetAuthToken(token string) {
+	l.authToken = token
+}
+
+// Returns whether a token matches the listener's auth token
+func (l *MessageListener) validToken(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(l.authToken)) == 1
+}
+
 // AddHandler will have the listener call the given handler when the "Command" parameter matches the given value
 func (l *MessageListener) AddHandler(command string, handler MessageHandler) {
 	l.handlers[strings.ToLower(command)] = handler
 }
 
+// AddCommand adds a handler along with the struct that its messages are parsed into. The struct is used to describe the command and messages with fields that are not in the struct are rejected.
+func (l *MessageListener) AddCommand(command string, handler MessageHandler, message interface{}) {
+	l.AddHandler(command, handler)
+	t := reflect.TypeOf(message)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	l.messages[strings.ToLower(command)] = t
+}
+
+// AddCapability adds a flag to the capabilities that the listener describes to clients
+func (l *MessageListener) AddCapability(capability string) {
+	for _, c := range l.capabilities {
+		if c == capability {
+			return
+		}
+	}
+	l.capabilities = append(l.capabilities, capability)
+}
+
+// Returns an error if a message has a field that is not in the message type of its command
+func (l *MessageListener) checkFields(command string, message []byte) error {
+	t, ok := l.messages[strings.ToLower(command)]
+	if !ok {
+		return nil
+	}
+	return checkMessageFields(command, t, message)
+}
+
+// Returns an error if a message for the given command has a field that is not in the message type t
+func checkMessageFields(command string, t reflect.Type, message []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(message, &fields); err != nil {
+		return fmt.Errorf("error parsing message: %s", err.Error())
+	}
+
+	known := make(map[string]bool)
+	for _, name := range messageFieldNames(reflect.TypeOf(commandData{})) {
+		known[strings.ToLower(name)] = true
+	}
+	for _, name := range messageFieldNames(t) {
+		known[strings.ToLower(name)] = true
+	}
+
+	unknown := make([]string, 0)
+	for name := range fields {
+		if !known[strings.ToLower(name)] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown fields for command %s: %s", command, strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// Returns an error if a message is from a client using a newer version of the protocol
+func checkProtocolVersion(c *commandData) error {
+	if c.ProtocolVersion > MessageProtocolVersion {
+		return fmt.Errorf("protocol version %d is not supported, the newest supported version is %d", c.ProtocolVersion, MessageProtocolVersion)
+	}
+	return nil
+}
+
 func (l *MessageListener) Handle(message []byte, conn net.Conn) error {
 	var c commandData
 	if err := json.Unmarshal(message, &c); err != nil {
 		return fmt.Errorf("error parsing message: %s", err.Error())
 	}
 
+	if err := checkProtocolVersion(&c); err != nil {
+		return err
+	}
+
 	handler, ok := l.handlers[strings.ToLower(c.Command)]
 	if !ok {
 		return fmt.Errorf("unknown command: %s", c.Command)
 	}
+	if err := l.checkFields(c.Command, message); err != nil {
+		return err
+	}
 
 	l.Logger.Printf("Calling handler for \"%s\"...", c.Command)
 	handler(message, conn, l.Logger, l.iproxy)
@@ -73,26 +175,202 @@ func (l *MessageListener) Serve(nl net.Listener) {
 			break
 		}
 
-		reader := bufio.NewReader(conn)
+		mc := &messageConn{
+			Conn:          conn,
+			l:             l,
+			reader:        bufio.NewReader(conn),
+			authenticated: l.authToken == "",
+		}
 		go func() {
 			for {
-				m, err := ReadMessage(reader)
-				l.Logger.Printf("> %s\n", m)
+				m, err := mc.nextMessage()
 				if err != nil {
-					if err != io.EOF {
-						ErrorResponse(conn, "error reading message")
-					}
 					return
 				}
-				err = l.Handle(m, conn)
+				rc := responseConn(mc, m)
+				err = l.Handle(m, rc)
 				if err != nil {
-					ErrorResponse(conn, err.Error())
+					ErrorResponse(rc, err.Error())
 				}
 			}
 		}()
 	}
 }
 
+/*
+Message connections
+*/
+
+// A connection served by a MessageListener. Handlers that keep reading messages after their command read them
+// from the same buffered reader as the listener so that messages the client already sent are not lost.
+type messageConn struct {
+	net.Conn
+	// The listener serving the connection. Nil if the connection is not served by a listener
+	l             *MessageListener
+	reader        *bufio.Reader
+	authenticated bool
+}
+
+func (c *messageConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// Returns the message connection that a handler was given. Connections that are not served by a MessageListener,
+// such as JSON-RPC streams, authenticate their messages before they are written to the connection.
+func handlerConn(c net.Conn) *messageConn {
+	if cc, ok := c.(*commandConn); ok {
+		c = cc.Conn
+	}
+	if mc, ok := c.(*messageConn); ok {
+		return mc
+	}
+	return &messageConn{Conn: c, reader: bufio.NewReader(c), authenticated: true}
+}
+
+// Reads the next message that is authenticated. Auth commands are handled and messages that are not authenticated
+// are answered with an error. Returns an error once the connection is closed.
+func (c *messageConn) nextMessage() ([]byte, error) {
+	for {
+		m, err := ReadMessage(c.reader)
+		if err != nil {
+			if err != io.EOF {
+				ErrorResponse(c.Conn, "error reading message")
+			}
+			return nil, err
+		}
+
+		var data commandData
+		if err := json.Unmarshal(m, &data); err != nil {
+			ErrorResponse(c.Conn, fmt.Sprintf("error parsing message: %s", err.Error()))
+			continue
+		}
+
+		if !c.authenticated {
+			if data.AuthToken == "" {
+				ErrorResponse(c.Conn, "authentication required")
+				continue
+			}
+			if !c.l.validToken(data.AuthToken) {
+				c.l.Logger.Println("Closing connection with an invalid auth token")
+				ErrorResponse(c.Conn, "invalid auth token")
+				c.Conn.Close()
+				return nil, errors.New("invalid auth token")
+			}
+		}
+		if strings.ToLower(data.Command) == "auth" {
+			// Tokens in later messages are ignored once the connection is authenticated
+			c.authenticated = true
+			MessageResponse(responseConn(c, m), &successResult{Success: true})
+			continue
+		}
+
+		if c.l != nil {
+			// Don't log messages that contain the token
+			if data.AuthToken == "" {
+				c.l.Logger.Printf("> %s\n", m)
+			} else {
+				c.l.Logger.Printf("> %s command with auth token\n", data.Command)
+			}
+		}
+		return m, nil
+	}
+}
+
+// Returns an error if a message read by a handler after its command uses a newer protocol version or has a field that is not in the message type t
+func checkHandlerMessage(m []byte, t reflect.Type) error {
+	var data commandData
+	if err := json.Unmarshal(m, &data); err != nil {
+		return fmt.Errorf("error parsing message: %s", err.Error())
+	}
+	if err := checkProtocolVersion(&data); err != nil {
+		return err
+	}
+	return checkMessageFields(data.Command, t, m)
+}
+
+// TLSMessageListener wraps a listener so that messages are served over TLS using the certificate and key in the given PEM files
+func TLSMessageListener(nl net.Listener, certFile string, keyFile string) (net.Listener, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading message listener certificate: %s", err.Error())
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	return tls.NewListener(nl, config), nil
+}
+
+/*
+Command ids and events
+
+A command may include a CommandId with any JSON value. Every response written for the command includes the same
+CommandId so that clients can send several commands on a connection without waiting for each response. Messages
+that are pushed to the client rather than sent in response to a command, such as intercepted requests and
+storage updates, instead include an Event field with the type of the event and never include a CommandId.
+*/
+
+// A connection that adds the id of the command being handled to the responses written to it
+type commandConn struct {
+	net.Conn
+	commandId json.RawMessage
+}
+
+// Returns the connection that responses to a message should be written to. If the message has a CommandId, it is added to every response written to the returned connection.
+func responseConn(c net.Conn, message []byte) net.Conn {
+	if cc, ok := c.(*commandConn); ok {
+		c = cc.Conn
+	}
+	var data commandData
+	if err := json.Unmarshal(message, &data); err != nil || len(data.CommandId) == 0 || string(data.CommandId) == "null" {
+		return c
+	}
+	var id bytes.Buffer
+	if err := json.Compact(&id, data.CommandId); err != nil {
+		return c
+	}
+	return &commandConn{Conn: c, commandId: id.Bytes()}
+}
+
+// Returns a message with additional fields added to the start of a JSON object. Messages that are not objects are returned unchanged.
+func addMessageFields(b []byte, fields string) []byte {
+	if len(b) < 2 || b[0] != '{' {
+		return b
+	}
+	rest := bytes.TrimSpace(b[1:])
+	ret := make([]byte, 0, len(b)+len(fields)+2)
+	ret = append(ret, '{')
+	ret = append(ret, fields...)
+	if rest[0] != '}' {
+		ret = append(ret, ',')
+	}
+	return append(ret, rest...)
+}
+
+// Writes a message terminated by a newline with a single write so that messages written by different goroutines are not interleaved
+func writeMessage(w io.Writer, b []byte) {
+	msg := make([]byte, 0, len(b)+1)
+	msg = append(msg, b...)
+	msg = append(msg, '\n')
+	w.Write(msg)
+}
+
+// PushEvent writes a message that is not a response to a command. The message is given an Event field with the type of the event.
+func PushEvent(w io.Writer, event string, m interface{}) {
+	b, err := json.Marshal(&m)
+	if err != nil {
+		panic(err)
+	}
+	eventName, err := json.Marshal(event)
+	if err != nil {
+		panic(err)
+	}
+	if cc, ok := w.(*commandConn); ok {
+		w = cc.Conn
+	}
+	writeMessage(w, addMessageFields(b, `"Event":`+string(eventName)))
+}
+
 // Error response writes an error message to the given writer
 func ErrorResponse(w io.Writer, reason string) {
 	var m errorMessage
@@ -107,8 +385,10 @@ func MessageResponse(w io.Writer, m interface{}) {
 	if err != nil {
 		panic(err)
 	}
-	w.Write(b)
-	w.Write([]byte("\n"))
+	if cc, ok := w.(*commandConn); ok {
+		b = addMessageFields(b, `"CommandId":`+string(cc.commandId))
+	}
+	writeMessage(w, b)
 }
 
 // ReadMessage reads a message from the given reader
@@ -0,0 +1,167 @@
+package puppy
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMessageListenerAuth(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	testErr(t, err)
+	defer ln.Close()
+
+	mserv := NewMessageListener(log.New(ioutil.Discard, "", 0), nil)
+	mserv.AddHandler("ping", func(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
+		MessageResponse(c, &successResult{Success: true})
+	})
+	mserv.SetAuthToken("secret")
+	go mserv.Serve(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	testErr(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	send := func(msg string) *errorMessage {
+		t.Helper()
+		_, err := conn.Write([]byte(msg + "\n"))
+		testErr(t, err)
+		resp, err := ReadMessage(reader)
+		testErr(t, err)
+		result := &errorMessage{}
+		testErr(t, json.Unmarshal(resp, result))
+		return result
+	}
+
+	if resp := send(`{"Command": "ping"}`); resp.Success || resp.Reason != "authentication required" {
+		t.Errorf("command was run without authentication: %+v", resp)
+	}
+	if resp := send(`{"Command": "ping", "AuthToken": "secret"}`); !resp.Success {
+		t.Errorf("command with the auth token failed: %+v", resp)
+	}
+	if resp := send(`{"Command": "ping"}`); resp.Success {
+		t.Errorf("token in a single message authenticated the connection: %+v", resp)
+	}
+	if resp := send(`{"Command": "auth", "AuthToken": "secret"}`); !resp.Success {
+		t.Errorf("auth command failed: %+v", resp)
+	}
+	if resp := send(`{"Command": "ping"}`); !resp.Success {
+		t.Errorf("command failed after authenticating: %+v", resp)
+	}
+
+	// Invalid tokens close the connection
+	conn2, err := net.Dial("tcp", ln.Addr().String())
+	testErr(t, err)
+	defer conn2.Close()
+	reader2 := bufio.NewReader(conn2)
+	_, err = conn2.Write([]byte(`{"Command": "auth", "AuthToken": "wrong"}` + "\n"))
+	testErr(t, err)
+	resp, err := ReadMessage(reader2)
+	testErr(t, err)
+	result := &errorMessage{}
+	testErr(t, json.Unmarshal(resp, result))
+	if result.Success || result.Reason != "invalid auth token" {
+		t.Errorf("incorrect response to an invalid token: %+v", result)
+	}
+	if _, err := ReadMessage(reader2); err == nil {
+		t.Errorf("connection was not closed after an invalid token")
+	}
+}
+
+func TestMessageCommandIds(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	testErr(t, err)
+	defer ln.Close()
+
+	mserv := NewMessageListener(log.New(ioutil.Discard, "", 0), nil)
+	mserv.AddHandler("ping", func(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
+		MessageResponse(c, &successResult{Success: true})
+		PushEvent(c, "pong", &successResult{Success: true})
+	})
+	go mserv.Serve(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	testErr(t, err)
+	defer conn.Close()
+
+	// Send several commands without waiting for the responses
+	_, err = conn.Write([]byte(`{"Command": "ping", "CommandId": 1}
+{"Command": "unknown", "CommandId": "two"}
+{"Command": "ping"}
+`))
+	testErr(t, err)
+
+	type message struct {
+		Success   bool
+		CommandId json.RawMessage
+		Event     string
+	}
+	reader := bufio.NewReader(conn)
+	expected := []message{
+		{true, json.RawMessage(`1`), ""},
+		{true, nil, "pong"},
+		{false, json.RawMessage(`"two"`), ""},
+		{true, nil, ""},
+		{true, nil, "pong"},
+	}
+	for i, exp := range expected {
+		b, err := ReadMessage(reader)
+		testErr(t, err)
+		var msg message
+		testErr(t, json.Unmarshal(b, &msg))
+		if msg.Success != exp.Success || string(msg.CommandId) != string(exp.CommandId) || msg.Event != exp.Event {
+			t.Errorf("incorrect message %d: %s", i, b)
+		}
+	}
+}
+
+func TestStreamingCommandMessages(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	testErr(t, err)
+	defer ln.Close()
+
+	mserv := NewProxyMessageListener(log.New(ioutil.Discard, "", 0), NewInterceptingProxy(nil))
+	mserv.SetAuthToken("secret")
+	go mserv.Serve(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	testErr(t, err)
+	defer conn.Close()
+
+	// Messages sent along with the command are read by the command and go through the same checks as other messages
+	_, err = conn.Write([]byte(`{"Command": "subscribequery", "AuthToken": "secret", "CommandId": 1}
+{"Command": "subscribequery", "CommandId": 2}
+{"Command": "auth", "AuthToken": "secret", "CommandId": 3}
+{"Command": "subscribequery", "Bogus": true, "CommandId": 4}
+{"Command": "unsubscribe", "Id": 1, "ProtocolVersion": 1000, "CommandId": 5}
+{"Command": "unsubscribe", "Id": 1, "CommandId": 6}
+`))
+	testErr(t, err)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	reader := bufio.NewReader(conn)
+	expected := []struct {
+		success bool
+		reason  string
+	}{
+		{true, ""},
+		{false, "authentication required"},
+		{true, ""},
+		{false, "unknown fields for command subscribequery: Bogus"},
+		{false, "protocol version 1000 is not supported, the newest supported version is 1"},
+		{true, ""},
+	}
+	for i, exp := range expected {
+		resp, err := ReadMessage(reader)
+		testErr(t, err)
+		result := &errorMessage{}
+		testErr(t, json.Unmarshal(resp, result))
+		if result.Success != exp.success || result.Reason != exp.reason {
+			t.Errorf("incorrect response to message %d: %s", i+1, resp)
+		}
+	}
+}
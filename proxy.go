@@ -4,6 +4,7 @@ package puppy
 import (
 	"crypto/tls"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -50,13 +51,23 @@ type GlobalStorageWatcher interface {
 }
 
 type globalWatcher struct {
+	// Guards watchers. The slice is replaced rather than modified so that it can be ranged over without the lock
+	mtx      sync.Mutex
 	watchers []GlobalStorageWatcher
 }
 
+// Returns the watchers that are currently registered
+func (gw *globalWatcher) current() []GlobalStorageWatcher {
+	gw.mtx.Lock()
+	defer gw.mtx.Unlock()
+	return gw.watchers
+}
+
 type globalWatcherShim struct {
 	storageId   int
 	globWatcher *globalWatcher
 	logger *log.Logger
+	iproxy *InterceptingProxy
 }
 
 // InterceptingProxy is a struct which represents a proxy which can intercept and modify HTTP and websocket messages
@@ -79,6 +90,14 @@ type InterceptingProxy struct {
 	wSInterceptor       WSInterceptor
 	scopeChecker        RequestChecker
 	scopeQuery          MessageQuery
+	scopeExpr           *QueryExpr
+	scopeVersion        int
+
+	// Incremented when a query is saved or deleted in any storage so that checkers that reference saved queries can be created again
+	savedQueryMtx     sync.Mutex
+	savedQueryVersion int
+	// The savedQueryVersion that the scope checker was created at
+	scopeQueryVersion int
 
 	reqSubs []*ReqIntSub
 	rspSubs []*RspIntSub
@@ -88,8 +107,31 @@ type InterceptingProxy struct {
 
 	messageStorage map[int]*savedStorage
 	globWatcher *globalWatcher
+
+	siteMapMtx   sync.Mutex
+	siteMaps     map[siteMapKey]*cachedSiteMap
+	siteMapClock int
 }
 
+// The arguments used to create a site map
+type siteMapKey struct {
+	storageId    int
+	query        string
+	inScope      bool
+	scopeVersion int
+	// Set if the query references saved queries. queryVersion is the savedQueryVersion the site map was created at
+	savedQueries bool
+	queryVersion int
+}
+
+type cachedSiteMap struct {
+	siteMap  *SiteMap
+	lastUsed int
+}
+
+// The maximum number of site maps that are kept up to date by the proxy
+const maxCachedSiteMaps = 16
+
 // ProxyCredentials are a username/password combination used to represent an HTTP BasicAuth session
 type ProxyCredentials struct {
 	Username string
@@ -141,6 +183,7 @@ func NewInterceptingProxy(logger *log.Logger) *InterceptingProxy {
 	}
 
 	iproxy.messageStorage = make(map[int]*savedStorage)
+	iproxy.siteMaps = make(map[siteMapKey]*cachedSiteMap)
 	iproxy.slistener = NewProxyListener(useLogger)
 	iproxy.server = newProxyServer(useLogger, &iproxy)
 	iproxy.logger = useLogger
@@ -231,6 +274,7 @@ func (iproxy *InterceptingProxy) AddMessageStorage(storage MessageStorage, descr
 		storageId: id,
 		globWatcher: iproxy.globWatcher,
 		logger: iproxy.logger,
+		iproxy: iproxy,
 	}
 	storage.Watch(shim)
 	return id
@@ -245,6 +289,16 @@ func (iproxy *InterceptingProxy) CloseMessageStorage(id int) {
 		return
 	}
 	delete(iproxy.messageStorage, id)
+
+	iproxy.siteMapMtx.Lock()
+	for key, cached := range iproxy.siteMaps {
+		if key.storageId == id {
+			cached.siteMap.Close()
+			delete(iproxy.siteMaps, key)
+		}
+	}
+	iproxy.siteMapMtx.Unlock()
+
 	savedStorage.storage.Close()
 }
 
@@ -293,8 +347,8 @@ func (iproxy *InterceptingProxy) LoadScope(storageId int) error {
 		return fmt.Errorf("proxy has no associated storage")
 	}
 	iproxy.logger.Println("loading scope")
-	if scope, err := savedStorage.storage.LoadQuery("__scope"); err == nil {
-		if err := iproxy.setScopeQuery(scope); err != nil {
+	if scope, err := savedStorage.storage.LoadQueryExpr("__scope"); err == nil {
+		if err := iproxy.setScopeExpr(scope); err != nil {
 			iproxy.logger.Println("error setting scope:", err.Error())
 		}
 	} else {
@@ -307,9 +361,51 @@ func (iproxy *InterceptingProxy) LoadScope(storageId int) error {
 func (iproxy *InterceptingProxy) GetScopeChecker() RequestChecker {
 	iproxy.mtx.Lock()
 	defer iproxy.mtx.Unlock()
+	iproxy.refreshScope()
 	return iproxy.scopeChecker
 }
 
+// Returns the current savedQueryVersion
+func (iproxy *InterceptingProxy) getSavedQueryVersion() int {
+	iproxy.savedQueryMtx.Lock()
+	defer iproxy.savedQueryMtx.Unlock()
+	return iproxy.savedQueryVersion
+}
+
+// Called by storage watchers when a saved query changes. Storages make the callback while they are locked, so the scope is only marked as out of date here and is updated the next time it is used.
+func (iproxy *InterceptingProxy) savedQueryChanged(name string) {
+	if name == "__scope" {
+		return
+	}
+	iproxy.savedQueryMtx.Lock()
+	defer iproxy.savedQueryMtx.Unlock()
+	iproxy.savedQueryVersion++
+}
+
+// Creates a checker for a scope expression. Saved queries referenced by the scope are loaded from the proxy storage.
+func (iproxy *InterceptingProxy) scopeCheckerFromExpr(expr *QueryExpr) (RequestChecker, error) {
+	iproxy.scopeQueryVersion = iproxy.getSavedQueryVersion()
+	if savedStorage, ok := iproxy.messageStorage[iproxy.proxyStorage]; ok {
+		return StorageCheckerFromQueryExpr(savedStorage.storage, expr)
+	}
+	return CheckerFromQueryExpr(expr)
+}
+
+// Creates the scope checker again if it references saved queries that may have changed. Must be called with iproxy.mtx held.
+func (iproxy *InterceptingProxy) refreshScope() {
+	if iproxy.scopeQueryVersion == iproxy.getSavedQueryVersion() || !exprReferencesSavedQuery(iproxy.scopeExpr) {
+		return
+	}
+	checker, err := iproxy.scopeCheckerFromExpr(iproxy.scopeExpr)
+	if err != nil {
+		// Keep using the previous version of the scope until the saved queries are fixed
+		iproxy.logger.Println("error updating scope:", err.Error())
+		return
+	}
+	iproxy.scopeChecker = checker
+	iproxy.scopeVersion++
+}
+
 // SetScopeChecker has the proxy use a specific RequestChecker to check if a request is in scope. If the checker returns true for a request it is considered in scope. Otherwise it is considered out of scope.
 func (iproxy *InterceptingProxy) SetScopeChecker(checker RequestChecker) error {
 	iproxy.mtx.Lock()
@@ -320,6 +416,8 @@ func (iproxy *InterceptingProxy) SetScopeChecker(checker RequestChecker) error {
 	}
 	iproxy.scopeChecker = checker
 	iproxy.scopeQuery = nil
+	iproxy.scopeExpr = nil
+	iproxy.scopeVersion++
 	emptyQuery := make(MessageQuery, 0)
 	if savedStorage != nil {
 		savedStorage.storage.SaveQuery("__scope", emptyQuery) // Assume it clears it I guess
@@ -327,7 +425,7 @@ func (iproxy *InterceptingProxy) SetScopeChecker(checker RequestChecker) error {
 	return nil
 }
 
-// GetScopeQuery returns the query associated with the proxy's scope. If the scope was set using SetScopeChecker, nil is returned
+// GetScopeQuery returns the query associated with the proxy's scope. If the scope was set using SetScopeChecker or with an expression that is too complex to be converted into a MessageQuery, nil is returned
 func (iproxy *InterceptingProxy) GetScopeQuery() MessageQuery {
 	iproxy.mtx.Lock()
 	defer iproxy.mtx.Unlock()
@@ -342,7 +440,7 @@ func (iproxy *InterceptingProxy) SetScopeQuery(query MessageQuery) error {
 }
 
 func (iproxy *InterceptingProxy) setScopeQuery(query MessageQuery) error {
-	checker, err := CheckerFromMessageQuery(query)
+	checker, err := iproxy.scopeCheckerFromExpr(QueryExprFromMessageQuery(query))
 	if err != nil {
 		return err
 	}
@@ -352,6 +450,8 @@ func (iproxy *InterceptingProxy) setScopeQuery(query MessageQuery) error {
 	}
 	iproxy.scopeChecker = checker
 	iproxy.scopeQuery = query
+	iproxy.scopeExpr = QueryExprFromMessageQuery(query)
+	iproxy.scopeVersion++
 	if savedStorage != nil {
 		if err = savedStorage.storage.SaveQuery("__scope", query); err != nil {
 			return fmt.Errorf("could not save scope to storage: %s", err.Error())
@@ -361,12 +461,55 @@ func (iproxy *InterceptingProxy) setScopeQuery(query MessageQuery) error {
 	return nil
 }
 
+// GetScopeExpr returns the query expression associated with the proxy's scope. If the scope was set using SetScopeChecker, nil is returned
+func (iproxy *InterceptingProxy) GetScopeExpr() *QueryExpr {
+	iproxy.mtx.Lock()
+	defer iproxy.mtx.Unlock()
+	return iproxy.scopeExpr
+}
+
+// SetScopeExpr sets the scope of the proxy to include any request which matches the given QueryExpr
+func (iproxy *InterceptingProxy) SetScopeExpr(expr *QueryExpr) error {
+	iproxy.mtx.Lock()
+	defer iproxy.mtx.Unlock()
+	return iproxy.setScopeExpr(expr)
+}
+
+func (iproxy *InterceptingProxy) setScopeExpr(expr *QueryExpr) error {
+	checker, err := iproxy.scopeCheckerFromExpr(expr)
+	if err != nil {
+		return err
+	}
+	savedStorage, ok := iproxy.messageStorage[iproxy.proxyStorage]
+	if !ok {
+		savedStorage = nil
+	}
+	iproxy.scopeChecker = checker
+	iproxy.scopeQuery, _ = MessageQueryFromExpr(expr)
+	iproxy.scopeExpr = expr
+	iproxy.scopeVersion++
+	if savedStorage != nil {
+		if err = savedStorage.storage.SaveQueryExpr("__scope", expr); err != nil {
+			return fmt.Errorf("could not save scope to storage: %s", err.Error())
+		}
+	}
+
+	return nil
+}
+
+// SetScopeSavedQuery sets the scope of the proxy to include any request which matches a query saved in the proxy storage. The scope is updated when the saved query or any saved queries it references change.
+func (iproxy *InterceptingProxy) SetScopeSavedQuery(name string) error {
+	return iproxy.SetScopeExpr(TermExpr(FieldSavedQuery, StrIs, name))
+}
+
 // ClearScope removes all scope checks from the proxy so that all requests passing through the proxy will be considered in-scope
 func (iproxy *InterceptingProxy) ClearScope() error {
 	iproxy.mtx.Lock()
 	defer iproxy.mtx.Unlock()
 	iproxy.scopeChecker = nil
-	iproxy.scopeChecker = nil
+	iproxy.scopeQuery = nil
+	iproxy.scopeExpr = nil
+	iproxy.scopeVersion++
 	emptyQuery := make(MessageQuery, 0)
 	savedStorage, ok := iproxy.messageStorage[iproxy.proxyStorage]
 	if !ok {
@@ -380,6 +523,84 @@ func (iproxy *InterceptingProxy) ClearScope() error {
 	return nil
 }
 
+// GetSiteMap returns a site map of the requests in a storage that match a query. If inScope is true, only requests that are in the proxy's scope are included. Site maps are kept up to date as the storage changes so that later calls with the same arguments don't need to load the storage again.
+func (iproxy *InterceptingProxy) GetSiteMap(storageId int, query MessageQuery, inScope bool) (*SiteMap, error) {
+	ms, _ := iproxy.GetMessageStorage(storageId)
+	if ms == nil {
+		return nil, fmt.Errorf("storage with id %d does not exist", storageId)
+	}
+
+	strQuery, err := MsgQueryToStrQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	queryKey, err := json.Marshal(strQuery)
+	if err != nil {
+		return nil, err
+	}
+	queryVersion := iproxy.getSavedQueryVersion()
+	checker, err := StorageCheckerFromMessageQuery(ms, query)
+	if err != nil {
+		return nil, err
+	}
+
+	iproxy.mtx.Lock()
+	iproxy.refreshScope()
+	scopeChecker := iproxy.scopeChecker
+	scopeVersion := iproxy.scopeVersion
+	iproxy.mtx.Unlock()
+
+	key := siteMapKey{storageId: storageId, query: string(queryKey), inScope: inScope}
+	if exprReferencesSavedQuery(QueryExprFromMessageQuery(query)) {
+		key.savedQueries = true
+		key.queryVersion = queryVersion
+	}
+	if inScope {
+		key.scopeVersion = scopeVersion
+		if scopeChecker != nil {
+			queryChecker := checker
+			checker = func(req *ProxyRequest) bool {
+				return scopeChecker(req) && queryChecker(req)
+			}
+		}
+	}
+
+	iproxy.siteMapMtx.Lock()
+	defer iproxy.siteMapMtx.Unlock()
+	iproxy.siteMapClock++
+
+	if cached, ok := iproxy.siteMaps[key]; ok {
+		cached.lastUsed = iproxy.siteMapClock
+		return cached.siteMap, nil
+	}
+
+	sm, err := NewSiteMap(ms, checker)
+	if err != nil {
+		return nil, err
+	}
+
+	// Close site maps for old scopes and saved queries and the least recently used site maps
+	var oldest *siteMapKey
+	for k, cached := range iproxy.siteMaps {
+		if (k.inScope && k.scopeVersion != scopeVersion) || (k.savedQueries && k.queryVersion != queryVersion) {
+			cached.siteMap.Close()
+			delete(iproxy.siteMaps, k)
+			continue
+		}
+		if oldest == nil || cached.lastUsed < iproxy.siteMaps[*oldest].lastUsed {
+			k := k
+			oldest = &k
+		}
+	}
+	if len(iproxy.siteMaps) >= maxCachedSiteMaps && oldest != nil {
+		iproxy.siteMaps[*oldest].siteMap.Close()
+		delete(iproxy.siteMaps, *oldest)
+	}
+
+	iproxy.siteMaps[key] = &cachedSiteMap{siteMap: sm, lastUsed: iproxy.siteMapClock}
+	return sm, nil
+}
+
 // SetNetDial sets the NetDialer that should be used to create outgoing connections when submitting HTTP requests. Overwrites the request's NetDialer
 func (iproxy *InterceptingProxy) SetNetDial(dialer NetDialer) {
 	iproxy.mtx.Lock()
@@ -538,16 +759,18 @@ func (iproxy *InterceptingProxy) RemoveWSInterceptor(sub *WSIntSub) {
 
 // Add a global storage watcher
 func (iproxy *InterceptingProxy) GlobalStorageWatch(watcher GlobalStorageWatcher) error {
-	iproxy.mtx.Lock()
-	defer iproxy.mtx.Unlock()
-	iproxy.globWatcher.watchers = append(iproxy.globWatcher.watchers, watcher)
+	gw := iproxy.globWatcher
+	gw.mtx.Lock()
+	defer gw.mtx.Unlock()
+	watchers := make([]GlobalStorageWatcher, 0, len(gw.watchers)+1)
+	gw.watchers = append(append(watchers, gw.watchers...), watcher)
 	return nil
 }
 
 // Remove a global storage watcher
 func (iproxy *InterceptingProxy) GlobalStorageEndWatch(watcher GlobalStorageWatcher) error {
-	iproxy.mtx.Lock()
-	defer iproxy.mtx.Unlock()
+	iproxy.globWatcher.mtx.Lock()
+	defer iproxy.globWatcher.mtx.Unlock()
 	var newWatched = make([]GlobalStorageWatcher, 0)
 	for _, testWatcher := range iproxy.globWatcher.watchers {
 		if (testWatcher != watcher) {
@@ -574,6 +797,12 @@ func (iproxy *InterceptingProxy) SetProxyStorage(storageId int) error {
 	return nil
 }
 
+func (iproxy *InterceptingProxy) proxyStorageId() int {
+	iproxy.mtx.Lock()
+	defer iproxy.mtx.Unlock()
+	return iproxy.proxyStorage
+}
+
 // GetProxyStorage returns the storage being used to save messages as they pass through the proxy
 func (iproxy *InterceptingProxy) GetProxyStorage() MessageStorage {
 	iproxy.mtx.Lock()
@@ -985,56 +1214,64 @@ func newProxyServer(logger *log.Logger, iproxy *InterceptingProxy) *http.Server
 
 // StorageWatcher implementation
 func (watcher *globalWatcherShim) NewRequestSaved(ms MessageStorage, req *ProxyRequest) {
-	for _, w := range watcher.globWatcher.watchers {
+	for _, w := range watcher.globWatcher.current() {
 		w.NewRequestSaved(watcher.storageId, ms, req)
 	}
 }
 
 func (watcher *globalWatcherShim) RequestUpdated(ms MessageStorage, req *ProxyRequest) {
-	for _, w := range watcher.globWatcher.watchers {
+	for _, w := range watcher.globWatcher.current() {
 		w.RequestUpdated(watcher.storageId, ms, req)
 	}
 }
 
 func (watcher *globalWatcherShim) RequestDeleted(ms MessageStorage, DbId string) {
-	for _, w := range watcher.globWatcher.watchers {
+	for _, w := range watcher.globWatcher.current() {
 		w.RequestDeleted(watcher.storageId, ms, DbId)
 	}
 }
 
 func (watcher *globalWatcherShim) NewResponseSaved(ms MessageStorage, rsp *ProxyResponse) {
-	for _, w := range watcher.globWatcher.watchers {
+	for _, w := range watcher.globWatcher.current() {
 		w.NewResponseSaved(watcher.storageId, ms, rsp)
 	}
 }
 
 func (watcher *globalWatcherShim) ResponseUpdated(ms MessageStorage, rsp *ProxyResponse) {
-	for _, w := range watcher.globWatcher.watchers {
+	for _, w := range watcher.globWatcher.current() {
 		w.ResponseUpdated(watcher.storageId, ms, rsp)
 	}
 }
 
 func (watcher *globalWatcherShim) ResponseDeleted(ms MessageStorage, DbId string) {
-	for _, w := range watcher.globWatcher.watchers {
+	for _, w := range watcher.globWatcher.current() {
 		w.ResponseDeleted(watcher.storageId, ms, DbId)
 	}
 }
 
 func (watcher *globalWatcherShim) NewWSMessageSaved(ms MessageStorage, req *ProxyRequest, wsm *ProxyWSMessage) {
-	for _, w := range watcher.globWatcher.watchers {
+	for _, w := range watcher.globWatcher.current() {
 		w.NewWSMessageSaved(watcher.storageId, ms, req, wsm)
 	}
 }
 
 func (watcher *globalWatcherShim) WSMessageUpdated(ms MessageStorage, req *ProxyRequest, wsm *ProxyWSMessage) {
-	for _, w := range watcher.globWatcher.watchers {
+	for _, w := range watcher.globWatcher.current() {
 		w.WSMessageUpdated(watcher.storageId, ms, req, wsm)
 	}
 }
 
 func (watcher *globalWatcherShim) WSMessageDeleted(ms MessageStorage, DbId string) {
-	for _, w := range watcher.globWatcher.watchers {
+	for _, w := range watcher.globWatcher.current() {
 		w.WSMessageDeleted(watcher.storageId, ms, DbId)
 	}
 }
 
+func (watcher *globalWatcherShim) QuerySaved(ms MessageStorage, name string) {
+	watcher.iproxy.savedQueryChanged(name)
+}
+
+func (watcher *globalWatcherShim) QueryDeleted(ms MessageStorage, name string) {
+	watcher.iproxy.savedQueryChanged(name)
+}
+
@@ -7,12 +7,14 @@ Wrappers around http.Request and http.Response to add helper functions needed by
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"reflect"
 	"strconv"
@@ -69,6 +71,15 @@ type ProxyRequest struct {
 	// The time at which the response to this request was received
 	EndDatetime time.Time
 
+	// Free-text notes attached to the request
+	Note string
+	// The color used to highlight the request. Blank string means the request is not highlighted.
+	Highlight string
+	// Whether the request has been marked as reviewed
+	Reviewed bool
+	// A breakdown of the time spent submitting the request
+	Timings RequestTimings
+
 	bodyBytes []byte
 	tags      mapset.Set
 
@@ -76,6 +87,27 @@ type ProxyRequest struct {
 	NetDial NetDialer
 }
 
+// RequestTimings is a breakdown of the time spent submitting a request. Phases that did not take place are zero.
+type RequestTimings struct {
+	// Time spent resolving the host name. Only measured when the default dialer is used.
+	DNS time.Duration
+	// Time spent opening the connection to the server or proxy
+	Connect time.Duration
+	// Time spent performing a CONNECT handshake with an upstream HTTP proxy
+	ProxyConnect time.Duration
+	// Time spent performing the TLS handshake
+	TLSHandshake time.Duration
+	// Time between writing the request and receiving the first byte of the response
+	TimeToFirstByte time.Duration
+	// Time spent reading the rest of the response after the first byte was received
+	Transfer time.Duration
+}
+
+// Total returns the sum of all of the timings
+func (t RequestTimings) Total() time.Duration {
+	return t.DNS + t.Connect + t.ProxyConnect + t.TLSHandshake + t.TimeToFirstByte + t.Transfer
+}
+
 // WSSession is an extension of websocket.Conn to contain a reference to the ProxyRequest used for the websocket handshake
 type WSSession struct {
 	websocket.Conn
@@ -142,6 +174,10 @@ func NewProxyRequest(r *http.Request, destHost string, destPort int, destUseTLS
 			"",
 			time.Unix(0, 0),
 			time.Unix(0, 0),
+			"",
+			"",
+			false,
+			RequestTimings{},
 			make([]byte, 0),
 			mapset.NewSet(),
 			nil,
@@ -161,6 +197,10 @@ func NewProxyRequest(r *http.Request, destHost string, destPort int, destUseTLS
 			"",
 			time.Unix(0, 0),
 			time.Unix(0, 0),
+			"",
+			"",
+			false,
+			RequestTimings{},
 			make([]byte, 0),
 			mapset.NewSet(),
 			nil,
@@ -283,8 +323,14 @@ func (req *ProxyRequest) SubmitProxy(conn net.Conn, creds *ProxyCredentials) err
 }
 
 func (req *ProxyRequest) submit(conn net.Conn, forProxy bool, proxyCreds *ProxyCredentials) error {
-	// Write the request to the connection
 	req.StartDatetime = time.Now()
+	req.Timings = RequestTimings{}
+	return req.submitTimed(conn, forProxy, proxyCreds)
+}
+
+// Writes the request to the connection and reads the response. Does not reset StartDatetime or the timings of any handshakes that have already been measured.
+func (req *ProxyRequest) submitTimed(conn net.Conn, forProxy bool, proxyCreds *ProxyCredentials) error {
+	// Write the request to the connection
 	if forProxy {
 		if req.DestUseTLS {
 			req.URL.Scheme = "https"
@@ -302,18 +348,78 @@ func (req *ProxyRequest) submit(conn net.Conn, forProxy bool, proxyCreds *ProxyC
 		}
 	}
 
+	sent := time.Now()
+
 	// Read a response from the server
-	httpRsp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	reader := bufio.NewReader(conn)
+	if _, err := reader.Peek(1); err != nil {
+		return fmt.Errorf("error reading response: %s", err.Error())
+	}
+	firstByte := time.Now()
+	req.Timings.TimeToFirstByte = firstByte.Sub(sent)
+
+	httpRsp, err := http.ReadResponse(reader, nil)
 	if err != nil {
 		return fmt.Errorf("error reading response: %s", err.Error())
 	}
-	req.EndDatetime = time.Now()
 
 	prsp := NewProxyResponse(httpRsp)
+	req.EndDatetime = time.Now()
+	req.Timings.Transfer = req.EndDatetime.Sub(firstByte)
 	req.ServerResponse = prsp
 	return nil
 }
 
+// Dials the given host and port, recording the time spent resolving the host and connecting in timings. If dialer is nil, the lookup is traced so that it can be timed separately from connecting. Custom dialers may not accept IP addresses so the whole dial is counted as connecting.
+func timedDial(dialer NetDialer, host string, port int, timings *RequestTimings) (net.Conn, error) {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	if dialer != nil {
+		start := time.Now()
+		conn, err := dialer("tcp", addr)
+		timings.Connect = time.Since(start)
+		return conn, err
+	}
+
+	// Dialing the host name lets net.Dialer race IPv4 and IPv6 addresses
+	start := time.Now()
+	connectStart := start
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			start = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			connectStart = time.Now()
+			timings.DNS = connectStart.Sub(start)
+		},
+	}
+	d := &net.Dialer{}
+	conn, err := d.DialContext(httptrace.WithClientTrace(context.Background(), trace), "tcp", addr)
+	timings.Connect = time.Since(connectStart)
+	return conn, err
+}
+
+// Performs a CONNECT handshake with an upstream proxy and records how long it took
+func timedConnect(conn net.Conn, destHost string, destPort int, timings *RequestTimings) error {
+	start := time.Now()
+	err := PerformConnect(conn, destHost, destPort)
+	timings.ProxyConnect = time.Since(start)
+	return err
+}
+
+// Wraps the connection in a TLS client and performs the handshake so that it can be timed
+func timedTLSClient(conn net.Conn, timings *RequestTimings) (net.Conn, error) {
+	tls_conn := tls.Client(conn, &tls.Config{
+		InsecureSkipVerify: true,
+	})
+	start := time.Now()
+	err := tls_conn.Handshake()
+	timings.TLSHandshake = time.Since(start)
+	if err != nil {
+		return nil, fmt.Errorf("error performing TLS handshake: %s", err.Error())
+	}
+	return tls_conn, nil
+}
+
 // WSDial performs a websocket handshake over the given connection. Does not take into account DestHost, DestPort, or DestUseTLS
 func (req *ProxyRequest) WSDial(conn net.Conn) (*WSSession, error) {
 	if !req.IsWSUpgrade() {
@@ -368,14 +474,10 @@ func WSDialSOCKSProxy(req *ProxyRequest, proxyHost string, proxyPort int, creds
 
 func wsDial(req *ProxyRequest, useProxy bool, proxyHost string, proxyPort int, proxyCreds *ProxyCredentials, proxyIsSOCKS bool) (*WSSession, error) {
 	var conn net.Conn
-	var dialer NetDialer
 	var err error
 
-	if req.NetDial != nil {
-		dialer = req.NetDial
-	} else {
-		dialer = net.Dial
-	}
+	req.StartDatetime = time.Now()
+	req.Timings = RequestTimings{}
 
 	if useProxy {
 		if proxyIsSOCKS {
@@ -390,37 +492,47 @@ func wsDial(req *ProxyRequest, useProxy bool, proxyHost string, proxyPort int, p
 			if err != nil {
 				return nil, fmt.Errorf("error creating SOCKS dialer: %s", err.Error())
 			}
+			start := time.Now()
 			conn, err = socksDialer.Dial("tcp", fmt.Sprintf("%s:%d", req.DestHost, req.DestPort))
+			req.Timings.Connect = time.Since(start)
 			if err != nil {
 				return nil, fmt.Errorf("error dialing host: %s", err.Error())
 			}
 			defer conn.Close()
 		} else {
-			conn, err = dialer("tcp", fmt.Sprintf("%s:%d", proxyHost, proxyPort))
+			conn, err = timedDial(req.NetDial, proxyHost, proxyPort, &req.Timings)
 			if err != nil {
 				return nil, fmt.Errorf("error dialing proxy: %s", err.Error())
 			}
 
 			// always perform a CONNECT for websocket regardless of SSL
-			if err := PerformConnect(conn, req.DestHost, req.DestPort); err != nil {
+			if err := timedConnect(conn, req.DestHost, req.DestPort, &req.Timings); err != nil {
 				return nil, err
 			}
 		}
 	} else {
-		conn, err = dialer("tcp", fmt.Sprintf("%s:%d", req.DestHost, req.DestPort))
+		conn, err = timedDial(req.NetDial, req.DestHost, req.DestPort, &req.Timings)
 		if err != nil {
 			return nil, fmt.Errorf("error dialing host: %s", err.Error())
 		}
 	}
 
 	if req.DestUseTLS {
-		tls_conn := tls.Client(conn, &tls.Config{
-			InsecureSkipVerify: true,
-		})
-		conn = tls_conn
+		conn, err = timedTLSClient(conn, &req.Timings)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return req.WSDial(conn)
+	// The handshake response has no body so the whole handshake is counted as waiting for the first byte
+	start := time.Now()
+	wsession, err := req.WSDial(conn)
+	req.Timings.TimeToFirstByte = time.Since(start)
+	if err != nil {
+		return nil, err
+	}
+	req.EndDatetime = time.Now()
+	return wsession, nil
 }
 
 // IsWSUpgrade returns whether the request is used to initiate a websocket handshake
@@ -480,6 +592,10 @@ func (req *ProxyRequest) DeepClone() *ProxyRequest {
 	// Returns a request with the same request, response, and associated websocket messages
 	newReq := req.Clone()
 	newReq.DbId = req.DbId
+	newReq.Note = req.Note
+	newReq.Highlight = req.Highlight
+	newReq.Reviewed = req.Reviewed
+	newReq.Timings = req.Timings
 
 	if req.Unmangled != nil {
 		newReq.Unmangled = req.Unmangled.DeepClone()
@@ -809,14 +925,14 @@ func copyHeader(hd http.Header) http.Header {
 
 func submitRequest(req *ProxyRequest, useProxy bool, proxyHost string,
 	proxyPort int, proxyCreds *ProxyCredentials, proxyIsSOCKS bool) error {
-	var dialer NetDialer = req.NetDial
-	if dialer == nil {
-		dialer = net.Dial
-	}
-
 	var conn net.Conn
 	var err error
 	var proxyFormat bool = false
+
+	// The request starts when we begin connecting rather than when it is written so that the handshakes are included
+	req.StartDatetime = time.Now()
+	req.Timings = RequestTimings{}
+
 	if useProxy {
 		if proxyIsSOCKS {
 			var socksCreds *proxy.Auth
@@ -830,19 +946,21 @@ func submitRequest(req *ProxyRequest, useProxy bool, proxyHost string,
 			if err != nil {
 				return fmt.Errorf("error creating SOCKS dialer: %s", err.Error())
 			}
+			start := time.Now()
 			conn, err = socksDialer.Dial("tcp", fmt.Sprintf("%s:%d", req.DestHost, req.DestPort))
+			req.Timings.Connect = time.Since(start)
 			if err != nil {
 				return fmt.Errorf("error dialing host: %s", err.Error())
 			}
 			defer conn.Close()
 		} else {
-			conn, err = dialer("tcp", fmt.Sprintf("%s:%d", proxyHost, proxyPort))
+			conn, err = timedDial(req.NetDial, proxyHost, proxyPort, &req.Timings)
 			if err != nil {
 				return fmt.Errorf("error dialing proxy: %s", err.Error())
 			}
 			defer conn.Close()
 			if req.DestUseTLS {
-				if err := PerformConnect(conn, req.DestHost, req.DestPort); err != nil {
+				if err := timedConnect(conn, req.DestHost, req.DestPort, &req.Timings); err != nil {
 					return err
 				}
 				proxyFormat = false
@@ -851,7 +969,7 @@ func submitRequest(req *ProxyRequest, useProxy bool, proxyHost string,
 			}
 		}
 	} else {
-		conn, err = dialer("tcp", fmt.Sprintf("%s:%d", req.DestHost, req.DestPort))
+		conn, err = timedDial(req.NetDial, req.DestHost, req.DestPort, &req.Timings)
 		if err != nil {
 			return fmt.Errorf("error dialing host: %s", err.Error())
 		}
@@ -859,17 +977,13 @@ func submitRequest(req *ProxyRequest, useProxy bool, proxyHost string,
 	}
 
 	if req.DestUseTLS {
-		tls_conn := tls.Client(conn, &tls.Config{
-			InsecureSkipVerify: true,
-		})
-		conn = tls_conn
+		conn, err = timedTLSClient(conn, &req.Timings)
+		if err != nil {
+			return err
+		}
 	}
 
-	if proxyFormat {
-		return req.SubmitProxy(conn, proxyCreds)
-	} else {
-		return req.Submit(conn)
-	}
+	return req.submitTimed(conn, proxyFormat, proxyCreds)
 }
 
 // SubmitRequest opens a connection to the request's DestHost:DestPort, using TLS if DestUseTLS is set, submits the request, and sets req.Response with the response when a response is received
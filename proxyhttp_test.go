@@ -1,9 +1,14 @@
 package puppy
 
 import (
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"runtime"
+	"strconv"
 	"testing"
+	"time"
 	// "bytes"
 	// "net/http"
 	// "bufio"
@@ -197,3 +202,65 @@ func TestDeepClone(t *testing.T) {
 // 	// 	t.Errorf("too many connection headers")
 // 	// }
 // }
+
+func TestSubmitTimings(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	host, portStr, _ := net.SplitHostPort(u.Host)
+	port, _ := strconv.Atoi(portStr)
+
+	req := testReq()
+	req.DestHost = host
+	req.DestPort = port
+	req.DestUseTLS = true
+
+	before := time.Now()
+	testErr(t, SubmitRequest(req))
+	if req.ServerResponse == nil || string(req.ServerResponse.BodyBytes()) != "hello" {
+		t.Fatalf("incorrect response")
+	}
+
+	timings := req.Timings
+	if timings.Connect <= 0 || timings.TLSHandshake <= 0 {
+		t.Errorf("connection timings were not recorded: %+v", timings)
+	}
+	if timings.TimeToFirstByte < 20*time.Millisecond {
+		t.Errorf("time to first byte is too short: %s", timings.TimeToFirstByte)
+	}
+	if timings.ProxyConnect != 0 {
+		t.Errorf("proxy timings were recorded without a proxy: %+v", timings)
+	}
+	if req.StartDatetime.Before(before) || req.EndDatetime.Sub(req.StartDatetime) < timings.Total() {
+		t.Errorf("request times do not cover the timings: %s-%s", req.StartDatetime, req.EndDatetime)
+	}
+}
+
+func TestTimedDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	testErr(t, err)
+	defer ln.Close()
+	_, portStr, _ := net.SplitHostPort(ln.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	// Host names are resolved by the dialer and the lookup is timed separately
+	var timings RequestTimings
+	conn, err := timedDial(nil, "localhost", port, &timings)
+	testErr(t, err)
+	conn.Close()
+	if timings.DNS <= 0 || timings.Connect <= 0 {
+		t.Errorf("dial timings were not recorded: %+v", timings)
+	}
+
+	timings = RequestTimings{}
+	conn, err = timedDial(nil, "127.0.0.1", port, &timings)
+	testErr(t, err)
+	conn.Close()
+	if timings.DNS != 0 || timings.Connect <= 0 {
+		t.Errorf("incorrect timings for dialing an address: %+v", timings)
+	}
+}
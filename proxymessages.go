@@ -9,8 +9,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
+	"os"
+	"reflect"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -24,43 +28,69 @@ import (
 func NewProxyMessageListener(logger *log.Logger, iproxy *InterceptingProxy) *MessageListener {
 	l := NewMessageListener(logger, iproxy)
 
-	l.AddHandler("ping", pingHandler)
-	l.AddHandler("submit", submitHandler)
-	l.AddHandler("savenew", saveNewHandler)
-	l.AddHandler("storagequery", storageQueryHandler)
-	l.AddHandler("validatequery", validateQueryHandler)
-	l.AddHandler("checkrequest", checkRequestHandler)
-	l.AddHandler("setscope", setScopeHandler)
-	l.AddHandler("viewscope", viewScopeHandler)
-	l.AddHandler("addtag", addTagHandler)
-	l.AddHandler("removetag", removeTagHandler)
-	l.AddHandler("cleartag", clearTagHandler)
-	l.AddHandler("intercept", interceptHandler)
-	l.AddHandler("allsavedqueries", allSavedQueriesHandler)
-	l.AddHandler("savequery", saveQueryHandler)
-	l.AddHandler("loadquery", loadQueryHandler)
-	l.AddHandler("deletequery", deleteQueryHandler)
-	l.AddHandler("addlistener", addListenerHandler)
-	l.AddHandler("removelistener", removeListenerHandler)
-	l.AddHandler("getlisteners", getListenersHandler)
-	l.AddHandler("loadcerts", loadCertificatesHandler)
-	l.AddHandler("setcerts", setCertificatesHandler)
-	l.AddHandler("clearcerts", clearCertificatesHandler)
-	l.AddHandler("gencerts", generateCertificatesHandler)
-	l.AddHandler("genpemcerts", generatePEMCertificatesHandler)
-	l.AddHandler("addsqlitestorage", addSQLiteStorageHandler)
-	l.AddHandler("addinmemorystorage", addInMemoryStorageHandler)
-	l.AddHandler("closestorage", closeStorageHandler)
-	l.AddHandler("setproxystorage", setProxyStorageHandler)
-	l.AddHandler("liststorage", listProxyStorageHandler)
-	l.AddHandler("setproxy", setProxyHandler)
-	l.AddHandler("watchstorage", watchStorageHandler)
-	l.AddHandler("setpluginvalue", setPluginValueHandler)
-	l.AddHandler("getpluginvalue", getPluginValueHandler)
+	l.AddCommand("ping", pingHandler, emptyMessage{})
+	l.AddCommand("submit", submitHandler, submitMessage{})
+	l.AddCommand("savenew", saveNewHandler, submitMessage{})
+	l.AddCommand("loadrequest", loadRequestHandler, loadRequestMessage{})
+	l.AddCommand("loadunmangled", loadUnmangledRequestHandler, loadRequestMessage{})
+	l.AddCommand("loadresponse", loadResponseHandler, loadResponseMessage{})
+	l.AddCommand("loadunmangledresponse", loadUnmangledResponseHandler, loadResponseMessage{})
+	l.AddCommand("loadwsmessage", loadWSMessageHandler, loadWSMessageMessage{})
+	l.AddCommand("loadunmangledwsmessage", loadUnmangledWSMessageHandler, loadWSMessageMessage{})
+	l.AddCommand("deleterequest", deleteRequestHandler, deleteRequestMessage{})
+	l.AddCommand("deleteresponse", deleteResponseHandler, deleteResponseMessage{})
+	l.AddCommand("deletewsmessage", deleteWSMessageHandler, deleteWSMessageMessage{})
+	l.AddCommand("updaterequest", updateRequestHandler, updateRequestMessage{})
+	l.AddCommand("updateresponse", updateResponseHandler, updateResponseMessage{})
+	l.AddCommand("updatewsmessage", updateWSMessageHandler, updateWSMessageMessage{})
+	l.AddCommand("storagequery", storageQueryHandler, storageQueryMessage{})
+	l.AddCommand("stats", statsHandler, statsMessage{})
+	l.AddCommand("sitemap", siteMapHandler, siteMapMessage{})
+	l.AddCommand("validatequery", validateQueryHandler, validateQueryMessage{})
+	l.AddCommand("checkrequest", checkRequestHandler, checkRequestMessage{})
+	l.AddCommand("setscope", setScopeHandler, setScopeMessage{})
+	l.AddCommand("viewscope", viewScopeHandler, emptyMessage{})
+	l.AddCommand("addtag", addTagHandler, addTagMessage{})
+	l.AddCommand("removetag", removeTagHandler, removeTagMessage{})
+	l.AddCommand("cleartag", clearTagHandler, clearTagsMessage{})
+	l.AddCommand("setnote", setNoteHandler, setNoteMessage{})
+	l.AddCommand("sethighlight", setHighlightHandler, setHighlightMessage{})
+	l.AddCommand("setreviewed", setReviewedHandler, setReviewedMessage{})
+	l.AddCommand("intercept", interceptHandler, interceptMessage{})
+	l.AddCommand("allsavedqueries", allSavedQueriesHandler, allSavedQueriesMessage{})
+	l.AddCommand("savequery", saveQueryHandler, saveQueryMessage{})
+	l.AddCommand("loadquery", loadQueryHandler, loadQueryMessage{})
+	l.AddCommand("deletequery", deleteQueryHandler, deleteQueryMessage{})
+	l.AddCommand("addlistener", addListenerHandler, addListenerMessage{})
+	l.AddCommand("removelistener", removeListenerHandler, removeListenerMessage{})
+	l.AddCommand("getlisteners", getListenersHandler, emptyMessage{})
+	l.AddCommand("loadcerts", loadCertificatesHandler, loadCertificatesMessage{})
+	l.AddCommand("setcerts", setCertificatesHandler, setCertificatesMessage{})
+	l.AddCommand("clearcerts", clearCertificatesHandler, emptyMessage{})
+	l.AddCommand("gencerts", generateCertificatesHandler, generateCertificatesMessage{})
+	l.AddCommand("genpemcerts", generatePEMCertificatesHandler, generateCertificatesMessage{})
+	l.AddCommand("addsqlitestorage", addSQLiteStorageHandler, addSQLiteStorageMessage{})
+	l.AddCommand("addinmemorystorage", addInMemoryStorageHandler, addInMemoryStorageMessage{})
+	l.AddCommand("addjsonlstorage", addJSONLStorageHandler, addJSONLStorageMessage{})
+	l.AddCommand("closestorage", closeStorageHandler, closeStorageMessage{})
+	l.AddCommand("rekeystorage", rekeyStorageHandler, rekeyStorageMessage{})
+	l.AddCommand("setproxystorage", setProxyStorageHandler, setProxyStorageMessage{})
+	l.AddCommand("liststorage", listProxyStorageHandler, emptyMessage{})
+	l.AddCommand("setproxy", setProxyHandler, setProxyMessage{})
+	l.AddCommand("watchstorage", watchStorageHandler, watchStorageMessage{})
+	l.AddCommand("subscribequery", subscribeQueryHandler, subscribeQueryMessage{})
+	l.AddCommand("setpluginvalue", setPluginValueHandler, setPluginValueMessage{})
+	l.AddCommand("getpluginvalue", getPluginValueHandler, getPluginValueMessage{})
+	l.AddCommand("import", importHandler, importMessage{})
+	l.AddCommand("export", exportHandler, exportMessage{})
+	l.AddCommand("copyrequests", copyRequestsHandler, copyRequestsMessage{})
 
 	return l
 }
 
+// The message of commands that don't have any fields
+type emptyMessage struct{}
+
 // JSON data representing a ProxyRequest
 type RequestJSON struct {
 	DestHost   string
@@ -74,15 +104,57 @@ type RequestJSON struct {
 	Body       string
 	Tags       []string
 
+	Note      string `json:"Note,omitempty"`
+	Highlight string `json:"Highlight,omitempty"`
+	Reviewed  bool   `json:"Reviewed,omitempty"`
+
 	StartTime int64 `json:"StartTime,omitempty"`
 	EndTime   int64 `json:"EndTime,omitempty"`
 
+	Timings *TimingsJSON `json:"Timings,omitempty"`
+
 	Unmangled  *RequestJSON     `json:"Unmangled,omitempty"`
 	Response   *ResponseJSON    `json:"Response,omitempty"`
 	WSMessages []*WSMessageJSON `json:"WSMessages,omitempty"`
 	DbId       string           `json:"DbId,omitempty"`
 }
 
+// JSON data representing the RequestTimings of a request. All values are in nanoseconds.
+type TimingsJSON struct {
+	DNS             int64
+	Connect         int64
+	ProxyConnect    int64
+	TLSHandshake    int64
+	TimeToFirstByte int64
+	Transfer        int64
+	Total           int64
+}
+
+// Convert RequestTimings into JSON data
+func NewTimingsJSON(timings RequestTimings) *TimingsJSON {
+	return &TimingsJSON{
+		DNS:             int64(timings.DNS),
+		Connect:         int64(timings.Connect),
+		ProxyConnect:    int64(timings.ProxyConnect),
+		TLSHandshake:    int64(timings.TLSHandshake),
+		TimeToFirstByte: int64(timings.TimeToFirstByte),
+		Transfer:        int64(timings.Transfer),
+		Total:           int64(timings.Total()),
+	}
+}
+
+// Convert TimingsJSON into RequestTimings. Total is ignored since it is derived from the other values.
+func (td *TimingsJSON) Parse() RequestTimings {
+	return RequestTimings{
+		DNS:             time.Duration(td.DNS),
+		Connect:         time.Duration(td.Connect),
+		ProxyConnect:    time.Duration(td.ProxyConnect),
+		TLSHandshake:    time.Duration(td.TLSHandshake),
+		TimeToFirstByte: time.Duration(td.TimeToFirstByte),
+		Transfer:        time.Duration(td.Transfer),
+	}
+}
+
 // JSON data representing a ProxyResponse
 type ResponseJSON struct {
 	ProtoMajor int
@@ -174,6 +246,12 @@ func (reqd *RequestJSON) Parse() (*ProxyRequest, error) {
 	for _, tag := range reqd.Tags {
 		req.AddTag(tag)
 	}
+	req.Note = reqd.Note
+	req.Highlight = reqd.Highlight
+	req.Reviewed = reqd.Reviewed
+	if reqd.Timings != nil {
+		req.Timings = reqd.Timings.Parse()
+	}
 
 	if reqd.Response != nil {
 		rsp, err := reqd.Response.Parse()
@@ -195,8 +273,11 @@ func (reqd *RequestJSON) Parse() (*ProxyRequest, error) {
 	return req, nil
 }
 
-// Convert a ProxyRequest into JSON data. If headersOnly is true, the JSON data will only contain the headers and metadata of the message
+// Convert a ProxyRequest into JSON data. If headersOnly is true, the JSON data will only contain the headers and metadata of the message. Returns nil if req is nil.
 func NewRequestJSON(req *ProxyRequest, headersOnly bool) *RequestJSON {
+	if req == nil {
+		return nil
+	}
 
 	newHeaders := make(map[string][]string)
 	for k, vs := range req.Header {
@@ -237,6 +318,10 @@ func NewRequestJSON(req *ProxyRequest, headersOnly bool) *RequestJSON {
 		Headers:    newHeaders,
 		Tags:       req.Tags(),
 
+		Note:      req.Note,
+		Highlight: req.Highlight,
+		Reviewed:  req.Reviewed,
+
 		StartTime: req.StartDatetime.UnixNano(),
 		EndTime:   req.EndDatetime.UnixNano(),
 
@@ -245,6 +330,9 @@ func NewRequestJSON(req *ProxyRequest, headersOnly bool) *RequestJSON {
 		WSMessages: wsms,
 		DbId:       req.DbId,
 	}
+	if req.Timings != (RequestTimings{}) {
+		ret.Timings = NewTimingsJSON(req.Timings)
+	}
 	if !headersOnly {
 		ret.Body = base64.StdEncoding.EncodeToString(req.BodyBytes())
 	}
@@ -561,240 +649,962 @@ func saveNewHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *Intercepti
 }
 
 /*
-QueryRequests
+Message management
 */
-type storageQueryMessage struct {
-	Query       StrMessageQuery
+
+// Returns the storage with the given id from a message
+func messageStorage(iproxy *InterceptingProxy, storageId int) (MessageStorage, error) {
+	if storageId == 0 {
+		return nil, errors.New("storage is required")
+	}
+	storage, _ := iproxy.GetMessageStorage(storageId)
+	if storage == nil {
+		return nil, fmt.Errorf("storage with id %d does not exist", storageId)
+	}
+	return storage, nil
+}
+
+type loadRequestMessage struct {
+	ReqId       string
 	HeadersOnly bool
-	MaxResults  int64
 	Storage     int
 }
 
-type storageQueryResult struct {
+type loadRequestResult struct {
 	Success bool
-	Results []*RequestJSON
+	Request *RequestJSON
 }
 
-func storageQueryHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
-	mreq := storageQueryMessage{
-		Query:       nil,
-		HeadersOnly: false,
-		MaxResults:  0,
-	}
+func loadRequestHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
+	respondLoadRequest(b, c, iproxy, false)
+}
+
+func loadUnmangledRequestHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
+	respondLoadRequest(b, c, iproxy, true)
+}
 
+// Loads a request or its unmangled version. The loaded request includes its response, websocket messages and unmangled versions.
+func respondLoadRequest(b []byte, c net.Conn, iproxy *InterceptingProxy, unmangled bool) {
+	mreq := loadRequestMessage{}
 	if err := json.Unmarshal(b, &mreq); err != nil {
-		ErrorResponse(c, "error parsing query message")
+		ErrorResponse(c, fmt.Sprintf("error parsing message: %s", err.Error()))
 		return
 	}
 
-	if mreq.Query == nil {
-		ErrorResponse(c, "query is required")
+	storage, err := messageStorage(iproxy, mreq.Storage)
+	if err != nil {
+		ErrorResponse(c, err.Error())
 		return
 	}
-
-	if mreq.Storage == 0 {
-		ErrorResponse(c, "storage is required")
+	if mreq.ReqId == "" {
+		ErrorResponse(c, "request id is required")
 		return
 	}
 
-	storage, _ := iproxy.GetMessageStorage(mreq.Storage)
-	if storage == nil {
-		ErrorResponse(c, fmt.Sprintf("storage with id %d does not exist", mreq.Storage))
+	var req *ProxyRequest
+	if unmangled {
+		req, err = storage.LoadUnmangledRequest(mreq.ReqId)
+	} else {
+		req, err = storage.LoadRequest(mreq.ReqId)
+	}
+	if err != nil {
+		ErrorResponse(c, fmt.Sprintf("error loading request: %s", err.Error()))
 		return
 	}
 
-	var searchResults []*ProxyRequest
-	if len(mreq.Query) == 1 && len(mreq.Query[0]) == 1 {
-		args, err := CheckArgsStrToGo(mreq.Query[0][0])
-		if err != nil {
-			ErrorResponse(c, err.Error())
-			return
-		}
-		logger.Println("Search query is one phrase, sending directly to storage...")
-		searchResults, err = storage.Search(mreq.MaxResults, args...)
-		if err != nil {
-			ErrorResponse(c, err.Error())
-			return
-		}
-	} else {
-		logger.Println("Search query is multple sets of arguments, creating checker and checking naively...")
-		goQuery, err := StrQueryToMsgQuery(mreq.Query)
-		if err != nil {
-			ErrorResponse(c, err.Error())
-			return
-		}
-
-		checker, err := CheckerFromMessageQuery(goQuery)
-		if err != nil {
-			ErrorResponse(c, err.Error())
-			return
-		}
+	MessageResponse(c, &loadRequestResult{
+		Success: true,
+		Request: NewRequestJSON(req, mreq.HeadersOnly),
+	})
+}
 
-		searchResults, err = storage.CheckRequests(mreq.MaxResults, checker)
-		if err != nil {
-			ErrorResponse(c, err.Error())
-			return
-		}
-	}
+type loadResponseMessage struct {
+	RspId       string
+	HeadersOnly bool
+	Storage     int
+}
 
-	var result storageQueryResult
-	reqResults := make([]*RequestJSON, len(searchResults))
-	for i, req := range searchResults {
-		reqResults[i] = NewRequestJSON(req, mreq.HeadersOnly)
-	}
-	result.Success = true
-	result.Results = reqResults
-	MessageResponse(c, &result)
+type loadResponseResult struct {
+	Success  bool
+	Response *ResponseJSON
 }
 
-/*
-ValidateQuery
-*/
+func loadResponseHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
+	respondLoadResponse(b, c, iproxy, false)
+}
 
-type validateQueryMessage struct {
-	Query StrMessageQuery
+func loadUnmangledResponseHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
+	respondLoadResponse(b, c, iproxy, true)
 }
 
-func validateQueryHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
-	mreq := validateQueryMessage{}
+// Loads a response or its unmangled version
+func respondLoadResponse(b []byte, c net.Conn, iproxy *InterceptingProxy, unmangled bool) {
+	mreq := loadResponseMessage{}
 	if err := json.Unmarshal(b, &mreq); err != nil {
-		ErrorResponse(c, "error parsing query message")
+		ErrorResponse(c, fmt.Sprintf("error parsing message: %s", err.Error()))
 		return
 	}
 
-	goQuery, err := StrQueryToMsgQuery(mreq.Query)
+	storage, err := messageStorage(iproxy, mreq.Storage)
 	if err != nil {
 		ErrorResponse(c, err.Error())
 		return
 	}
+	if mreq.RspId == "" {
+		ErrorResponse(c, "response id is required")
+		return
+	}
 
-	_, err = CheckerFromMessageQuery(goQuery)
+	var rsp *ProxyResponse
+	if unmangled {
+		rsp, err = storage.LoadUnmangledResponse(mreq.RspId)
+	} else {
+		rsp, err = storage.LoadResponse(mreq.RspId)
+	}
 	if err != nil {
-		ErrorResponse(c, err.Error())
+		ErrorResponse(c, fmt.Sprintf("error loading response: %s", err.Error()))
 		return
 	}
-	MessageResponse(c, &successResult{Success: true})
+
+	MessageResponse(c, &loadResponseResult{
+		Success:  true,
+		Response: NewResponseJSON(rsp, mreq.HeadersOnly),
+	})
 }
 
-/*
-CheckRequest
-*/
+type loadWSMessageMessage struct {
+	WSId    string
+	Storage int
+}
 
-type checkRequestMessage struct {
-	Query       StrMessageQuery
-	Request     *RequestJSON
-	DbId        string
-	StorageId   int
+type loadWSMessageResult struct {
+	Success   bool
+	WSMessage *WSMessageJSON
 }
 
-type checkRequestResponse struct {
-	Result  bool
-	Success bool
+func loadWSMessageHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
+	respondLoadWSMessage(b, c, iproxy, false)
 }
 
-func checkRequestHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
-	mreq := checkRequestMessage{}
+func loadUnmangledWSMessageHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
+	respondLoadWSMessage(b, c, iproxy, true)
+}
+
+// Loads a websocket message or its unmangled version
+func respondLoadWSMessage(b []byte, c net.Conn, iproxy *InterceptingProxy, unmangled bool) {
+	mreq := loadWSMessageMessage{}
 	if err := json.Unmarshal(b, &mreq); err != nil {
-		ErrorResponse(c, "error parsing query message")
+		ErrorResponse(c, fmt.Sprintf("error parsing message: %s", err.Error()))
 		return
 	}
 
-	var req *ProxyRequest
-	var err error
+	storage, err := messageStorage(iproxy, mreq.Storage)
+	if err != nil {
+		ErrorResponse(c, err.Error())
+		return
+	}
+	if mreq.WSId == "" {
+		ErrorResponse(c, "websocket message id is required")
+		return
+	}
 
-	if mreq.DbId != "" {
-		storage, _ := iproxy.GetMessageStorage(mreq.StorageId)
-		if storage == nil {
-			ErrorResponse(c, fmt.Sprintf("storage with id %d does not exist", mreq.StorageId))
-			return
-		}
-		searchResults, err := storage.Search(1, FieldId, StrIs, mreq.DbId)
-		if err != nil {
-			ErrorResponse(c, err.Error())
-			return
-		}
-	    if len(searchResults) == 0 {
-			ErrorResponse(c, fmt.Sprintf("message with id=%s does not exist", mreq.DbId))
-			return
-		}
-		req = searchResults[0]
+	var wsm *ProxyWSMessage
+	if unmangled {
+		wsm, err = storage.LoadUnmangledWSMessage(mreq.WSId)
 	} else {
-		req, err = mreq.Request.Parse()
-		if err != nil {
-			ErrorResponse(c, fmt.Sprintf("error parsing http request: %s", err.Error()))
-			return
-		}
+		wsm, err = storage.LoadWSMessage(mreq.WSId)
 	}
-
-	goQuery, err := StrQueryToMsgQuery(mreq.Query)
 	if err != nil {
-		ErrorResponse(c, err.Error())
+		ErrorResponse(c, fmt.Sprintf("error loading websocket message: %s", err.Error()))
 		return
 	}
 
-	checker, err := CheckerFromMessageQuery(goQuery)
+	MessageResponse(c, &loadWSMessageResult{
+		Success:   true,
+		WSMessage: NewWSMessageJSON(wsm),
+	})
+}
+
+// Deletes a message after checking that it exists so that watchers are not told about deleting messages that don't exist
+func deleteMessage(c net.Conn, iproxy *InterceptingProxy, storageId int, kind string, id string, load func(MessageStorage, string) error, del func(MessageStorage, string) error) {
+	storage, err := messageStorage(iproxy, storageId)
 	if err != nil {
 		ErrorResponse(c, err.Error())
 		return
 	}
+	if id == "" {
+		ErrorResponse(c, fmt.Sprintf("%s id is required", kind))
+		return
+	}
+	if err := load(storage, id); err != nil {
+		ErrorResponse(c, fmt.Sprintf("error loading %s: %s", kind, err.Error()))
+		return
+	}
+	if err := del(storage, id); err != nil {
+		ErrorResponse(c, fmt.Sprintf("error deleting %s: %s", kind, err.Error()))
+		return
+	}
+	MessageResponse(c, &successResult{Success: true})
+}
 
-	result := &checkRequestResponse{
-		Success: true,
-		Result:  checker(req),
+type deleteRequestMessage struct {
+	ReqId   string
+	Storage int
+}
+
+// Deletes a request along with its response, websocket messages and unmangled versions
+func deleteRequestHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
+	mreq := deleteRequestMessage{}
+	if err := json.Unmarshal(b, &mreq); err != nil {
+		ErrorResponse(c, fmt.Sprintf("error parsing message: %s", err.Error()))
+		return
+	}
+	deleteMessage(c, iproxy, mreq.Storage, "request", mreq.ReqId,
+		func(ms MessageStorage, id string) error {
+			_, err := ms.LoadRequest(id)
+			return err
+		},
+		func(ms MessageStorage, id string) error {
+			return ms.DeleteRequest(id)
+		})
+}
+
+type deleteResponseMessage struct {
+	RspId   string
+	Storage int
+}
+
+func deleteResponseHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
+	mreq := deleteResponseMessage{}
+	if err := json.Unmarshal(b, &mreq); err != nil {
+		ErrorResponse(c, fmt.Sprintf("error parsing message: %s", err.Error()))
+		return
 	}
+	deleteMessage(c, iproxy, mreq.Storage, "response", mreq.RspId,
+		func(ms MessageStorage, id string) error {
+			_, err := ms.LoadResponse(id)
+			return err
+		},
+		func(ms MessageStorage, id string) error {
+			return ms.DeleteResponse(id)
+		})
+}
 
-	MessageResponse(c, result)
+type deleteWSMessageMessage struct {
+	WSId    string
+	Storage int
 }
 
-/*
-SetScope
-*/
+func deleteWSMessageHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
+	mreq := deleteWSMessageMessage{}
+	if err := json.Unmarshal(b, &mreq); err != nil {
+		ErrorResponse(c, fmt.Sprintf("error parsing message: %s", err.Error()))
+		return
+	}
+	deleteMessage(c, iproxy, mreq.Storage, "websocket message", mreq.WSId,
+		func(ms MessageStorage, id string) error {
+			_, err := ms.LoadWSMessage(id)
+			return err
+		},
+		func(ms MessageStorage, id string) error {
+			return ms.DeleteWSMessage(id)
+		})
+}
 
-type setScopeMessage struct {
-	Query StrMessageQuery
+type updateRequestMessage struct {
+	ReqId   string
+	Request *RequestJSON
+	Storage int
 }
 
-func setScopeHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
-	mreq := setScopeMessage{}
+type updateRequestResult struct {
+	Success bool
+	Request *RequestJSON
+}
 
+// Replaces the contents of a stored request. The request keeps its id, response, websocket messages, unmangled version, tags, annotations and times.
+func updateRequestHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
+	mreq := updateRequestMessage{}
 	if err := json.Unmarshal(b, &mreq); err != nil {
-		ErrorResponse(c, "error parsing query message")
+		ErrorResponse(c, fmt.Sprintf("error parsing message: %s", err.Error()))
 		return
 	}
 
-	goQuery, err := StrQueryToMsgQuery(mreq.Query)
+	storage, err := messageStorage(iproxy, mreq.Storage)
 	if err != nil {
 		ErrorResponse(c, err.Error())
 		return
 	}
+	if mreq.ReqId == "" {
+		ErrorResponse(c, "request id is required")
+		return
+	}
+	if mreq.Request == nil {
+		ErrorResponse(c, "request is required")
+		return
+	}
 
-	err = iproxy.SetScopeQuery(goQuery)
+	old, err := storage.LoadRequest(mreq.ReqId)
 	if err != nil {
-		ErrorResponse(c, err.Error())
+		ErrorResponse(c, fmt.Sprintf("error loading request: %s", err.Error()))
 		return
 	}
 
-	MessageResponse(c, &successResult{Success: true})
-}
+	CleanReqJSON(mreq.Request)
+	req, err := mreq.Request.Parse()
+	if err != nil {
+		ErrorResponse(c, fmt.Sprintf("error parsing request: %s", err.Error()))
+		return
+	}
+	req.DbId = old.DbId
+	req.ServerResponse = old.ServerResponse
+	req.WSMessages = old.WSMessages
+	req.Unmangled = old.Unmangled
+	req.StartDatetime = old.StartDatetime
+	req.EndDatetime = old.EndDatetime
+	req.Timings = old.Timings
+	req.Note = old.Note
+	req.Highlight = old.Highlight
+	req.Reviewed = old.Reviewed
+	req.ClearTags()
+	for _, tag := range old.Tags() {
+		req.AddTag(tag)
+	}
 
-/*
-ViewScope
-*/
+	// Only the request itself changed so its dependent messages are not saved again
+	if err := storage.UpdateRequest(req); err != nil {
+		ErrorResponse(c, fmt.Sprintf("error saving request: %s", err.Error()))
+		return
+	}
 
-type viewScopeMessage struct {
+	MessageResponse(c, &updateRequestResult{
+		Success: true,
+		Request: NewRequestJSON(req, false),
+	})
 }
 
-type viewScopeResult struct {
+type updateResponseMessage struct {
+	RspId    string
+	Response *ResponseJSON
+	Storage  int
+}
+
+type updateResponseResult struct {
 	Success  bool
-	IsCustom bool
-	Query    StrMessageQuery
+	Response *ResponseJSON
 }
 
-func viewScopeHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
+// Replaces the contents of a stored response. The response keeps its id and unmangled version.
+func updateResponseHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
+	mreq := updateResponseMessage{}
+	if err := json.Unmarshal(b, &mreq); err != nil {
+		ErrorResponse(c, fmt.Sprintf("error parsing message: %s", err.Error()))
+		return
+	}
+
+	storage, err := messageStorage(iproxy, mreq.Storage)
+	if err != nil {
+		ErrorResponse(c, err.Error())
+		return
+	}
+	if mreq.RspId == "" {
+		ErrorResponse(c, "response id is required")
+		return
+	}
+	if mreq.Response == nil {
+		ErrorResponse(c, "response is required")
+		return
+	}
+
+	old, err := storage.LoadResponse(mreq.RspId)
+	if err != nil {
+		ErrorResponse(c, fmt.Sprintf("error loading response: %s", err.Error()))
+		return
+	}
+
+	CleanRspJSON(mreq.Response)
+	rsp, err := mreq.Response.Parse()
+	if err != nil {
+		ErrorResponse(c, fmt.Sprintf("error parsing response: %s", err.Error()))
+		return
+	}
+	rsp.DbId = old.DbId
+	rsp.Unmangled = old.Unmangled
+
+	if err := storage.UpdateResponse(rsp); err != nil {
+		ErrorResponse(c, fmt.Sprintf("error saving response: %s", err.Error()))
+		return
+	}
+
+	MessageResponse(c, &updateResponseResult{
+		Success:  true,
+		Response: NewResponseJSON(rsp, false),
+	})
+}
+
+type updateWSMessageMessage struct {
+	// The request of the websocket session that the message was sent over
+	ReqId     string
+	WSId      string
+	WSMessage *WSMessageJSON
+	Storage   int
+}
+
+type updateWSMessageResult struct {
+	Success   bool
+	WSMessage *WSMessageJSON
+}
+
+// Replaces the contents and type of a stored websocket message. The message keeps its id, direction, timestamp and unmangled version.
+func updateWSMessageHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
+	mreq := updateWSMessageMessage{}
+	if err := json.Unmarshal(b, &mreq); err != nil {
+		ErrorResponse(c, fmt.Sprintf("error parsing message: %s", err.Error()))
+		return
+	}
+
+	storage, err := messageStorage(iproxy, mreq.Storage)
+	if err != nil {
+		ErrorResponse(c, err.Error())
+		return
+	}
+	if mreq.ReqId == "" || mreq.WSId == "" {
+		ErrorResponse(c, "both request id and websocket message id are required")
+		return
+	}
+	if mreq.WSMessage == nil {
+		ErrorResponse(c, "websocket message is required")
+		return
+	}
+
+	req, err := storage.LoadRequest(mreq.ReqId)
+	if err != nil {
+		ErrorResponse(c, fmt.Sprintf("error loading request: %s", err.Error()))
+		return
+	}
+
+	// Find the message in the session. Unmangled versions are the record of what was originally sent and can't be updated.
+	var old *ProxyWSMessage
+	for _, wsm := range req.WSMessages {
+		if wsm.DbId == mreq.WSId {
+			old = wsm
+			break
+		}
+		for m := wsm.Unmangled; m != nil; m = m.Unmangled {
+			if m.DbId == mreq.WSId {
+				ErrorResponse(c, fmt.Sprintf("websocket message %s is an unmangled version and can't be updated", mreq.WSId))
+				return
+			}
+		}
+	}
+	if old == nil {
+		ErrorResponse(c, fmt.Sprintf("request %s does not have a websocket message with id %s", mreq.ReqId, mreq.WSId))
+		return
+	}
+
+	CleanWSJSON(mreq.WSMessage)
+	wsm, err := mreq.WSMessage.Parse()
+	if err != nil {
+		ErrorResponse(c, fmt.Sprintf("error parsing websocket message: %s", err.Error()))
+		return
+	}
+	wsm.DbId = old.DbId
+	wsm.Direction = old.Direction
+	wsm.Timestamp = old.Timestamp
+	wsm.Unmangled = old.Unmangled
+
+	if err := storage.UpdateWSMessage(req, wsm); err != nil {
+		ErrorResponse(c, fmt.Sprintf("error saving websocket message: %s", err.Error()))
+		return
+	}
+
+	MessageResponse(c, &updateWSMessageResult{
+		Success:   true,
+		WSMessage: NewWSMessageJSON(wsm),
+	})
+}
+
+/*
+QueryRequests
+*/
+type storageQueryMessage struct {
+	Query       StrMessageQuery
+	Expr        *StrQueryExpr
+	HeadersOnly bool
+	MaxResults  int64
+	Storage     int
+}
+
+type storageQueryResult struct {
+	Success bool
+	Results []*RequestJSON
+}
+
+func storageQueryHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
+	mreq := storageQueryMessage{
+		Query:       nil,
+		HeadersOnly: false,
+		MaxResults:  0,
+	}
+
+	if err := json.Unmarshal(b, &mreq); err != nil {
+		ErrorResponse(c, fmt.Sprintf("error parsing query message: %s", err.Error()))
+		return
+	}
+
+	if mreq.Query == nil && mreq.Expr == nil {
+		ErrorResponse(c, "query is required")
+		return
+	}
+
+	if mreq.Storage == 0 {
+		ErrorResponse(c, "storage is required")
+		return
+	}
+
+	storage, _ := iproxy.GetMessageStorage(mreq.Storage)
+	if storage == nil {
+		ErrorResponse(c, fmt.Sprintf("storage with id %d does not exist", mreq.Storage))
+		return
+	}
+
+	var searchResults []*ProxyRequest
+	if mreq.Expr != nil {
+		checker, err := checkerFromStrQueryOrExpr(storage, mreq.Query, mreq.Expr)
+		if err != nil {
+			ErrorResponse(c, err.Error())
+			return
+		}
+
+		searchResults, err = storage.CheckRequests(mreq.MaxResults, checker)
+		if err != nil {
+			ErrorResponse(c, err.Error())
+			return
+		}
+	} else if len(mreq.Query) == 1 && len(mreq.Query[0]) == 1 {
+		args, err := CheckArgsStrToGo(mreq.Query[0][0])
+		if err != nil {
+			ErrorResponse(c, err.Error())
+			return
+		}
+		logger.Println("Search query is one phrase, sending directly to storage...")
+		searchResults, err = storage.Search(mreq.MaxResults, args...)
+		if err != nil {
+			ErrorResponse(c, err.Error())
+			return
+		}
+	} else {
+		logger.Println("Search query is multple sets of arguments, creating checker and checking naively...")
+		goQuery, err := StrQueryToMsgQuery(mreq.Query)
+		if err != nil {
+			ErrorResponse(c, err.Error())
+			return
+		}
+
+		checker, err := StorageCheckerFromMessageQuery(storage, goQuery)
+		if err != nil {
+			ErrorResponse(c, err.Error())
+			return
+		}
+
+		searchResults, err = storage.CheckRequests(mreq.MaxResults, checker)
+		if err != nil {
+			ErrorResponse(c, err.Error())
+			return
+		}
+	}
+
+	var result storageQueryResult
+	reqResults := make([]*RequestJSON, len(searchResults))
+	for i, req := range searchResults {
+		reqResults[i] = NewRequestJSON(req, mreq.HeadersOnly)
+	}
+	result.Success = true
+	result.Results = reqResults
+	MessageResponse(c, &result)
+}
+
+// Returns a RequestChecker for a message that takes either a query or a query expression. A nil query and expression match every request. If ms is not nil, references to saved queries are loaded from it.
+func checkerFromStrQueryOrExpr(ms MessageStorage, query StrMessageQuery, expr *StrQueryExpr) (RequestChecker, error) {
+	if query != nil && expr != nil {
+		return nil, errors.New("only one of a query and a query expression can be given")
+	}
+
+	if expr != nil {
+		goExpr, err := StrExprToQueryExpr(expr)
+		if err != nil {
+			return nil, err
+		}
+		if ms != nil {
+			return StorageCheckerFromQueryExpr(ms, goExpr)
+		}
+		return CheckerFromQueryExpr(goExpr)
+	}
+
+	goQuery, err := StrQueryToMsgQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if ms != nil {
+		return StorageCheckerFromMessageQuery(ms, goQuery)
+	}
+	return CheckerFromMessageQuery(goQuery)
+}
+
+/*
+Stats
+*/
+
+type statsMessage struct {
+	Query      StrMessageQuery
+	Expr       *StrQueryExpr
+	GroupBy    string
+	MaxResults int
+	Storage    int
+}
+
+// JSON data representing the statistics for a group of requests. Durations are in nanoseconds.
+type RequestStatsJSON struct {
+	Key             string
+	Count           int64
+	Responses       int64
+	Timed           int64
+	TotalDuration   int64
+	AverageDuration int64
+	RequestBytes    int64
+	ResponseBytes   int64
+}
+
+type statsResult struct {
+	Success bool
+	Results []*RequestStatsJSON
+}
+
+// Convert RequestStats into JSON data
+func NewRequestStatsJSON(stats *RequestStats) *RequestStatsJSON {
+	return &RequestStatsJSON{
+		Key:             stats.Key,
+		Count:           stats.Count,
+		Responses:       stats.Responses,
+		Timed:           stats.Timed,
+		TotalDuration:   int64(stats.TotalDuration),
+		AverageDuration: int64(stats.AverageDuration()),
+		RequestBytes:    stats.RequestBytes,
+		ResponseBytes:   stats.ResponseBytes,
+	}
+}
+
+// Returns the MessageQuery for a message that takes either a query or a query expression. A nil query and expression match every request.
+func msgQueryFromStrQueryOrExpr(query StrMessageQuery, expr *StrQueryExpr) (MessageQuery, error) {
+	if query != nil && expr != nil {
+		return nil, errors.New("only one of a query and a query expression can be given")
+	}
+
+	if expr != nil {
+		goExpr, err := StrExprToQueryExpr(expr)
+		if err != nil {
+			return nil, err
+		}
+		return MessageQueryFromExpr(goExpr)
+	}
+	return StrQueryToMsgQuery(query)
+}
+
+func statsHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
+	mreq := statsMessage{}
+	if err := json.Unmarshal(b, &mreq); err != nil {
+		ErrorResponse(c, fmt.Sprintf("error parsing stats message: %s", err.Error()))
+		return
+	}
+
+	if mreq.Storage == 0 {
+		ErrorResponse(c, "storage is required")
+		return
+	}
+
+	storage, _ := iproxy.GetMessageStorage(mreq.Storage)
+	if storage == nil {
+		ErrorResponse(c, fmt.Sprintf("storage with id %d does not exist", mreq.Storage))
+		return
+	}
+
+	group, err := statsGroupStrToGo(mreq.GroupBy)
+	if err != nil {
+		ErrorResponse(c, err.Error())
+		return
+	}
+
+	query, err := msgQueryFromStrQueryOrExpr(mreq.Query, mreq.Expr)
+	if err != nil {
+		ErrorResponse(c, err.Error())
+		return
+	}
+
+	stats, err := storage.RequestStats(query, group)
+	if err != nil {
+		ErrorResponse(c, err.Error())
+		return
+	}
+	if mreq.MaxResults > 0 && len(stats) > mreq.MaxResults {
+		stats = stats[:mreq.MaxResults]
+	}
+
+	result := &statsResult{Success: true, Results: make([]*RequestStatsJSON, len(stats))}
+	for i, groupStats := range stats {
+		result.Results[i] = NewRequestStatsJSON(groupStats)
+	}
+	MessageResponse(c, result)
+}
+
+/*
+SiteMap
+*/
+
+type siteMapMessage struct {
+	Query   StrMessageQuery
+	Expr    *StrQueryExpr
+	InScope bool
+	Depth   int
+	Storage int
+}
+
+type siteMapResult struct {
+	Success bool
+	Root    *SiteMapNode
+}
+
+func siteMapHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
+	mreq := siteMapMessage{}
+	if err := json.Unmarshal(b, &mreq); err != nil {
+		ErrorResponse(c, fmt.Sprintf("error parsing site map message: %s", err.Error()))
+		return
+	}
+
+	if mreq.Storage == 0 {
+		ErrorResponse(c, "storage is required")
+		return
+	}
+
+	query, err := msgQueryFromStrQueryOrExpr(mreq.Query, mreq.Expr)
+	if err != nil {
+		ErrorResponse(c, err.Error())
+		return
+	}
+
+	sm, err := iproxy.GetSiteMap(mreq.Storage, query, mreq.InScope)
+	if err != nil {
+		ErrorResponse(c, err.Error())
+		return
+	}
+
+	MessageResponse(c, &siteMapResult{Success: true, Root: sm.Tree(mreq.Depth)})
+}
+
+/*
+ValidateQuery
+*/
+
+type validateQueryMessage struct {
+	Query StrMessageQuery
+	Expr  *StrQueryExpr
+	// The storage to load referenced saved queries from. Queries that reference saved queries are invalid if it is not given
+	Storage int
+}
+
+type validateQueryResult struct {
+	Success bool
+	Text    string
+}
+
+func validateQueryHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
+	mreq := validateQueryMessage{}
+	if err := json.Unmarshal(b, &mreq); err != nil {
+		ErrorResponse(c, fmt.Sprintf("error parsing query message: %s", err.Error()))
+		return
+	}
+
+	var storage MessageStorage
+	if mreq.Storage != 0 {
+		storage, _ = iproxy.GetMessageStorage(mreq.Storage)
+		if storage == nil {
+			ErrorResponse(c, fmt.Sprintf("storage with id %d does not exist", mreq.Storage))
+			return
+		}
+	}
+
+	_, err := checkerFromStrQueryOrExpr(storage, mreq.Query, mreq.Expr)
+	if err != nil {
+		ErrorResponse(c, err.Error())
+		return
+	}
+
+	var text string
+	if mreq.Expr != nil {
+		text, err = FormatStrQueryExpr(mreq.Expr)
+	} else {
+		text, err = FormatStrQuery(mreq.Query)
+	}
+	if err != nil {
+		ErrorResponse(c, err.Error())
+		return
+	}
+	MessageResponse(c, &validateQueryResult{Success: true, Text: text})
+}
+
+/*
+CheckRequest
+*/
+
+type checkRequestMessage struct {
+	Query       StrMessageQuery
+	Expr        *StrQueryExpr
+	Request     *RequestJSON
+	DbId        string
+	StorageId   int
+}
+
+type checkRequestResponse struct {
+	Result  bool
+	Success bool
+}
+
+func checkRequestHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
+	mreq := checkRequestMessage{}
+	if err := json.Unmarshal(b, &mreq); err != nil {
+		ErrorResponse(c, fmt.Sprintf("error parsing query message: %s", err.Error()))
+		return
+	}
+
+	var req *ProxyRequest
+	var err error
+
+	var storage MessageStorage
+	if mreq.StorageId != 0 {
+		storage, _ = iproxy.GetMessageStorage(mreq.StorageId)
+	}
+
+	if mreq.DbId != "" {
+		if storage == nil {
+			ErrorResponse(c, fmt.Sprintf("storage with id %d does not exist", mreq.StorageId))
+			return
+		}
+		searchResults, err := storage.Search(1, FieldId, StrIs, mreq.DbId)
+		if err != nil {
+			ErrorResponse(c, err.Error())
+			return
+		}
+	    if len(searchResults) == 0 {
+			ErrorResponse(c, fmt.Sprintf("message with id=%s does not exist", mreq.DbId))
+			return
+		}
+		req = searchResults[0]
+	} else {
+		req, err = mreq.Request.Parse()
+		if err != nil {
+			ErrorResponse(c, fmt.Sprintf("error parsing http request: %s", err.Error()))
+			return
+		}
+	}
+
+	checker, err := checkerFromStrQueryOrExpr(storage, mreq.Query, mreq.Expr)
+	if err != nil {
+		ErrorResponse(c, err.Error())
+		return
+	}
+
+	result := &checkRequestResponse{
+		Success: true,
+		Result:  checker(req),
+	}
+
+	MessageResponse(c, result)
+}
+
+/*
+SetScope
+*/
+
+type setScopeMessage struct {
+	Query StrMessageQuery
+	Expr  *StrQueryExpr
+	// The name of a query saved in the proxy storage to use as the scope
+	SavedQuery string
+}
+
+func setScopeHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
+	mreq := setScopeMessage{}
+
+	if err := json.Unmarshal(b, &mreq); err != nil {
+		ErrorResponse(c, fmt.Sprintf("error parsing query message: %s", err.Error()))
+		return
+	}
+
+	if (mreq.Query != nil && mreq.Expr != nil) || (mreq.SavedQuery != "" && (mreq.Query != nil || mreq.Expr != nil)) {
+		ErrorResponse(c, "only one of a query, a query expression and a saved query can be given")
+		return
+	}
+
+	if mreq.SavedQuery != "" {
+		if err := iproxy.SetScopeSavedQuery(mreq.SavedQuery); err != nil {
+			ErrorResponse(c, err.Error())
+			return
+		}
+		MessageResponse(c, &successResult{Success: true})
+		return
+	}
+
+	if mreq.Expr != nil {
+		goExpr, err := StrExprToQueryExpr(mreq.Expr)
+		if err != nil {
+			ErrorResponse(c, err.Error())
+			return
+		}
+
+		if err := iproxy.SetScopeExpr(goExpr); err != nil {
+			ErrorResponse(c, err.Error())
+			return
+		}
+		MessageResponse(c, &successResult{Success: true})
+		return
+	}
+
+	goQuery, err := StrQueryToMsgQuery(mreq.Query)
+	if err != nil {
+		ErrorResponse(c, err.Error())
+		return
+	}
+
+	err = iproxy.SetScopeQuery(goQuery)
+	if err != nil {
+		ErrorResponse(c, err.Error())
+		return
+	}
+
+	MessageResponse(c, &successResult{Success: true})
+}
+
+/*
+ViewScope
+*/
+
+type viewScopeMessage struct {
+}
+
+type viewScopeResult struct {
+	Success  bool
+	IsCustom bool
+	Query    StrMessageQuery
+	Expr     *StrQueryExpr
+	// Set if the scope is a reference to a saved query
+	SavedQuery string
+}
+
+func viewScopeHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
 	scopeQuery := iproxy.GetScopeQuery()
+	scopeExpr := iproxy.GetScopeExpr()
 	scopeChecker := iproxy.GetScopeChecker()
 
-	if scopeQuery == nil && scopeChecker != nil {
+	if scopeExpr == nil && scopeChecker != nil {
 		MessageResponse(c, &viewScopeResult{
 			Success:  true,
 			IsCustom: true,
@@ -809,10 +1619,19 @@ func viewScopeHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *Intercep
 		return
 	}
 
+	strExpr, err := QueryExprToStrExpr(scopeExpr)
+	if err != nil {
+		ErrorResponse(c, err.Error())
+		return
+	}
+
+	savedQuery, _ := savedQueryRefName(scopeExpr)
 	MessageResponse(c, &viewScopeResult{
-		Success:  true,
-		IsCustom: false,
-		Query:    strQuery,
+		Success:    true,
+		IsCustom:   false,
+		Query:      strQuery,
+		Expr:       strExpr,
+		SavedQuery: savedQuery,
 	})
 }
 
@@ -952,6 +1771,110 @@ func clearTagHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *Intercept
 	MessageResponse(c, &successResult{Success: true})
 }
 
+/*
+Annotations
+*/
+
+// Highlight colors are either a color name or a hex color code
+var highlightRegexp = regexp.MustCompile(`^([a-zA-Z]+|#[0-9a-fA-F]{3}|#[0-9a-fA-F]{6})$`)
+
+// Loads a request, applies a change to it, and saves it back to the storage
+func updateAnnotation(c net.Conn, iproxy *InterceptingProxy, storageId int, reqId string, annotate func(req *ProxyRequest)) {
+	if storageId == 0 {
+		ErrorResponse(c, "storage is required")
+		return
+	}
+
+	storage, _ := iproxy.GetMessageStorage(storageId)
+	if storage == nil {
+		ErrorResponse(c, fmt.Sprintf("storage with id %d does not exist", storageId))
+		return
+	}
+
+	if reqId == "" {
+		ErrorResponse(c, "request id is required")
+		return
+	}
+
+	req, err := storage.LoadRequest(reqId)
+	if err != nil {
+		ErrorResponse(c, fmt.Sprintf("error loading request: %s", err.Error()))
+		return
+	}
+
+	annotate(req)
+	err = UpdateRequest(storage, req)
+	if err != nil {
+		ErrorResponse(c, fmt.Sprintf("error saving request: %s", err.Error()))
+		return
+	}
+
+	MessageResponse(c, &successResult{Success: true})
+}
+
+type setNoteMessage struct {
+	ReqId   string
+	Note    string
+	Storage int
+}
+
+func setNoteHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
+	mreq := setNoteMessage{}
+
+	if err := json.Unmarshal(b, &mreq); err != nil {
+		ErrorResponse(c, fmt.Sprintf("error parsing message: %s", err.Error()))
+		return
+	}
+
+	updateAnnotation(c, iproxy, mreq.Storage, mreq.ReqId, func(req *ProxyRequest) {
+		req.Note = mreq.Note
+	})
+}
+
+type setHighlightMessage struct {
+	ReqId   string
+	Color   string
+	Storage int
+}
+
+func setHighlightHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
+	mreq := setHighlightMessage{}
+
+	if err := json.Unmarshal(b, &mreq); err != nil {
+		ErrorResponse(c, fmt.Sprintf("error parsing message: %s", err.Error()))
+		return
+	}
+
+	// A blank color removes the highlight
+	if mreq.Color != "" && !highlightRegexp.MatchString(mreq.Color) {
+		ErrorResponse(c, fmt.Sprintf("invalid highlight color: %s", mreq.Color))
+		return
+	}
+
+	updateAnnotation(c, iproxy, mreq.Storage, mreq.ReqId, func(req *ProxyRequest) {
+		req.Highlight = mreq.Color
+	})
+}
+
+type setReviewedMessage struct {
+	ReqId    string
+	Reviewed bool
+	Storage  int
+}
+
+func setReviewedHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
+	mreq := setReviewedMessage{}
+
+	if err := json.Unmarshal(b, &mreq); err != nil {
+		ErrorResponse(c, fmt.Sprintf("error parsing message: %s", err.Error()))
+		return
+	}
+
+	updateAnnotation(c, iproxy, mreq.Storage, mreq.ReqId, func(req *ProxyRequest) {
+		req.Reviewed = mreq.Reviewed
+	})
+}
+
 /*
 Intercept
 */
@@ -962,7 +1885,8 @@ type interceptMessage struct {
 	InterceptWS        bool
 
 	UseQuery bool
-	Query    MessageQuery
+	Query    StrMessageQuery
+	Expr     *StrQueryExpr
 }
 
 type intHandshakeResult struct {
@@ -1059,7 +1983,8 @@ func interceptHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *Intercep
 	var checker RequestChecker = nil
 	if mreq.UseQuery {
 		var err error
-		checker, err = CheckerFromMessageQuery(mreq.Query)
+		storage, _ := iproxy.GetMessageStorage(iproxy.proxyStorageId())
+		checker, err = checkerFromStrQueryOrExpr(storage, mreq.Query, mreq.Expr)
 		if err != nil {
 			ErrorResponse(c, fmt.Sprintf("error with message query: %s", err.Error()))
 			return
@@ -1098,7 +2023,7 @@ func interceptHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *Intercep
 			defer removePendingRequest(intReq)
 
 			// submit the request
-			MessageResponse(c, intReq)
+			PushEvent(c, "intercept", intReq)
 
 			// wait for result
 			intRsp, ok := <-intReq.Result
@@ -1156,7 +2081,7 @@ func interceptHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *Intercep
 			defer removePendingRequest(intReq)
 
 			// submit the request
-			MessageResponse(c, intReq)
+			PushEvent(c, "intercept", intReq)
 
 			// wait for result
 			intRsp, ok := <-intReq.Result
@@ -1223,7 +2148,7 @@ func interceptHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *Intercep
 			defer removePendingRequest(intReq)
 
 			// submit the request
-			MessageResponse(c, intReq)
+			PushEvent(c, "intercept", intReq)
 
 			// wait for result
 			intRsp, ok := <-intReq.Result
@@ -1289,18 +2214,19 @@ func interceptHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *Intercep
 			logger.Println("Connection closed")
 			return
 		}
+		rc := responseConn(c, m)
 
 		// convert line to appropriate struct
 		var intRsp intResponse
 		if err := json.Unmarshal(m, &intRsp); err != nil {
-			intErrorResponse(0, c, fmt.Sprintf("error parsing message: %s", err.Error()))
+			intErrorResponse(0, rc, fmt.Sprintf("error parsing message: %s", err.Error()))
 			continue
 		}
 
 		// get the pending request
 		pendingReq, err := getPendingRequest(intRsp.Id)
 		if err != nil {
-			intErrorResponse(intRsp.Id, c, err.Error())
+			intErrorResponse(intRsp.Id, rc, err.Error())
 			continue
 		}
 
@@ -1308,22 +2234,22 @@ func interceptHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *Intercep
 		switch pendingReq.Type {
 		case "httprequest":
 			if intRsp.Request == nil {
-				intErrorResponse(intRsp.Id, c, "missing request")
+				intErrorResponse(intRsp.Id, rc, "missing request")
 				continue
 			}
 		case "httpresponse":
 			if intRsp.Response == nil {
-				intErrorResponse(intRsp.Id, c, "missing response")
+				intErrorResponse(intRsp.Id, rc, "missing response")
 				continue
 			}
 		case "wstoserver", "wstoclient":
 			if intRsp.WSMessage == nil {
-				intErrorResponse(intRsp.Id, c, "missing websocket message")
+				intErrorResponse(intRsp.Id, rc, "missing websocket message")
 				continue
 			}
 			intRsp.WSMessage.ToServer = (pendingReq.Type == "wstoserver")
 		default:
-			intErrorResponse(intRsp.Id, c, "internal error, stored message has invalid type")
+			intErrorResponse(intRsp.Id, rc, "internal error, stored message has invalid type")
 			continue
 		}
 
@@ -1339,6 +2265,8 @@ Query management
 
 type allSavedQueriesMessage struct {
 	Storage int
+	// Only return the queries in this folder. All queries are returned if it is blank
+	Folder string
 }
 
 type allSavedQueriesResponse struct {
@@ -1347,8 +2275,11 @@ type allSavedQueriesResponse struct {
 }
 
 type StrSavedQuery struct {
-	Name  string
-	Query StrMessageQuery
+	Name        string
+	Query       StrMessageQuery
+	Expr        *StrQueryExpr
+	Description string
+	Folder      string
 }
 
 func allSavedQueriesHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
@@ -1377,15 +2308,28 @@ func allSavedQueriesHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *In
 	}
 	savedQueries := make([]*StrSavedQuery, 0)
 	for _, q := range goQueries {
+		if mreq.Folder != "" && q.Folder != mreq.Folder {
+			continue
+		}
 		strSavedQuery := &StrSavedQuery{
-			Name:  q.Name,
-			Query: nil,
+			Name:        q.Name,
+			Query:       nil,
+			Description: q.Description,
+			Folder:      q.Folder,
+		}
+		se, err := QueryExprToStrExpr(q.Expr)
+		if err != nil {
+			continue
 		}
-		sq, err := MsgQueryToStrQuery(q.Query)
-		if err == nil {
+		strSavedQuery.Expr = se
+		if q.Query != nil {
+			sq, err := MsgQueryToStrQuery(q.Query)
+			if err != nil {
+				continue
+			}
 			strSavedQuery.Query = sq
-			savedQueries = append(savedQueries, strSavedQuery)
 		}
+		savedQueries = append(savedQueries, strSavedQuery)
 	}
 	MessageResponse(c, &allSavedQueriesResponse{
 		Success: true,
@@ -1394,16 +2338,19 @@ func allSavedQueriesHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *In
 }
 
 type saveQueryMessage struct {
-	Name    string
-	Query   StrMessageQuery
-	Storage int
+	Name        string
+	Query       StrMessageQuery
+	Expr        *StrQueryExpr
+	Description string
+	Folder      string
+	Storage     int
 }
 
 func saveQueryHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
 	mreq := saveQueryMessage{}
 
 	if err := json.Unmarshal(b, &mreq); err != nil {
-		ErrorResponse(c, "error parsing message")
+		ErrorResponse(c, fmt.Sprintf("error parsing message: %s", err.Error()))
 		return
 	}
 
@@ -1418,24 +2365,46 @@ func saveQueryHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *Intercep
 		return
 	}
 
-	if mreq.Name == "" || mreq.Query == nil {
+	if mreq.Name == "" || (mreq.Query == nil && mreq.Expr == nil) {
 		ErrorResponse(c, "name and query are required")
 		return
 	}
 
-	goQuery, err := StrQueryToMsgQuery(mreq.Query)
-	if err != nil {
-		ErrorResponse(c, err.Error())
+	if mreq.Query != nil && mreq.Expr != nil {
+		ErrorResponse(c, "only one of a query and a query expression can be given")
 		return
 	}
-	_, err = CheckerFromMessageQuery(goQuery)
-	if err != nil {
+
+	sq := &SavedQuery{
+		Name:        mreq.Name,
+		Description: mreq.Description,
+		Folder:      mreq.Folder,
+	}
+	var goExpr *QueryExpr
+	if mreq.Expr != nil {
+		var err error
+		goExpr, err = StrExprToQueryExpr(mreq.Expr)
+		if err != nil {
+			ErrorResponse(c, err.Error())
+			return
+		}
+		sq.Expr = goExpr
+	} else {
+		goQuery, err := StrQueryToMsgQuery(mreq.Query)
+		if err != nil {
+			ErrorResponse(c, err.Error())
+			return
+		}
+		sq.Query = goQuery
+		goExpr = QueryExprFromMessageQuery(goQuery)
+	}
+
+	if err := ValidateSavedQuery(storage, mreq.Name, goExpr); err != nil {
 		ErrorResponse(c, err.Error())
 		return
 	}
 
-	err = storage.SaveQuery(mreq.Name, goQuery)
-	if err != nil {
+	if err := storage.SaveSavedQuery(sq); err != nil {
 		ErrorResponse(c, err.Error())
 		return
 	}
@@ -1449,8 +2418,11 @@ type loadQueryMessage struct {
 }
 
 type loadQueryResult struct {
-	Success bool
-	Query   StrMessageQuery
+	Success     bool
+	Query       StrMessageQuery
+	Expr        *StrQueryExpr
+	Description string
+	Folder      string
 }
 
 func loadQueryHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
@@ -1476,21 +2448,34 @@ func loadQueryHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *Intercep
 		return
 	}
 
-	query, err := storage.LoadQuery(mreq.Name)
+	sq, err := storage.LoadSavedQuery(mreq.Name)
 	if err != nil {
 		ErrorResponse(c, err.Error())
 		return
 	}
 
-	strQuery, err := MsgQueryToStrQuery(query)
+	strExpr, err := QueryExprToStrExpr(sq.Expr)
 	if err != nil {
 		ErrorResponse(c, err.Error())
 		return
 	}
 
+	// Expressions that are too complex to be converted are only returned as an expression
+	var strQuery StrMessageQuery = nil
+	if sq.Query != nil {
+		strQuery, err = MsgQueryToStrQuery(sq.Query)
+		if err != nil {
+			ErrorResponse(c, err.Error())
+			return
+		}
+	}
+
 	result := &loadQueryResult{
-		Success: true,
-		Query:   strQuery,
+		Success:     true,
+		Query:       strQuery,
+		Expr:        strExpr,
+		Description: sq.Description,
+		Folder:      sq.Folder,
 	}
 
 	MessageResponse(c, result)
@@ -1770,6 +2755,8 @@ Storage functions
 type addSQLiteStorageMessage struct {
 	Path        string
 	Description string
+	// If set, the datafile is opened as an encrypted datafile
+	Passphrase string
 }
 
 type addSQLiteStorageResult struct {
@@ -1789,7 +2776,13 @@ func addSQLiteStorageHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *I
 		return
 	}
 
-	storage, err := OpenSQLiteStorage(mreq.Path, logger)
+	var storage *SQLiteStorage
+	var err error
+	if mreq.Passphrase != "" {
+		storage, err = OpenEncryptedSQLiteStorage(mreq.Path, mreq.Passphrase, logger)
+	} else {
+		storage, err = OpenSQLiteStorage(mreq.Path, logger)
+	}
 	if err != nil {
 		ErrorResponse(c, "error opening SQLite databae: "+err.Error())
 		return
@@ -1805,6 +2798,10 @@ func addSQLiteStorageHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *I
 
 type addInMemoryStorageMessage struct {
 	Description string
+
+	// Optional limits. If either is set, a bounded storage that evicts the oldest requests is used instead of SQLite.
+	MaxRequests int
+	MaxBytes    int64
 }
 
 type addInMemoryStorageResult struct {
@@ -1819,12 +2816,23 @@ func addInMemoryStorageHandler(b []byte, c net.Conn, logger *log.Logger, iproxy
 		return
 	}
 
-	storage, err := InMemoryStorage(logger)
-	if err != nil {
-		ErrorResponse(c, "error creating in memory storage: "+err.Error())
+	if mreq.MaxRequests < 0 || mreq.MaxBytes < 0 {
+		ErrorResponse(c, "storage limits cannot be negative")
 		return
 	}
 
+	var storage MessageStorage
+	if mreq.MaxRequests > 0 || mreq.MaxBytes > 0 {
+		storage = NewBoundedMemoryStorage(mreq.MaxRequests, mreq.MaxBytes)
+	} else {
+		var err error
+		storage, err = InMemoryStorage(logger)
+		if err != nil {
+			ErrorResponse(c, "error creating in memory storage: "+err.Error())
+			return
+		}
+	}
+
 	sid := iproxy.AddMessageStorage(storage, mreq.Description)
 	result := &addInMemoryStorageResult{
 		Success:   true,
@@ -1833,6 +2841,42 @@ func addInMemoryStorageHandler(b []byte, c net.Conn, logger *log.Logger, iproxy
 	MessageResponse(c, result)
 }
 
+type addJSONLStorageMessage struct {
+	Path        string
+	Description string
+}
+
+type addJSONLStorageResult struct {
+	Success   bool
+	StorageId int
+}
+
+func addJSONLStorageHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
+	mreq := addJSONLStorageMessage{}
+	if err := json.Unmarshal(b, &mreq); err != nil {
+		ErrorResponse(c, "error parsing message")
+		return
+	}
+
+	if mreq.Path == "" {
+		ErrorResponse(c, "file path is required")
+		return
+	}
+
+	storage, err := OpenJSONLStorage(mreq.Path, logger)
+	if err != nil {
+		ErrorResponse(c, "error opening JSONL log: "+err.Error())
+		return
+	}
+
+	sid := iproxy.AddMessageStorage(storage, mreq.Description)
+	result := &addJSONLStorageResult{
+		Success:   true,
+		StorageId: sid,
+	}
+	MessageResponse(c, result)
+}
+
 type closeStorageMessage struct {
 	StorageId int
 }
@@ -1841,19 +2885,56 @@ type closeStorageResult struct {
 	Success bool
 }
 
-func closeStorageHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
-	mreq := closeStorageMessage{}
-	if err := json.Unmarshal(b, &mreq); err != nil {
-		ErrorResponse(c, "error parsing message")
+func closeStorageHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
+	mreq := closeStorageMessage{}
+	if err := json.Unmarshal(b, &mreq); err != nil {
+		ErrorResponse(c, "error parsing message")
+		return
+	}
+
+	if mreq.StorageId == 0 {
+		ErrorResponse(c, "StorageId is required")
+		return
+	}
+
+	iproxy.CloseMessageStorage(mreq.StorageId)
+	MessageResponse(c, &successResult{Success: true})
+}
+
+type rekeyStorageMessage struct {
+	Storage    int
+	Passphrase string
+}
+
+func rekeyStorageHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
+	mreq := rekeyStorageMessage{}
+	if err := json.Unmarshal(b, &mreq); err != nil {
+		ErrorResponse(c, "error parsing message")
+		return
+	}
+
+	if mreq.Passphrase == "" {
+		ErrorResponse(c, "passphrase is required")
+		return
+	}
+
+	storage, _ := iproxy.GetMessageStorage(mreq.Storage)
+	if storage == nil {
+		ErrorResponse(c, fmt.Sprintf("storage with id %d does not exist", mreq.Storage))
+		return
+	}
+
+	sqlStorage, ok := storage.(*SQLiteStorage)
+	if !ok {
+		ErrorResponse(c, fmt.Sprintf("storage with id %d does not support encryption", mreq.Storage))
 		return
 	}
 
-	if mreq.StorageId == 0 {
-		ErrorResponse(c, "StorageId is required")
+	if err := sqlStorage.Rekey(mreq.Passphrase); err != nil {
+		ErrorResponse(c, "error changing storage key: "+err.Error())
 		return
 	}
 
-	iproxy.CloseMessageStorage(mreq.StorageId)
 	MessageResponse(c, &successResult{Success: true})
 }
 
@@ -1978,7 +3059,7 @@ func (sw *proxyMsgStorageWatcher) NewRequestSaved(storageId int, ms MessageStora
 	msgRsp.Request = NewRequestJSON(req, sw.headersOnly)
 	msgRsp.Action = "NewRequest"
 	msgRsp.StorageId = storageId
-	MessageResponse(sw.conn, msgRsp)
+	PushEvent(sw.conn, "storageupdate", msgRsp)
 }
 
 func (sw *proxyMsgStorageWatcher) RequestUpdated(storageId int, ms MessageStorage, req *ProxyRequest) {
@@ -1988,7 +3069,7 @@ func (sw *proxyMsgStorageWatcher) RequestUpdated(storageId int, ms MessageStorag
 	msgRsp.Request = NewRequestJSON(req, sw.headersOnly)
 	msgRsp.Action = "RequestUpdated"
 	msgRsp.StorageId = storageId
-	MessageResponse(sw.conn, msgRsp)
+	PushEvent(sw.conn, "storageupdate", msgRsp)
 }
 
 func (sw *proxyMsgStorageWatcher) RequestDeleted(storageId int, ms MessageStorage, DbId string) {
@@ -1998,7 +3079,7 @@ func (sw *proxyMsgStorageWatcher) RequestDeleted(storageId int, ms MessageStorag
 	msgRsp.Action = "RequestDeleted"
 	msgRsp.MessageId = DbId
 	msgRsp.StorageId = storageId
-	MessageResponse(sw.conn, msgRsp)
+	PushEvent(sw.conn, "storageupdate", msgRsp)
 }
 
 func (sw *proxyMsgStorageWatcher) NewResponseSaved(storageId int, ms MessageStorage, rsp *ProxyResponse) {
@@ -2008,7 +3089,7 @@ func (sw *proxyMsgStorageWatcher) NewResponseSaved(storageId int, ms MessageStor
 	msgRsp.Response = NewResponseJSON(rsp, sw.headersOnly)
 	msgRsp.Action = "NewResponse"
 	msgRsp.StorageId = storageId
-	MessageResponse(sw.conn, msgRsp)
+	PushEvent(sw.conn, "storageupdate", msgRsp)
 }
 
 func (sw *proxyMsgStorageWatcher) ResponseUpdated(storageId int, ms MessageStorage, rsp *ProxyResponse) {
@@ -2018,7 +3099,7 @@ func (sw *proxyMsgStorageWatcher) ResponseUpdated(storageId int, ms MessageStora
 	msgRsp.Response = NewResponseJSON(rsp, sw.headersOnly)
 	msgRsp.Action = "ResponseUpdated"
 	msgRsp.StorageId = storageId
-	MessageResponse(sw.conn, msgRsp)
+	PushEvent(sw.conn, "storageupdate", msgRsp)
 }
 
 func (sw *proxyMsgStorageWatcher) ResponseDeleted(storageId int, ms MessageStorage, DbId string) {
@@ -2028,9 +3109,10 @@ func (sw *proxyMsgStorageWatcher) ResponseDeleted(storageId int, ms MessageStora
 	msgRsp.Action = "ResponseDeleted"
 	msgRsp.MessageId = DbId
 	msgRsp.StorageId = storageId
-	MessageResponse(sw.conn, msgRsp)
+	PushEvent(sw.conn, "storageupdate", msgRsp)
 }
 
+// Unmangled versions of websocket messages are saved without a request, in which case the update has no Request
 func (sw *proxyMsgStorageWatcher) NewWSMessageSaved(storageId int, ms MessageStorage, req *ProxyRequest, wsm *ProxyWSMessage) {
 	sw.connMtx.Lock()
 	defer sw.connMtx.Unlock()
@@ -2039,7 +3121,7 @@ func (sw *proxyMsgStorageWatcher) NewWSMessageSaved(storageId int, ms MessageSto
 	msgRsp.WSMessage = NewWSMessageJSON(wsm)
 	msgRsp.Action = "NewWSMessage"
 	msgRsp.StorageId = storageId
-	MessageResponse(sw.conn, msgRsp)
+	PushEvent(sw.conn, "storageupdate", msgRsp)
 }
 
 func (sw *proxyMsgStorageWatcher) WSMessageUpdated(storageId int, ms MessageStorage, req *ProxyRequest, wsm *ProxyWSMessage) {
@@ -2050,7 +3132,7 @@ func (sw *proxyMsgStorageWatcher) WSMessageUpdated(storageId int, ms MessageStor
 	msgRsp.WSMessage = NewWSMessageJSON(wsm)
 	msgRsp.Action = "WSMessageUpdated"
 	msgRsp.StorageId = storageId
-	MessageResponse(sw.conn, msgRsp)
+	PushEvent(sw.conn, "storageupdate", msgRsp)
 }
 
 func (sw *proxyMsgStorageWatcher) WSMessageDeleted(storageId int, ms MessageStorage, DbId string) {
@@ -2060,7 +3142,7 @@ func (sw *proxyMsgStorageWatcher) WSMessageDeleted(storageId int, ms MessageStor
 	msgRsp.Action = "WSMessageDeleted"
 	msgRsp.MessageId = DbId
 	msgRsp.StorageId = storageId
-	MessageResponse(sw.conn, msgRsp)
+	PushEvent(sw.conn, "storageupdate", msgRsp)
 }
 
 // Actual handler
@@ -2089,6 +3171,242 @@ func watchStorageHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *Inter
 	}
 }
 
+/*
+SubscribeQuery
+*/
+
+type subscribeQueryMessage struct {
+	// "subscribequery" to add a subscription or "unsubscribe" to remove one
+	Command string
+
+	// Used by subscribequery
+	Query       StrMessageQuery
+	Expr        *StrQueryExpr
+	HeadersOnly bool
+	// Only match requests in this storage. Requests in every storage are matched if it is zero
+	Storage int
+
+	// Used by unsubscribe
+	Id int
+}
+
+type subscribeQueryResult struct {
+	Success bool
+	Id      int
+}
+
+// A message pushed to the client when a request matching a subscription changes. Action is "NewRequest" or "RequestUpdated" for requests that match the query and "RequestRemoved" when a request that matched is deleted or no longer matches
+type queryUpdateMessage struct {
+	SubscriptionId int
+	StorageId      int
+	Action         string
+	MessageId      string
+	Request        *RequestJSON `json:"Request,omitempty"`
+}
+
+// A single query subscription
+type querySubscription struct {
+	id          int
+	storageId   int
+	checker     RequestChecker
+	headersOnly bool
+	// Ids of requests that have been pushed as matching the query
+	matched map[string]bool
+}
+
+// The query subscriptions of a connection. Watches every storage and pushes requests that match a subscription to the connection.
+type querySubscriptions struct {
+	mtx    sync.Mutex
+	conn   io.Writer
+	nextId func() int
+	subs   map[int]*querySubscription
+}
+
+func newQuerySubscriptions(conn io.Writer) *querySubscriptions {
+	return &querySubscriptions{
+		conn:   conn,
+		nextId: IdCounter(),
+		subs:   make(map[int]*querySubscription),
+	}
+}
+
+// Adds a subscription for the query in a message and returns its id
+func (qs *querySubscriptions) subscribe(mreq *subscribeQueryMessage, iproxy *InterceptingProxy) (int, error) {
+	var storage MessageStorage
+	if mreq.Storage != 0 {
+		storage, _ = iproxy.GetMessageStorage(mreq.Storage)
+		if storage == nil {
+			return 0, fmt.Errorf("storage with id %d does not exist", mreq.Storage)
+		}
+	}
+
+	checker, err := checkerFromStrQueryOrExpr(storage, mreq.Query, mreq.Expr)
+	if err != nil {
+		return 0, err
+	}
+
+	qs.mtx.Lock()
+	defer qs.mtx.Unlock()
+	sub := &querySubscription{
+		id:          qs.nextId(),
+		storageId:   mreq.Storage,
+		checker:     checker,
+		headersOnly: mreq.HeadersOnly,
+		matched:     make(map[string]bool),
+	}
+	qs.subs[sub.id] = sub
+	return sub.id, nil
+}
+
+func (qs *querySubscriptions) unsubscribe(id int) error {
+	qs.mtx.Lock()
+	defer qs.mtx.Unlock()
+	if _, ok := qs.subs[id]; !ok {
+		return fmt.Errorf("subscription with id %d does not exist", id)
+	}
+	delete(qs.subs, id)
+	return nil
+}
+
+// Pushes an update to the connection. Must be called with qs.mtx held so that updates are pushed in order
+func (qs *querySubscriptions) push(m *queryUpdateMessage) {
+	PushEvent(qs.conn, "queryupdate", m)
+}
+
+func (qs *querySubscriptions) requestChanged(storageId int, req *ProxyRequest, action string) {
+	qs.mtx.Lock()
+	defer qs.mtx.Unlock()
+	for _, sub := range qs.subs {
+		if sub.storageId != 0 && sub.storageId != storageId {
+			continue
+		}
+		if sub.checker(req) {
+			sub.matched[req.DbId] = true
+			qs.push(&queryUpdateMessage{
+				SubscriptionId: sub.id,
+				StorageId:      storageId,
+				Action:         action,
+				MessageId:      req.DbId,
+				Request:        NewRequestJSON(req, sub.headersOnly),
+			})
+		} else if sub.matched[req.DbId] {
+			qs.removed(sub, storageId, req.DbId)
+		}
+	}
+}
+
+// Pushes that a request no longer matches a subscription
+func (qs *querySubscriptions) removed(sub *querySubscription, storageId int, reqid string) {
+	delete(sub.matched, reqid)
+	qs.push(&queryUpdateMessage{
+		SubscriptionId: sub.id,
+		StorageId:      storageId,
+		Action:         "RequestRemoved",
+		MessageId:      reqid,
+	})
+}
+
+// Implement watcher
+
+func (qs *querySubscriptions) NewRequestSaved(storageId int, ms MessageStorage, req *ProxyRequest) {
+	qs.requestChanged(storageId, req, "NewRequest")
+}
+
+func (qs *querySubscriptions) RequestUpdated(storageId int, ms MessageStorage, req *ProxyRequest) {
+	qs.requestChanged(storageId, req, "RequestUpdated")
+}
+
+func (qs *querySubscriptions) RequestDeleted(storageId int, ms MessageStorage, DbId string) {
+	qs.mtx.Lock()
+	defer qs.mtx.Unlock()
+	for _, sub := range qs.subs {
+		if sub.matched[DbId] && (sub.storageId == 0 || sub.storageId == storageId) {
+			qs.removed(sub, storageId, DbId)
+		}
+	}
+}
+
+func (qs *querySubscriptions) NewResponseSaved(storageId int, ms MessageStorage, rsp *ProxyResponse) {
+}
+
+func (qs *querySubscriptions) ResponseUpdated(storageId int, ms MessageStorage, rsp *ProxyResponse) {
+}
+
+func (qs *querySubscriptions) ResponseDeleted(storageId int, ms MessageStorage, DbId string) {
+}
+
+func (qs *querySubscriptions) NewWSMessageSaved(storageId int, ms MessageStorage, req *ProxyRequest, wsm *ProxyWSMessage) {
+}
+
+func (qs *querySubscriptions) WSMessageUpdated(storageId int, ms MessageStorage, req *ProxyRequest, wsm *ProxyWSMessage) {
+}
+
+func (qs *querySubscriptions) WSMessageDeleted(storageId int, ms MessageStorage, DbId string) {
+}
+
+// Actual handler
+
+func subscribeQueryHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
+	mreq := subscribeQueryMessage{}
+	if err := json.Unmarshal(b, &mreq); err != nil {
+		ErrorResponse(c, fmt.Sprintf("error parsing message: %s", err.Error()))
+		return
+	}
+
+	subs := newQuerySubscriptions(c)
+	id, err := subs.subscribe(&mreq, iproxy)
+	if err != nil {
+		ErrorResponse(c, err.Error())
+		return
+	}
+
+	// The result is written before the subscriptions start watching so that no update is pushed before it
+	subs.mtx.Lock()
+	MessageResponse(c, &subscribeQueryResult{Success: true, Id: id})
+	iproxy.GlobalStorageWatch(subs)
+	subs.mtx.Unlock()
+	defer iproxy.GlobalStorageEndWatch(subs)
+
+	// Read messages to add and remove subscriptions until the connection is closed
+	mc := handlerConn(c)
+	for {
+		m, err := mc.nextMessage()
+		if err != nil {
+			return
+		}
+
+		var result interface{}
+		mreq := subscribeQueryMessage{}
+		if err := checkHandlerMessage(m, reflect.TypeOf(mreq)); err != nil {
+			result = &errorMessage{Reason: err.Error()}
+		} else if err := json.Unmarshal(m, &mreq); err != nil {
+			result = &errorMessage{Reason: fmt.Sprintf("error parsing message: %s", err.Error())}
+		} else {
+			switch strings.ToLower(mreq.Command) {
+			case "subscribequery":
+				id, err := subs.subscribe(&mreq, iproxy)
+				if err != nil {
+					result = &errorMessage{Reason: err.Error()}
+				} else {
+					result = &subscribeQueryResult{Success: true, Id: id}
+				}
+			case "unsubscribe":
+				if err := subs.unsubscribe(mreq.Id); err != nil {
+					result = &errorMessage{Reason: err.Error()}
+				} else {
+					result = &successResult{Success: true}
+				}
+			default:
+				result = &errorMessage{Reason: fmt.Sprintf("unknown command: %s", mreq.Command)}
+			}
+		}
+
+		subs.mtx.Lock()
+		MessageResponse(responseConn(c, m), result)
+		subs.mtx.Unlock()
+	}
+}
+
 /*
 SetPluginValue and GetPluginValue
 */
@@ -2174,3 +3492,238 @@ func getPluginValueHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *Int
 	MessageResponse(c, &getPluginValueResponse{Value: value, Success: true})
 }
 
+
+/*
+Import
+*/
+
+type importMessage struct {
+	Format  string
+	Path    string
+	Data    []byte
+	Storage int
+}
+
+type importResult struct {
+	Success bool
+	DbIds   []string
+	Errors  []string
+}
+
+func importHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
+	mreq := importMessage{}
+
+	if err := json.Unmarshal(b, &mreq); err != nil {
+		ErrorResponse(c, "error parsing message")
+		return
+	}
+
+	if mreq.Storage == 0 {
+		ErrorResponse(c, "storage is required")
+		return
+	}
+
+	storage, _ := iproxy.GetMessageStorage(mreq.Storage)
+	if storage == nil {
+		ErrorResponse(c, fmt.Sprintf("storage with id %d does not exist", mreq.Storage))
+		return
+	}
+
+	var r io.Reader
+	if mreq.Path != "" {
+		f, err := os.Open(mreq.Path)
+		if err != nil {
+			ErrorResponse(c, fmt.Sprintf("error opening file: %s", err.Error()))
+			return
+		}
+		defer f.Close()
+		r = f
+	} else if len(mreq.Data) > 0 {
+		r = bytes.NewReader(mreq.Data)
+	} else {
+		ErrorResponse(c, "either path or data is required")
+		return
+	}
+
+	var result *ImportResult
+	var err error
+	switch strings.ToLower(mreq.Format) {
+	case "burp":
+		result, err = ImportBurpXML(storage, r)
+	case "har":
+		result, err = ImportHAR(storage, r)
+	case "zap":
+		result, err = ImportZAPXML(storage, r)
+	default:
+		ErrorResponse(c, "format must be \"burp\", \"har\" or \"zap\"")
+		return
+	}
+	if err != nil {
+		ErrorResponse(c, err.Error())
+		return
+	}
+
+	rsp := &importResult{
+		Success: true,
+		DbIds:   make([]string, len(result.Imported)),
+		Errors:  make([]string, len(result.Errors)),
+	}
+	for i, req := range result.Imported {
+		rsp.DbIds[i] = req.DbId
+	}
+	for i, ierr := range result.Errors {
+		rsp.Errors[i] = ierr.Error()
+	}
+	MessageResponse(c, rsp)
+}
+
+type exportMessage struct {
+	Format  string
+	Path    string
+	Query   StrMessageQuery
+	Storage int
+}
+
+type exportResult struct {
+	Success  bool
+	Exported int
+	Data     []byte `json:"Data,omitempty"`
+}
+
+func exportHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
+	mreq := exportMessage{}
+
+	if err := json.Unmarshal(b, &mreq); err != nil {
+		ErrorResponse(c, fmt.Sprintf("error parsing message: %s", err.Error()))
+		return
+	}
+
+	if mreq.Storage == 0 {
+		ErrorResponse(c, "storage is required")
+		return
+	}
+
+	storage, _ := iproxy.GetMessageStorage(mreq.Storage)
+	if storage == nil {
+		ErrorResponse(c, fmt.Sprintf("storage with id %d does not exist", mreq.Storage))
+		return
+	}
+
+	if strings.ToLower(mreq.Format) != "har" {
+		ErrorResponse(c, "format must be \"har\"")
+		return
+	}
+
+	goQuery, err := StrQueryToMsgQuery(mreq.Query)
+	if err != nil {
+		ErrorResponse(c, err.Error())
+		return
+	}
+	checker, err := StorageCheckerFromMessageQuery(storage, goQuery)
+	if err != nil {
+		ErrorResponse(c, err.Error())
+		return
+	}
+	reqs, err := storage.CheckRequests(0, checker)
+	if err != nil {
+		ErrorResponse(c, err.Error())
+		return
+	}
+	sort.Sort(ReqSort(reqs))
+
+	// Write to the file if a path is given, otherwise return the data in the response
+	buf := new(bytes.Buffer)
+	if err := ExportHAR(buf, reqs); err != nil {
+		ErrorResponse(c, err.Error())
+		return
+	}
+
+	result := &exportResult{
+		Success:  true,
+		Exported: len(reqs),
+	}
+	if mreq.Path != "" {
+		if err := ioutil.WriteFile(mreq.Path, buf.Bytes(), 0600); err != nil {
+			ErrorResponse(c, fmt.Sprintf("error writing file: %s", err.Error()))
+			return
+		}
+	} else {
+		result.Data = buf.Bytes()
+	}
+	MessageResponse(c, result)
+}
+
+/*
+CopyRequests
+*/
+
+type copyRequestsMessage struct {
+	Query         StrMessageQuery
+	SourceStorage int
+	DestStorage   int
+}
+
+type copyRequestsResult struct {
+	Success bool
+	Copied  int
+	IdMap   map[string]string
+	// Set if copying failed part way through. Copied and IdMap describe the requests copied before the failure
+	Reason string `json:"Reason,omitempty"`
+}
+
+func copyRequestsHandler(b []byte, c net.Conn, logger *log.Logger, iproxy *InterceptingProxy) {
+	mreq := copyRequestsMessage{}
+
+	if err := json.Unmarshal(b, &mreq); err != nil {
+		ErrorResponse(c, fmt.Sprintf("error parsing message: %s", err.Error()))
+		return
+	}
+
+	if mreq.SourceStorage == 0 || mreq.DestStorage == 0 {
+		ErrorResponse(c, "both source and destination storage are required")
+		return
+	}
+
+	src, _ := iproxy.GetMessageStorage(mreq.SourceStorage)
+	if src == nil {
+		ErrorResponse(c, fmt.Sprintf("storage with id %d does not exist", mreq.SourceStorage))
+		return
+	}
+
+	dest, _ := iproxy.GetMessageStorage(mreq.DestStorage)
+	if dest == nil {
+		ErrorResponse(c, fmt.Sprintf("storage with id %d does not exist", mreq.DestStorage))
+		return
+	}
+
+	goQuery, err := StrQueryToMsgQuery(mreq.Query)
+	if err != nil {
+		ErrorResponse(c, err.Error())
+		return
+	}
+
+	progress := func(copied int, total int) {
+		logger.Printf("Copied %d/%d requests", copied, total)
+	}
+
+	idMap, err := CopyRequests(src, goQuery, dest, progress)
+	if err != nil {
+		if idMap == nil {
+			ErrorResponse(c, err.Error())
+			return
+		}
+		MessageResponse(c, &copyRequestsResult{
+			Success: false,
+			Copied:  len(idMap),
+			IdMap:   idMap,
+			Reason:  err.Error(),
+		})
+		return
+	}
+
+	MessageResponse(c, &copyRequestsResult{
+		Success: true,
+		Copied:  len(idMap),
+		IdMap:   idMap,
+	})
+}
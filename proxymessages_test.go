@@ -0,0 +1,377 @@
+package puppy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// Returns the messages written to a buffer and clears it
+func takeMessages(t *testing.T, buf *bytes.Buffer) []*queryUpdateMessage {
+	t.Helper()
+	msgs := make([]*queryUpdateMessage, 0)
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		msg := &queryUpdateMessage{}
+		testErr(t, json.Unmarshal([]byte(line), msg))
+		msgs = append(msgs, msg)
+	}
+	buf.Reset()
+	return msgs
+}
+
+func TestQuerySubscriptions(t *testing.T) {
+	storage := NewBoundedMemoryStorage(0, 0)
+	defer storage.Close()
+	iproxy := NewInterceptingProxy(nil)
+	storageId := iproxy.AddMessageStorage(storage, "test")
+
+	var buf bytes.Buffer
+	subs := newQuerySubscriptions(&buf)
+	pathId, err := subs.subscribe(&subscribeQueryMessage{
+		Query:   StrMessageQuery{{{"path", "is", "/a"}}},
+		Storage: storageId,
+	}, iproxy)
+	testErr(t, err)
+	allId, err := subs.subscribe(&subscribeQueryMessage{HeadersOnly: true}, iproxy)
+	testErr(t, err)
+	if pathId == allId {
+		t.Fatalf("subscriptions have the same id")
+	}
+	iproxy.GlobalStorageWatch(subs)
+	defer iproxy.GlobalStorageEndWatch(subs)
+
+	a := siteMapReq(t, "POST", "/a", "body", 0)
+	testErr(t, SaveNewRequest(storage, a))
+	msgs := takeMessages(t, &buf)
+	if len(msgs) != 2 {
+		t.Fatalf("incorrect number of messages for a matching request: %d", len(msgs))
+	}
+	for _, msg := range msgs {
+		if msg.Action != "NewRequest" || msg.StorageId != storageId || msg.Request == nil {
+			t.Errorf("incorrect message for a new request: %+v", msg)
+		} else if msg.SubscriptionId == allId && len(msg.Request.Body) != 0 {
+			t.Errorf("headers only subscription included the body")
+		} else if msg.SubscriptionId == pathId && len(msg.Request.Body) == 0 {
+			t.Errorf("subscription did not include the body")
+		}
+	}
+
+	b := siteMapReq(t, "GET", "/b", "", 0)
+	testErr(t, SaveNewRequest(storage, b))
+	if msgs := takeMessages(t, &buf); len(msgs) != 1 || msgs[0].SubscriptionId != allId {
+		t.Errorf("incorrect messages for a request matching one subscription: %+v", msgs)
+	}
+
+	// Requests that stop matching are removed
+	a.URL.Path = "/c"
+	testErr(t, UpdateRequest(storage, a))
+	actions := make(map[int]string)
+	for _, msg := range takeMessages(t, &buf) {
+		actions[msg.SubscriptionId] = msg.Action
+	}
+	if actions[pathId] != "RequestRemoved" || actions[allId] != "RequestUpdated" {
+		t.Errorf("incorrect actions for an updated request: %v", actions)
+	}
+
+	testErr(t, subs.unsubscribe(allId))
+	if err := subs.unsubscribe(allId); err == nil {
+		t.Errorf("unsubscribing twice did not return an error")
+	}
+	testErr(t, storage.DeleteRequest(b.DbId))
+	if msgs := takeMessages(t, &buf); len(msgs) != 0 {
+		t.Errorf("messages were sent after unsubscribing: %+v", msgs)
+	}
+}
+
+func TestSubscribeResultFirst(t *testing.T) {
+	storage := NewBoundedMemoryStorage(0, 0)
+	defer storage.Close()
+	iproxy := NewInterceptingProxy(nil)
+	iproxy.AddMessageStorage(storage, "test")
+
+	// Save requests while subscribing so that updates are ready to be pushed as soon as the subscription starts
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				SaveNewRequest(storage, siteMapReq(t, "GET", "/a", "", 0))
+			}
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		client, server := net.Pipe()
+		go subscribeQueryHandler([]byte(`{"Command": "subscribequery"}`), server, log.New(ioutil.Discard, "", 0), iproxy)
+		m, err := ReadMessage(bufio.NewReader(client))
+		testErr(t, err)
+		msg := &struct {
+			Success bool
+			Event   string
+		}{}
+		testErr(t, json.Unmarshal(m, msg))
+		if !msg.Success || msg.Event != "" {
+			t.Fatalf("an update was pushed before the subscribe result: %s", m)
+		}
+		client.Close()
+	}
+}
+
+func TestMessageManagement(t *testing.T) {
+	storage := NewBoundedMemoryStorage(0, 0)
+	defer storage.Close()
+	iproxy := NewInterceptingProxy(nil)
+	storageId := iproxy.AddMessageStorage(storage, "test")
+	l := NewProxyMessageListener(log.New(ioutil.Discard, "", 0), iproxy)
+
+	req := siteMapReq(t, "GET", "/a", "", 200)
+	req.Unmangled = siteMapReq(t, "GET", "/original", "", 0)
+	req.AddTag("foo")
+	testErr(t, SaveNewRequest(storage, req))
+
+	var buf bytes.Buffer
+	subs := newQuerySubscriptions(&buf)
+	_, err := subs.subscribe(&subscribeQueryMessage{}, iproxy)
+	testErr(t, err)
+	iproxy.GlobalStorageWatch(subs)
+	defer iproxy.GlobalStorageEndWatch(subs)
+
+	handle := func(format string, args ...interface{}) []byte {
+		t.Helper()
+		return handleTestMessage(t, l, fmt.Sprintf(format, args...))
+	}
+
+	loaded := &loadRequestResult{}
+	testErr(t, json.Unmarshal(handle(`{"Command": "loadrequest", "Storage": %d, "ReqId": "%s"}`, storageId, req.DbId), loaded))
+	if !loaded.Success || loaded.Request.Path != "/a" || loaded.Request.Response == nil || loaded.Request.Unmangled == nil || loaded.Request.Unmangled.Path != "/original" {
+		t.Fatalf("incorrect loaded request: %+v", loaded.Request)
+	}
+	unmangled := &loadRequestResult{}
+	testErr(t, json.Unmarshal(handle(`{"Command": "loadunmangled", "Storage": %d, "ReqId": "%s"}`, storageId, req.DbId), unmangled))
+	if !unmangled.Success || unmangled.Request.Path != "/original" {
+		t.Errorf("incorrect unmangled request: %+v", unmangled.Request)
+	}
+
+	// Updating the request only replaces its contents
+	reqJSON := loaded.Request
+	reqJSON.Path = "/b"
+	reqJSON.Tags = nil
+	update, err := json.Marshal(&updateRequestMessage{ReqId: req.DbId, Request: reqJSON, Storage: storageId})
+	testErr(t, err)
+	updated := &updateRequestResult{}
+	testErr(t, json.Unmarshal(handleTestMessage(t, l, `{"Command": "updaterequest", `+string(update[1:])), updated))
+	if !updated.Success {
+		t.Fatalf("updating request failed")
+	}
+	if msgs := takeMessages(t, &buf); len(msgs) != 1 || msgs[0].Action != "RequestUpdated" || msgs[0].MessageId != req.DbId {
+		t.Errorf("incorrect notifications for an updated request: %+v", msgs)
+	}
+	stored, err := storage.LoadRequest(req.DbId)
+	testErr(t, err)
+	if stored.URL.Path != "/b" || !stored.CheckTag("foo") || stored.ServerResponse == nil || stored.Unmangled == nil {
+		t.Errorf("request was not updated in place: %+v", NewRequestJSON(stored, true))
+	}
+
+	rspJSON := loaded.Request.Response
+	rspJSON.StatusCode = 404
+	update, err = json.Marshal(&updateResponseMessage{RspId: rspJSON.DbId, Response: rspJSON, Storage: storageId})
+	testErr(t, err)
+	testErr(t, json.Unmarshal(handleTestMessage(t, l, `{"Command": "updateresponse", `+string(update[1:])), updated))
+	rsp, err := storage.LoadResponse(rspJSON.DbId)
+	testErr(t, err)
+	if !updated.Success || rsp.StatusCode != 404 {
+		t.Errorf("response was not updated")
+	}
+
+	result := &errorMessage{}
+	testErr(t, json.Unmarshal(handle(`{"Command": "deleterequest", "Storage": %d, "ReqId": "nosuchrequest"}`, storageId), result))
+	if result.Success {
+		t.Errorf("deleting a request that does not exist succeeded")
+	}
+	if msgs := takeMessages(t, &buf); len(msgs) != 0 {
+		t.Errorf("watchers were notified about deleting a request that does not exist: %+v", msgs)
+	}
+
+	testErr(t, json.Unmarshal(handle(`{"Command": "deleterequest", "Storage": %d, "ReqId": "%s"}`, storageId, req.DbId), result))
+	if !result.Success {
+		t.Errorf("deleting request failed: %s", result.Reason)
+	}
+	if msgs := takeMessages(t, &buf); len(msgs) != 1 || msgs[0].Action != "RequestRemoved" {
+		t.Errorf("incorrect notifications for a deleted request: %+v", msgs)
+	}
+	if _, err := storage.LoadRequest(req.DbId); err == nil {
+		t.Errorf("request was not deleted")
+	}
+}
+
+func TestWSMessageManagement(t *testing.T) {
+	sqliteStorage := testStorage()
+	defer sqliteStorage.Close()
+	for name, storage := range map[string]MessageStorage{
+		"memory": NewBoundedMemoryStorage(0, 0),
+		"sqlite": sqliteStorage,
+	} {
+		t.Run(name, func(t *testing.T) {
+			testWSMessageManagement(t, storage)
+		})
+	}
+}
+
+func testWSMessageManagement(t *testing.T, storage MessageStorage) {
+	iproxy := NewInterceptingProxy(nil)
+	storageId := iproxy.AddMessageStorage(storage, "test")
+	l := NewProxyMessageListener(log.New(ioutil.Discard, "", 0), iproxy)
+
+	req := siteMapReq(t, "GET", "/ws", "", 101)
+	plain, err := NewProxyWSMessage(websocket.TextMessage, []byte("plain"), ToServer)
+	testErr(t, err)
+	mangled, err := NewProxyWSMessage(websocket.TextMessage, []byte("mangled"), ToClient)
+	testErr(t, err)
+	mangled.Unmangled, err = NewProxyWSMessage(websocket.TextMessage, []byte("original"), ToClient)
+	testErr(t, err)
+	req.WSMessages = []*ProxyWSMessage{plain, mangled}
+	testErr(t, SaveNewRequest(storage, req))
+
+	// Watch the storage like a client that sent watchstorage
+	updates := make([]*storageUpdateResponse, 0)
+	conn := newRPCConn(func(m []byte) {
+		update := &storageUpdateResponse{}
+		testErr(t, json.Unmarshal(m, update))
+		updates = append(updates, update)
+	})
+	watcher := &proxyMsgStorageWatcher{conn: conn}
+	iproxy.GlobalStorageWatch(watcher)
+	defer iproxy.GlobalStorageEndWatch(watcher)
+
+	handle := func(format string, args ...interface{}) *errorMessage {
+		t.Helper()
+		result := &errorMessage{}
+		testErr(t, json.Unmarshal(handleTestMessage(t, l, fmt.Sprintf(format, args...)), result))
+		return result
+	}
+
+	if result := handle(`{"Command": "updatewsmessage", "Storage": %d, "ReqId": "%s", "WSId": "%s", "WSMessage": {"Message": "dXBkYXRlZA==", "IsBinary": true}}`, storageId, req.DbId, plain.DbId); !result.Success {
+		t.Fatalf("updating websocket message failed: %s", result.Reason)
+	}
+	if len(updates) != 1 || updates[0].Action != "WSMessageUpdated" || updates[0].Request == nil || updates[0].Request.DbId != req.DbId {
+		t.Errorf("incorrect notifications for an updated websocket message: %+v", updates)
+	}
+	stored, err := storage.LoadWSMessage(plain.DbId)
+	testErr(t, err)
+	if string(stored.Message) != "updated" || stored.Type != websocket.BinaryMessage || stored.Direction != ToServer {
+		t.Errorf("websocket message was not updated in place: %+v", stored)
+	}
+	reloaded, err := storage.LoadRequest(req.DbId)
+	testErr(t, err)
+	if len(reloaded.WSMessages) != 2 {
+		t.Errorf("updated websocket message was removed from its session")
+	}
+
+	if result := handle(`{"Command": "updatewsmessage", "Storage": %d, "ReqId": "%s", "WSId": "%s", "WSMessage": {"Message": ""}}`, storageId, req.DbId, mangled.Unmangled.DbId); result.Success {
+		t.Errorf("unmangled version of a websocket message was updated")
+	}
+
+	// Messages saved without a request don't break watchers
+	watcher.WSMessageUpdated(storageId, storage, nil, mangled.Unmangled)
+
+	updates = updates[:0]
+	if result := handle(`{"Command": "deletewsmessage", "Storage": %d, "WSId": "%s"}`, storageId, plain.DbId); !result.Success {
+		t.Fatalf("deleting websocket message failed: %s", result.Reason)
+	}
+	if len(updates) != 1 || updates[0].Action != "WSMessageDeleted" || updates[0].MessageId != plain.DbId {
+		t.Errorf("incorrect notifications for a deleted websocket message: %+v", updates)
+	}
+	if _, err := storage.LoadWSMessage(plain.DbId); err == nil {
+		t.Errorf("websocket message was not deleted")
+	}
+	if result := handle(`{"Command": "deletewsmessage", "Storage": %d, "WSId": "%s"}`, storageId, plain.DbId); result.Success {
+		t.Errorf("deleting a websocket message that does not exist succeeded")
+	}
+}
+
+func TestImportFormats(t *testing.T) {
+	storage := NewBoundedMemoryStorage(0, 0)
+	defer storage.Close()
+	iproxy := NewInterceptingProxy(nil)
+	storageId := iproxy.AddMessageStorage(storage, "test")
+	l := NewProxyMessageListener(log.New(ioutil.Discard, "", 0), iproxy)
+
+	har := `{"log": {"entries": []}}`
+	data, err := json.Marshal([]byte(har))
+	testErr(t, err)
+	result := &errorMessage{}
+	testErr(t, json.Unmarshal(handleTestMessage(t, l, fmt.Sprintf(`{"Command": "import", "Storage": %d, "Format": "har", "Data": %s}`, storageId, data)), result))
+	if !result.Success {
+		t.Errorf("importing a har file failed: %s", result.Reason)
+	}
+
+	zap, err := json.Marshal([]byte(`<messages type="list"></messages>`))
+	testErr(t, err)
+	result = &errorMessage{}
+	testErr(t, json.Unmarshal(handleTestMessage(t, l, fmt.Sprintf(`{"Command": "import", "Storage": %d, "Format": "zap", "Data": %s}`, storageId, zap)), result))
+	if !result.Success {
+		t.Errorf("importing a zap export failed: %s", result.Reason)
+	}
+
+	result = &errorMessage{}
+	testErr(t, json.Unmarshal(handleTestMessage(t, l, fmt.Sprintf(`{"Command": "import", "Storage": %d, "Format": "pcap", "Data": %s}`, storageId, data)), result))
+	if result.Success {
+		t.Errorf("importing an unsupported format did not fail")
+	}
+}
+
+// A storage which fails to save any requests after the first limit
+type limitedStorage struct {
+	*BoundedMemoryStorage
+	limit int
+}
+
+func (ms *limitedStorage) SaveNewRequest(req *ProxyRequest) error {
+	if ms.limit == 0 {
+		return errors.New("storage is full")
+	}
+	ms.limit--
+	return ms.BoundedMemoryStorage.SaveNewRequest(req)
+}
+
+func TestCopyRequestsPartial(t *testing.T) {
+	src := NewBoundedMemoryStorage(0, 0)
+	dest := &limitedStorage{NewBoundedMemoryStorage(0, 0), 2}
+	iproxy := NewInterceptingProxy(nil)
+	srcId := iproxy.AddMessageStorage(src, "src")
+	destId := iproxy.AddMessageStorage(dest, "dest")
+	l := NewProxyMessageListener(log.New(ioutil.Discard, "", 0), iproxy)
+
+	for i := 0; i < 3; i++ {
+		testErr(t, SaveNewRequest(src, testReq()))
+	}
+
+	result := &copyRequestsResult{}
+	testErr(t, json.Unmarshal(handleTestMessage(t, l, fmt.Sprintf(`{"Command": "copyrequests", "SourceStorage": %d, "DestStorage": %d}`, srcId, destId)), result))
+	if result.Success || result.Reason == "" {
+		t.Errorf("copying more requests than the destination can hold did not fail")
+	}
+	if result.Copied != 2 || len(result.IdMap) != 2 {
+		t.Errorf("incorrect partial result: copied %d, %v", result.Copied, result.IdMap)
+	}
+	for srcReqId, destReqId := range result.IdMap {
+		if _, err := dest.LoadRequest(destReqId); err != nil {
+			t.Errorf("request %s was not copied to %s", srcReqId, destReqId)
+		}
+	}
+}
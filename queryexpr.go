@@ -0,0 +1,407 @@
+package puppy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// An operator in a QueryExpr
+type QueryOp int
+
+// Query expression operators
+const (
+	// Matches if the search arguments match the request
+	QueryTerm QueryOp = iota
+	// Matches if all of the children match
+	QueryAnd
+	// Matches if any of the children match
+	QueryOr
+	// Matches if the single child does not match
+	QueryNot
+)
+
+// A boolean expression of searches. Unlike MessageQuery, ANDs, ORs and NOTs can be nested in any order.
+type QueryExpr struct {
+	Op QueryOp
+	// The search arguments for a QueryTerm. Same arguments as NewRequestChecker
+	Args []interface{}
+	// The children of a QueryAnd, QueryOr or QueryNot
+	Children []*QueryExpr
+}
+
+// A QueryExpr in string form. Op is one of "term", "and", "or" or "not".
+type StrQueryExpr struct {
+	Op       string
+	Args     []string        `json:",omitempty"`
+	Children []*StrQueryExpr `json:",omitempty"`
+}
+
+// Returns an expression that matches if the search arguments match the request
+func TermExpr(args ...interface{}) *QueryExpr {
+	return &QueryExpr{Op: QueryTerm, Args: args}
+}
+
+// Returns an expression that matches if all of the children match. An AND with no children matches every request.
+func AndExpr(children ...*QueryExpr) *QueryExpr {
+	return &QueryExpr{Op: QueryAnd, Children: children}
+}
+
+// Returns an expression that matches if any of the children match. An OR with no children matches no requests.
+func OrExpr(children ...*QueryExpr) *QueryExpr {
+	return &QueryExpr{Op: QueryOr, Children: children}
+}
+
+// Returns an expression that matches if the child does not match
+func NotExpr(child *QueryExpr) *QueryExpr {
+	return &QueryExpr{Op: QueryNot, Children: []*QueryExpr{child}}
+}
+
+// Creates a RequestChecker from a QueryExpr. A nil expression matches every request.
+func CheckerFromQueryExpr(expr *QueryExpr) (RequestChecker, error) {
+	return checkerFromQueryExpr(nil, expr)
+}
+
+func checkerFromQueryExpr(sqr *savedQueryResolver, expr *QueryExpr) (RequestChecker, error) {
+	if expr == nil {
+		return func(req *ProxyRequest) bool { return true }, nil
+	}
+
+	switch expr.Op {
+	case QueryTerm:
+		return newRequestChecker(sqr, expr.Args...)
+	case QueryAnd, QueryOr:
+		checkers := make([]RequestChecker, len(expr.Children))
+		for i, child := range expr.Children {
+			checker, err := checkerFromQueryExpr(sqr, child)
+			if err != nil {
+				return nil, err
+			}
+			checkers[i] = checker
+		}
+		if expr.Op == QueryAnd {
+			return func(req *ProxyRequest) bool {
+				for _, checker := range checkers {
+					if !checker(req) {
+						return false
+					}
+				}
+				return true
+			}, nil
+		}
+		return func(req *ProxyRequest) bool {
+			for _, checker := range checkers {
+				if checker(req) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case QueryNot:
+		if len(expr.Children) != 1 {
+			return nil, errors.New("not expressions require exactly one child")
+		}
+		checker, err := checkerFromQueryExpr(sqr, expr.Children[0])
+		if err != nil {
+			return nil, err
+		}
+		return func(req *ProxyRequest) bool {
+			return !checker(req)
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid query operator: %d", expr.Op)
+	}
+}
+
+// Converts a MessageQuery into an AND of ORs
+func QueryExprFromMessageQuery(query MessageQuery) *QueryExpr {
+	expr := AndExpr()
+	for _, phrase := range query {
+		orExpr := OrExpr()
+		for _, args := range phrase {
+			orExpr.Children = append(orExpr.Children, TermExpr(args...))
+		}
+		expr.Children = append(expr.Children, orExpr)
+	}
+	return expr
+}
+
+// Converts a QueryExpr into an equivalent MessageQuery. Returns an error if the MessageQuery would be too large.
+func MessageQueryFromExpr(expr *QueryExpr) (MessageQuery, error) {
+	strExpr, err := QueryExprToStrExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+	strQuery, err := StrExprToStrQuery(strExpr)
+	if err != nil {
+		return nil, err
+	}
+	return StrQueryToMsgQuery(strQuery)
+}
+
+func queryOpGoToStr(op QueryOp) (string, error) {
+	switch op {
+	case QueryTerm:
+		return "term", nil
+	case QueryAnd:
+		return "and", nil
+	case QueryOr:
+		return "or", nil
+	case QueryNot:
+		return "not", nil
+	default:
+		return "", fmt.Errorf("invalid query operator: %d", op)
+	}
+}
+
+func queryOpStrToGo(op string) (QueryOp, error) {
+	switch op {
+	case "term":
+		return QueryTerm, nil
+	case "and":
+		return QueryAnd, nil
+	case "or":
+		return QueryOr, nil
+	case "not":
+		return QueryNot, nil
+	default:
+		return 0, fmt.Errorf("invalid query operator: %s", op)
+	}
+}
+
+// Converts a QueryExpr into a StrQueryExpr
+func QueryExprToStrExpr(expr *QueryExpr) (*StrQueryExpr, error) {
+	if expr == nil {
+		return nil, nil
+	}
+
+	op, err := queryOpGoToStr(expr.Op)
+	if err != nil {
+		return nil, err
+	}
+	strExpr := &StrQueryExpr{Op: op}
+
+	if expr.Op == QueryTerm {
+		strExpr.Args, err = CheckArgsGoToStr(expr.Args)
+		if err != nil {
+			return nil, err
+		}
+		return strExpr, nil
+	}
+
+	if expr.Op == QueryNot && len(expr.Children) != 1 {
+		return nil, errors.New("not expressions require exactly one child")
+	}
+	for _, child := range expr.Children {
+		strChild, err := QueryExprToStrExpr(child)
+		if err != nil {
+			return nil, err
+		}
+		strExpr.Children = append(strExpr.Children, strChild)
+	}
+	return strExpr, nil
+}
+
+// Converts a StrQueryExpr into a QueryExpr
+func StrExprToQueryExpr(strExpr *StrQueryExpr) (*QueryExpr, error) {
+	if strExpr == nil {
+		return nil, nil
+	}
+
+	op, err := queryOpStrToGo(strExpr.Op)
+	if err != nil {
+		return nil, err
+	}
+	expr := &QueryExpr{Op: op}
+
+	if op == QueryTerm {
+		expr.Args, err = CheckArgsStrToGo(strExpr.Args)
+		if err != nil {
+			return nil, err
+		}
+		return expr, nil
+	}
+
+	if op == QueryNot && len(strExpr.Children) != 1 {
+		return nil, errors.New("not expressions require exactly one child")
+	}
+	for _, strChild := range strExpr.Children {
+		child, err := StrExprToQueryExpr(strChild)
+		if err != nil {
+			return nil, err
+		}
+		expr.Children = append(expr.Children, child)
+	}
+	return expr, nil
+}
+
+// Converts a StrMessageQuery into an AND of ORs
+func StrQueryToStrExpr(query StrMessageQuery) *StrQueryExpr {
+	expr := &StrQueryExpr{Op: "and"}
+	for _, phrase := range query {
+		orExpr := &StrQueryExpr{Op: "or"}
+		for _, args := range phrase {
+			orExpr.Children = append(orExpr.Children, &StrQueryExpr{Op: "term", Args: args})
+		}
+		expr.Children = append(expr.Children, orExpr)
+	}
+	return expr
+}
+
+// Converts a StrQueryExpr into an equivalent StrMessageQuery. NOTs are pushed down to the terms using FieldInvert and ORs are distributed over ANDs. Returns an error if the result would be too large.
+func StrExprToStrQuery(expr *StrQueryExpr) (StrMessageQuery, error) {
+	if expr == nil {
+		return StrMessageQuery{}, nil
+	}
+	return strExprToStrQuery(expr, false)
+}
+
+func strExprToStrQuery(expr *StrQueryExpr, negate bool) (StrMessageQuery, error) {
+	if expr == nil {
+		return nil, errors.New("expressions can't have nil children")
+	}
+
+	op := expr.Op
+	if negate {
+		switch op {
+		case "and":
+			op = "or"
+		case "or":
+			op = "and"
+		}
+	}
+
+	switch op {
+	case "term":
+		if len(expr.Args) == 0 {
+			return nil, errors.New("missing field")
+		}
+		args := expr.Args
+		if negate {
+			args = invertStrArgs(args)
+		}
+		return StrMessageQuery{StrQueryPhrase{args}}, nil
+	case "not":
+		if len(expr.Children) != 1 {
+			return nil, errors.New("not expressions require exactly one child")
+		}
+		return strExprToStrQuery(expr.Children[0], !negate)
+	case "and":
+		result := StrMessageQuery{}
+		for _, child := range expr.Children {
+			childQuery, err := strExprToStrQuery(child, negate)
+			if err != nil {
+				return nil, err
+			}
+			if len(result)+len(childQuery) > maxQueryPhrases {
+				return nil, errors.New("query is too complex")
+			}
+			result = append(result, childQuery...)
+		}
+		return result, nil
+	case "or":
+		// Start with a single empty phrase, which doesn't match anything
+		result := StrMessageQuery{StrQueryPhrase{}}
+		for _, child := range expr.Children {
+			childQuery, err := strExprToStrQuery(child, negate)
+			if err != nil {
+				return nil, err
+			}
+			if len(result)*len(childQuery) > maxQueryPhrases {
+				return nil, errors.New("query is too complex")
+			}
+			distributed := make(StrMessageQuery, 0, len(result)*len(childQuery))
+			for _, lphrase := range result {
+				for _, rphrase := range childQuery {
+					phrase := make(StrQueryPhrase, 0, len(lphrase)+len(rphrase))
+					phrase = append(phrase, lphrase...)
+					phrase = append(phrase, rphrase...)
+					distributed = append(distributed, phrase)
+				}
+			}
+			result = distributed
+		}
+		return result, nil
+	default:
+		return nil, fmt.Errorf("invalid query operator: %s", expr.Op)
+	}
+}
+
+// Allows a StrQueryExpr to be given either as an object or as a text query
+func (e *StrQueryExpr) UnmarshalJSON(b []byte) error {
+	var text string
+	if err := json.Unmarshal(b, &text); err == nil {
+		expr, err := ParseStrQueryExpr(text)
+		if err != nil {
+			return err
+		}
+		*e = *expr
+		return nil
+	}
+
+	// Use a type without the UnmarshalJSON method to avoid recursing
+	type strQueryExprJSON StrQueryExpr
+	var raw strQueryExprJSON
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	*e = StrQueryExpr(raw)
+	return nil
+}
+
+// Returns a SavedQuery for a query that was stored in string form. If strExpr is nil, the query was saved as a MessageQuery. If the expression is too complex to be converted into a MessageQuery, Query is left as nil.
+func savedQueryFromStr(name string, strQuery StrMessageQuery, strExpr *StrQueryExpr) (*SavedQuery, error) {
+	if strExpr == nil {
+		query, err := StrQueryToMsgQuery(strQuery)
+		if err != nil {
+			return nil, err
+		}
+		return &SavedQuery{Name: name, Query: query, Expr: QueryExprFromMessageQuery(query)}, nil
+	}
+
+	expr, err := StrExprToQueryExpr(strExpr)
+	if err != nil {
+		return nil, err
+	}
+	query, _ := MessageQueryFromExpr(expr)
+	return &SavedQuery{Name: name, Query: query, Expr: expr}, nil
+}
+
+// Returns the string form of an expression to be saved in a storage along with its StrMessageQuery form if it can be converted into one
+func strExprForSaving(expr *QueryExpr) (StrMessageQuery, *StrQueryExpr, error) {
+	if expr == nil {
+		return nil, nil, errors.New("query expression is required")
+	}
+	strExpr, err := QueryExprToStrExpr(expr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating string version of query: %s", err.Error())
+	}
+	if _, err := checkerFromQueryExpr(&savedQueryResolver{}, expr); err != nil {
+		return nil, nil, err
+	}
+	strQuery, _ := StrExprToStrQuery(strExpr)
+	return strQuery, strExpr, nil
+}
+
+// Returns the string forms of a SavedQuery to be saved in a storage. Expr is used if it is set, otherwise the query is saved as a MessageQuery and strExpr is nil
+func savedQueryForSaving(sq *SavedQuery) (StrMessageQuery, *StrQueryExpr, error) {
+	if sq.Name == "" {
+		return nil, nil, errors.New("query name is required")
+	}
+	if sq.Expr != nil {
+		return strExprForSaving(sq.Expr)
+	}
+	strQuery, err := MsgQueryToStrQuery(sq.Query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating string version of query: %s", err.Error())
+	}
+	return strQuery, nil, nil
+}
+
+// Returns the MessageQuery version of a loaded query or an error if it is too complex to be converted
+func savedMessageQuery(sq *SavedQuery) (MessageQuery, error) {
+	if sq.Query == nil {
+		return nil, fmt.Errorf("query %s is too complex to be converted into a MessageQuery", sq.Name)
+	}
+	return sq.Query, nil
+}
@@ -0,0 +1,172 @@
+package puppy
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestQueryExprChecker(t *testing.T) {
+	req := testReq()
+	tests := []struct {
+		expr     *QueryExpr
+		expected bool
+	}{
+		{AndExpr(), true},
+		{OrExpr(), false},
+		{TermExpr(FieldMethod, StrIs, "POST"), true},
+		{NotExpr(TermExpr(FieldMethod, StrIs, "POST")), false},
+		{AndExpr(TermExpr(FieldMethod, StrIs, "POST"), TermExpr(FieldPath, StrContains, "nope")), false},
+		{OrExpr(TermExpr(FieldMethod, StrIs, "GET"), TermExpr(FieldRequestBody, StrContains, "baz")), true},
+		{
+			NotExpr(AndExpr(
+				TermExpr(FieldMethod, StrIs, "POST"),
+				OrExpr(TermExpr(FieldStatusCode, StrIs, "200"), TermExpr(FieldTag, StrIs, "foo")),
+			)),
+			false,
+		},
+	}
+
+	for i, test := range tests {
+		checker, err := CheckerFromQueryExpr(test.expr)
+		if err != nil {
+			t.Errorf("error creating checker %d: %s", i, err)
+			continue
+		}
+		if checker(req) != test.expected {
+			t.Errorf("expected expression %d to return %v", i, test.expected)
+		}
+
+		// The MessageQuery version must give the same result
+		query, err := MessageQueryFromExpr(test.expr)
+		if err != nil {
+			t.Errorf("error converting expression %d: %s", i, err)
+			continue
+		}
+		queryChecker, err := CheckerFromMessageQuery(query)
+		if err != nil {
+			t.Errorf("error creating checker for query %d: %s", i, err)
+			continue
+		}
+		if queryChecker(req) != test.expected {
+			t.Errorf("expected query %d to return %v", i, test.expected)
+		}
+	}
+}
+
+func TestQueryExprFromMessageQuery(t *testing.T) {
+	strQuery := StrMessageQuery{
+		{{"host", "is", "foo"}, {"invert", "tag", "is", "bar"}},
+		{{"method", "is", "GET"}},
+	}
+	query, err := StrQueryToMsgQuery(strQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := MessageQueryFromExpr(QueryExprFromMessageQuery(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resultStr, err := MsgQueryToStrQuery(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(resultStr, strQuery) {
+		t.Errorf("expected %v, got %v", strQuery, resultStr)
+	}
+}
+
+func TestQueryExprTooComplex(t *testing.T) {
+	// (a1 AND b1) OR (a2 AND b2) OR ... doubles in size with each OR
+	expr := OrExpr()
+	for i := 0; i < 10; i++ {
+		expr.Children = append(expr.Children, AndExpr(
+			TermExpr(FieldHost, StrIs, "a"),
+			TermExpr(FieldPath, StrIs, "b"),
+		))
+	}
+
+	if _, err := MessageQueryFromExpr(expr); err == nil {
+		t.Error("expected an error converting a large expression")
+	}
+	if _, err := CheckerFromQueryExpr(expr); err != nil {
+		t.Errorf("error creating checker for a large expression: %s", err)
+	}
+}
+
+func TestStrQueryExprRoundTrip(t *testing.T) {
+	texts := []string{
+		"host:example.com AND (status:5* OR body~error) AND NOT tag:ignored",
+		"NOT (a AND (b OR c))",
+		"(a AND b) AND c",
+		"method=GET OR (port>8000 AND NOT header[Host]=foo)",
+	}
+
+	for _, text := range texts {
+		strExpr, err := ParseStrQueryExpr(text)
+		if err != nil {
+			t.Errorf("error parsing %q: %s", text, err)
+			continue
+		}
+		expr, err := StrExprToQueryExpr(strExpr)
+		if err != nil {
+			t.Errorf("error converting %q: %s", text, err)
+			continue
+		}
+		result, err := FormatQueryExpr(expr)
+		if err != nil {
+			t.Errorf("error formatting %q: %s", text, err)
+			continue
+		}
+		reparsed, err := ParseStrQueryExpr(result)
+		if err != nil {
+			t.Errorf("error parsing formatted query %q: %s", result, err)
+			continue
+		}
+		// Field aliases are replaced with their full names so compare the formatted versions
+		reformatted, err := FormatStrQueryExpr(reparsed)
+		if err != nil {
+			t.Errorf("error formatting %q: %s", result, err)
+			continue
+		}
+		if reformatted != result {
+			t.Errorf("round trip of %q through %q gave %q", text, result, reformatted)
+		}
+		if len(reparsed.Children) != len(strExpr.Children) || reparsed.Op != strExpr.Op {
+			t.Errorf("round trip of %q changed the structure of the expression", text)
+		}
+	}
+}
+
+func TestStrQueryExprUnmarshal(t *testing.T) {
+	var msg struct {
+		Expr *StrQueryExpr
+	}
+
+	expected := &StrQueryExpr{Op: "not", Children: []*StrQueryExpr{
+		{Op: "or", Children: []*StrQueryExpr{
+			{Op: "term", Args: []string{"host", "contains", "foo"}},
+			{Op: "term", Args: []string{"tag", "contains", "bar"}},
+		}},
+	}}
+
+	if err := json.Unmarshal([]byte(`{"Expr": "NOT (host:foo OR tag:bar)"}`), &msg); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(msg.Expr, expected) {
+		t.Errorf("expected %v, got %v", expected, msg.Expr)
+	}
+
+	b, err := json.Marshal(expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Expr = nil
+	if err := json.Unmarshal([]byte(`{"Expr": `+string(b)+`}`), &msg); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(msg.Expr, expected) {
+		t.Errorf("expected %v, got %v", expected, msg.Expr)
+	}
+}
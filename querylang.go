@@ -0,0 +1,938 @@
+package puppy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Text query language
+
+Queries can be written as text instead of nested lists of arguments. A query is
+made of terms combined with AND, OR, NOT and parentheses. Terms next to each other
+are ANDed together. For example:
+
+	host:example.com AND (status:5* OR body~"error") AND NOT tag:ignored
+
+Terms take the following forms:
+
+	word                 all:word
+	field:value          field contains value. Unquoted values containing * are globs
+	field=value          field is value
+	field~value          field contains a match for the regexp value
+	field>n, field<n     numeric comparisons for numeric fields and status codes. >= and
+	                     <= are also supported and spaces are allowed around the operator
+	field:lo..hi         numeric range, inclusive. Also used for timerange
+	field[key]:value     key/value fields where the key is exactly key. For JSON and
+	                     XML fields the key is a JSONPath or XPath expression
+	field(arg arg ...)   the raw arguments to CheckArgsStrToGo
+	unmangled:term       term matches the messages as they were before being modified.
+	                     unmangled:(expr) applies to every term in expr
+
+after, before and timerange take RFC3339 times or nanoseconds since the epoch.
+savedquery=name matches the requests that match the query saved with that name.
+*/
+
+// The maximum number of phrases a text query can expand to when it is converted into a MessageQuery
+const maxQueryPhrases = 256
+
+// An error returned when a text query can't be parsed. Offset is the byte offset in the query where the error was found.
+type QueryParseError struct {
+	Offset int
+	Msg    string
+}
+
+func (e *QueryParseError) Error() string {
+	return fmt.Sprintf("error parsing query at position %d: %s", e.Offset, e.Msg)
+}
+
+type queryParser struct {
+	text string
+	pos  int
+}
+
+func (p *queryParser) errorf(offset int, format string, a ...interface{}) error {
+	return &QueryParseError{Offset: offset, Msg: fmt.Sprintf(format, a...)}
+}
+
+func (p *queryParser) skipSpace() {
+	for p.pos < len(p.text) && isQuerySpace(p.text[p.pos]) {
+		p.pos++
+	}
+}
+
+func (p *queryParser) done() bool {
+	p.skipSpace()
+	return p.pos >= len(p.text)
+}
+
+// Returns the keyword at the current position or an empty string if there isn't one
+func (p *queryParser) peekKeyword() string {
+	p.skipSpace()
+	end := p.pos
+	for end < len(p.text) && !isQuerySpace(p.text[end]) && p.text[end] != '(' && p.text[end] != ')' {
+		end++
+	}
+	word := strings.ToUpper(p.text[p.pos:end])
+	switch word {
+	case "AND", "OR", "NOT":
+		return word
+	}
+	return ""
+}
+
+func (p *queryParser) consumeKeyword() {
+	p.skipSpace()
+	for p.pos < len(p.text) && !isQuerySpace(p.text[p.pos]) && p.text[p.pos] != '(' && p.text[p.pos] != ')' {
+		p.pos++
+	}
+}
+
+func (p *queryParser) parseOr() (*StrQueryExpr, error) {
+	expr, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	children := []*StrQueryExpr{expr}
+	for p.peekKeyword() == "OR" {
+		p.consumeKeyword()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, right)
+	}
+	if len(children) == 1 {
+		return expr, nil
+	}
+	return &StrQueryExpr{Op: "or", Children: children}, nil
+}
+
+func (p *queryParser) parseAnd() (*StrQueryExpr, error) {
+	expr, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	children := []*StrQueryExpr{expr}
+	for {
+		if p.done() || p.text[p.pos] == ')' || p.peekKeyword() == "OR" {
+			break
+		}
+		if p.peekKeyword() == "AND" {
+			p.consumeKeyword()
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, right)
+	}
+	if len(children) == 1 {
+		return expr, nil
+	}
+	return &StrQueryExpr{Op: "and", Children: children}, nil
+}
+
+func (p *queryParser) parseUnary() (*StrQueryExpr, error) {
+	if p.done() {
+		return nil, p.errorf(p.pos, "expected a search term")
+	}
+
+	switch p.peekKeyword() {
+	case "NOT":
+		p.consumeKeyword()
+		child, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &StrQueryExpr{Op: "not", Children: []*StrQueryExpr{child}}, nil
+	case "AND", "OR":
+		return nil, p.errorf(p.pos, "expected a search term")
+	}
+
+	if p.text[p.pos] == '(' {
+		start := p.pos
+		p.pos++
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.done() || p.text[p.pos] != ')' {
+			return nil, p.errorf(start, "unclosed parenthesis")
+		}
+		p.pos++
+		return node, nil
+	}
+
+	if p.text[p.pos] == ')' {
+		return nil, p.errorf(p.pos, "unexpected closing parenthesis")
+	}
+
+	return p.parseTerm()
+}
+
+// Parses a quoted string starting at the current position
+func (p *queryParser) parseQuoted() (string, error) {
+	start := p.pos
+	p.pos++
+	var sb strings.Builder
+	for p.pos < len(p.text) {
+		c := p.text[p.pos]
+		switch c {
+		case '\\':
+			if p.pos+1 >= len(p.text) {
+				return "", p.errorf(p.pos, "unfinished escape sequence")
+			}
+			sb.WriteByte(p.text[p.pos+1])
+			p.pos += 2
+		case '"':
+			p.pos++
+			return sb.String(), nil
+		default:
+			sb.WriteByte(c)
+			p.pos++
+		}
+	}
+	return "", p.errorf(start, "unterminated quoted string")
+}
+
+// Parses a value. Returns the value and whether it was quoted.
+func (p *queryParser) parseValue(stop string) (string, bool, error) {
+	if p.pos < len(p.text) && p.text[p.pos] == '"' {
+		val, err := p.parseQuoted()
+		return val, true, err
+	}
+	start := p.pos
+	for p.pos < len(p.text) && !isQuerySpace(p.text[p.pos]) && !strings.ContainsRune(stop, rune(p.text[p.pos])) {
+		p.pos++
+	}
+	if p.pos == start {
+		return "", false, p.errorf(start, "expected a value")
+	}
+	return p.text[start:p.pos], false, nil
+}
+
+// Parses a value or a range of values in the form lo..hi
+func (p *queryParser) parseRange() ([]string, error) {
+	if p.pos < len(p.text) && p.text[p.pos] == '"' {
+		lo, err := p.parseQuoted()
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(p.text[p.pos:], "..") {
+			return []string{lo}, nil
+		}
+		p.pos += 2
+		hi, _, err := p.parseValue("()\"")
+		if err != nil {
+			return nil, err
+		}
+		return []string{lo, hi}, nil
+	}
+
+	val, _, err := p.parseValue("()\"")
+	if err != nil {
+		return nil, err
+	}
+	if i := strings.Index(val, ".."); i >= 0 {
+		if i == 0 || i+2 == len(val) {
+			return nil, p.errorf(p.pos-len(val), "ranges require a start and an end")
+		}
+		return []string{val[:i], val[i+2:]}, nil
+	}
+	return []string{val}, nil
+}
+
+func (p *queryParser) parseTerm() (*StrQueryExpr, error) {
+	start := p.pos
+
+	// A quoted word searches every field
+	if p.text[p.pos] == '"' {
+		val, err := p.parseQuoted()
+		if err != nil {
+			return nil, err
+		}
+		return &StrQueryExpr{Op: "term", Args: []string{"all", "contains", val}}, nil
+	}
+
+	identEnd := p.pos
+	for identEnd < len(p.text) && isQueryIdentChar(p.text[identEnd]) {
+		identEnd++
+	}
+
+	// Comparisons may have spaces before the operator, as in status >= 500
+	opPos := identEnd
+	for opPos < len(p.text) && isQuerySpace(p.text[opPos]) {
+		opPos++
+	}
+	if opPos >= len(p.text) || (p.text[opPos] != '<' && p.text[opPos] != '>') {
+		opPos = identEnd
+	} else if _, err := fieldStrToGo(p.text[p.pos:identEnd]); err != nil {
+		opPos = identEnd
+	}
+
+	if identEnd == p.pos || opPos >= len(p.text) || !strings.ContainsRune(":=~<>[(", rune(p.text[opPos])) {
+		// A bare word searches every field
+		val, quoted, err := p.parseValue("()\"")
+		if err != nil {
+			return nil, err
+		}
+		return &StrQueryExpr{Op: "term", Args: globArgs("all", val, quoted)}, nil
+	}
+
+	fieldStr := p.text[p.pos:identEnd]
+	field, err := fieldStrToGo(fieldStr)
+	if err != nil {
+		return nil, p.errorf(start, "invalid field: %s", fieldStr)
+	}
+	p.pos = opPos
+
+	var args []string
+	switch {
+	case field == FieldUnmangled && p.text[p.pos] == ':':
+		// unmangled:term runs the following term on the unmangled messages
+		p.pos++
+		if p.done() || p.text[p.pos] == ')' {
+			return nil, p.errorf(p.pos, "expected a term after %s:", fieldStr)
+		}
+		if p.text[p.pos] == '(' {
+			// unmangled:(expr) runs every term in the group on the unmangled messages
+			group, err := p.parseUnary()
+			if err != nil {
+				return nil, err
+			}
+			return prefixTerms(group, fieldStr), nil
+		}
+		inner, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		args = append([]string{fieldStr}, inner.Args...)
+	case p.text[p.pos] == '(':
+		args, err = p.parseRawArgs(fieldStr)
+	case p.text[p.pos] == '[':
+		args, err = p.parseKeyTerm(field, fieldStr)
+	default:
+		args, err = p.parseFieldTerm(field, fieldStr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Check the arguments now so that the error points at the term
+	if _, err := CheckArgsStrToGo(args); err != nil {
+		return nil, p.errorf(start, "%s", err.Error())
+	}
+	return &StrQueryExpr{Op: "term", Args: args}, nil
+}
+
+// Parses the raw form of a term, field(arg arg ...)
+func (p *queryParser) parseRawArgs(fieldStr string) ([]string, error) {
+	start := p.pos
+	p.pos++
+	args := []string{fieldStr}
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.text) {
+			return nil, p.errorf(start, "unclosed parenthesis")
+		}
+		if p.text[p.pos] == ')' {
+			p.pos++
+			return args, nil
+		}
+		val, _, err := p.parseValue("()\"")
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, val)
+	}
+}
+
+// Parses the key of a key/value term. Unquoted keys may contain balanced brackets so that paths such as $.items[0] can be used as keys.
+func (p *queryParser) parseKey() (string, error) {
+	if p.pos < len(p.text) && p.text[p.pos] == '"' {
+		return p.parseQuoted()
+	}
+	start := p.pos
+	depth := 0
+	for p.pos < len(p.text) && !isQuerySpace(p.text[p.pos]) {
+		if p.text[p.pos] == '[' {
+			depth++
+		} else if p.text[p.pos] == ']' {
+			if depth == 0 {
+				break
+			}
+			depth--
+		}
+		p.pos++
+	}
+	if p.pos == start {
+		return "", p.errorf(start, "expected a key")
+	}
+	return p.text[start:p.pos], nil
+}
+
+// Parses a term for a key/value field with a key, field[key]<op>value
+func (p *queryParser) parseKeyTerm(field SearchField, fieldStr string) ([]string, error) {
+	if !isKvField(field) {
+		return nil, p.errorf(p.pos, "%s does not take a key", fieldStr)
+	}
+	p.pos++
+	key, err := p.parseKey()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos >= len(p.text) || p.text[p.pos] != ']' {
+		return nil, p.errorf(p.pos, "expected ]")
+	}
+	p.pos++
+
+	if p.pos >= len(p.text) || !strings.ContainsRune(":=~", rune(p.text[p.pos])) {
+		return nil, p.errorf(p.pos, "expected :, = or ~ after key")
+	}
+	op := p.text[p.pos]
+	p.pos++
+	val, quoted, err := p.parseValue("()\"")
+	if err != nil {
+		return nil, err
+	}
+	args := []string{fieldStr, "is", key}
+	return append(args, opArgs(op, val, quoted)...), nil
+}
+
+// Parses a term in the form field<op>value
+func (p *queryParser) parseFieldTerm(field SearchField, fieldStr string) ([]string, error) {
+	op := p.text[p.pos]
+	opPos := p.pos
+	p.pos++
+
+	switch {
+	case field == FieldAfter || field == FieldBefore:
+		if op != ':' && op != '=' {
+			return nil, p.errorf(opPos, "%s must be followed by :", fieldStr)
+		}
+		valPos := p.pos
+		val, _, err := p.parseValue("()\"")
+		if err != nil {
+			return nil, err
+		}
+		ns, err := queryTimeToNanos(val)
+		if err != nil {
+			return nil, p.errorf(valPos, "%s", err.Error())
+		}
+		return []string{fieldStr, ns}, nil
+
+	case field == FieldTimeRange:
+		if op != ':' && op != '=' {
+			return nil, p.errorf(opPos, "%s must be followed by :", fieldStr)
+		}
+		valPos := p.pos
+		vals, err := p.parseRange()
+		if err != nil {
+			return nil, err
+		}
+		if len(vals) != 2 {
+			return nil, p.errorf(valPos, "%s requires a range in the form start..end", fieldStr)
+		}
+		args := []string{fieldStr}
+		for _, val := range vals {
+			ns, err := queryTimeToNanos(val)
+			if err != nil {
+				return nil, p.errorf(valPos, "%s", err.Error())
+			}
+			args = append(args, ns)
+		}
+		return args, nil
+
+	case isNumField(field) || (field == FieldStatusCode && (op == '<' || op == '>' || p.rangeAhead())):
+		switch op {
+		case '<', '>':
+			cmp := string(op)
+			if p.pos < len(p.text) && p.text[p.pos] == '=' {
+				cmp += "="
+				p.pos++
+			}
+			cmp = map[string]string{"<": "lt", ">": "gt", "<=": "le", ">=": "ge"}[cmp]
+			p.skipSpace()
+			val, _, err := p.parseValue("()\"")
+			if err != nil {
+				return nil, err
+			}
+			return []string{fieldStr, cmp, val}, nil
+		case ':', '=':
+			vals, err := p.parseRange()
+			if err != nil {
+				return nil, err
+			}
+			if len(vals) == 2 {
+				return []string{fieldStr, "between", vals[0], vals[1]}, nil
+			}
+			return []string{fieldStr, "eq", vals[0]}, nil
+		default:
+			return nil, p.errorf(opPos, "%s is a numeric field and must be followed by :, =, < or >", fieldStr)
+		}
+
+	default:
+		if op == '<' || op == '>' {
+			return nil, p.errorf(opPos, "%s is not a numeric field", fieldStr)
+		}
+		val, quoted, err := p.parseValue("()\"")
+		if err != nil {
+			return nil, err
+		}
+		return append([]string{fieldStr}, opArgs(op, val, quoted)...), nil
+	}
+}
+
+// Returns a copy of an expression with every term run on the field given by prefix
+func prefixTerms(expr *StrQueryExpr, prefix string) *StrQueryExpr {
+	if expr.Op == "term" {
+		return &StrQueryExpr{Op: "term", Args: append([]string{prefix}, expr.Args...)}
+	}
+	children := make([]*StrQueryExpr, len(expr.Children))
+	for i, child := range expr.Children {
+		children[i] = prefixTerms(child, prefix)
+	}
+	return &StrQueryExpr{Op: expr.Op, Children: children}
+}
+
+// Returns whether the bare value at the current position is a range
+func (p *queryParser) rangeAhead() bool {
+	end := p.pos
+	for end < len(p.text) && !isQuerySpace(p.text[end]) && !strings.ContainsRune("()\"", rune(p.text[end])) {
+		end++
+	}
+	return strings.Contains(p.text[p.pos:end], "..")
+}
+
+// Returns the comparer and value arguments for a string operator
+func opArgs(op byte, val string, quoted bool) []string {
+	switch op {
+	case '=':
+		return []string{"is", val}
+	case '~':
+		return []string{"containsregexp", val}
+	default:
+		return globArgs("", val, quoted)[1:]
+	}
+}
+
+// Returns the arguments to search a field for a value. Unquoted values containing * are treated as globs.
+func globArgs(fieldStr string, val string, quoted bool) []string {
+	if quoted || !strings.Contains(val, "*") {
+		return []string{fieldStr, "contains", val}
+	}
+	parts := strings.Split(val, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return []string{fieldStr, "containsregexp", "^" + strings.Join(parts, ".*") + "$"}
+}
+
+// Converts an RFC3339 time or a number of nanoseconds into a string of nanoseconds since the epoch
+func queryTimeToNanos(val string) (string, error) {
+	if _, err := strconv.ParseInt(val, 10, 64); err == nil {
+		return val, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, val)
+	if err != nil {
+		return "", fmt.Errorf("invalid time: %s", val)
+	}
+	return strconv.FormatInt(t.UnixNano(), 10), nil
+}
+
+func isQuerySpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func isQueryIdentChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_'
+}
+
+func isKvField(field SearchField) bool {
+	switch field {
+	case FieldRequestHeaders, FieldResponseHeaders, FieldBothHeaders, FieldBothParam, FieldURLParam, FieldPostParam, FieldResponseCookie, FieldRequestCookie, FieldBothCookie, FieldRequestJSON, FieldResponseJSON, FieldBothJSON, FieldRequestXML, FieldResponseXML, FieldBothXML, FieldMultipart:
+		return true
+	}
+	return false
+}
+
+func isNumField(field SearchField) bool {
+	switch field {
+	case FieldDuration, FieldRequestBodySize, FieldResponseBodySize, FieldWSMessageCount, FieldPort, FieldDNSTime, FieldConnectTime, FieldProxyConnectTime, FieldTLSTime, FieldTimeToFirstByte, FieldTransferTime:
+		return true
+	}
+	return false
+}
+
+// Returns the inverse of a set of query arguments, removing an existing invert rather than adding another one
+func invertStrArgs(args []string) []string {
+	if len(args) > 0 {
+		if field, err := fieldStrToGo(args[0]); err == nil && field == FieldInvert {
+			return args[1:]
+		}
+	}
+	return append([]string{"invert"}, args...)
+}
+
+// Parses a text query into a StrQueryExpr. An empty query returns an AND with no children which matches every request.
+func ParseStrQueryExpr(text string) (*StrQueryExpr, error) {
+	p := &queryParser{text: text}
+	if p.done() {
+		return &StrQueryExpr{Op: "and"}, nil
+	}
+
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if !p.done() {
+		return nil, p.errorf(p.pos, "unexpected closing parenthesis")
+	}
+	return expr, nil
+}
+
+// Parses a text query into a QueryExpr
+func ParseQueryExpr(text string) (*QueryExpr, error) {
+	strExpr, err := ParseStrQueryExpr(text)
+	if err != nil {
+		return nil, err
+	}
+	return StrExprToQueryExpr(strExpr)
+}
+
+// Parses a text query into a StrMessageQuery. An empty query returns an empty StrMessageQuery which matches every request.
+func ParseStrQuery(text string) (StrMessageQuery, error) {
+	expr, err := ParseStrQueryExpr(text)
+	if err != nil {
+		return nil, err
+	}
+
+	query, err := StrExprToStrQuery(expr)
+	if err != nil {
+		return nil, &QueryParseError{Offset: 0, Msg: err.Error()}
+	}
+	return query, nil
+}
+
+// Parses a text query into a MessageQuery
+func ParseQuery(text string) (MessageQuery, error) {
+	strQuery, err := ParseStrQuery(text)
+	if err != nil {
+		return nil, err
+	}
+	return StrQueryToMsgQuery(strQuery)
+}
+
+// Returns a value quoted if it would otherwise be read as something else
+func quoteQueryValue(val string) string {
+	needsQuote := val == "" || strings.ContainsAny(val, " \t\r\n\"\\()*[]") || strings.Contains(val, "..")
+	switch strings.ToUpper(val) {
+	case "AND", "OR", "NOT":
+		needsQuote = true
+	}
+	if !needsQuote {
+		return val
+	}
+	val = strings.Replace(val, "\\", "\\\\", -1)
+	val = strings.Replace(val, "\"", "\\\"", -1)
+	return "\"" + val + "\""
+}
+
+// Returns a key quoted if it would otherwise be read as something else. Keys with balanced brackets don't need to be quoted.
+func quoteQueryKey(key string) string {
+	depth := 0
+	balanced := key != "" && !strings.ContainsAny(key, " \t\r\n\"\\")
+	for _, c := range key {
+		if c == '[' {
+			depth++
+		} else if c == ']' {
+			depth--
+			if depth < 0 {
+				balanced = false
+			}
+		}
+	}
+	if balanced && depth == 0 {
+		return key
+	}
+	return quoteQueryValue(key)
+}
+
+func formatRawArgs(args []string) string {
+	vals := make([]string, len(args)-1)
+	for i, arg := range args[1:] {
+		vals[i] = quoteQueryValue(arg)
+	}
+	return args[0] + "(" + strings.Join(vals, " ") + ")"
+}
+
+// Formats a string comparer and value with the given prefix. Returns false if there is no text form for the comparer.
+func formatCmpVal(prefix string, cmp string, val string) (string, bool) {
+	switch cmp {
+	case "contains", "ct":
+		return prefix + ":" + quoteQueryValue(val), true
+	case "is":
+		return prefix + "=" + quoteQueryValue(val), true
+	case "containsregexp", "ctr":
+		if glob, ok := regexpToGlob(val); ok {
+			return prefix + ":" + glob, true
+		}
+		return prefix + "~" + quoteQueryValue(val), true
+	}
+	return "", false
+}
+
+// Returns the glob that globArgs turns into the given regexp. Returns false if the regexp was not created from a glob
+// or if the glob would have to be quoted, which would make it a plain string.
+func regexpToGlob(re string) (string, bool) {
+	if !strings.HasPrefix(re, "^") || !strings.HasSuffix(re, "$") || len(re) < 2 {
+		return "", false
+	}
+	parts := strings.Split(re[1:len(re)-1], ".*")
+	if len(parts) < 2 {
+		return "", false
+	}
+	for i, part := range parts {
+		var sb strings.Builder
+		for j := 0; j < len(part); j++ {
+			if part[j] == '\\' && j+1 < len(part) {
+				j++
+			}
+			sb.WriteByte(part[j])
+		}
+		unquoted := sb.String()
+		if regexp.QuoteMeta(unquoted) != part || (unquoted != "" && quoteQueryValue(unquoted) != unquoted) {
+			return "", false
+		}
+		parts[i] = unquoted
+	}
+	return strings.Join(parts, "*"), true
+}
+
+func formatNanos(val string) string {
+	ns, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return quoteQueryValue(val)
+	}
+	return time.Unix(0, ns).UTC().Format(time.RFC3339Nano)
+}
+
+// Formats a set of string query arguments as a text query term
+func formatQueryTerm(args []string) (string, error) {
+	if len(args) == 0 {
+		return "", errors.New("missing field")
+	}
+	field, err := fieldStrToGo(args[0])
+	if err != nil {
+		return "", err
+	}
+	fieldStr := args[0]
+	remaining := args[1:]
+
+	switch {
+	case field == FieldInvert:
+		term, err := formatQueryTerm(remaining)
+		if err != nil {
+			return "", err
+		}
+		return "NOT " + term, nil
+
+	case field == FieldUnmangled:
+		term, err := formatQueryTerm(remaining)
+		if err != nil {
+			return "", err
+		}
+		if !strings.HasPrefix(term, "NOT ") {
+			return fieldStr + ":" + term, nil
+		}
+
+	case field == FieldAfter || field == FieldBefore:
+		if len(remaining) == 1 {
+			return fieldStr + ":" + formatNanos(remaining[0]), nil
+		}
+
+	case field == FieldTimeRange:
+		if len(remaining) == 2 {
+			return fieldStr + ":" + formatNanos(remaining[0]) + ".." + formatNanos(remaining[1]), nil
+		}
+
+	case isNumField(field) || field == FieldStatusCode && hasNumComparer(remaining):
+		cmp, ok := numComparerStrToGo(firstArg(remaining))
+		if !ok || len(remaining) != numComparerArgs(cmp)+1 {
+			break
+		}
+		switch cmp {
+		case NumEqualTo:
+			// field=value is a string comparison for status codes
+			if field == FieldStatusCode {
+				break
+			}
+			return fieldStr + "=" + quoteQueryValue(remaining[1]), nil
+		case NumGreaterThan:
+			return fieldStr + ">" + quoteQueryValue(remaining[1]), nil
+		case NumLessThan:
+			return fieldStr + "<" + quoteQueryValue(remaining[1]), nil
+		case NumGreaterOrEqual:
+			return fieldStr + ">=" + quoteQueryValue(remaining[1]), nil
+		case NumLessOrEqual:
+			return fieldStr + "<=" + quoteQueryValue(remaining[1]), nil
+		case NumBetween:
+			return fieldStr + ":" + quoteQueryValue(remaining[1]) + ".." + quoteQueryValue(remaining[2]), nil
+		}
+
+	case isKvField(field) && len(remaining) == 4:
+		if remaining[0] == "is" {
+			if term, ok := formatCmpVal(fieldStr+"["+quoteQueryKey(remaining[1])+"]", remaining[2], remaining[3]); ok {
+				return term, nil
+			}
+		}
+
+	default:
+		if len(remaining) == 2 {
+			if term, ok := formatCmpVal(fieldStr, remaining[0], remaining[1]); ok {
+				return term, nil
+			}
+		}
+	}
+	return formatRawArgs(args), nil
+}
+
+func firstArg(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	return args[0]
+}
+
+func hasNumComparer(args []string) bool {
+	_, ok := numComparerStrToGo(firstArg(args))
+	return ok
+}
+
+// Formats a StrMessageQuery as a text query
+func FormatStrQuery(query StrMessageQuery) (string, error) {
+	phraseStrs := make([]string, 0, len(query))
+	for _, phrase := range query {
+		termStrs := make([]string, 0, len(phrase))
+		for _, args := range phrase {
+			term, err := formatQueryTerm(args)
+			if err != nil {
+				return "", err
+			}
+			termStrs = append(termStrs, term)
+		}
+		if len(termStrs) == 0 {
+			return "", errors.New("query phrases must contain at least one term")
+		}
+		phraseStr := strings.Join(termStrs, " OR ")
+		if len(termStrs) > 1 && len(query) > 1 {
+			phraseStr = "(" + phraseStr + ")"
+		}
+		phraseStrs = append(phraseStrs, phraseStr)
+	}
+	return strings.Join(phraseStrs, " AND "), nil
+}
+
+// Formats a MessageQuery as a text query
+func FormatQuery(query MessageQuery) (string, error) {
+	strQuery, err := MsgQueryToStrQuery(query)
+	if err != nil {
+		return "", err
+	}
+	return FormatStrQuery(strQuery)
+}
+
+// Formats a StrQueryExpr as a text query
+func FormatStrQueryExpr(expr *StrQueryExpr) (string, error) {
+	if expr == nil || expr.Op == "and" && len(expr.Children) == 0 {
+		return "", nil
+	}
+	return formatStrExpr(expr)
+}
+
+func formatStrExpr(expr *StrQueryExpr) (string, error) {
+	if expr == nil {
+		return "", errors.New("expressions can't have nil children")
+	}
+
+	switch expr.Op {
+	case "term":
+		return formatQueryTerm(expr.Args)
+	case "not":
+		if len(expr.Children) != 1 {
+			return "", errors.New("not expressions require exactly one child")
+		}
+		childStr, err := formatStrExprChild(expr.Children[0])
+		if err != nil {
+			return "", err
+		}
+		return "NOT " + childStr, nil
+	case "and", "or":
+		if len(expr.Children) == 0 {
+			return "", fmt.Errorf("empty %s expressions can't be written as text", expr.Op)
+		}
+		childStrs := make([]string, len(expr.Children))
+		for i, child := range expr.Children {
+			childStr, err := formatStrExprChild(child)
+			if err != nil {
+				return "", err
+			}
+			childStrs[i] = childStr
+		}
+		return strings.Join(childStrs, " "+strings.ToUpper(expr.Op)+" "), nil
+	default:
+		return "", fmt.Errorf("invalid query operator: %s", expr.Op)
+	}
+}
+
+// Formats a child expression, wrapping it in parentheses if it combines more than one expression
+func formatStrExprChild(expr *StrQueryExpr) (string, error) {
+	str, err := formatStrExpr(expr)
+	if err != nil {
+		return "", err
+	}
+	if (expr.Op == "and" || expr.Op == "or") && len(expr.Children) > 1 {
+		return "(" + str + ")", nil
+	}
+	return str, nil
+}
+
+// Formats a QueryExpr as a text query
+func FormatQueryExpr(expr *QueryExpr) (string, error) {
+	strExpr, err := QueryExprToStrExpr(expr)
+	if err != nil {
+		return "", err
+	}
+	return FormatStrQueryExpr(strExpr)
+}
+
+// Allows a StrMessageQuery to be given either as a list of phrases or as a text query
+func (q *StrMessageQuery) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		*q = nil
+		return nil
+	}
+
+	var text string
+	if err := json.Unmarshal(b, &text); err == nil {
+		query, err := ParseStrQuery(text)
+		if err != nil {
+			return err
+		}
+		*q = query
+		return nil
+	}
+
+	var phrases []StrQueryPhrase
+	if err := json.Unmarshal(b, &phrases); err != nil {
+		return err
+	}
+	*q = phrases
+	return nil
+}
@@ -0,0 +1,272 @@
+package puppy
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseStrQuery(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected StrMessageQuery
+	}{
+		{"foo", StrMessageQuery{{{"all", "contains", "foo"}}}},
+		{`"foo bar"`, StrMessageQuery{{{"all", "contains", "foo bar"}}}},
+		{"host:example.com", StrMessageQuery{{{"host", "contains", "example.com"}}}},
+		{"method=POST", StrMessageQuery{{{"method", "is", "POST"}}}},
+		{`body~"err(or)?"`, StrMessageQuery{{{"body", "containsregexp", "err(or)?"}}}},
+		{"status:5*", StrMessageQuery{{{"status", "containsregexp", "^5.*$"}}}},
+		{`path:"a*b"`, StrMessageQuery{{{"path", "contains", "a*b"}}}},
+		{"sc>499", StrMessageQuery{{{"sc", "gt", "499"}}}},
+		{"statuscode:200..299", StrMessageQuery{{{"statuscode", "between", "200", "299"}}}},
+		{"duration<1.5s", StrMessageQuery{{{"duration", "lt", "1.5s"}}}},
+		{"status >= 500", StrMessageQuery{{{"status", "ge", "500"}}}},
+		{"status<=299", StrMessageQuery{{{"status", "le", "299"}}}},
+		{"port > 80", StrMessageQuery{{{"port", "gt", "80"}}}},
+		{"a > b", StrMessageQuery{{{"all", "contains", "a"}}, {{"all", "contains", ">"}}, {{"all", "contains", "b"}}}},
+		{"port:8080", StrMessageQuery{{{"port", "eq", "8080"}}}},
+		{"header[Content-Type]:json", StrMessageQuery{{{"header", "is", "Content-Type", "contains", "json"}}}},
+		{"after:1970-01-01T00:00:01Z", StrMessageQuery{{{"after", "1000000000"}}}},
+		{"timerange:5..10", StrMessageQuery{{{"timerange", "5", "10"}}}},
+		{"reqbody(lengt 10)", StrMessageQuery{{{"reqbody", "lengt", "10"}}}},
+		{"unmangled:body~admin", StrMessageQuery{{{"unmangled", "body", "containsregexp", "admin"}}}},
+		{"um:foo", StrMessageQuery{{{"um", "all", "contains", "foo"}}}},
+		{"unmangled:(a OR NOT host:b)", StrMessageQuery{{{"unmangled", "all", "contains", "a"}, {"invert", "unmangled", "host", "contains", "b"}}}},
+		{"NOT modified=true", StrMessageQuery{{{"invert", "modified", "is", "true"}}}},
+		{"a b", StrMessageQuery{{{"all", "contains", "a"}}, {{"all", "contains", "b"}}}},
+		{"a or b", StrMessageQuery{{{"all", "contains", "a"}, {"all", "contains", "b"}}}},
+		{"NOT tag:ignored", StrMessageQuery{{{"invert", "tag", "contains", "ignored"}}}},
+		{"NOT NOT tag:x", StrMessageQuery{{{"tag", "contains", "x"}}}},
+		{"NOT (a OR b)", StrMessageQuery{{{"invert", "all", "contains", "a"}}, {{"invert", "all", "contains", "b"}}}},
+		{
+			`host:example.com AND (status:5* OR body~"error") AND NOT tag:ignored`,
+			StrMessageQuery{
+				{{"host", "contains", "example.com"}},
+				{{"status", "containsregexp", "^5.*$"}, {"body", "containsregexp", "error"}},
+				{{"invert", "tag", "contains", "ignored"}},
+			},
+		},
+		{
+			"(a AND b) OR c",
+			StrMessageQuery{
+				{{"all", "contains", "a"}, {"all", "contains", "c"}},
+				{{"all", "contains", "b"}, {"all", "contains", "c"}},
+			},
+		},
+		{"", StrMessageQuery{}},
+	}
+
+	for _, test := range tests {
+		result, err := ParseStrQuery(test.text)
+		if err != nil {
+			t.Errorf("error parsing %q: %s", test.text, err)
+			continue
+		}
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("parsing %q: expected %v, got %v", test.text, test.expected, result)
+		}
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	tests := []struct {
+		text   string
+		offset int
+	}{
+		{"host:a AND (b", 11},
+		{"host:a)", 6},
+		{`body:"abc`, 5},
+		{"foo AND", 7},
+		{"OR foo", 0},
+		{"a nosuchfield:x", 2},
+		{"host:a port>abc", 7},
+		{"host>5", 4},
+		{"after:yesterday", 6},
+		{"timerange:5", 10},
+		{"method[x]:y", 6},
+		{"unmangled:", 10},
+		{"unmangled:(a", 10},
+		{"host >= 5", 5},
+	}
+
+	for _, test := range tests {
+		_, err := ParseStrQuery(test.text)
+		if err == nil {
+			t.Errorf("expected error parsing %q", test.text)
+			continue
+		}
+		perr, ok := err.(*QueryParseError)
+		if !ok {
+			t.Errorf("expected a QueryParseError parsing %q, got %T", test.text, err)
+			continue
+		}
+		if perr.Offset != test.offset {
+			t.Errorf("parsing %q: expected error at %d, got %d (%s)", test.text, test.offset, perr.Offset, perr.Msg)
+		}
+	}
+}
+
+func TestFormatQueryRoundTrip(t *testing.T) {
+	queries := []StrMessageQuery{
+		{{{"host", "contains", "example.com"}}},
+		{{{"all", "contains", "two words"}}, {{"path", "is", "/a*b"}}},
+		{{{"body", "containsregexp", `"quoted" \ (x)`}}},
+		{{{"statuscode", "gt", "499"}, {"statuscode", "is", "200"}}},
+		{{{"statuscode", "ge", "500"}}, {{"duration", "le", "1s"}}},
+		{{{"status", "containsregexp", "^5.*$"}}},
+		{{{"path", "containsregexp", "^/api/.*\\.json$"}}},
+		{{{"body", "containsregexp", "^a.*b"}}},
+		{{{"statuscode", "eq", "200"}}},
+		{{{"duration", "between", "1s", "2s"}}},
+		{{{"port", "eq", "443"}}},
+		{{{"header", "is", "Host", "contains", "foo"}}},
+		{{{"header", "contains", "Host", "contains", "foo"}}},
+		{{{"invert", "tag", "is", "AND"}}},
+		{{{"reqbody", "lengt", "10"}}},
+		{{{"after", "1500000000123456789"}}},
+		{{{"timerange", "0", "1000"}}},
+		{{{"unmangled", "header", "is", "Host", "contains", "foo"}}},
+		{{{"unmangled", "invert", "tag", "is", "x"}}},
+		{{{"unmangled", "unmangled", "reqbody", "lengt", "10"}}},
+	}
+
+	for _, query := range queries {
+		text, err := FormatStrQuery(query)
+		if err != nil {
+			t.Errorf("error formatting %v: %s", query, err)
+			continue
+		}
+		result, err := ParseStrQuery(text)
+		if err != nil {
+			t.Errorf("error parsing formatted query %q: %s", text, err)
+			continue
+		}
+		if !reflect.DeepEqual(result, query) {
+			t.Errorf("round trip of %v through %q gave %v", query, text, result)
+		}
+	}
+}
+
+func TestFormatQuery(t *testing.T) {
+	query := MessageQuery{
+		{{FieldHost, StrContains, "example.com"}},
+		{{FieldStatusCode, NumGreaterThan, 499}, {FieldAllBody, StrContainsRegexp, "error"}},
+		{{FieldInvert, FieldTag, StrIs, "ignored"}},
+		{{FieldPath, StrContainsRegexp, "^/api/.*$"}},
+		{{FieldStatusCode, NumLessOrEqual, 299}},
+	}
+	text, err := FormatQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "host:example.com AND (statuscode>499 OR body~error) AND NOT tag=ignored AND path:/api/* AND statuscode<=299"
+	if text != expected {
+		t.Errorf("expected %q, got %q", expected, text)
+	}
+}
+
+func TestParseQuerySearch(t *testing.T) {
+	req := testReq()
+	tests := []struct {
+		text     string
+		expected bool
+	}{
+		{"baz", true},
+		{"host:foo* AND method=POST", true},
+		{"reqbody:baz NOT rspbody:baz", true},
+		{"sc:2* AND rspbody~B{4}", true},
+		{"sc>299 OR port<80", false},
+		{"NOT (sc:200 OR method=GET)", false},
+		{"tlstime>1ms OR ttfb<1s", false},
+		{"sc >= 200 AND sc <= 200", true},
+		{"sc>=201", false},
+		{"unmangled:(baz OR method=GET)", true},
+		{"unmangled:(nope OR method=GET)", false},
+	}
+
+	for _, test := range tests {
+		query, err := ParseQuery(test.text)
+		if err != nil {
+			t.Errorf("error parsing %q: %s", test.text, err)
+			continue
+		}
+		checker, err := CheckerFromMessageQuery(query)
+		if err != nil {
+			t.Errorf("error creating checker for %q: %s", test.text, err)
+			continue
+		}
+		if checker(req) != test.expected {
+			t.Errorf("expected %q to return %v", test.text, test.expected)
+		}
+	}
+}
+
+func TestStrMessageQueryUnmarshal(t *testing.T) {
+	var msg struct {
+		Query StrMessageQuery
+	}
+
+	if err := json.Unmarshal([]byte(`{"Query": "host:foo OR tag:bar"}`), &msg); err != nil {
+		t.Fatal(err)
+	}
+	expected := StrMessageQuery{{{"host", "contains", "foo"}, {"tag", "contains", "bar"}}}
+	if !reflect.DeepEqual(msg.Query, expected) {
+		t.Errorf("expected %v, got %v", expected, msg.Query)
+	}
+
+	msg.Query = nil
+	if err := json.Unmarshal([]byte(`{"Query": [[["host", "contains", "foo"], ["tag", "contains", "bar"]]]}`), &msg); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(msg.Query, expected) {
+		t.Errorf("expected %v, got %v", expected, msg.Query)
+	}
+
+	if err := json.Unmarshal([]byte(`{"Query": null}`), &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Query != nil {
+		t.Errorf("expected a null query to be nil, got %v", msg.Query)
+	}
+
+	if err := json.Unmarshal([]byte(`{"Query": "host:(foo"}`), &msg); err == nil {
+		t.Error("expected an error unmarshaling an invalid text query")
+	}
+}
+
+func TestParseStructuredKeys(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected StrMessageQuery
+	}{
+		{"json[$.items[0].id]=5", StrMessageQuery{{{"json", "is", "$.items[0].id", "is", "5"}}}},
+		{`rspjson["$['a b']"]:x`, StrMessageQuery{{{"rspjson", "is", "$['a b']", "contains", "x"}}}},
+		{"xml[//div[2]/@class]~btn", StrMessageQuery{{{"xml", "is", "//div[2]/@class", "containsregexp", "btn"}}}},
+	}
+
+	for _, test := range tests {
+		result, err := ParseStrQuery(test.text)
+		if err != nil {
+			t.Errorf("error parsing %q: %s", test.text, err)
+			continue
+		}
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("parsing %q: expected %v, got %v", test.text, test.expected, result)
+		}
+
+		text, err := FormatStrQuery(result)
+		if err != nil {
+			t.Errorf("error formatting %v: %s", result, err)
+			continue
+		}
+		reparsed, err := ParseStrQuery(text)
+		if err != nil {
+			t.Errorf("error parsing formatted query %q: %s", text, err)
+			continue
+		}
+		if !reflect.DeepEqual(reparsed, result) {
+			t.Errorf("round trip of %q through %q gave %v", test.text, text, reparsed)
+		}
+	}
+}
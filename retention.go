@@ -0,0 +1,263 @@
+package puppy
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+/*
+Retention policies for SQLiteStorage
+*/
+
+// RetentionPolicy describes which requests should be pruned from a storage. Zero values disable the associated rule.
+type RetentionPolicy struct {
+	// Only keep the most recent MaxRequests requests
+	MaxRequests int64
+	// Delete requests which were submitted more than MaxAge ago
+	MaxAge time.Duration
+
+	// Drop bodies larger than MaxBodySize bytes from requests and responses which were submitted more than BodyAge ago
+	MaxBodySize int
+	BodyAge     time.Duration
+
+	// Requests with any of these tags are never pruned
+	ProtectedTags []string
+	// Requests which match this query are never pruned
+	ProtectedQuery MessageQuery
+}
+
+// PruneResult contains the results of applying a RetentionPolicy
+type PruneResult struct {
+	// DbIds of the requests which were deleted
+	DeletedRequests []string
+	// Number of request and response bodies which were dropped
+	DroppedBodies int
+}
+
+type retentionCandidate struct {
+	reqid     string
+	startTime time.Time
+}
+
+// ApplyRetentionPolicy prunes the storage according to the policy then vacuums the database. Requests are deleted using the same path as DeleteRequest so any storage watchers will be notified.
+func (ms *SQLiteStorage) ApplyRetentionPolicy(policy *RetentionPolicy) (*PruneResult, error) {
+	ms.mtx.Lock()
+	tx, err := ms.dbConn.Begin()
+	if err != nil {
+		ms.mtx.Unlock()
+		return nil, err
+	}
+	result, updated, err := ms.applyRetentionPolicy(tx, policy)
+	if err != nil {
+		tx.Rollback()
+		ms.mtx.Unlock()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		ms.mtx.Unlock()
+		return nil, fmt.Errorf("error committing pruned requests: %s", err.Error())
+	}
+
+	for _, watcher := range ms.storageWatchers {
+		for _, reqid := range result.DeletedRequests {
+			watcher.RequestDeleted(ms, reqid)
+		}
+		for _, req := range updated {
+			watcher.RequestUpdated(ms, req)
+		}
+	}
+
+	// VACUUM can't be run inside of a transaction
+	_, err = ms.dbConn.Exec("VACUUM;")
+	ms.mtx.Unlock()
+	if err != nil {
+		return result, fmt.Errorf("error vacuuming database: %s", err.Error())
+	}
+	return result, nil
+}
+
+func (ms *SQLiteStorage) applyRetentionPolicy(tx *sql.Tx, policy *RetentionPolicy) (*PruneResult, []*ProxyRequest, error) {
+	result := &PruneResult{
+		DeletedRequests: make([]string, 0),
+	}
+	updated := make([]*ProxyRequest, 0)
+
+	protected, err := ms.protectedRequests(tx, policy)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Only look at requests which are not the unmangled version of another request. Unmangled versions are removed with their parent.
+	rows, err := tx.Query(`
+    SELECT id, start_datetime FROM requests
+    WHERE id NOT IN (SELECT unmangled_id FROM requests WHERE unmangled_id IS NOT NULL)
+    ORDER BY start_datetime DESC;
+    `)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error loading requests: %s", err.Error())
+	}
+	defer rows.Close()
+
+	candidates := make([]*retentionCandidate, 0)
+	for rows.Next() {
+		var db_id sql.NullInt64
+		var db_start_datetime sql.NullInt64
+		if err := rows.Scan(&db_id, &db_start_datetime); err != nil {
+			return nil, nil, fmt.Errorf("error loading requests: %s", err.Error())
+		}
+		if !db_id.Valid {
+			continue
+		}
+		candidates = append(candidates, &retentionCandidate{
+			reqid:     strconv.FormatInt(db_id.Int64, 10),
+			startTime: time.Unix(0, db_start_datetime.Int64),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("error loading requests: %s", err.Error())
+	}
+	rows.Close()
+
+	now := time.Now()
+	// Protected requests don't count towards MaxRequests
+	var kept int64
+	for _, c := range candidates {
+		if protected[c.reqid] {
+			continue
+		}
+		kept++
+
+		if (policy.MaxRequests > 0 && kept > policy.MaxRequests) ||
+			(policy.MaxAge > 0 && c.startTime.Before(now.Add(-policy.MaxAge))) {
+			if err := ms.deleteRequest(tx, c.reqid); err != nil {
+				return nil, nil, fmt.Errorf("error deleting request %s: %s", c.reqid, err.Error())
+			}
+			result.DeletedRequests = append(result.DeletedRequests, c.reqid)
+			continue
+		}
+
+		if policy.MaxBodySize > 0 && c.startTime.Before(now.Add(-policy.BodyAge)) {
+			req, err := ms.loadRequest(tx, c.reqid)
+			if err != nil {
+				return nil, nil, err
+			}
+			dropped, err := ms.dropLargeBodies(tx, req, policy.MaxBodySize)
+			if err != nil {
+				return nil, nil, err
+			}
+			if dropped > 0 {
+				result.DroppedBodies += dropped
+				updated = append(updated, req)
+			}
+		}
+	}
+
+	return result, updated, nil
+}
+
+// Returns the set of request ids which are exempt from the retention policy
+func (ms *SQLiteStorage) protectedRequests(tx *sql.Tx, policy *RetentionPolicy) (map[string]bool, error) {
+	protected := make(map[string]bool)
+
+	for _, tag := range policy.ProtectedTags {
+		rows, err := tx.Query(`
+        SELECT tgd.reqid FROM tagged tgd, tags tg
+        WHERE tgd.tagid=tg.id AND tg.tag=?;
+        `, tag)
+		if err != nil {
+			return nil, fmt.Errorf("error loading protected tags: %s", err.Error())
+		}
+		for rows.Next() {
+			var db_reqid sql.NullInt64
+			if err := rows.Scan(&db_reqid); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("error loading protected tags: %s", err.Error())
+			}
+			if db_reqid.Valid {
+				protected[strconv.FormatInt(db_reqid.Int64, 10)] = true
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error loading protected tags: %s", err.Error())
+		}
+	}
+
+	if len(policy.ProtectedQuery) > 0 {
+		checker, err := CheckerFromMessageQuery(policy.ProtectedQuery)
+		if err != nil {
+			return nil, fmt.Errorf("error with protected query: %s", err.Error())
+		}
+		reqs, err := ms.checkRequests(tx, 0, checker)
+		if err != nil {
+			return nil, err
+		}
+		for _, req := range reqs {
+			protected[req.DbId] = true
+		}
+	}
+
+	return protected, nil
+}
+
+// Empties any bodies in the request, its response, and their unmangled versions which are larger than maxSize. Returns the number of bodies dropped.
+func (ms *SQLiteStorage) dropLargeBodies(tx *sql.Tx, req *ProxyRequest, maxSize int) (int, error) {
+	dropped := 0
+	for r := req; r != nil; r = r.Unmangled {
+		if len(r.BodyBytes()) > maxSize {
+			r.SetBodyBytes([]byte{})
+			if err := ms.updateRequest(tx, r); err != nil {
+				return 0, err
+			}
+			dropped++
+		}
+
+		for rsp := r.ServerResponse; rsp != nil; rsp = rsp.Unmangled {
+			if len(rsp.BodyBytes()) > maxSize {
+				rsp.SetBodyBytes([]byte{})
+				if err := ms.updateResponse(tx, rsp); err != nil {
+					return 0, err
+				}
+				dropped++
+			}
+		}
+	}
+	return dropped, nil
+}
+
+// SetRetentionPolicy has the storage apply the given policy every interval until the storage is closed. Passing a nil policy stops any scheduled pruning.
+func (ms *SQLiteStorage) SetRetentionPolicy(policy *RetentionPolicy, interval time.Duration) {
+	ms.mtx.Lock()
+	if ms.retentionStop != nil {
+		close(ms.retentionStop)
+		ms.retentionStop = nil
+	}
+	if policy == nil || interval <= 0 {
+		ms.mtx.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	ms.retentionStop = stop
+	ms.mtx.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				result, err := ms.ApplyRetentionPolicy(policy)
+				if err != nil {
+					ms.logger.Println("error applying retention policy:", err.Error())
+					continue
+				}
+				ms.logger.Printf("Retention policy deleted %d requests and dropped %d bodies", len(result.DeletedRequests), result.DroppedBodies)
+			}
+		}
+	}()
+}
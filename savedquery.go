@@ -0,0 +1,143 @@
+package puppy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+/*
+Saved query references
+
+A search on FieldSavedQuery matches the requests that match another query saved in the same
+storage, for example ["savedquery", "is", "api-only"]. References are resolved when the checker is
+created, so checkers created with NewStorageRequestChecker, StorageCheckerFromMessageQuery or
+StorageCheckerFromQueryExpr keep using the version of the saved query that existed at that time.
+Saved queries may reference other saved queries as long as no query ends up referencing itself.
+*/
+
+// Resolves references to saved queries while creating a RequestChecker
+type savedQueryResolver struct {
+	// The storage to load saved queries from. If nil, the arguments of references are checked but the queries are not loaded
+	ms MessageStorage
+	// The names of the saved queries currently being resolved, used to detect cycles
+	resolving []string
+}
+
+// Returns a checker for the arguments of a saved query search
+func (sqr *savedQueryResolver) checker(args []interface{}) (RequestChecker, error) {
+	if len(args) != 2 {
+		return nil, errors.New("searching by saved query requires one comparer and the name of the query")
+	}
+	comparer, ok := args[0].(StrComparer)
+	if !ok || comparer != StrIs {
+		return nil, errors.New("saved queries can only be referenced using \"is\"")
+	}
+	name, ok := args[1].(string)
+	if !ok {
+		return nil, errors.New("saved query name must be a string")
+	}
+
+	if sqr == nil {
+		return nil, fmt.Errorf("saved query %s can only be searched for in a storage", name)
+	}
+	if sqr.ms == nil {
+		// Only checking the arguments
+		return func(req *ProxyRequest) bool { return false }, nil
+	}
+
+	for i, resolving := range sqr.resolving {
+		if resolving == name {
+			cycle := append(append([]string{}, sqr.resolving[i:]...), name)
+			return nil, fmt.Errorf("saved query references itself: %s", strings.Join(cycle, " -> "))
+		}
+	}
+
+	expr, err := sqr.ms.LoadQueryExpr(name)
+	if err != nil {
+		return nil, err
+	}
+
+	inner := &savedQueryResolver{
+		ms:        sqr.ms,
+		resolving: append(append([]string{}, sqr.resolving...), name),
+	}
+	checker, err := checkerFromQueryExpr(inner, expr)
+	if err != nil {
+		return nil, fmt.Errorf("error with saved query %s: %s", name, err.Error())
+	}
+	return checker, nil
+}
+
+// Return a function that returns whether a request matches the given conditions. References to saved queries are loaded from ms.
+func NewStorageRequestChecker(ms MessageStorage, args ...interface{}) (RequestChecker, error) {
+	return newRequestChecker(&savedQueryResolver{ms: ms}, args...)
+}
+
+// Creates a RequestChecker from a MessageQuery. References to saved queries are loaded from ms.
+func StorageCheckerFromMessageQuery(ms MessageStorage, query MessageQuery) (RequestChecker, error) {
+	return checkerFromMessageQuery(&savedQueryResolver{ms: ms}, query)
+}
+
+// Creates a RequestChecker from a QueryExpr. References to saved queries are loaded from ms. A nil expression matches every request.
+func StorageCheckerFromQueryExpr(ms MessageStorage, expr *QueryExpr) (RequestChecker, error) {
+	return checkerFromQueryExpr(&savedQueryResolver{ms: ms}, expr)
+}
+
+// Checks that a query can be saved in a storage under the given name. Every saved query that the expression references must exist and none of them can reference the query being saved.
+func ValidateSavedQuery(ms MessageStorage, name string, expr *QueryExpr) error {
+	_, err := checkerFromQueryExpr(&savedQueryResolver{ms: ms, resolving: []string{name}}, expr)
+	return err
+}
+
+// Returns whether an expression contains a search that references a saved query
+func exprReferencesSavedQuery(expr *QueryExpr) bool {
+	if expr == nil {
+		return false
+	}
+	if expr.Op == QueryTerm {
+		for _, arg := range expr.Args {
+			if field, ok := arg.(SearchField); ok && field == FieldSavedQuery {
+				return true
+			}
+		}
+		return false
+	}
+	for _, child := range expr.Children {
+		if exprReferencesSavedQuery(child) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the name of the saved query that an expression references if the expression consists of only that reference
+func savedQueryRefName(expr *QueryExpr) (string, bool) {
+	// Unwrap the AND of ORs that MessageQueries are converted into
+	for expr != nil && (expr.Op == QueryAnd || expr.Op == QueryOr) && len(expr.Children) == 1 {
+		expr = expr.Children[0]
+	}
+	if expr == nil || expr.Op != QueryTerm || len(expr.Args) != 3 {
+		return "", false
+	}
+	if field, ok := expr.Args[0].(SearchField); !ok || field != FieldSavedQuery {
+		return "", false
+	}
+	name, ok := expr.Args[2].(string)
+	return name, ok
+}
+
+// Calls the QueryWatcher callbacks of the watchers that implement it
+func notifyQueryWatchers(watchers []StorageWatcher, ms MessageStorage, name string, deleted bool) {
+	for _, watcher := range watchers {
+		qw, ok := watcher.(QueryWatcher)
+		if !ok {
+			continue
+		}
+		if deleted {
+			qw.QueryDeleted(ms, name)
+		} else {
+			qw.QuerySaved(ms, name)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package puppy
+
+import (
+	"testing"
+)
+
+func TestSavedQueryRequiresStorage(t *testing.T) {
+	if _, err := NewRequestChecker(FieldSavedQuery, StrIs, "foo"); err == nil {
+		t.Errorf("saved query was searched for without a storage")
+	}
+	if _, err := NewRequestChecker(FieldSavedQuery, StrContains, "foo"); err == nil {
+		t.Errorf("saved query was referenced with a comparer other than is")
+	}
+
+	// References can be saved before the query they reference exists
+	storage := NewBoundedMemoryStorage(0, 0)
+	defer storage.Close()
+	testErr(t, storage.SaveQueryExpr("foo", TermExpr(FieldSavedQuery, StrIs, "bar")))
+
+	args, err := CheckArgsStrToGo([]string{"sq", "is", "foo"})
+	testErr(t, err)
+	strArgs, err := CheckArgsGoToStr(args)
+	testErr(t, err)
+	if len(strArgs) != 3 || strArgs[0] != "savedquery" || strArgs[2] != "foo" {
+		t.Errorf("incorrect string arguments: %v", strArgs)
+	}
+}
+
+func TestScopeSavedQuery(t *testing.T) {
+	storage := NewBoundedMemoryStorage(0, 0)
+	defer storage.Close()
+	a := siteMapReq(t, "GET", "/a", "", 200)
+	b := siteMapReq(t, "GET", "/b", "", 200)
+
+	iproxy := NewInterceptingProxy(nil)
+	id := iproxy.AddMessageStorage(storage, "test")
+	testErr(t, iproxy.SetProxyStorage(id))
+
+	if err := iproxy.SetScopeSavedQuery("targets"); err == nil {
+		t.Errorf("scope was set to a saved query that does not exist")
+	}
+
+	testErr(t, storage.SaveQueryExpr("targets", TermExpr(FieldPath, StrIs, "/a")))
+	testErr(t, iproxy.SetScopeSavedQuery("targets"))
+	checker := iproxy.GetScopeChecker()
+	if !checker(a) || checker(b) {
+		t.Errorf("scope did not use the saved query")
+	}
+
+	// Changing the saved query changes the scope
+	testErr(t, storage.SaveQueryExpr("targets", TermExpr(FieldPath, StrIs, "/b")))
+	checker = iproxy.GetScopeChecker()
+	if checker(a) || !checker(b) {
+		t.Errorf("scope was not updated when the saved query changed")
+	}
+	if name, ok := savedQueryRefName(iproxy.GetScopeExpr()); !ok || name != "targets" {
+		t.Errorf("scope expression does not reference the saved query: %v", iproxy.GetScopeExpr())
+	}
+
+	// The previous scope is kept if the saved query is deleted
+	testErr(t, storage.DeleteQuery("targets"))
+	checker = iproxy.GetScopeChecker()
+	if checker(a) || !checker(b) {
+		t.Errorf("scope changed when the saved query was deleted")
+	}
+}
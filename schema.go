@@ -1,7 +1,11 @@
 package puppy
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -20,6 +24,13 @@ var schemaUpdaters = []schemaUpdater{
 	schema8,
 	schema9,
 	schema10,
+	schema11,
+	schema12,
+	schema13,
+	schema14,
+	schema15,
+	schema16,
+	schema17,
 }
 
 func UpdateSchema(db *sql.DB, logger *log.Logger) error {
@@ -568,3 +579,225 @@ func schema10(tx *sql.Tx) error {
 
 	return nil
 }
+
+type s11Message struct {
+	id  int64
+	msg []byte
+}
+
+func s11MoveBodies(tx *sql.Tx, table string, column string) error {
+	rows, err := tx.Query(fmt.Sprintf("SELECT id, %s FROM %s;", column, table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	msgs := make([]*s11Message, 0)
+	for rows.Next() {
+		m := &s11Message{}
+		if err := rows.Scan(&m.id, &m.msg); err != nil {
+			return err
+		}
+		msgs = append(msgs, m)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	updateStmt, err := tx.Prepare(fmt.Sprintf("UPDATE %s SET %s=?, body_hash=? WHERE id=?", table, column))
+	if err != nil {
+		return err
+	}
+	defer updateStmt.Close()
+
+	for _, m := range msgs {
+		head, bodyHash, err := s11StoreBody(tx, m.msg)
+		if err != nil {
+			return err
+		}
+		if _, err := updateStmt.Exec(head, bodyHash, m.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Splits a message and stores its body the way bodies were stored at version 11, before datafiles could be
+// encrypted. This is kept separate from the storage code so that later changes to how bodies are stored don't change
+// what this migration writes.
+func s11StoreBody(tx *sql.Tx, msg []byte) ([]byte, *string, error) {
+	ind := bytes.Index(msg, []byte("\r\n\r\n"))
+	if ind < 0 || ind+4 == len(msg) {
+		return msg, nil, nil
+	}
+	head, body := msg[:ind+4], msg[ind+4:]
+
+	sum := sha256.Sum256(body)
+	hash := hex.EncodeToString(sum[:])
+
+	res, err := tx.Exec("UPDATE message_bodies SET refcount=refcount+1 WHERE hash=?;", hash)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error updating message body reference count: %s", err.Error())
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		buf := new(bytes.Buffer)
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(body); err != nil {
+			return nil, nil, fmt.Errorf("error compressing message body: %s", err.Error())
+		}
+		if err := w.Close(); err != nil {
+			return nil, nil, fmt.Errorf("error compressing message body: %s", err.Error())
+		}
+		if _, err := tx.Exec("INSERT INTO message_bodies (hash, refcount, data) VALUES (?, 1, ?);", hash, buf.Bytes()); err != nil {
+			return nil, nil, fmt.Errorf("error inserting message body into database: %s", err.Error())
+		}
+	}
+	return head, &hash, nil
+}
+
+func schema11(tx *sql.Tx) error {
+	/*
+	   Move the bodies of requests and responses into a content-addressed table of compressed blobs
+	*/
+	cmds := []string{`
+    CREATE TABLE message_bodies (
+            hash      TEXT      PRIMARY KEY,
+            refcount  INTEGER   NOT NULL,
+            data      BLOB      NOT NULL
+        );
+    `,
+
+		`ALTER TABLE requests ADD COLUMN body_hash TEXT REFERENCES message_bodies(hash)`,
+		`ALTER TABLE responses ADD COLUMN body_hash TEXT REFERENCES message_bodies(hash)`,
+	}
+
+	if err := executeMultiple(tx, cmds); err != nil {
+		return err
+	}
+
+	if err := s11MoveBodies(tx, "requests", "full_request"); err != nil {
+		return err
+	}
+
+	if err := s11MoveBodies(tx, "responses", "full_response"); err != nil {
+		return err
+	}
+
+	if err := execute(tx, `UPDATE schema_meta SET version=11`); err != nil {
+		return err
+	}
+	return nil
+}
+
+func schema12(tx *sql.Tx) error {
+	/*
+	   Add a table to hold the parameters used to derive the key for encrypted datafiles
+	*/
+	cmds := []string{`
+    CREATE TABLE encryption_meta (
+            salt      BLOB      NOT NULL,
+            scrypt_n  INTEGER   NOT NULL,
+            scrypt_r  INTEGER   NOT NULL,
+            scrypt_p  INTEGER   NOT NULL,
+            verifier  BLOB      NOT NULL
+        );
+    `,
+
+		`UPDATE schema_meta SET version=12`,
+	}
+
+	if err := executeMultiple(tx, cmds); err != nil {
+		return err
+	}
+	return nil
+}
+
+func schema13(tx *sql.Tx) error {
+	/*
+	   Add notes, highlight colors, and a reviewed flag to requests
+	*/
+	cmds := []string{
+		`ALTER TABLE requests ADD COLUMN note BLOB`,
+		`ALTER TABLE requests ADD COLUMN highlight TEXT`,
+		`ALTER TABLE requests ADD COLUMN reviewed BOOLEAN NOT NULL DEFAULT 0`,
+
+		`UPDATE schema_meta SET version=13`,
+	}
+
+	if err := executeMultiple(tx, cmds); err != nil {
+		return err
+	}
+	return nil
+}
+
+func schema14(tx *sql.Tx) error {
+	/*
+	   Add a breakdown of the time spent submitting each request
+	*/
+	cmds := []string{
+		`ALTER TABLE requests ADD COLUMN timings TEXT`,
+
+		`UPDATE schema_meta SET version=14`,
+	}
+
+	if err := executeMultiple(tx, cmds); err != nil {
+		return err
+	}
+	return nil
+}
+
+func schema15(tx *sql.Tx) error {
+	/*
+	   Allow saved queries to be stored as boolean expressions
+	*/
+	cmds := []string{
+		`ALTER TABLE saved_contexts ADD COLUMN expression TEXT`,
+
+		`UPDATE schema_meta SET version=15`,
+	}
+
+	if err := executeMultiple(tx, cmds); err != nil {
+		return err
+	}
+	return nil
+}
+
+func schema16(tx *sql.Tx) error {
+	/*
+	   Store request and response metadata so that statistics can be computed in SQL. The columns are
+	   left NULL for messages saved before this version and for messages in encrypted datafiles.
+	*/
+	cmds := []string{
+		`ALTER TABLE requests ADD COLUMN method TEXT`,
+		`ALTER TABLE requests ADD COLUMN path TEXT`,
+		`ALTER TABLE requests ADD COLUMN body_size INTEGER`,
+		`ALTER TABLE responses ADD COLUMN status_code INTEGER`,
+		`ALTER TABLE responses ADD COLUMN body_size INTEGER`,
+
+		`UPDATE schema_meta SET version=16`,
+	}
+
+	if err := executeMultiple(tx, cmds); err != nil {
+		return err
+	}
+	return nil
+}
+
+func schema17(tx *sql.Tx) error {
+	/*
+	   Add descriptions and folders to saved queries
+	*/
+	cmds := []string{
+		`ALTER TABLE saved_contexts ADD COLUMN description TEXT`,
+		`ALTER TABLE saved_contexts ADD COLUMN folder TEXT`,
+
+		`UPDATE schema_meta SET version=17`,
+	}
+
+	if err := executeMultiple(tx, cmds); err != nil {
+		return err
+	}
+	return nil
+}
@@ -13,9 +13,11 @@ import (
 
 type SearchField int
 type StrComparer int
+type NumComparer int
 
 type strFieldGetter func(req *ProxyRequest) ([]string, error)
 type kvFieldGetter func(req *ProxyRequest) ([]*PairValue, error)
+type numFieldGetter func(req *ProxyRequest) ([]int64, error)
 
 type RequestChecker func(req *ProxyRequest) bool
 
@@ -53,6 +55,40 @@ const (
 	FieldInvert
 
 	FieldId
+
+	FieldNote
+	FieldHighlight
+	FieldReviewed
+
+	FieldDuration
+	FieldRequestBodySize
+	FieldResponseBodySize
+	FieldWSMessageCount
+	FieldPort
+
+	FieldRequestJSON
+	FieldResponseJSON
+	FieldBothJSON
+	FieldRequestXML
+	FieldResponseXML
+	FieldBothXML
+	FieldMultipart
+
+	FieldUnmangled
+	FieldRequestModified
+	FieldResponseModified
+	FieldWSModified
+	FieldModified
+
+	FieldSavedQuery
+
+	// Parts of the timing breakdown of a request
+	FieldDNSTime
+	FieldConnectTime
+	FieldProxyConnectTime
+	FieldTLSTime
+	FieldTimeToFirstByte
+	FieldTransferTime
 )
 
 // Operators for string values
@@ -66,6 +102,17 @@ const (
 	StrLengthEqualTo
 )
 
+// Operators for numeric values
+const (
+	NumEqualTo NumComparer = iota
+	NumGreaterThan
+	NumLessThan
+	// Takes two values and matches if the value is between them, inclusive
+	NumBetween
+	NumGreaterOrEqual
+	NumLessOrEqual
+)
+
 // A struct representing the data to be searched for a pair such as a header or url param
 type PairValue struct {
 	key   string
@@ -82,8 +129,13 @@ type StrQueryPhrase [][]string
 // A list of phrases in string form. Will match if all the phrases match the request
 type StrMessageQuery []StrQueryPhrase
 
-// Return a function that returns whether a request matches the given conditions
+// Return a function that returns whether a request matches the given conditions. Searches that reference saved queries require a storage and must be created with NewStorageRequestChecker.
 func NewRequestChecker(args ...interface{}) (RequestChecker, error) {
+	return newRequestChecker(nil, args...)
+}
+
+// Creates a RequestChecker that resolves references to saved queries using sqr. If sqr is nil, referencing a saved query is an error.
+func newRequestChecker(sqr *savedQueryResolver, args ...interface{}) (RequestChecker, error) {
 	// Generates a request checker from the given search arguments
 	if len(args) == 0 {
 		return nil, errors.New("search requires a search field")
@@ -97,7 +149,14 @@ func NewRequestChecker(args ...interface{}) (RequestChecker, error) {
 	switch field {
 
 	// Normal string fields
-	case FieldAll, FieldRequestBody, FieldResponseBody, FieldAllBody, FieldWSMessage, FieldMethod, FieldHost, FieldPath, FieldStatusCode, FieldTag, FieldId:
+	case FieldAll, FieldRequestBody, FieldResponseBody, FieldAllBody, FieldWSMessage, FieldMethod, FieldHost, FieldPath, FieldStatusCode, FieldTag, FieldId, FieldNote, FieldHighlight, FieldReviewed, FieldRequestModified, FieldResponseModified, FieldWSModified, FieldModified:
+		// Status codes can also be compared as numbers
+		if field == FieldStatusCode && len(args) > 1 {
+			if _, ok := args[1].(NumComparer); ok {
+				return newNumFieldChecker(field, args[1:])
+			}
+		}
+
 		getter, err := createstrFieldGetter(field)
 		if err != nil {
 			return nil, fmt.Errorf("error performing search: %s", err.Error())
@@ -115,7 +174,7 @@ func NewRequestChecker(args ...interface{}) (RequestChecker, error) {
 		return genStrFieldChecker(getter, comparer, args[2])
 
 	// Normal key/value fields
-	case FieldRequestHeaders, FieldResponseHeaders, FieldBothHeaders, FieldBothParam, FieldURLParam, FieldPostParam, FieldResponseCookie, FieldRequestCookie, FieldBothCookie:
+	case FieldRequestHeaders, FieldResponseHeaders, FieldBothHeaders, FieldBothParam, FieldURLParam, FieldPostParam, FieldResponseCookie, FieldRequestCookie, FieldBothCookie, FieldRequestJSON, FieldResponseJSON, FieldBothJSON, FieldRequestXML, FieldResponseXML, FieldBothXML, FieldMultipart:
 		getter, err := createKvPairGetter(field)
 		if err != nil {
 			return nil, fmt.Errorf("error performing search: %s", err.Error())
@@ -161,12 +220,22 @@ func NewRequestChecker(args ...interface{}) (RequestChecker, error) {
 				return nil, errors.New("second val must be a list of bytes")
 			}
 
+			// Keys of structured body fields can be JSONPath or XPath expressions
+			comparer1, val1, err = structuredKeyComparer(field, comparer1, val1)
+			if err != nil {
+				return nil, err
+			}
+
 			// Create a checker out of our getter, comparers, and vals
 			return genKvFieldChecker(getter, comparer1, val1, comparer2, val2)
 		} else {
 			return nil, errors.New("invalid number of arguments for a key/value search")
 		}
 
+	// Numeric fields
+	case FieldDuration, FieldRequestBodySize, FieldResponseBodySize, FieldWSMessageCount, FieldPort, FieldDNSTime, FieldConnectTime, FieldProxyConnectTime, FieldTLSTime, FieldTimeToFirstByte, FieldTransferTime:
+		return newNumFieldChecker(field, args[1:])
+
 	// Other fields
 	case FieldAfter:
 		if len(args) != 2 {
@@ -216,7 +285,7 @@ func NewRequestChecker(args ...interface{}) (RequestChecker, error) {
 		}, nil
 
 	case FieldInvert:
-		orig, err := NewRequestChecker(args[1:]...)
+		orig, err := newRequestChecker(sqr, args[1:]...)
 		if err != nil {
 			return nil, fmt.Errorf("error with query to invert: %s", err.Error())
 		}
@@ -224,11 +293,69 @@ func NewRequestChecker(args ...interface{}) (RequestChecker, error) {
 			return !orig(req)
 		}, nil
 
+	case FieldUnmangled:
+		orig, err := newRequestChecker(sqr, args[1:]...)
+		if err != nil {
+			return nil, fmt.Errorf("error with query to run on unmangled messages: %s", err.Error())
+		}
+		return func(req *ProxyRequest) bool {
+			return orig(unmangledView(req))
+		}, nil
+
+	case FieldSavedQuery:
+		return sqr.checker(args[1:])
+
 	default:
 		return nil, errors.New("invalid field")
 	}
 }
 
+// Returns a copy of the request where the request, response and websocket messages are replaced with their unmangled versions if they were modified. Metadata such as the id, tags and notes are kept from the original request.
+func unmangledView(req *ProxyRequest) *ProxyRequest {
+	view := *req
+	view.Unmangled = nil
+	if req.Unmangled != nil {
+		view.Request = req.Unmangled.Request
+		view.bodyBytes = req.Unmangled.bodyBytes
+		view.DestHost = req.Unmangled.DestHost
+		view.DestPort = req.Unmangled.DestPort
+		view.DestUseTLS = req.Unmangled.DestUseTLS
+	}
+
+	if req.ServerResponse != nil && req.ServerResponse.Unmangled != nil {
+		view.ServerResponse = req.ServerResponse.Unmangled
+	}
+
+	if wsModified(req) {
+		view.WSMessages = make([]*ProxyWSMessage, len(req.WSMessages))
+		for i, wsm := range req.WSMessages {
+			if wsm.Unmangled != nil {
+				view.WSMessages[i] = wsm.Unmangled
+			} else {
+				view.WSMessages[i] = wsm
+			}
+		}
+	}
+	return &view
+}
+
+func requestModified(req *ProxyRequest) bool {
+	return req.Unmangled != nil
+}
+
+func responseModified(req *ProxyRequest) bool {
+	return req.ServerResponse != nil && req.ServerResponse.Unmangled != nil
+}
+
+func wsModified(req *ProxyRequest) bool {
+	for _, wsm := range req.WSMessages {
+		if wsm.Unmangled != nil {
+			return true
+		}
+	}
+	return false
+}
+
 func createstrFieldGetter(field SearchField) (strFieldGetter, error) {
 	switch field {
 	case FieldAll:
@@ -322,6 +449,41 @@ func createstrFieldGetter(field SearchField) (strFieldGetter, error) {
 			strs[0] = req.DbId
 			return strs, nil
 		}, nil
+	case FieldNote:
+		return func(req *ProxyRequest) ([]string, error) {
+			strs := make([]string, 1)
+			strs[0] = req.Note
+			return strs, nil
+		}, nil
+	case FieldHighlight:
+		return func(req *ProxyRequest) ([]string, error) {
+			strs := make([]string, 1)
+			strs[0] = req.Highlight
+			return strs, nil
+		}, nil
+	case FieldReviewed:
+		return func(req *ProxyRequest) ([]string, error) {
+			strs := make([]string, 1)
+			strs[0] = strconv.FormatBool(req.Reviewed)
+			return strs, nil
+		}, nil
+	case FieldRequestModified:
+		return func(req *ProxyRequest) ([]string, error) {
+			return []string{strconv.FormatBool(requestModified(req))}, nil
+		}, nil
+	case FieldResponseModified:
+		return func(req *ProxyRequest) ([]string, error) {
+			return []string{strconv.FormatBool(responseModified(req))}, nil
+		}, nil
+	case FieldWSModified:
+		return func(req *ProxyRequest) ([]string, error) {
+			return []string{strconv.FormatBool(wsModified(req))}, nil
+		}, nil
+	case FieldModified:
+		return func(req *ProxyRequest) ([]string, error) {
+			modified := requestModified(req) || responseModified(req) || wsModified(req)
+			return []string{strconv.FormatBool(modified)}, nil
+		}, nil
 	default:
 		return nil, errors.New("field is not a string")
 	}
@@ -422,6 +584,193 @@ func genStrFieldChecker(strGetter strFieldGetter, cmp StrComparer, val interface
 	}, nil
 }
 
+func createNumFieldGetter(field SearchField) (numFieldGetter, error) {
+	switch field {
+	case FieldDuration:
+		return func(req *ProxyRequest) ([]int64, error) {
+			// Requests that never finished don't have a duration
+			nums := make([]int64, 0)
+			if req.EndDatetime.After(req.StartDatetime) {
+				nums = append(nums, int64(req.EndDatetime.Sub(req.StartDatetime)))
+			}
+			return nums, nil
+		}, nil
+	case FieldRequestBodySize:
+		return func(req *ProxyRequest) ([]int64, error) {
+			nums := make([]int64, 1)
+			nums[0] = int64(len(req.BodyBytes()))
+			return nums, nil
+		}, nil
+	case FieldResponseBodySize:
+		return func(req *ProxyRequest) ([]int64, error) {
+			nums := make([]int64, 0)
+			if req.ServerResponse != nil {
+				nums = append(nums, int64(len(req.ServerResponse.BodyBytes())))
+			}
+			return nums, nil
+		}, nil
+	case FieldWSMessageCount:
+		return func(req *ProxyRequest) ([]int64, error) {
+			nums := make([]int64, 1)
+			nums[0] = int64(len(req.WSMessages))
+			return nums, nil
+		}, nil
+	case FieldPort:
+		return func(req *ProxyRequest) ([]int64, error) {
+			nums := make([]int64, 1)
+			nums[0] = int64(req.DestPort)
+			return nums, nil
+		}, nil
+	case FieldStatusCode:
+		return func(req *ProxyRequest) ([]int64, error) {
+			nums := make([]int64, 0)
+			if req.ServerResponse != nil {
+				nums = append(nums, int64(req.ServerResponse.StatusCode))
+			}
+			return nums, nil
+		}, nil
+	case FieldDNSTime:
+		return timingGetter(func(t *RequestTimings) time.Duration { return t.DNS }), nil
+	case FieldConnectTime:
+		return timingGetter(func(t *RequestTimings) time.Duration { return t.Connect }), nil
+	case FieldProxyConnectTime:
+		return timingGetter(func(t *RequestTimings) time.Duration { return t.ProxyConnect }), nil
+	case FieldTLSTime:
+		return timingGetter(func(t *RequestTimings) time.Duration { return t.TLSHandshake }), nil
+	case FieldTimeToFirstByte:
+		return timingGetter(func(t *RequestTimings) time.Duration { return t.TimeToFirstByte }), nil
+	case FieldTransferTime:
+		return timingGetter(func(t *RequestTimings) time.Duration { return t.Transfer }), nil
+	default:
+		return nil, errors.New("field is not numeric")
+	}
+}
+
+// Returns a getter for one part of a request's timing breakdown. Parts that were not recorded, such as the TLS handshake of a plaintext request, have no value.
+func timingGetter(part func(t *RequestTimings) time.Duration) numFieldGetter {
+	return func(req *ProxyRequest) ([]int64, error) {
+		nums := make([]int64, 0)
+		if d := part(&req.Timings); d > 0 {
+			nums = append(nums, int64(d))
+		}
+		return nums, nil
+	}
+}
+
+// Returns whether the values of a numeric field are durations
+func isDurationField(field SearchField) bool {
+	switch field {
+	case FieldDuration, FieldDNSTime, FieldConnectTime, FieldProxyConnectTime, FieldTLSTime, FieldTimeToFirstByte, FieldTransferTime:
+		return true
+	}
+	return false
+}
+
+// Converts a numeric search argument to an int64
+func numArg(argval interface{}) (int64, error) {
+	switch val := argval.(type) {
+	case int:
+		return int64(val), nil
+	case int64:
+		return val, nil
+	case time.Duration:
+		return int64(val), nil
+	default:
+		return 0, errors.New("argument must be an integer or a time.Duration")
+	}
+}
+
+// Returns the number of values a numeric comparer takes
+func numComparerArgs(cmp NumComparer) int {
+	if cmp == NumBetween {
+		return 2
+	}
+	return 1
+}
+
+func genNumChecker(cmp NumComparer, argvals ...interface{}) (func(num int64) bool, error) {
+	if len(argvals) != numComparerArgs(cmp) {
+		return nil, fmt.Errorf("comparer takes %d values, got %d", numComparerArgs(cmp), len(argvals))
+	}
+
+	vals := make([]int64, len(argvals))
+	for i, argval := range argvals {
+		var err error
+		vals[i], err = numArg(argval)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch cmp {
+	case NumEqualTo:
+		return func(num int64) bool {
+			return num == vals[0]
+		}, nil
+	case NumGreaterThan:
+		return func(num int64) bool {
+			return num > vals[0]
+		}, nil
+	case NumLessThan:
+		return func(num int64) bool {
+			return num < vals[0]
+		}, nil
+	case NumBetween:
+		return func(num int64) bool {
+			return num >= vals[0] && num <= vals[1]
+		}, nil
+	case NumGreaterOrEqual:
+		return func(num int64) bool {
+			return num >= vals[0]
+		}, nil
+	case NumLessOrEqual:
+		return func(num int64) bool {
+			return num <= vals[0]
+		}, nil
+	default:
+		return nil, errors.New("invalid comparer")
+	}
+}
+
+func genNumFieldChecker(getter numFieldGetter, cmp NumComparer, vals ...interface{}) (RequestChecker, error) {
+	comparer, err := genNumChecker(cmp, vals...)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(req *ProxyRequest) bool {
+		nums, err := getter(req)
+		if err != nil {
+			return false
+		}
+		for _, num := range nums {
+			if comparer(num) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// Creates a checker for a numeric field from a comparer followed by its values
+func newNumFieldChecker(field SearchField, args []interface{}) (RequestChecker, error) {
+	getter, err := createNumFieldGetter(field)
+	if err != nil {
+		return nil, fmt.Errorf("error performing search: %s", err.Error())
+	}
+
+	if len(args) < 2 {
+		return nil, errors.New("searches through numeric fields must have one comparer and at least one value")
+	}
+
+	comparer, ok := args[0].(NumComparer)
+	if !ok {
+		return nil, errors.New("comparer must be a NumComparer")
+	}
+
+	return genNumFieldChecker(getter, comparer, args[1:]...)
+}
+
 func pairValuesFromHeader(header http.Header) []*PairValue {
 	// Returns a list of pair values from a http.Header
 	pairs := make([]*PairValue, 0)
@@ -533,6 +882,53 @@ func createKvPairGetter(field SearchField) (kvFieldGetter, error) {
 			}
 			return pairs, nil
 		}, nil
+	// Bodies that can't be parsed have no pairs
+	case FieldRequestJSON:
+		return func(req *ProxyRequest) ([]*PairValue, error) {
+			return jsonPairsOrEmpty(req.BodyBytes()), nil
+		}, nil
+	case FieldResponseJSON:
+		return func(req *ProxyRequest) ([]*PairValue, error) {
+			if req.ServerResponse == nil {
+				return make([]*PairValue, 0), nil
+			}
+			return jsonPairsOrEmpty(req.ServerResponse.BodyBytes()), nil
+		}, nil
+	case FieldBothJSON:
+		return func(req *ProxyRequest) ([]*PairValue, error) {
+			pairs := jsonPairsOrEmpty(req.BodyBytes())
+			if req.ServerResponse != nil {
+				pairs = append(pairs, jsonPairsOrEmpty(req.ServerResponse.BodyBytes())...)
+			}
+			return pairs, nil
+		}, nil
+	case FieldRequestXML:
+		return func(req *ProxyRequest) ([]*PairValue, error) {
+			return xmlPairsOrEmpty(req.Header, req.BodyBytes()), nil
+		}, nil
+	case FieldResponseXML:
+		return func(req *ProxyRequest) ([]*PairValue, error) {
+			if req.ServerResponse == nil {
+				return make([]*PairValue, 0), nil
+			}
+			return xmlPairsOrEmpty(req.ServerResponse.Header, req.ServerResponse.BodyBytes()), nil
+		}, nil
+	case FieldBothXML:
+		return func(req *ProxyRequest) ([]*PairValue, error) {
+			pairs := xmlPairsOrEmpty(req.Header, req.BodyBytes())
+			if req.ServerResponse != nil {
+				pairs = append(pairs, xmlPairsOrEmpty(req.ServerResponse.Header, req.ServerResponse.BodyBytes())...)
+			}
+			return pairs, nil
+		}, nil
+	case FieldMultipart:
+		return func(req *ProxyRequest) ([]*PairValue, error) {
+			pairs, err := multipartBodyPairs(req.Header, req.BodyBytes())
+			if err != nil {
+				return make([]*PairValue, 0), nil
+			}
+			return pairs, nil
+		}, nil
 	default:
 		return nil, errors.New("not implemented")
 	}
@@ -566,10 +962,10 @@ func genKvFieldChecker(kvGetter kvFieldGetter, cmp1 StrComparer, val1 string,
 	}, nil
 }
 
-func checkerFromPhrase(phrase QueryPhrase) (RequestChecker, error) {
+func checkerFromPhrase(sqr *savedQueryResolver, phrase QueryPhrase) (RequestChecker, error) {
 	checkers := make([]RequestChecker, len(phrase))
 	for i, args := range phrase {
-		newChecker, err := NewRequestChecker(args...)
+		newChecker, err := newRequestChecker(sqr, args...)
 		if err != nil {
 			return nil, fmt.Errorf("error with search %d: %s", i, err.Error())
 		}
@@ -590,9 +986,13 @@ func checkerFromPhrase(phrase QueryPhrase) (RequestChecker, error) {
 
 // Creates a RequestChecker from a MessageQuery
 func CheckerFromMessageQuery(query MessageQuery) (RequestChecker, error) {
+	return checkerFromMessageQuery(nil, query)
+}
+
+func checkerFromMessageQuery(sqr *savedQueryResolver, query MessageQuery) (RequestChecker, error) {
 	checkers := make([]RequestChecker, len(query))
 	for i, phrase := range query {
-		newChecker, err := checkerFromPhrase(phrase)
+		newChecker, err := checkerFromPhrase(sqr, phrase)
 		if err != nil {
 			return nil, fmt.Errorf("error with phrase %d: %s", i, err.Error())
 		}
@@ -667,6 +1067,60 @@ func fieldGoToString(field SearchField) (string, error) {
 		return "invert", nil
 	case FieldId:
 		return "dbid", nil
+	case FieldNote:
+		return "note", nil
+	case FieldHighlight:
+		return "highlight", nil
+	case FieldReviewed:
+		return "reviewed", nil
+	case FieldDuration:
+		return "duration", nil
+	case FieldRequestBodySize:
+		return "reqsize", nil
+	case FieldResponseBodySize:
+		return "rspsize", nil
+	case FieldWSMessageCount:
+		return "wscount", nil
+	case FieldPort:
+		return "port", nil
+	case FieldDNSTime:
+		return "dnstime", nil
+	case FieldConnectTime:
+		return "connecttime", nil
+	case FieldProxyConnectTime:
+		return "proxyconnecttime", nil
+	case FieldTLSTime:
+		return "tlstime", nil
+	case FieldTimeToFirstByte:
+		return "ttfb", nil
+	case FieldTransferTime:
+		return "transfertime", nil
+	case FieldRequestJSON:
+		return "reqjson", nil
+	case FieldResponseJSON:
+		return "rspjson", nil
+	case FieldBothJSON:
+		return "json", nil
+	case FieldRequestXML:
+		return "reqxml", nil
+	case FieldResponseXML:
+		return "rspxml", nil
+	case FieldBothXML:
+		return "xml", nil
+	case FieldMultipart:
+		return "multipart", nil
+	case FieldUnmangled:
+		return "unmangled", nil
+	case FieldRequestModified:
+		return "reqmodified", nil
+	case FieldResponseModified:
+		return "rspmodified", nil
+	case FieldWSModified:
+		return "wsmodified", nil
+	case FieldModified:
+		return "modified", nil
+	case FieldSavedQuery:
+		return "savedquery", nil
 	default:
 		return "", errors.New("invalid field")
 	}
@@ -698,7 +1152,7 @@ func fieldStrToGo(field string) (SearchField, error) {
 		return FieldPath, nil
 	case "url":
 		return FieldURL, nil
-	case "statuscode", "sc":
+	case "statuscode", "status", "sc":
 		return FieldStatusCode, nil
 	case "param", "pm":
 		return FieldBothParam, nil
@@ -724,6 +1178,60 @@ func fieldStrToGo(field string) (SearchField, error) {
 		return FieldInvert, nil
 	case "dbid":
 		return FieldId, nil
+	case "note":
+		return FieldNote, nil
+	case "highlight", "hl":
+		return FieldHighlight, nil
+	case "reviewed":
+		return FieldReviewed, nil
+	case "duration", "dur":
+		return FieldDuration, nil
+	case "reqsize", "qsz":
+		return FieldRequestBodySize, nil
+	case "rspsize", "ssz":
+		return FieldResponseBodySize, nil
+	case "wscount", "wsc":
+		return FieldWSMessageCount, nil
+	case "port":
+		return FieldPort, nil
+	case "dnstime", "dns":
+		return FieldDNSTime, nil
+	case "connecttime", "conn":
+		return FieldConnectTime, nil
+	case "proxyconnecttime", "proxytime":
+		return FieldProxyConnectTime, nil
+	case "tlstime", "tls":
+		return FieldTLSTime, nil
+	case "ttfb":
+		return FieldTimeToFirstByte, nil
+	case "transfertime", "xfer":
+		return FieldTransferTime, nil
+	case "reqjson", "qjs":
+		return FieldRequestJSON, nil
+	case "rspjson", "sjs":
+		return FieldResponseJSON, nil
+	case "json", "js":
+		return FieldBothJSON, nil
+	case "reqxml", "qxml":
+		return FieldRequestXML, nil
+	case "rspxml", "sxml", "xpath":
+		return FieldResponseXML, nil
+	case "xml":
+		return FieldBothXML, nil
+	case "multipart", "mp":
+		return FieldMultipart, nil
+	case "unmangled", "um":
+		return FieldUnmangled, nil
+	case "reqmodified", "qmod":
+		return FieldRequestModified, nil
+	case "rspmodified", "smod":
+		return FieldResponseModified, nil
+	case "wsmodified", "wsmod":
+		return FieldWSModified, nil
+	case "modified", "mod":
+		return FieldModified, nil
+	case "savedquery", "sq":
+		return FieldSavedQuery, nil
 	default:
 		return 0, fmt.Errorf("invalid field: %s", field)
 	}
@@ -815,6 +1323,121 @@ func cmpValStrToGo(strArgs []string) (StrComparer, interface{}, error) {
 	}
 }
 
+// Converts a NumComparer and its values for the given field into strings that can be used in string queries. Durations are written in the form used by time.ParseDuration.
+func numArgsGoToStr(field SearchField, args []interface{}) ([]string, error) {
+	if len(args) == 0 {
+		return nil, errors.New("missing comparer")
+	}
+
+	comparer, ok := args[0].(NumComparer)
+	if !ok {
+		return nil, errors.New("comparer must be a NumComparer")
+	}
+
+	var cmpStr string
+	switch comparer {
+	case NumEqualTo:
+		cmpStr = "eq"
+	case NumGreaterThan:
+		cmpStr = "gt"
+	case NumLessThan:
+		cmpStr = "lt"
+	case NumBetween:
+		cmpStr = "between"
+	case NumGreaterOrEqual:
+		cmpStr = "ge"
+	case NumLessOrEqual:
+		cmpStr = "le"
+	default:
+		return nil, errors.New("invalid comparer")
+	}
+
+	vals := args[1:]
+	if len(vals) != numComparerArgs(comparer) {
+		return nil, fmt.Errorf("%s takes %d values, got %d", cmpStr, numComparerArgs(comparer), len(vals))
+	}
+
+	retargs := []string{cmpStr}
+	for _, val := range vals {
+		num, err := numArg(val)
+		if err != nil {
+			return nil, err
+		}
+		if isDurationField(field) {
+			retargs = append(retargs, time.Duration(num).String())
+		} else {
+			retargs = append(retargs, strconv.FormatInt(num, 10))
+		}
+	}
+	return retargs, nil
+}
+
+// Parses a numeric comparer name
+func numComparerStrToGo(cmpStr string) (NumComparer, bool) {
+	switch cmpStr {
+	case "eq", "=":
+		return NumEqualTo, true
+	case "gt", ">":
+		return NumGreaterThan, true
+	case "lt", "<":
+		return NumLessThan, true
+	case "between", "btw":
+		return NumBetween, true
+	case "ge", ">=":
+		return NumGreaterOrEqual, true
+	case "le", "<=":
+		return NumLessOrEqual, true
+	default:
+		return 0, false
+	}
+}
+
+// Parses a numeric value for the given field. Duration values may either be a number of nanoseconds or a duration such as "1.5s".
+func numValStrToGo(field SearchField, valStr string) (interface{}, error) {
+	num, err := strconv.ParseInt(valStr, 10, 64)
+	if isDurationField(field) {
+		if err != nil {
+			d, err := time.ParseDuration(valStr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid duration: %s", valStr)
+			}
+			return d, nil
+		}
+		return time.Duration(num), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid number: %s", valStr)
+	}
+	return num, nil
+}
+
+// Parses a numeric comparer and its values for the given field
+func numArgsStrToGo(field SearchField, strArgs []string) ([]interface{}, error) {
+	if len(strArgs) == 0 {
+		return nil, errors.New("missing comparer")
+	}
+
+	cmp, ok := numComparerStrToGo(strArgs[0])
+	if !ok {
+		return nil, fmt.Errorf("invalid comparer: %s", strArgs[0])
+	}
+
+	valStrs := strArgs[1:]
+	if len(valStrs) != numComparerArgs(cmp) {
+		return nil, fmt.Errorf("%s takes %d values, got %d", strArgs[0], numComparerArgs(cmp), len(valStrs))
+	}
+
+	args := []interface{}{cmp}
+	for _, valStr := range valStrs {
+		val, err := numValStrToGo(field, valStr)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, val)
+	}
+	return args, nil
+}
+
 func CheckArgsStrToGo(strArgs []string) ([]interface{}, error) {
 	args := make([]interface{}, 0)
 	if len(strArgs) == 0 {
@@ -832,7 +1455,19 @@ func CheckArgsStrToGo(strArgs []string) ([]interface{}, error) {
 	// Parse the query arguments
 	switch args[0] {
 	// Normal string fields
-	case FieldAll, FieldRequestBody, FieldResponseBody, FieldAllBody, FieldWSMessage, FieldMethod, FieldHost, FieldPath, FieldStatusCode, FieldTag, FieldId:
+	case FieldAll, FieldRequestBody, FieldResponseBody, FieldAllBody, FieldWSMessage, FieldMethod, FieldHost, FieldPath, FieldStatusCode, FieldTag, FieldId, FieldNote, FieldHighlight, FieldReviewed, FieldRequestModified, FieldResponseModified, FieldWSModified, FieldModified, FieldSavedQuery:
+		// Status codes can also be compared as numbers
+		if field == FieldStatusCode && len(remaining) > 0 {
+			if _, ok := numComparerStrToGo(remaining[0]); ok {
+				numArgs, err := numArgsStrToGo(field, remaining)
+				if err != nil {
+					return nil, err
+				}
+				args = append(args, numArgs...)
+				break
+			}
+		}
+
 		if len(remaining) != 2 {
 			return nil, errors.New("string field searches require one comparer and one value")
 		}
@@ -844,7 +1479,7 @@ func CheckArgsStrToGo(strArgs []string) ([]interface{}, error) {
 		args = append(args, cmp)
 		args = append(args, val)
 	// Normal key/value fields
-	case FieldRequestHeaders, FieldResponseHeaders, FieldBothHeaders, FieldBothParam, FieldURLParam, FieldPostParam, FieldResponseCookie, FieldRequestCookie, FieldBothCookie:
+	case FieldRequestHeaders, FieldResponseHeaders, FieldBothHeaders, FieldBothParam, FieldURLParam, FieldPostParam, FieldResponseCookie, FieldRequestCookie, FieldBothCookie, FieldRequestJSON, FieldResponseJSON, FieldBothJSON, FieldRequestXML, FieldResponseXML, FieldBothXML, FieldMultipart:
 		if len(remaining) == 2 {
 			cmp, val, err := cmpValStrToGo(remaining)
 			if err != nil {
@@ -870,6 +1505,14 @@ func CheckArgsStrToGo(strArgs []string) ([]interface{}, error) {
 			return nil, errors.New("key/value field searches require either one comparer and one value or two comparer/value pairs")
 		}
 
+	// Numeric fields
+	case FieldDuration, FieldRequestBodySize, FieldResponseBodySize, FieldWSMessageCount, FieldPort, FieldDNSTime, FieldConnectTime, FieldProxyConnectTime, FieldTLSTime, FieldTimeToFirstByte, FieldTransferTime:
+		numArgs, err := numArgsStrToGo(field, remaining)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, numArgs...)
+
 	// Other fields
 	case FieldAfter, FieldBefore:
 		if len(remaining) != 1 {
@@ -904,6 +1547,12 @@ func CheckArgsStrToGo(strArgs []string) ([]interface{}, error) {
 			return nil, fmt.Errorf("error with query to invert: %s", err.Error())
 		}
 		args = append(args, remainingArgs...)
+	case FieldUnmangled:
+		remainingArgs, err := CheckArgsStrToGo(remaining)
+		if err != nil {
+			return nil, fmt.Errorf("error with query to run on unmangled messages: %s", err.Error())
+		}
+		args = append(args, remainingArgs...)
 	default:
 		return nil, fmt.Errorf("field not yet implemented: %s", strArgs[0])
 	}
@@ -930,7 +1579,19 @@ func CheckArgsGoToStr(args []interface{}) ([]string, error) {
 	retargs = append(retargs, strField)
 
 	switch field {
-	case FieldAll, FieldRequestBody, FieldResponseBody, FieldAllBody, FieldWSMessage, FieldMethod, FieldHost, FieldPath, FieldStatusCode, FieldTag, FieldId:
+	case FieldAll, FieldRequestBody, FieldResponseBody, FieldAllBody, FieldWSMessage, FieldMethod, FieldHost, FieldPath, FieldStatusCode, FieldTag, FieldId, FieldNote, FieldHighlight, FieldReviewed, FieldRequestModified, FieldResponseModified, FieldWSModified, FieldModified, FieldSavedQuery:
+		// Status codes can also be compared as numbers
+		if field == FieldStatusCode && len(args) > 1 {
+			if _, ok := args[1].(NumComparer); ok {
+				strs, err := numArgsGoToStr(field, args[1:])
+				if err != nil {
+					return nil, err
+				}
+				retargs = append(retargs, strs...)
+				return retargs, nil
+			}
+		}
+
 		if len(args) != 3 {
 			return nil, errors.New("string fields require exactly two arguments")
 		}
@@ -948,7 +1609,7 @@ func CheckArgsGoToStr(args []interface{}) ([]string, error) {
 		retargs = append(retargs, valStr)
 		return retargs, nil
 
-	case FieldRequestHeaders, FieldResponseHeaders, FieldBothHeaders, FieldBothParam, FieldURLParam, FieldPostParam, FieldResponseCookie, FieldRequestCookie, FieldBothCookie:
+	case FieldRequestHeaders, FieldResponseHeaders, FieldBothHeaders, FieldBothParam, FieldURLParam, FieldPostParam, FieldResponseCookie, FieldRequestCookie, FieldBothCookie, FieldRequestJSON, FieldResponseJSON, FieldBothJSON, FieldRequestXML, FieldResponseXML, FieldBothXML, FieldMultipart:
 		if len(args) == 3 {
 			comparer, ok := args[1].(StrComparer)
 			if !ok {
@@ -976,12 +1637,12 @@ func CheckArgsGoToStr(args []interface{}) ([]string, error) {
 			retargs = append(retargs, cmpStr1)
 			retargs = append(retargs, valStr1)
 
-			comparer2, ok := args[1].(StrComparer)
+			comparer2, ok := args[3].(StrComparer)
 			if !ok {
 				return nil, errors.New("comparer2 must be a StrComparer")
 			}
 
-			cmpStr2, valStr2, err := cmpValGoToStr(comparer2, args[2])
+			cmpStr2, valStr2, err := cmpValGoToStr(comparer2, args[4])
 			if err != nil {
 				return nil, err
 			}
@@ -993,6 +1654,14 @@ func CheckArgsGoToStr(args []interface{}) ([]string, error) {
 			return nil, errors.New("key/value queries take exactly two or four arguments")
 		}
 
+	case FieldDuration, FieldRequestBodySize, FieldResponseBodySize, FieldWSMessageCount, FieldPort, FieldDNSTime, FieldConnectTime, FieldProxyConnectTime, FieldTLSTime, FieldTimeToFirstByte, FieldTransferTime:
+		strs, err := numArgsGoToStr(field, args[1:])
+		if err != nil {
+			return nil, err
+		}
+		retargs = append(retargs, strs...)
+		return retargs, nil
+
 	case FieldAfter, FieldBefore:
 		if len(args) != 2 {
 			return nil, errors.New("before/after fields require exactly one argument")
@@ -1026,7 +1695,7 @@ func CheckArgsGoToStr(args []interface{}) ([]string, error) {
 		retargs = append(retargs, strconv.FormatInt(nanoseconds2, 10))
 		return retargs, nil
 
-	case FieldInvert:
+	case FieldInvert, FieldUnmangled:
 		strs, err := CheckArgsGoToStr(args[1:])
 		if err != nil {
 			return nil, err
@@ -3,7 +3,9 @@ package puppy
 import (
 	"runtime"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func checkSearch(t *testing.T, req *ProxyRequest, expected bool, args ...interface{}) {
@@ -62,3 +64,292 @@ func TestRegexpSearch(t *testing.T) {
 	checkSearch(t, req, true, FieldRequestBody, StrContainsRegexp, "^f.+z")
 	checkSearch(t, req, false, FieldRequestBody, StrContainsRegexp, "^baz")
 }
+
+func TestAnnotationSearch(t *testing.T) {
+	req := testReq()
+	req.Note = "check the foo parameter"
+	req.Highlight = "red"
+
+	checkSearch(t, req, true, FieldNote, StrContains, "foo parameter")
+	checkSearch(t, req, false, FieldNote, StrContains, "bar")
+	checkSearch(t, req, true, FieldHighlight, StrIs, "red")
+	checkSearch(t, req, false, FieldHighlight, StrIs, "blue")
+	checkSearch(t, req, true, FieldReviewed, StrIs, "false")
+
+	req.Reviewed = true
+	checkSearch(t, req, true, FieldReviewed, StrIs, "true")
+}
+
+func TestDurationSearch(t *testing.T) {
+	req := testReq()
+	req.StartDatetime = time.Unix(0, 1500000000000000000)
+	req.EndDatetime = req.StartDatetime.Add(2 * time.Second)
+
+	checkSearch(t, req, true, FieldDuration, NumGreaterThan, time.Second)
+	checkSearch(t, req, false, FieldDuration, NumGreaterThan, 3*time.Second)
+	checkSearch(t, req, true, FieldDuration, NumLessThan, 3*time.Second)
+	checkSearch(t, req, true, FieldDuration, NumEqualTo, 2*time.Second)
+
+	// Requests that never finished don't match any duration
+	req.EndDatetime = time.Unix(0, 0)
+	checkSearch(t, req, false, FieldDuration, NumLessThan, 3*time.Second)
+}
+
+func TestDurationStrArgs(t *testing.T) {
+	args, err := CheckArgsStrToGo([]string{"duration", "gt", "1.5s"})
+	testErr(t, err)
+	if len(args) != 3 || args[1] != NumGreaterThan || args[2] != 1500*time.Millisecond {
+		t.Errorf("incorrect arguments: %v", args)
+	}
+
+	strArgs, err := CheckArgsGoToStr(args)
+	testErr(t, err)
+	if len(strArgs) != 3 || strArgs[2] != "1.5s" {
+		t.Errorf("incorrect string arguments: %v", strArgs)
+	}
+
+	args, err = CheckArgsStrToGo([]string{"dur", "lt", "1000"})
+	testErr(t, err)
+	if len(args) != 3 || args[2] != time.Microsecond {
+		t.Errorf("incorrect arguments: %v", args)
+	}
+
+	if _, err := CheckArgsStrToGo([]string{"duration", "gt", "soon"}); err == nil {
+		t.Errorf("invalid duration did not return an error")
+	}
+}
+
+func TestTimingSearch(t *testing.T) {
+	req := testReq()
+	req.Timings = RequestTimings{
+		DNS:             time.Millisecond,
+		Connect:         2 * time.Millisecond,
+		TLSHandshake:    3 * time.Millisecond,
+		TimeToFirstByte: 40 * time.Millisecond,
+		Transfer:        5 * time.Millisecond,
+	}
+
+	checkSearch(t, req, true, FieldDNSTime, NumEqualTo, time.Millisecond)
+	checkSearch(t, req, true, FieldConnectTime, NumGreaterThan, time.Millisecond)
+	checkSearch(t, req, true, FieldTLSTime, NumBetween, 2*time.Millisecond, 4*time.Millisecond)
+	checkSearch(t, req, false, FieldTimeToFirstByte, NumLessThan, 10*time.Millisecond)
+	checkSearch(t, req, true, FieldTransferTime, NumLessThan, 10*time.Millisecond)
+
+	// Parts that were not recorded don't match
+	checkSearch(t, req, false, FieldProxyConnectTime, NumLessThan, time.Second)
+
+	args, err := CheckArgsStrToGo([]string{"ttfb", "gt", "30ms"})
+	testErr(t, err)
+	if len(args) != 3 || args[0] != FieldTimeToFirstByte || args[2] != 30*time.Millisecond {
+		t.Errorf("incorrect arguments: %v", args)
+	}
+	strArgs, err := CheckArgsGoToStr(args)
+	testErr(t, err)
+	if len(strArgs) != 3 || strArgs[0] != "ttfb" || strArgs[2] != "30ms" {
+		t.Errorf("incorrect string arguments: %v", strArgs)
+	}
+}
+
+func TestNumericSearch(t *testing.T) {
+	req := testReq()
+
+	checkSearch(t, req, true, FieldRequestBodySize, NumEqualTo, 7)
+	checkSearch(t, req, true, FieldResponseBodySize, NumGreaterThan, 3)
+	checkSearch(t, req, false, FieldResponseBodySize, NumGreaterThan, 4)
+	checkSearch(t, req, true, FieldWSMessageCount, NumEqualTo, 0)
+	checkSearch(t, req, true, FieldPort, NumBetween, 1, 1024)
+	checkSearch(t, req, true, FieldPort, NumBetween, 80, 80)
+	checkSearch(t, req, false, FieldPort, NumBetween, 81, 1024)
+
+	checkSearch(t, req, true, FieldStatusCode, NumLessThan, 300)
+	checkSearch(t, req, false, FieldStatusCode, NumGreaterThan, 499)
+	checkSearch(t, req, true, FieldStatusCode, StrIs, "200")
+
+	req.ServerResponse = nil
+	checkSearch(t, req, false, FieldResponseBodySize, NumLessThan, 100)
+	checkSearch(t, req, false, FieldStatusCode, NumLessThan, 300)
+}
+
+func TestNumericStrArgs(t *testing.T) {
+	queries := [][]string{
+		{"port", "between", "80", "443"},
+		{"rspsize", "gt", "1048576"},
+		{"reqsize", "eq", "0"},
+		{"wscount", "lt", "10"},
+		{"statuscode", "gt", "499"},
+		{"statuscode", "is", "200"},
+		{"duration", "between", "1s", "2m0s"},
+	}
+
+	for _, query := range queries {
+		args, err := CheckArgsStrToGo(query)
+		testErr(t, err)
+		if _, err := NewRequestChecker(args...); err != nil {
+			t.Errorf("error creating checker for %v: %s", query, err.Error())
+		}
+		strArgs, err := CheckArgsGoToStr(args)
+		testErr(t, err)
+		checkTags(t, strArgs, query)
+	}
+
+	if _, err := CheckArgsStrToGo([]string{"port", "between", "80"}); err == nil {
+		t.Errorf("between with one value did not return an error")
+	}
+	if _, err := CheckArgsStrToGo([]string{"port", "contains", "80"}); err == nil {
+		t.Errorf("string comparer on a numeric field did not return an error")
+	}
+}
+
+func bodyReq(t *testing.T, reqHeaders string, reqBody string, rspHeaders string, rspBody string) *ProxyRequest {
+	req, err := ProxyRequestFromBytes(
+		[]byte("POST / HTTP/1.1\r\n"+reqHeaders+"Content-Length: "+strconv.Itoa(len(reqBody))+"\r\n\r\n"+reqBody),
+		"example.com", 80, false,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp, err := ProxyResponseFromBytes(
+		[]byte("HTTP/1.1 200 OK\r\n" + rspHeaders + "Content-Length: " + strconv.Itoa(len(rspBody)) + "\r\n\r\n" + rspBody),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.ServerResponse = rsp
+	return req
+}
+
+func TestJSONSearch(t *testing.T) {
+	req := bodyReq(t,
+		"Content-Type: application/json\r\n", `{"user": {"role": "admin", "id": 5}, "odd key": true}`,
+		"Content-Type: application/json\r\n", `{"items": [{"id": 1}, {"id": 2, "tags": ["a", "b"]}], "error": null}`,
+	)
+
+	checkSearch(t, req, true, FieldRequestJSON, StrIs, "$.user.role", StrIs, "admin")
+	checkSearch(t, req, true, FieldRequestJSON, StrIs, "user.role", StrIs, "admin")
+	checkSearch(t, req, false, FieldRequestJSON, StrIs, "$.user.role", StrIs, "user")
+	checkSearch(t, req, true, FieldRequestJSON, StrIs, "$.user.id", StrIs, "5")
+	checkSearch(t, req, true, FieldRequestJSON, StrIs, "$['odd key']", StrIs, "true")
+	checkSearch(t, req, true, FieldRequestJSON, StrIs, "$.user", StrContains, `"role":"admin"`)
+
+	// Check for the presence of a key
+	checkSearch(t, req, true, FieldResponseJSON, StrIs, "$.error", StrContains, "")
+	checkSearch(t, req, false, FieldResponseJSON, StrIs, "$.user", StrContains, "")
+	checkSearch(t, req, true, FieldBothJSON, StrIs, "$.user", StrContains, "")
+
+	// Wildcards and recursive descent
+	checkSearch(t, req, true, FieldResponseJSON, StrIs, "$.items[1].id", StrIs, "2")
+	checkSearch(t, req, false, FieldResponseJSON, StrIs, "$.items[0].id", StrIs, "2")
+	checkSearch(t, req, true, FieldResponseJSON, StrIs, "$.items[*].id", StrIs, "2")
+	checkSearch(t, req, true, FieldResponseJSON, StrIs, "$..tags[*]", StrIs, "b")
+	checkSearch(t, req, true, FieldResponseJSON, StrIs, "$..id", StrIs, "1")
+	checkSearch(t, req, false, FieldResponseJSON, StrIs, "$..role", StrContains, "")
+
+	// Search keys and values together
+	checkSearch(t, req, true, FieldBothJSON, StrIs, "admin")
+	checkSearch(t, req, true, FieldBothJSON, StrContains, "$.items")
+
+	// Non-JSON bodies don't match
+	checkSearch(t, testReq(), false, FieldBothJSON, StrContains, "")
+
+	if _, err := NewRequestChecker(FieldBothJSON, StrIs, "$.foo[bar]", StrIs, "x"); err == nil {
+		t.Error("expected an error for an invalid JSONPath")
+	}
+}
+
+func TestXMLSearch(t *testing.T) {
+	req := bodyReq(t,
+		"Content-Type: text/xml\r\n", `<user id="5"><role>admin</role><role>user</role></user>`,
+		"Content-Type: text/html\r\n", `<html><body><div class="a">one<br>two</div><div><p>three</p></div></body></html>`,
+	)
+
+	checkSearch(t, req, true, FieldRequestXML, StrIs, "/user/role", StrIs, "admin")
+	checkSearch(t, req, true, FieldRequestXML, StrIs, "/user/role[2]", StrIs, "user")
+	checkSearch(t, req, false, FieldRequestXML, StrIs, "/user/role[1]", StrIs, "user")
+	checkSearch(t, req, true, FieldRequestXML, StrIs, "/user/@id", StrIs, "5")
+	checkSearch(t, req, true, FieldRequestXML, StrIs, "user/role/text()", StrIs, "admin")
+
+	checkSearch(t, req, true, FieldResponseXML, StrIs, "//div[1]", StrIs, "onetwo")
+	checkSearch(t, req, true, FieldResponseXML, StrIs, "//div/@class", StrIs, "a")
+	checkSearch(t, req, true, FieldResponseXML, StrIs, "/html/body/*/p", StrIs, "three")
+	checkSearch(t, req, true, FieldResponseXML, StrIs, "//p", StrContains, "")
+	checkSearch(t, req, false, FieldResponseXML, StrIs, "//span", StrContains, "")
+	checkSearch(t, req, true, FieldBothXML, StrIs, "//role", StrIs, "admin")
+
+	checkSearch(t, testReq(), false, FieldBothXML, StrContains, "")
+
+	if _, err := NewRequestChecker(FieldBothXML, StrIs, "//div[@class='a']", StrIs, "x"); err == nil {
+		t.Error("expected an error for an unsupported XPath predicate")
+	}
+}
+
+func TestMultipartSearch(t *testing.T) {
+	body := "--XX\r\nContent-Disposition: form-data; name=\"user\"\r\n\r\nadmin\r\n" +
+		"--XX\r\nContent-Disposition: form-data; name=\"file\"; filename=\"a.txt\"\r\nContent-Type: text/plain\r\n\r\nfile contents\r\n" +
+		"--XX--\r\n"
+	req := bodyReq(t, "Content-Type: multipart/form-data; boundary=XX\r\n", body, "", "")
+
+	checkSearch(t, req, true, FieldMultipart, StrIs, "user", StrIs, "admin")
+	checkSearch(t, req, true, FieldMultipart, StrIs, "file", StrContains, "contents")
+	checkSearch(t, req, false, FieldMultipart, StrIs, "user", StrIs, "file contents")
+	checkSearch(t, req, true, FieldMultipart, StrContains, "contents")
+	checkSearch(t, testReq(), false, FieldMultipart, StrContains, "")
+}
+
+func TestUnmangledSearch(t *testing.T) {
+	req := bodyReq(t, "", "mangled request", "", "mangled response")
+	checkSearch(t, req, false, FieldModified, StrIs, "true")
+	checkSearch(t, req, true, FieldUnmangled, FieldRequestBody, StrContains, "mangled request")
+
+	orig := bodyReq(t, "", "original request", "", "original response")
+	req.Unmangled = orig
+	req.ServerResponse.Unmangled = orig.ServerResponse
+	req.Note = "annotated"
+
+	checkSearch(t, req, true, FieldRequestModified, StrIs, "true")
+	checkSearch(t, req, true, FieldResponseModified, StrIs, "true")
+	checkSearch(t, req, true, FieldWSModified, StrIs, "false")
+	checkSearch(t, req, true, FieldModified, StrIs, "true")
+
+	checkSearch(t, req, true, FieldRequestBody, StrContains, "mangled request")
+	checkSearch(t, req, false, FieldRequestBody, StrContains, "original request")
+	checkSearch(t, req, true, FieldUnmangled, FieldRequestBody, StrContains, "original request")
+	checkSearch(t, req, true, FieldUnmangled, FieldResponseBody, StrContains, "original response")
+	checkSearch(t, req, false, FieldUnmangled, FieldResponseBody, StrContains, "mangled response")
+	checkSearch(t, req, true, FieldUnmangled, FieldNote, StrIs, "annotated")
+	checkSearch(t, req, true, FieldUnmangled, FieldModified, StrIs, "false")
+	checkSearch(t, req, false, FieldUnmangled, FieldInvert, FieldRequestBody, StrContains, "original")
+
+	wsReq := testReq()
+	wsm, err := NewProxyWSMessage(1, []byte("mangled message"), ToServer)
+	testErr(t, err)
+	wsm.Unmangled, err = NewProxyWSMessage(1, []byte("original message"), ToServer)
+	testErr(t, err)
+	wsReq.WSMessages = []*ProxyWSMessage{wsm}
+
+	checkSearch(t, wsReq, true, FieldWSModified, StrIs, "true")
+	checkSearch(t, wsReq, true, FieldRequestModified, StrIs, "false")
+	checkSearch(t, wsReq, true, FieldModified, StrIs, "true")
+	checkSearch(t, wsReq, true, FieldWSMessage, StrContains, "mangled message")
+	checkSearch(t, wsReq, true, FieldUnmangled, FieldWSMessage, StrContains, "original message")
+	checkSearch(t, wsReq, false, FieldUnmangled, FieldWSMessage, StrContains, "mangled message")
+}
+
+func TestUnmangledStrArgs(t *testing.T) {
+	args, err := CheckArgsStrToGo([]string{"um", "inv", "body", "contains", "foo"})
+	testErr(t, err)
+	expected := []interface{}{FieldUnmangled, FieldInvert, FieldAllBody, StrContains, "foo"}
+	if len(args) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, args)
+	}
+	for i := range args {
+		if args[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, args)
+		}
+	}
+
+	strArgs, err := CheckArgsGoToStr(args)
+	testErr(t, err)
+	if strings.Join(strArgs, " ") != "unmangled invert body contains foo" {
+		t.Errorf("unexpected string arguments: %v", strArgs)
+	}
+}
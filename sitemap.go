@@ -0,0 +1,379 @@
+package puppy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+Site map
+
+A site map is a tree of the sites and paths that requests in a storage were sent to. The children
+of the root are sites named by their scheme, host and port, such as https://example.com or
+http://example.com:8080. The children of a site are the segments of the request paths. Segments
+that have children are directories and end with a slash, so a request to /a/b is stored at the
+node a/ -> b and a request to /a/b/ is stored at a/ -> b/. Requests to / are stored at the site.
+
+Site maps watch their storage and are updated as requests are saved, updated and deleted.
+Requests that are only stored as the unmangled version of another request are not included.
+*/
+
+// A node in a site map
+type SiteMapNode struct {
+	// The site or path segment that the node represents. The root node has a blank name
+	Name string
+	// The number of requests made to exactly this node
+	Count int64
+	// The number of requests made to this node and all of its descendants
+	Total int64
+	// The number of requests made to this node with each method
+	Methods map[string]int64
+	// The number of requests made to this node with each URL or POST parameter name
+	Params map[string]int64
+	// The number of responses to requests made to this node with each status code
+	StatusCodes map[int]int64
+	// The children of this node keyed by their names
+	Children map[string]*SiteMapNode
+}
+
+// The contribution of a single request to a site map
+type siteMapEntry struct {
+	keys        []string
+	method      string
+	params      []string
+	hasResponse bool
+	statusCode  int
+	rspId       string
+}
+
+// A site map of the requests in a storage. Create one with NewSiteMap.
+type SiteMap struct {
+	mtx     sync.Mutex
+	ms      MessageStorage
+	checker RequestChecker
+	root    *SiteMapNode
+
+	entries   map[string]*siteMapEntry
+	unmangled map[string]bool
+
+	// Ids of requests that changed while the storage was being loaded
+	loading bool
+	touched map[string]bool
+}
+
+func newSiteMapNode(name string) *SiteMapNode {
+	return &SiteMapNode{
+		Name:        name,
+		Methods:     make(map[string]int64),
+		Params:      make(map[string]int64),
+		StatusCodes: make(map[int]int64),
+		Children:    make(map[string]*SiteMapNode),
+	}
+}
+
+// Creates a site map of the requests in a storage that match a checker and watches the storage to keep it up to date. A nil checker includes every request. Close must be called to stop watching the storage.
+func NewSiteMap(ms MessageStorage, checker RequestChecker) (*SiteMap, error) {
+	if checker == nil {
+		checker = func(req *ProxyRequest) bool { return true }
+	}
+	sm := &SiteMap{
+		ms:        ms,
+		checker:   checker,
+		root:      newSiteMapNode(""),
+		entries:   make(map[string]*siteMapEntry),
+		unmangled: make(map[string]bool),
+		loading:   true,
+		touched:   make(map[string]bool),
+	}
+
+	// Start watching before loading so that no changes are missed. Requests that change while loading are already up to date and are skipped when adding the loaded requests.
+	if err := ms.Watch(sm); err != nil {
+		return nil, err
+	}
+	reqs, err := ms.CheckRequests(0, func(req *ProxyRequest) bool { return true })
+	if err != nil {
+		ms.EndWatch(sm)
+		return nil, err
+	}
+
+	sm.mtx.Lock()
+	defer sm.mtx.Unlock()
+	for _, req := range reqs {
+		if req.Unmangled != nil && !sm.touched[req.Unmangled.DbId] {
+			sm.markUnmangled(req.Unmangled.DbId)
+		}
+	}
+	for _, req := range reqs {
+		if !sm.touched[req.DbId] && !sm.unmangled[req.DbId] && checker(req) {
+			sm.add(req)
+		}
+	}
+	sm.loading = false
+	sm.touched = nil
+	return sm, nil
+}
+
+// Stops watching the storage. The site map is not updated after it is closed.
+func (sm *SiteMap) Close() {
+	sm.ms.EndWatch(sm)
+}
+
+// Returns a copy of the site map tree. If depth is greater than zero, only that many levels below the root are included.
+func (sm *SiteMap) Tree(depth int) *SiteMapNode {
+	sm.mtx.Lock()
+	defer sm.mtx.Unlock()
+	if depth <= 0 {
+		depth = -1
+	}
+	return copySiteMapNode(sm.root, depth)
+}
+
+func copySiteMapNode(node *SiteMapNode, depth int) *SiteMapNode {
+	ret := newSiteMapNode(node.Name)
+	ret.Count = node.Count
+	ret.Total = node.Total
+	for k, v := range node.Methods {
+		ret.Methods[k] = v
+	}
+	for k, v := range node.Params {
+		ret.Params[k] = v
+	}
+	for k, v := range node.StatusCodes {
+		ret.StatusCodes[k] = v
+	}
+	if depth == 0 {
+		return ret
+	}
+	for k, child := range node.Children {
+		ret.Children[k] = copySiteMapNode(child, depth-1)
+	}
+	return ret
+}
+
+// Returns the children of a node sorted by name
+func (node *SiteMapNode) SortedChildren() []*SiteMapNode {
+	children := make([]*SiteMapNode, 0, len(node.Children))
+	for _, child := range node.Children {
+		children = append(children, child)
+	}
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].Name < children[j].Name
+	})
+	return children
+}
+
+// Returns the name of the site that a request was sent to
+func siteMapSiteName(req *ProxyRequest) string {
+	scheme := "http"
+	defaultPort := 80
+	if req.DestUseTLS {
+		scheme = "https"
+		defaultPort = 443
+	}
+	if req.DestPort == defaultPort {
+		return fmt.Sprintf("%s://%s", scheme, req.DestHost)
+	}
+	return fmt.Sprintf("%s://%s:%d", scheme, req.DestHost, req.DestPort)
+}
+
+// Returns the keys of the nodes from the root to the node for a request
+func siteMapKeys(req *ProxyRequest) []string {
+	keys := []string{siteMapSiteName(req)}
+	path := strings.TrimPrefix(req.URL.Path, "/")
+	if path == "" {
+		return keys
+	}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if i < len(segments)-1 {
+			keys = append(keys, segment+"/")
+		} else if segment != "" {
+			keys = append(keys, segment)
+		}
+	}
+	return keys
+}
+
+func newSiteMapEntry(req *ProxyRequest) *siteMapEntry {
+	entry := &siteMapEntry{
+		keys:   siteMapKeys(req),
+		method: req.Method,
+	}
+
+	seen := make(map[string]bool)
+	for name := range req.URLParameters() {
+		seen[name] = true
+	}
+	if postParams, err := req.PostParameters(); err == nil {
+		for name := range postParams {
+			seen[name] = true
+		}
+	}
+	for name := range seen {
+		entry.params = append(entry.params, name)
+	}
+
+	if req.ServerResponse != nil {
+		entry.hasResponse = true
+		entry.statusCode = req.ServerResponse.StatusCode
+		entry.rspId = req.ServerResponse.DbId
+	}
+	return entry
+}
+
+// Adds a request to the tree, replacing the previous version of it
+func (sm *SiteMap) add(req *ProxyRequest) {
+	sm.remove(req.DbId)
+	entry := newSiteMapEntry(req)
+	sm.entries[req.DbId] = entry
+
+	node := sm.root
+	node.Total++
+	for _, key := range entry.keys {
+		child, ok := node.Children[key]
+		if !ok {
+			child = newSiteMapNode(key)
+			node.Children[key] = child
+		}
+		node = child
+		node.Total++
+	}
+
+	node.Count++
+	node.Methods[entry.method]++
+	for _, param := range entry.params {
+		node.Params[param]++
+	}
+	if entry.hasResponse {
+		node.StatusCodes[entry.statusCode]++
+	}
+}
+
+// Removes a request from the tree and prunes nodes that no longer have any requests
+func (sm *SiteMap) remove(reqid string) {
+	entry, ok := sm.entries[reqid]
+	if !ok {
+		return
+	}
+	delete(sm.entries, reqid)
+
+	node := sm.root
+	node.Total--
+	for _, key := range entry.keys {
+		child := node.Children[key]
+		child.Total--
+		if child.Total == 0 {
+			delete(node.Children, key)
+		}
+		node = child
+	}
+
+	node.Count--
+	decrementCount(node.Methods, entry.method)
+	for _, param := range entry.params {
+		decrementCount(node.Params, param)
+	}
+	if entry.hasResponse {
+		node.StatusCodes[entry.statusCode]--
+		if node.StatusCodes[entry.statusCode] <= 0 {
+			delete(node.StatusCodes, entry.statusCode)
+		}
+	}
+}
+
+func decrementCount(counts map[string]int64, key string) {
+	counts[key]--
+	if counts[key] <= 0 {
+		delete(counts, key)
+	}
+}
+
+// Returns the node that a request's entry is stored at
+func (sm *SiteMap) entryNode(entry *siteMapEntry) *SiteMapNode {
+	node := sm.root
+	for _, key := range entry.keys {
+		node = node.Children[key]
+	}
+	return node
+}
+
+// Records that a request is the unmangled version of another request and removes it from the tree
+func (sm *SiteMap) markUnmangled(reqid string) {
+	sm.unmangled[reqid] = true
+	sm.remove(reqid)
+}
+
+func (sm *SiteMap) touch(reqid string) {
+	if sm.loading {
+		sm.touched[reqid] = true
+	}
+}
+
+func (sm *SiteMap) requestChanged(req *ProxyRequest) {
+	sm.mtx.Lock()
+	defer sm.mtx.Unlock()
+	sm.touch(req.DbId)
+	if req.Unmangled != nil {
+		sm.touch(req.Unmangled.DbId)
+		sm.markUnmangled(req.Unmangled.DbId)
+	}
+	if !sm.unmangled[req.DbId] && sm.checker(req) {
+		sm.add(req)
+	} else {
+		sm.remove(req.DbId)
+	}
+}
+
+/*
+StorageWatcher implementation
+*/
+
+func (sm *SiteMap) NewRequestSaved(ms MessageStorage, req *ProxyRequest) {
+	sm.requestChanged(req)
+}
+
+func (sm *SiteMap) RequestUpdated(ms MessageStorage, req *ProxyRequest) {
+	sm.requestChanged(req)
+}
+
+func (sm *SiteMap) RequestDeleted(ms MessageStorage, DbId string) {
+	sm.mtx.Lock()
+	defer sm.mtx.Unlock()
+	sm.touch(DbId)
+	sm.remove(DbId)
+	delete(sm.unmangled, DbId)
+}
+
+func (sm *SiteMap) NewResponseSaved(ms MessageStorage, rsp *ProxyResponse) {
+}
+
+func (sm *SiteMap) ResponseUpdated(ms MessageStorage, rsp *ProxyResponse) {
+	sm.mtx.Lock()
+	defer sm.mtx.Unlock()
+	for _, entry := range sm.entries {
+		if !entry.hasResponse || entry.rspId != rsp.DbId || entry.statusCode == rsp.StatusCode {
+			continue
+		}
+		node := sm.entryNode(entry)
+		node.StatusCodes[entry.statusCode]--
+		if node.StatusCodes[entry.statusCode] <= 0 {
+			delete(node.StatusCodes, entry.statusCode)
+		}
+		entry.statusCode = rsp.StatusCode
+		node.StatusCodes[entry.statusCode]++
+	}
+}
+
+func (sm *SiteMap) ResponseDeleted(ms MessageStorage, DbId string) {
+}
+
+func (sm *SiteMap) NewWSMessageSaved(ms MessageStorage, req *ProxyRequest, wsm *ProxyWSMessage) {
+}
+
+func (sm *SiteMap) WSMessageUpdated(ms MessageStorage, req *ProxyRequest, wsm *ProxyWSMessage) {
+}
+
+func (sm *SiteMap) WSMessageDeleted(ms MessageStorage, DbId string) {
+}
@@ -0,0 +1,130 @@
+package puppy
+
+import (
+	"strconv"
+	"testing"
+)
+
+func siteMapReq(t *testing.T, method string, path string, body string, status int) *ProxyRequest {
+	req, err := ProxyRequestFromBytes(
+		[]byte(method+" "+path+" HTTP/1.1\r\nContent-Type: application/x-www-form-urlencoded\r\nContent-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+body),
+		"example.com", 443, true,
+	)
+	testErr(t, err)
+	if status != 0 {
+		req.ServerResponse, err = ProxyResponseFromBytes([]byte("HTTP/1.1 " + strconv.Itoa(status) + " Status\r\nContent-Length: 0\r\n\r\n"))
+		testErr(t, err)
+	}
+	return req
+}
+
+// Returns the node at the given keys or nil if it does not exist
+func siteMapNode(root *SiteMapNode, keys ...string) *SiteMapNode {
+	node := root
+	for _, key := range keys {
+		node = node.Children[key]
+		if node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+func TestSiteMap(t *testing.T) {
+	storage := NewBoundedMemoryStorage(0, 0)
+	defer storage.Close()
+
+	login := siteMapReq(t, "POST", "/app/login", "user=admin&pass=x", 302)
+	testErr(t, SaveNewRequest(storage, login))
+	testErr(t, SaveNewRequest(storage, siteMapReq(t, "GET", "/app/login?next=/", "", 200)))
+	testErr(t, SaveNewRequest(storage, siteMapReq(t, "GET", "/", "", 200)))
+
+	sm, err := NewSiteMap(storage, nil)
+	testErr(t, err)
+	defer sm.Close()
+
+	root := sm.Tree(0)
+	site := siteMapNode(root, "https://example.com")
+	if root.Total != 3 || site == nil || site.Count != 1 || site.Total != 3 {
+		t.Fatalf("unexpected site map %+v", root)
+	}
+	node := siteMapNode(root, "https://example.com", "app/", "login")
+	if node == nil || node.Count != 2 || node.Methods["GET"] != 1 || node.Methods["POST"] != 1 {
+		t.Fatalf("unexpected login node %+v", node)
+	}
+	if node.Params["user"] != 1 || node.Params["pass"] != 1 || node.Params["next"] != 1 {
+		t.Errorf("unexpected params %v", node.Params)
+	}
+	if node.StatusCodes[200] != 1 || node.StatusCodes[302] != 1 {
+		t.Errorf("unexpected status codes %v", node.StatusCodes)
+	}
+
+	// Changes to the storage are applied to the site map
+	other := siteMapReq(t, "GET", "/app/", "", 0)
+	other.DestPort = 8443
+	other.Unmangled = siteMapReq(t, "GET", "/unmangled", "", 0)
+	testErr(t, SaveNewRequest(storage, other))
+	root = sm.Tree(0)
+	if node := siteMapNode(root, "https://example.com:8443", "app/"); node == nil || node.Count != 1 {
+		t.Errorf("new request was not added to the site map")
+	}
+	if siteMapNode(root, "https://example.com", "unmangled") != nil || root.Total != 4 {
+		t.Errorf("unmangled request was added to the site map")
+	}
+
+	login.ServerResponse.StatusCode = 500
+	testErr(t, UpdateRequest(storage, login))
+	node = siteMapNode(sm.Tree(0), "https://example.com", "app/", "login")
+	if node.StatusCodes[500] != 1 || node.StatusCodes[302] != 0 || node.Count != 2 {
+		t.Errorf("updated request was not applied to the site map: %v", node.StatusCodes)
+	}
+
+	testErr(t, storage.DeleteRequest(other.DbId))
+	root = sm.Tree(0)
+	if siteMapNode(root, "https://example.com:8443") != nil || root.Total != 3 {
+		t.Errorf("deleted request was not removed from the site map")
+	}
+
+	// Depth limits the number of levels returned
+	root = sm.Tree(1)
+	if site := siteMapNode(root, "https://example.com"); site == nil || len(site.Children) != 0 || site.Total != 3 {
+		t.Errorf("depth was not applied to the site map")
+	}
+}
+
+func TestSiteMapFilter(t *testing.T) {
+	storage := NewBoundedMemoryStorage(0, 0)
+	defer storage.Close()
+	testErr(t, SaveNewRequest(storage, siteMapReq(t, "GET", "/a", "", 200)))
+	testErr(t, SaveNewRequest(storage, siteMapReq(t, "GET", "/b", "", 404)))
+
+	iproxy := NewInterceptingProxy(nil)
+	id := iproxy.AddMessageStorage(storage, "test")
+
+	query := MessageQuery{{{FieldStatusCode, StrIs, "200"}}}
+	sm, err := iproxy.GetSiteMap(id, query, false)
+	testErr(t, err)
+	root := sm.Tree(0)
+	if siteMapNode(root, "https://example.com", "a") == nil || siteMapNode(root, "https://example.com", "b") != nil {
+		t.Errorf("query was not applied to the site map")
+	}
+	if cached, _ := iproxy.GetSiteMap(id, query, false); cached != sm {
+		t.Errorf("site map was not reused")
+	}
+
+	testErr(t, iproxy.SetScopeQuery(MessageQuery{{{FieldPath, StrIs, "/b"}}}))
+	scoped, err := iproxy.GetSiteMap(id, nil, true)
+	testErr(t, err)
+	root = scoped.Tree(0)
+	if siteMapNode(root, "https://example.com", "a") != nil || siteMapNode(root, "https://example.com", "b") == nil {
+		t.Errorf("scope was not applied to the site map")
+	}
+
+	// Changing the scope creates a new site map
+	testErr(t, iproxy.ClearScope())
+	scoped2, err := iproxy.GetSiteMap(id, nil, true)
+	testErr(t, err)
+	if scoped2 == scoped || siteMapNode(scoped2.Tree(0), "https://example.com", "a") == nil {
+		t.Errorf("site map was not updated for the new scope")
+	}
+}
@@ -0,0 +1,131 @@
+package puppy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+)
+
+/*
+Content-addressed message bodies
+
+The body section of each request and response is stored gzip compressed in the message_bodies table and is keyed by
+the sha256 hash of its uncompressed contents (or an HMAC for encrypted storages). The full_request/full_response columns only hold the header section of
+the message when body_hash is set. Each body keeps a count of how many messages reference it and is deleted once
+nothing references it.
+*/
+
+// Splits a full HTTP message into its header section (including the blank line) and everything following it
+func splitMessage(msg []byte) ([]byte, []byte) {
+	ind := bytes.Index(msg, []byte("\r\n\r\n"))
+	if ind < 0 {
+		return msg, nil
+	}
+	return msg[:ind+4], msg[ind+4:]
+}
+
+// Joins the header section of a message with its body
+func joinMessage(head []byte, body []byte) []byte {
+	msg := make([]byte, 0, len(head)+len(body))
+	msg = append(msg, head...)
+	return append(msg, body...)
+}
+
+func compressBody(body []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	w := gzip.NewWriter(buf)
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompressBody(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// Splits a message and stores its body in the message_bodies table. Returns the header section of the message sealed with the cipher and the hash of the body. If the message has no body, the full sealed message and a nil hash are returned.
+func storeMessageBody(tx *sql.Tx, crypt *blobCipher, msg []byte) ([]byte, *string, error) {
+	head, body := splitMessage(msg)
+	if len(body) == 0 {
+		sealed, err := crypt.seal(msg)
+		if err != nil {
+			return nil, nil, err
+		}
+		return sealed, nil, nil
+	}
+
+	hash := crypt.hash(body)
+
+	res, err := tx.Exec("UPDATE message_bodies SET refcount=refcount+1 WHERE hash=?;", hash)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error updating message body reference count: %s", err.Error())
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		compressed, err := compressBody(body)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error compressing message body: %s", err.Error())
+		}
+		sealed, err := crypt.seal(compressed)
+		if err != nil {
+			return nil, nil, err
+		}
+		_, err = tx.Exec("INSERT INTO message_bodies (hash, refcount, data) VALUES (?, 1, ?);", hash, sealed)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error inserting message body into database: %s", err.Error())
+		}
+	}
+
+	sealedHead, err := crypt.seal(head)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sealedHead, &hash, nil
+}
+
+// Removes a reference to a body and deletes it if it is no longer referenced
+func releaseMessageBody(tx *sql.Tx, hash sql.NullString) error {
+	if !hash.Valid {
+		return nil
+	}
+
+	if _, err := tx.Exec("UPDATE message_bodies SET refcount=refcount-1 WHERE hash=?;", hash.String); err != nil {
+		return fmt.Errorf("error updating message body reference count: %s", err.Error())
+	}
+
+	if _, err := tx.Exec("DELETE FROM message_bodies WHERE hash=? AND refcount<=0;", hash.String); err != nil {
+		return fmt.Errorf("error deleting message body: %s", err.Error())
+	}
+	return nil
+}
+
+// Rebuilds a full message from the header section stored in the messages table and the compressed body joined from message_bodies
+func loadMessageBody(crypt *blobCipher, sealedHead []byte, sealedBody []byte) ([]byte, error) {
+	head, err := crypt.open(sealedHead)
+	if err != nil {
+		return nil, err
+	}
+	if sealedBody == nil {
+		return head, nil
+	}
+	compressedBody, err := crypt.open(sealedBody)
+	if err != nil {
+		return nil, err
+	}
+	body, err := decompressBody(compressedBody)
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing message body: %s", err.Error())
+	}
+	return joinMessage(head, body), nil
+}
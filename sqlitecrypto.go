@@ -0,0 +1,413 @@
+package puppy
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+/*
+Encrypted SQLiteStorage
+
+Encrypted storages seal the stored request, response, and websocket message contents along with request notes and
+plugin data values using AES-256-GCM with a key derived from a passphrase using scrypt. Metadata such as ids, hosts,
+ports, timestamps, tags, and highlights are left unencrypted so that they can still be indexed. Content-addressed bodies are keyed by an HMAC of
+their contents rather than a plain hash so that the hashes do not reveal the bodies.
+*/
+
+// ErrStorageEncrypted is returned when opening an encrypted datafile without a passphrase
+const ErrStorageEncrypted = ConstErr("datafile is encrypted and requires a passphrase")
+
+// ErrIncorrectPassphrase is returned when the passphrase for an encrypted datafile is incorrect
+const ErrIncorrectPassphrase = ConstErr("incorrect passphrase")
+
+// Parameters used to derive keys for new datafiles
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// Known value sealed with the key so that an incorrect passphrase can be detected
+var keyVerifier = []byte("puppy encrypted datafile")
+
+// Encrypts and authenticates blobs stored in the database. A nil blobCipher leaves blobs unencrypted.
+type blobCipher struct {
+	aead   cipher.AEAD
+	macKey []byte
+}
+
+type encryptionParams struct {
+	salt     []byte
+	n        int
+	r        int
+	p        int
+	verifier []byte
+}
+
+func deriveBlobCipher(passphrase string, params *encryptionParams) (*blobCipher, error) {
+	key, err := scrypt.Key([]byte(passphrase), params.salt, params.n, params.r, params.p, 64)
+	if err != nil {
+		return nil, fmt.Errorf("error deriving key: %s", err.Error())
+	}
+
+	block, err := aes.NewCipher(key[:32])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &blobCipher{
+		aead:   aead,
+		macKey: key[32:],
+	}, nil
+}
+
+// Generates a new salt and derives a new cipher from the passphrase
+func newBlobCipher(passphrase string) (*blobCipher, *encryptionParams, error) {
+	if passphrase == "" {
+		return nil, nil, errors.New("passphrase cannot be empty")
+	}
+
+	params := &encryptionParams{
+		salt: make([]byte, 32),
+		n:    scryptN,
+		r:    scryptR,
+		p:    scryptP,
+	}
+	if _, err := rand.Read(params.salt); err != nil {
+		return nil, nil, fmt.Errorf("error generating salt: %s", err.Error())
+	}
+
+	c, err := deriveBlobCipher(passphrase, params)
+	if err != nil {
+		return nil, nil, err
+	}
+	params.verifier, err = c.seal(keyVerifier)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, params, nil
+}
+
+func (c *blobCipher) seal(data []byte) ([]byte, error) {
+	if c == nil || data == nil {
+		return data, nil
+	}
+
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("error generating nonce: %s", err.Error())
+	}
+	return c.aead.Seal(nonce, nonce, data, nil), nil
+}
+
+func (c *blobCipher) open(data []byte) ([]byte, error) {
+	if c == nil || data == nil {
+		return data, nil
+	}
+
+	if len(data) < c.aead.NonceSize() {
+		return nil, errors.New("encrypted data is too short")
+	}
+	nonce := data[:c.aead.NonceSize()]
+	plaintext, err := c.aead.Open(nil, nonce, data[c.aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting data: %s", err.Error())
+	}
+	return plaintext, nil
+}
+
+// Returns the key used to store a body in the message_bodies table
+func (c *blobCipher) hash(body []byte) string {
+	if c == nil {
+		sum := sha256.Sum256(body)
+		return hex.EncodeToString(sum[:])
+	}
+
+	mac := hmac.New(sha256.New, c.macKey)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Plugin data values are stored as text so encrypted values are base64 encoded
+func (c *blobCipher) sealString(value string) (string, error) {
+	if c == nil {
+		return value, nil
+	}
+	sealed, err := c.seal([]byte(value))
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (c *blobCipher) openString(value string) (string, error) {
+	if c == nil {
+		return value, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", fmt.Errorf("error decoding encrypted value: %s", err.Error())
+	}
+	plaintext, err := c.open(sealed)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// Returns the encryption parameters stored in the datafile or nil if the datafile is not encrypted
+func loadEncryptionParams(db *sql.DB) (*encryptionParams, error) {
+	params := &encryptionParams{}
+	err := db.QueryRow("SELECT salt, scrypt_n, scrypt_r, scrypt_p, verifier FROM encryption_meta;").Scan(
+		&params.salt,
+		&params.n,
+		&params.r,
+		&params.p,
+		&params.verifier,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error loading encryption parameters: %s", err.Error())
+	}
+	return params, nil
+}
+
+func saveEncryptionParams(tx *sql.Tx, params *encryptionParams) error {
+	if _, err := tx.Exec("DELETE FROM encryption_meta;"); err != nil {
+		return fmt.Errorf("error saving encryption parameters: %s", err.Error())
+	}
+	_, err := tx.Exec("INSERT INTO encryption_meta (salt, scrypt_n, scrypt_r, scrypt_p, verifier) VALUES (?, ?, ?, ?, ?);",
+		params.salt, params.n, params.r, params.p, params.verifier)
+	if err != nil {
+		return fmt.Errorf("error saving encryption parameters: %s", err.Error())
+	}
+	return nil
+}
+
+// OpenEncryptedSQLiteStorage opens a datafile whose contents are encrypted using the given passphrase. If the datafile
+// does not exist it is created. If the datafile exists but is not encrypted, its contents are encrypted.
+func OpenEncryptedSQLiteStorage(fname string, passphrase string, logger *log.Logger) (*SQLiteStorage, error) {
+	if passphrase == "" {
+		return nil, errors.New("passphrase cannot be empty")
+	}
+
+	rs, err := openSQLiteStorage(fname, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	params, err := loadEncryptionParams(rs.dbConn)
+	if err != nil {
+		rs.Close()
+		return nil, err
+	}
+
+	if params == nil {
+		logger.Println("Datafile is not encrypted. Encrypting...")
+		if err := rs.Rekey(passphrase); err != nil {
+			rs.Close()
+			return nil, err
+		}
+		return rs, nil
+	}
+
+	c, err := deriveBlobCipher(passphrase, params)
+	if err != nil {
+		rs.Close()
+		return nil, err
+	}
+	if _, err := c.open(params.verifier); err != nil {
+		rs.Close()
+		return nil, ErrIncorrectPassphrase
+	}
+	rs.crypt = c
+	return rs, nil
+}
+
+// Rekey re-encrypts the contents of the storage with a key derived from a new passphrase. If the storage is not
+// encrypted, its contents will be encrypted.
+func (ms *SQLiteStorage) Rekey(passphrase string) error {
+	newCrypt, params, err := newBlobCipher(passphrase)
+	if err != nil {
+		return err
+	}
+
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	ms.keyMtx.Lock()
+	defer ms.keyMtx.Unlock()
+
+	tx, err := ms.dbConn.Begin()
+	if err != nil {
+		return err
+	}
+	err = ms.rekey(tx, newCrypt, params)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing new key: %s", err.Error())
+	}
+	ms.crypt = newCrypt
+	return ms.scrub()
+}
+
+// Removes the contents that were replaced by a rekey from the datafile. Replaced rows are left in free pages and the
+// write-ahead log until they are overwritten, so the database is rebuilt with secure_delete enabled and the log is
+// truncated. Readers that are still open can keep the log from being truncated.
+func (ms *SQLiteStorage) scrub() error {
+	// Pragmas only apply to the connection that they are run on
+	conn, err := ms.dbConn.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, stmt := range []string{"PRAGMA secure_delete=ON;", "VACUUM;", "PRAGMA wal_checkpoint(TRUNCATE);"} {
+		if _, err := conn.ExecContext(context.Background(), stmt); err != nil {
+			return fmt.Errorf("error scrubbing old contents from the datafile: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+type rekeyRow struct {
+	key   string
+	value []byte
+}
+
+// Loads every row of a two column query so that the rows can be updated
+func loadRekeyRows(tx *sql.Tx, query string) ([]*rekeyRow, error) {
+	rows, err := tx.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := make([]*rekeyRow, 0)
+	for rows.Next() {
+		r := &rekeyRow{}
+		if err := rows.Scan(&r.key, &r.value); err != nil {
+			return nil, err
+		}
+		ret = append(ret, r)
+	}
+	return ret, rows.Err()
+}
+
+// Re-encrypts the values in a column of a table
+func (ms *SQLiteStorage) rekeyColumn(tx *sql.Tx, newCrypt *blobCipher, table string, keyColumn string, column string) error {
+	rows, err := loadRekeyRows(tx, fmt.Sprintf("SELECT %s, %s FROM %s;", keyColumn, column, table))
+	if err != nil {
+		return fmt.Errorf("error loading %s: %s", table, err.Error())
+	}
+
+	for _, r := range rows {
+		plaintext, err := ms.crypt.open(r.value)
+		if err != nil {
+			return fmt.Errorf("error decrypting %s: %s", table, err.Error())
+		}
+		sealed, err := newCrypt.seal(plaintext)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(fmt.Sprintf("UPDATE %s SET %s=? WHERE %s=?;", table, column, keyColumn), sealed, r.key)
+		if err != nil {
+			return fmt.Errorf("error updating %s: %s", table, err.Error())
+		}
+	}
+	return nil
+}
+
+func (ms *SQLiteStorage) rekey(tx *sql.Tx, newCrypt *blobCipher, params *encryptionParams) error {
+	if err := ms.rekeyColumn(tx, newCrypt, "requests", "id", "full_request"); err != nil {
+		return err
+	}
+	if err := ms.rekeyColumn(tx, newCrypt, "requests", "id", "note"); err != nil {
+		return err
+	}
+	if err := ms.rekeyColumn(tx, newCrypt, "responses", "id", "full_response"); err != nil {
+		return err
+	}
+	if err := ms.rekeyColumn(tx, newCrypt, "websocket_messages", "id", "contents"); err != nil {
+		return err
+	}
+
+	// Bodies are keyed by their hash which changes along with the key
+	bodies, err := loadRekeyRows(tx, "SELECT hash, data FROM message_bodies;")
+	if err != nil {
+		return fmt.Errorf("error loading message bodies: %s", err.Error())
+	}
+	for _, r := range bodies {
+		oldHash := r.key
+		compressed, err := ms.crypt.open(r.value)
+		if err != nil {
+			return fmt.Errorf("error decrypting message body: %s", err.Error())
+		}
+		body, err := decompressBody(compressed)
+		if err != nil {
+			return fmt.Errorf("error decompressing message body: %s", err.Error())
+		}
+		sealed, err := newCrypt.seal(compressed)
+		if err != nil {
+			return err
+		}
+		newHash := newCrypt.hash(body)
+
+		if _, err := tx.Exec("UPDATE message_bodies SET hash=?, data=? WHERE hash=?;", newHash, sealed, oldHash); err != nil {
+			return fmt.Errorf("error updating message body: %s", err.Error())
+		}
+		if _, err := tx.Exec("UPDATE requests SET body_hash=? WHERE body_hash=?;", newHash, oldHash); err != nil {
+			return fmt.Errorf("error updating message body: %s", err.Error())
+		}
+		if _, err := tx.Exec("UPDATE responses SET body_hash=? WHERE body_hash=?;", newHash, oldHash); err != nil {
+			return fmt.Errorf("error updating message body: %s", err.Error())
+		}
+	}
+
+	values, err := loadRekeyRows(tx, "SELECT key, value FROM plugin_data;")
+	if err != nil {
+		return fmt.Errorf("error loading plugin data: %s", err.Error())
+	}
+	for _, r := range values {
+		value, err := ms.crypt.openString(string(r.value))
+		if err != nil {
+			return fmt.Errorf("error decrypting plugin data: %s", err.Error())
+		}
+		sealed, err := newCrypt.sealString(value)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE plugin_data SET value=? WHERE key=?;", sealed, r.key); err != nil {
+			return fmt.Errorf("error updating plugin data: %s", err.Error())
+		}
+	}
+
+	// Metadata columns filled in before the datafile was encrypted would reveal the contents of the messages
+	if _, err := tx.Exec("UPDATE requests SET method=NULL, path=NULL, body_size=NULL;"); err != nil {
+		return fmt.Errorf("error clearing request metadata: %s", err.Error())
+	}
+	if _, err := tx.Exec("UPDATE responses SET status_code=NULL, body_size=NULL;"); err != nil {
+		return fmt.Errorf("error clearing response metadata: %s", err.Error())
+	}
+
+	return saveEncryptionParams(tx, params)
+}
@@ -8,6 +8,7 @@ import (
 	"log"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,25 +16,82 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
-var request_select string = "SELECT id, full_request, response_id, unmangled_id, port, is_ssl, host, start_datetime, end_datetime FROM requests"
-var response_select string = "SELECT id, full_response, unmangled_id FROM responses"
+var request_select string = "SELECT id, full_request, message_bodies.data, response_id, unmangled_id, port, is_ssl, host, start_datetime, end_datetime, note, highlight, reviewed, timings FROM requests LEFT JOIN message_bodies ON requests.body_hash=message_bodies.hash"
+var response_select string = "SELECT id, full_response, message_bodies.data, unmangled_id FROM responses LEFT JOIN message_bodies ON responses.body_hash=message_bodies.hash"
 var ws_select string = "SELECT id, parent_request, unmangled_id, is_binary, direction, time_sent, contents FROM websocket_messages"
 
 var inmemIdCounter = IdCounter()
 
+// Maximum number of queued writes that will be committed in a single transaction
+const maxWriteBatch = 64
+
+// Maximum number of connections in the read pool of a file backed storage
+const maxReadConns = 8
+
 type SQLiteStorage struct {
 	dbConn *sql.DB
 	mtx    sync.Mutex
 	logger *log.Logger
 	storageWatchers []StorageWatcher
+
+	// Pool of read only connections. Nil for in-memory storages which reads will share dbConn with writes.
+	readConn *sql.DB
+
+	// Cipher for stored blobs. Nil if the storage is not encrypted. Reads hold keyMtx so the key can't change mid-read.
+	crypt  *blobCipher
+	keyMtx sync.RWMutex
+
+	// Writes from the proxy are queued and committed in batches by batchWrites
+	writeQueue  chan *batchedWrite
+	queueMtx    sync.RWMutex
+	batcherDone chan struct{}
+
+	retentionStop chan struct{}
 }
 
 /*
 SQLiteStorage Implementation
 */
 
+// Adds connection parameters to a sqlite3 data source name
+func sqliteDSN(fname string, params string) string {
+	if strings.Contains(fname, "?") {
+		return fname + "&" + params
+	}
+	return fname + "?" + params
+}
+
+func isInMemoryDSN(fname string) bool {
+	return fname == ":memory:" || strings.Contains(fname, "mode=memory")
+}
+
 func OpenSQLiteStorage(fname string, logger *log.Logger) (*SQLiteStorage, error) {
-	db, err := sql.Open("sqlite3", fname)
+	rs, err := openSQLiteStorage(fname, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	params, err := loadEncryptionParams(rs.dbConn)
+	if err != nil {
+		rs.Close()
+		return nil, err
+	}
+	if params != nil {
+		rs.Close()
+		return nil, ErrStorageEncrypted
+	}
+	return rs, nil
+}
+
+func openSQLiteStorage(fname string, logger *log.Logger) (*SQLiteStorage, error) {
+	inMemory := isInMemoryDSN(fname)
+
+	writeDSN := fname
+	if !inMemory {
+		// WAL mode lets readers use the database while a write is in progress
+		writeDSN = sqliteDSN(fname, "_journal_mode=WAL&_busy_timeout=5000")
+	}
+	db, err := sql.Open("sqlite3", writeDSN)
 	if err != nil {
 		return nil, err
 	}
@@ -44,11 +102,27 @@ func OpenSQLiteStorage(fname string, logger *log.Logger) (*SQLiteStorage, error)
 
 	err = UpdateSchema(rs.dbConn, logger)
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
 
+	if !inMemory {
+		// In-memory databases can't use WAL mode so they don't get a separate read pool
+		readConn, err := sql.Open("sqlite3", sqliteDSN(fname, "_busy_timeout=5000&_query_only=1"))
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		readConn.SetMaxOpenConns(maxReadConns)
+		rs.readConn = readConn
+	}
+
 	rs.logger = logger
 	rs.storageWatchers = make([]StorageWatcher, 0)
+
+	rs.writeQueue = make(chan *batchedWrite, maxWriteBatch)
+	rs.batcherDone = make(chan struct{})
+	go rs.batchWrites(rs.writeQueue)
 	return rs, nil
 }
 
@@ -58,14 +132,158 @@ func InMemoryStorage(logger *log.Logger) (*SQLiteStorage, error) {
 }
 
 func (rs *SQLiteStorage) Close() {
+	rs.SetRetentionPolicy(nil, 0)
+
+	// Wait for any queued writes to be committed
+	rs.queueMtx.Lock()
+	if rs.writeQueue != nil {
+		close(rs.writeQueue)
+		rs.writeQueue = nil
+		<-rs.batcherDone
+	}
+	rs.queueMtx.Unlock()
+
+	if rs.readConn != nil {
+		rs.readConn.Close()
+	}
 	rs.dbConn.Close()
 }
 
+/*
+Concurrent reads and batched writes
+*/
+
+// Begins a transaction for an operation which only reads from the database. File backed storages read from a separate
+// pool of connections so that reads never wait on writes. Must be ended with endRead.
+func (ms *SQLiteStorage) beginRead() (*sql.Tx, error) {
+	if ms.readConn == nil {
+		ms.mtx.Lock()
+		tx, err := ms.dbConn.Begin()
+		if err != nil {
+			ms.mtx.Unlock()
+			return nil, err
+		}
+		return tx, nil
+	}
+
+	ms.keyMtx.RLock()
+	tx, err := ms.readConn.Begin()
+	if err != nil {
+		ms.keyMtx.RUnlock()
+		return nil, err
+	}
+	return tx, nil
+}
+
+func (ms *SQLiteStorage) endRead(tx *sql.Tx) {
+	tx.Rollback()
+	if ms.readConn == nil {
+		ms.mtx.Unlock()
+	} else {
+		ms.keyMtx.RUnlock()
+	}
+}
+
+type batchedWrite struct {
+	write  func(tx *sql.Tx) error
+	notify func()
+	done   chan error
+}
+
+// Queues a write to be committed with any other pending writes and waits for it to complete. Each write is wrapped in
+// a savepoint so a failed write is rolled back without affecting the rest of its batch. notify is called once the
+// write has been committed.
+func (ms *SQLiteStorage) batchWrite(write func(tx *sql.Tx) error, notify func()) error {
+	op := &batchedWrite{
+		write:  write,
+		notify: notify,
+		done:   make(chan error, 1),
+	}
+
+	ms.queueMtx.RLock()
+	if ms.writeQueue == nil {
+		ms.queueMtx.RUnlock()
+		return errors.New("storage is closed")
+	}
+	ms.writeQueue <- op
+	ms.queueMtx.RUnlock()
+
+	return <-op.done
+}
+
+func (ms *SQLiteStorage) batchWrites(queue chan *batchedWrite) {
+	defer close(ms.batcherDone)
+	for op := range queue {
+		batch := []*batchedWrite{op}
+	collect:
+		for len(batch) < maxWriteBatch {
+			select {
+			case next, ok := <-queue:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, next)
+			default:
+				break collect
+			}
+		}
+		ms.commitBatch(batch)
+	}
+}
+
+func (ms *SQLiteStorage) commitBatch(batch []*batchedWrite) {
+	errs := make([]error, len(batch))
+
+	ms.mtx.Lock()
+	defer func() {
+		ms.mtx.Unlock()
+		for i, op := range batch {
+			op.done <- errs[i]
+		}
+	}()
+
+	tx, err := ms.dbConn.Begin()
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return
+	}
+
+	for i, op := range batch {
+		if _, err := tx.Exec("SAVEPOINT batched_write;"); err != nil {
+			errs[i] = err
+			continue
+		}
+		if err := op.write(tx); err != nil {
+			errs[i] = err
+			tx.Exec("ROLLBACK TO batched_write;")
+		}
+		tx.Exec("RELEASE batched_write;")
+	}
+
+	if err := tx.Commit(); err != nil {
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = fmt.Errorf("error committing batched writes: %s", err.Error())
+			}
+		}
+		return
+	}
+
+	for i, op := range batch {
+		if errs[i] == nil && op.notify != nil {
+			op.notify()
+		}
+	}
+}
+
 func reqFromRow(
 	tx *sql.Tx,
 	ms *SQLiteStorage,
 	db_id sql.NullInt64,
 	db_full_request []byte,
+	db_body []byte,
 	db_response_id sql.NullInt64,
 	db_unmangled_id sql.NullInt64,
 	db_port sql.NullInt64,
@@ -73,6 +291,10 @@ func reqFromRow(
 	db_host sql.NullString,
 	db_start_datetime sql.NullInt64,
 	db_end_datetime sql.NullInt64,
+	db_note []byte,
+	db_highlight sql.NullString,
+	db_reviewed sql.NullBool,
+	db_timings sql.NullString,
 ) (*ProxyRequest, error) {
 	var host string
 	var port int
@@ -104,7 +326,12 @@ func reqFromRow(
 		useTLS = false
 	}
 
-	req, err := ProxyRequestFromBytes(db_full_request, host, port, useTLS)
+	fullRequest, err := loadMessageBody(ms.crypt, db_full_request, db_body)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load body for request (id=%d): %s", db_id.Int64, err.Error())
+	}
+
+	req, err := ProxyRequestFromBytes(fullRequest, host, port, useTLS)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to create request (id=%d) from data in database: %s", db_id.Int64, err.Error())
 	}
@@ -122,6 +349,20 @@ func reqFromRow(
 		req.EndDatetime = time.Unix(0, 0)
 	}
 
+	note, err := ms.crypt.open(db_note)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load note for request (id=%d): %s", db_id.Int64, err.Error())
+	}
+	req.Note = string(note)
+	req.Highlight = db_highlight.String
+	req.Reviewed = db_reviewed.Bool
+
+	if db_timings.Valid && db_timings.String != "" {
+		if err := json.Unmarshal([]byte(db_timings.String), &req.Timings); err != nil {
+			return nil, fmt.Errorf("Unable to load timings for request (id=%d): %s", db_id.Int64, err.Error())
+		}
+	}
+
 	if db_unmangled_id.Valid {
 		unmangledReq, err := ms.loadRequest(tx, strconv.FormatInt(db_unmangled_id.Int64, 10))
 		if err != nil {
@@ -214,11 +455,15 @@ func reqFromRow(
 	return req, nil
 }
 
-func rspFromRow(tx *sql.Tx, ms *SQLiteStorage, id sql.NullInt64, db_full_response []byte, db_unmangled_id sql.NullInt64) (*ProxyResponse, error) {
+func rspFromRow(tx *sql.Tx, ms *SQLiteStorage, id sql.NullInt64, db_full_response []byte, db_body []byte, db_unmangled_id sql.NullInt64) (*ProxyResponse, error) {
 	if !id.Valid {
 		return nil, fmt.Errorf("unable to load response: null id value")
 	}
-	rsp, err := ProxyResponseFromBytes(db_full_response)
+	fullResponse, err := loadMessageBody(ms.crypt, db_full_response, db_body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load body for response: %s", err.Error())
+	}
+	rsp, err := ProxyResponseFromBytes(fullResponse)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create response from data in datafile: %s", err.Error())
 	}
@@ -249,6 +494,11 @@ func wsFromRow(tx *sql.Tx, ms *SQLiteStorage, id sql.NullInt64, parent_request s
 		mtype = websocket.TextMessage
 	}
 
+	contents, err := ms.crypt.open(contents)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decrypt websocket message: %s", err.Error())
+	}
+
 	wsm, err := NewProxyWSMessage(mtype, contents, int(direction.Int64))
 	if err != nil {
 		return nil, fmt.Errorf("Unable to create websocket message from data in datafile: %s", err.Error())
@@ -363,22 +613,13 @@ func cleanTags(tx *sql.Tx) error {
 }
 
 func (ms *SQLiteStorage) SaveNewRequest(req *ProxyRequest) error {
-	ms.mtx.Lock()
-	defer ms.mtx.Unlock()
-	tx, err := ms.dbConn.Begin()
-	if err != nil {
-		return err
-	}
-	err = ms.saveNewRequest(tx, req)
-	if err != nil {
-		tx.Rollback()
-		return err
-	}
-	tx.Commit()
-	for _, watcher := range ms.storageWatchers {
-		watcher.NewRequestSaved(ms, req)
-	}
-	return nil
+	return ms.batchWrite(func(tx *sql.Tx) error {
+		return ms.saveNewRequest(tx, req)
+	}, func() {
+		for _, watcher := range ms.storageWatchers {
+			watcher.NewRequestSaved(ms, req)
+		}
+	})
 }
 
 func (ms *SQLiteStorage) saveNewRequest(tx *sql.Tx, req *ProxyRequest) error {
@@ -405,9 +646,26 @@ func (ms *SQLiteStorage) saveNewRequest(tx *sql.Tx, req *ProxyRequest) error {
 		unmangledId = nil
 	}
 
+	head, bodyHash, err := storeMessageBody(tx, ms.crypt, req.FullMessage())
+	if err != nil {
+		return err
+	}
+
+	note, err := ms.crypt.seal([]byte(req.Note))
+	if err != nil {
+		return err
+	}
+
+	timings, err := json.Marshal(&req.Timings)
+	if err != nil {
+		return err
+	}
+	method, path, bodySize := ms.requestMetadata(req)
+
 	stmt, err := tx.Prepare(`
     INSERT INTO requests (
             full_request,
+            body_hash,
             submitted,
             response_id,
             unmangled_id,
@@ -416,8 +674,15 @@ func (ms *SQLiteStorage) saveNewRequest(tx *sql.Tx, req *ProxyRequest) error {
             host,
             plugin_data,
             start_datetime,
-            end_datetime
-    ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+            end_datetime,
+            note,
+            highlight,
+            reviewed,
+            timings,
+            method,
+            path,
+            body_size
+    ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
     `)
 	if err != nil {
 		return fmt.Errorf("error preparing statement to insert request into database: %s", err.Error())
@@ -425,8 +690,9 @@ func (ms *SQLiteStorage) saveNewRequest(tx *sql.Tx, req *ProxyRequest) error {
 	defer stmt.Close()
 
 	res, err := stmt.Exec(
-		req.FullMessage(), true, rspid, unmangledId, &req.DestPort, &req.DestUseTLS, &req.DestHost, "",
-		req.StartDatetime.UnixNano(), req.EndDatetime.UnixNano(),
+		head, bodyHash, true, rspid, unmangledId, &req.DestPort, &req.DestUseTLS, &req.DestHost, "",
+		req.StartDatetime.UnixNano(), req.EndDatetime.UnixNano(), note, req.Highlight, req.Reviewed, string(timings),
+		method, path, bodySize,
 	)
 	if err != nil {
 		return fmt.Errorf("error inserting request into database: %s", err.Error())
@@ -442,22 +708,13 @@ func (ms *SQLiteStorage) saveNewRequest(tx *sql.Tx, req *ProxyRequest) error {
 }
 
 func (ms *SQLiteStorage) UpdateRequest(req *ProxyRequest) error {
-	ms.mtx.Lock()
-	defer ms.mtx.Unlock()
-	tx, err := ms.dbConn.Begin()
-	if err != nil {
-		return err
-	}
-	err = ms.updateRequest(tx, req)
-	if err != nil {
-		tx.Rollback()
-		return err
-	}
-	tx.Commit()
-	for _, watcher := range ms.storageWatchers {
-		watcher.RequestUpdated(ms, req)
-	}
-	return nil
+	return ms.batchWrite(func(tx *sql.Tx) error {
+		return ms.updateRequest(tx, req)
+	}, func() {
+		for _, watcher := range ms.storageWatchers {
+			watcher.RequestUpdated(ms, req)
+		}
+	})
 }
 
 func (ms *SQLiteStorage) updateRequest(tx *sql.Tx, req *ProxyRequest) error {
@@ -488,9 +745,36 @@ func (ms *SQLiteStorage) updateRequest(tx *sql.Tx, req *ProxyRequest) error {
 		unmangledId = nil
 	}
 
+	var oldBodyHash sql.NullString
+	err := tx.QueryRow("SELECT body_hash FROM requests WHERE id=?", req.DbId).Scan(&oldBodyHash)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("error loading request from datafile: %s", err.Error())
+	}
+
+	head, bodyHash, err := storeMessageBody(tx, ms.crypt, req.FullMessage())
+	if err != nil {
+		return err
+	}
+
+	note, err := ms.crypt.seal([]byte(req.Note))
+	if err != nil {
+		return err
+	}
+
+	timings, err := json.Marshal(&req.Timings)
+	if err != nil {
+		return err
+	}
+	method, path, bodySize := ms.requestMetadata(req)
+
+	if err := releaseMessageBody(tx, oldBodyHash); err != nil {
+		return err
+	}
+
 	stmt, err := tx.Prepare(`
     UPDATE requests SET 
             full_request=?,
+            body_hash=?,
             submitted=?,
             response_id=?,
             unmangled_id=?,
@@ -499,7 +783,14 @@ func (ms *SQLiteStorage) updateRequest(tx *sql.Tx, req *ProxyRequest) error {
             host=?,
             plugin_data=?,
             start_datetime=?,
-            end_datetime=?
+            end_datetime=?,
+            note=?,
+            highlight=?,
+            reviewed=?,
+            timings=?,
+            method=?,
+            path=?,
+            body_size=?
     WHERE id=?;
     `)
 	if err != nil {
@@ -508,8 +799,9 @@ func (ms *SQLiteStorage) updateRequest(tx *sql.Tx, req *ProxyRequest) error {
 	defer stmt.Close()
 
 	_, err = stmt.Exec(
-		req.FullMessage(), true, rspid, unmangledId, &req.DestPort, &req.DestUseTLS, &req.DestHost, "",
-		req.StartDatetime.UnixNano(), req.EndDatetime.UnixNano(), req.DbId,
+		head, bodyHash, true, rspid, unmangledId, &req.DestPort, &req.DestUseTLS, &req.DestHost, "",
+		req.StartDatetime.UnixNano(), req.EndDatetime.UnixNano(), note, req.Highlight, req.Reviewed, string(timings),
+		method, path, bodySize, req.DbId,
 	)
 	if err != nil {
 		return fmt.Errorf("error inserting request into database: %s", err.Error())
@@ -534,19 +826,12 @@ func (ms *SQLiteStorage) updateRequest(tx *sql.Tx, req *ProxyRequest) error {
 }
 
 func (ms *SQLiteStorage) LoadRequest(reqid string) (*ProxyRequest, error) {
-	ms.mtx.Lock()
-	defer ms.mtx.Unlock()
-	tx, err := ms.dbConn.Begin()
-	if err != nil {
-		return nil, err
-	}
-	req, err := ms.loadRequest(tx, reqid)
+	tx, err := ms.beginRead()
 	if err != nil {
-		tx.Rollback()
 		return nil, err
 	}
-	tx.Commit()
-	return req, nil
+	defer ms.endRead(tx)
+	return ms.loadRequest(tx, reqid)
 }
 
 func (ms *SQLiteStorage) loadRequest(tx *sql.Tx, reqid string) (*ProxyRequest, error) {
@@ -557,6 +842,7 @@ func (ms *SQLiteStorage) loadRequest(tx *sql.Tx, reqid string) (*ProxyRequest, e
 
 	var db_id sql.NullInt64
 	var db_full_request []byte
+	var db_body []byte
 	var db_response_id sql.NullInt64
 	var db_unmangled_id sql.NullInt64
 	var db_port sql.NullInt64
@@ -564,6 +850,10 @@ func (ms *SQLiteStorage) loadRequest(tx *sql.Tx, reqid string) (*ProxyRequest, e
 	var db_host sql.NullString
 	var db_start_datetime sql.NullInt64
 	var db_end_datetime sql.NullInt64
+	var db_note []byte
+	var db_highlight sql.NullString
+	var db_reviewed sql.NullBool
+	var db_timings sql.NullString
 
 	// err = tx.QueryRow(`
 	//     SELECT
@@ -572,6 +862,7 @@ func (ms *SQLiteStorage) loadRequest(tx *sql.Tx, reqid string) (*ProxyRequest, e
 	err = tx.QueryRow(request_select+" WHERE id=?", dbId).Scan(
 		&db_id,
 		&db_full_request,
+		&db_body,
 		&db_response_id,
 		&db_unmangled_id,
 		&db_port,
@@ -579,6 +870,10 @@ func (ms *SQLiteStorage) loadRequest(tx *sql.Tx, reqid string) (*ProxyRequest, e
 		&db_host,
 		&db_start_datetime,
 		&db_end_datetime,
+		&db_note,
+		&db_highlight,
+		&db_reviewed,
+		&db_timings,
 	)
 	if err == sql.ErrNoRows {
 		return nil, fmt.Errorf("Request with id %d does not exist", dbId)
@@ -586,8 +881,8 @@ func (ms *SQLiteStorage) loadRequest(tx *sql.Tx, reqid string) (*ProxyRequest, e
 		return nil, fmt.Errorf("Error loading data from datafile: %s", err.Error())
 	}
 
-	req, err := reqFromRow(tx, ms, db_id, db_full_request, db_response_id, db_unmangled_id,
-		db_port, db_is_ssl, db_host, db_start_datetime, db_end_datetime)
+	req, err := reqFromRow(tx, ms, db_id, db_full_request, db_body, db_response_id, db_unmangled_id,
+		db_port, db_is_ssl, db_host, db_start_datetime, db_end_datetime, db_note, db_highlight, db_reviewed, db_timings)
 	if err != nil {
 		return nil, fmt.Errorf("Error loading data from datafile: %s", err.Error())
 	}
@@ -596,19 +891,12 @@ func (ms *SQLiteStorage) loadRequest(tx *sql.Tx, reqid string) (*ProxyRequest, e
 }
 
 func (ms *SQLiteStorage) LoadUnmangledRequest(reqid string) (*ProxyRequest, error) {
-	ms.mtx.Lock()
-	defer ms.mtx.Unlock()
-	tx, err := ms.dbConn.Begin()
+	tx, err := ms.beginRead()
 	if err != nil {
 		return nil, err
 	}
-	req, err := ms.loadUnmangledRequest(tx, reqid)
-	if err != nil {
-		tx.Rollback()
-		return nil, err
-	}
-	tx.Commit()
-	return req, nil
+	defer ms.endRead(tx)
+	return ms.loadUnmangledRequest(tx, reqid)
 }
 
 func (ms *SQLiteStorage) loadUnmangledRequest(tx *sql.Tx, reqid string) (*ProxyRequest, error) {
@@ -665,9 +953,11 @@ func (ms *SQLiteStorage) deleteRequest(tx *sql.Tx, reqid string) error {
 	// Get IDs
 	var db_unmangled_id sql.NullInt64
 	var db_response_id sql.NullInt64
-	err = tx.QueryRow("SELECT unmangled_id, response_id FROM requests WHERE id=?", dbId).Scan(
+	var db_body_hash sql.NullString
+	err = tx.QueryRow("SELECT unmangled_id, response_id, body_hash FROM requests WHERE id=?", dbId).Scan(
 		&db_unmangled_id,
 		&db_response_id,
+		&db_body_hash,
 	)
 
 	// Delete unmangled
@@ -678,7 +968,7 @@ func (ms *SQLiteStorage) deleteRequest(tx *sql.Tx, reqid string) error {
 	}
 
 	// Delete response
-	if db_unmangled_id.Valid {
+	if db_response_id.Valid {
 		if err := ms.deleteResponse(tx, strconv.FormatInt(db_response_id.Int64, 10)); err != nil {
 			return err
 		}
@@ -718,26 +1008,36 @@ func (ms *SQLiteStorage) deleteRequest(tx *sql.Tx, reqid string) error {
 		return fmt.Errorf("error deleting request from database: %s", err.Error())
 	}
 
-	return nil
+	return releaseMessageBody(tx, db_body_hash)
 }
 
 func (ms *SQLiteStorage) SaveNewResponse(rsp *ProxyResponse) error {
-	ms.mtx.Lock()
-	defer ms.mtx.Unlock()
-	tx, err := ms.dbConn.Begin()
-	if err != nil {
-		return err
-	}
-	err = ms.saveNewResponse(tx, rsp)
-	if err != nil {
-		tx.Rollback()
-		return err
+	return ms.batchWrite(func(tx *sql.Tx) error {
+		return ms.saveNewResponse(tx, rsp)
+	}, func() {
+		for _, watcher := range ms.storageWatchers {
+			watcher.NewResponseSaved(ms, rsp)
+		}
+	})
+}
+
+// Returns the values of the metadata columns used to compute statistics for a request. The columns are left NULL in encrypted datafiles so that they don't reveal the contents of the request.
+func (ms *SQLiteStorage) requestMetadata(req *ProxyRequest) (sql.NullString, sql.NullString, sql.NullInt64) {
+	if ms.crypt != nil {
+		return sql.NullString{}, sql.NullString{}, sql.NullInt64{}
 	}
-	tx.Commit()
-	for _, watcher := range ms.storageWatchers {
-		watcher.NewResponseSaved(ms, rsp)
+	return sql.NullString{String: req.Method, Valid: true},
+		sql.NullString{String: req.URL.Path, Valid: true},
+		sql.NullInt64{Int64: int64(len(req.BodyBytes())), Valid: true}
+}
+
+// Returns the values of the metadata columns used to compute statistics for a response. The columns are left NULL in encrypted datafiles.
+func (ms *SQLiteStorage) responseMetadata(rsp *ProxyResponse) (sql.NullInt64, sql.NullInt64) {
+	if ms.crypt != nil {
+		return sql.NullInt64{}, sql.NullInt64{}
 	}
-	return nil
+	return sql.NullInt64{Int64: int64(rsp.StatusCode), Valid: true},
+		sql.NullInt64{Int64: int64(len(rsp.BodyBytes())), Valid: true}
 }
 
 func (ms *SQLiteStorage) saveNewResponse(tx *sql.Tx, rsp *ProxyResponse) error {
@@ -753,19 +1053,28 @@ func (ms *SQLiteStorage) saveNewResponse(tx *sql.Tx, rsp *ProxyResponse) error {
 		unmangledId = nil
 	}
 
+	head, bodyHash, err := storeMessageBody(tx, ms.crypt, rsp.FullMessage())
+	if err != nil {
+		return err
+	}
+
 	stmt, err := tx.Prepare(`
     INSERT INTO responses (
             full_response,
-            unmangled_id
-    ) VALUES (?, ?);
+            body_hash,
+            unmangled_id,
+            status_code,
+            body_size
+    ) VALUES (?, ?, ?, ?, ?);
     `)
 	if err != nil {
 		return fmt.Errorf("error preparing statement to insert response with id=%d into database: %s", rsp.DbId, err.Error())
 	}
 	defer stmt.Close()
 
+	statusCode, bodySize := ms.responseMetadata(rsp)
 	res, err := stmt.Exec(
-		rsp.FullMessage(), unmangledId,
+		head, bodyHash, unmangledId, statusCode, bodySize,
 	)
 	if err != nil {
 		return fmt.Errorf("error inserting response into database: %s", err.Error())
@@ -778,22 +1087,13 @@ func (ms *SQLiteStorage) saveNewResponse(tx *sql.Tx, rsp *ProxyResponse) error {
 }
 
 func (ms *SQLiteStorage) UpdateResponse(rsp *ProxyResponse) error {
-	ms.mtx.Lock()
-	defer ms.mtx.Unlock()
-	tx, err := ms.dbConn.Begin()
-	if err != nil {
-		return err
-	}
-	err = ms.updateResponse(tx, rsp)
-	if err != nil {
-		tx.Rollback()
-		return err
-	}
-	tx.Commit()
-	for _, watcher := range ms.storageWatchers {
-		watcher.ResponseUpdated(ms, rsp)
-	}
-	return nil
+	return ms.batchWrite(func(tx *sql.Tx) error {
+		return ms.updateResponse(tx, rsp)
+	}, func() {
+		for _, watcher := range ms.storageWatchers {
+			watcher.ResponseUpdated(ms, rsp)
+		}
+	})
 }
 
 func (ms *SQLiteStorage) updateResponse(tx *sql.Tx, rsp *ProxyResponse) error {
@@ -813,10 +1113,28 @@ func (ms *SQLiteStorage) updateResponse(tx *sql.Tx, rsp *ProxyResponse) error {
 		unmangledId = nil
 	}
 
+	var oldBodyHash sql.NullString
+	err := tx.QueryRow("SELECT body_hash FROM responses WHERE id=?", rsp.DbId).Scan(&oldBodyHash)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("error loading response from datafile: %s", err.Error())
+	}
+
+	head, bodyHash, err := storeMessageBody(tx, ms.crypt, rsp.FullMessage())
+	if err != nil {
+		return err
+	}
+
+	if err := releaseMessageBody(tx, oldBodyHash); err != nil {
+		return err
+	}
+
 	stmt, err := tx.Prepare(`
     UPDATE responses SET 
             full_response=?,
-            unmangled_id=?
+            body_hash=?,
+            unmangled_id=?,
+            status_code=?,
+            body_size=?
     WHERE id=?;
     `)
 	if err != nil {
@@ -824,8 +1142,9 @@ func (ms *SQLiteStorage) updateResponse(tx *sql.Tx, rsp *ProxyResponse) error {
 	}
 	defer stmt.Close()
 
+	statusCode, bodySize := ms.responseMetadata(rsp)
 	_, err = stmt.Exec(
-		rsp.FullMessage(), unmangledId, rsp.DbId,
+		head, bodyHash, unmangledId, statusCode, bodySize, rsp.DbId,
 	)
 	if err != nil {
 		return fmt.Errorf("error inserting response into database: %s", err.Error())
@@ -835,19 +1154,12 @@ func (ms *SQLiteStorage) updateResponse(tx *sql.Tx, rsp *ProxyResponse) error {
 }
 
 func (ms *SQLiteStorage) LoadResponse(rspid string) (*ProxyResponse, error) {
-	ms.mtx.Lock()
-	defer ms.mtx.Unlock()
-	tx, err := ms.dbConn.Begin()
+	tx, err := ms.beginRead()
 	if err != nil {
 		return nil, err
 	}
-	rsp, err := ms.loadResponse(tx, rspid)
-	if err != nil {
-		tx.Rollback()
-		return nil, err
-	}
-	tx.Commit()
-	return rsp, nil
+	defer ms.endRead(tx)
+	return ms.loadResponse(tx, rspid)
 }
 
 func (ms *SQLiteStorage) loadResponse(tx *sql.Tx, rspid string) (*ProxyResponse, error) {
@@ -858,11 +1170,13 @@ func (ms *SQLiteStorage) loadResponse(tx *sql.Tx, rspid string) (*ProxyResponse,
 
 	var db_id sql.NullInt64
 	var db_full_response []byte
+	var db_body []byte
 	var db_unmangled_id sql.NullInt64
 
 	err = tx.QueryRow(response_select+" WHERE id=?", dbId).Scan(
 		&db_id,
 		&db_full_response,
+		&db_body,
 		&db_unmangled_id,
 	)
 	if err == sql.ErrNoRows {
@@ -871,7 +1185,7 @@ func (ms *SQLiteStorage) loadResponse(tx *sql.Tx, rspid string) (*ProxyResponse,
 		return nil, fmt.Errorf("Error loading data from datafile: %s", err.Error())
 	}
 
-	rsp, err := rspFromRow(tx, ms, db_id, db_full_response, db_unmangled_id)
+	rsp, err := rspFromRow(tx, ms, db_id, db_full_response, db_body, db_unmangled_id)
 	if err != nil {
 		return nil, fmt.Errorf("Error loading data from datafile: %s", err.Error())
 	}
@@ -879,19 +1193,12 @@ func (ms *SQLiteStorage) loadResponse(tx *sql.Tx, rspid string) (*ProxyResponse,
 }
 
 func (ms *SQLiteStorage) LoadUnmangledResponse(rspid string) (*ProxyResponse, error) {
-	ms.mtx.Lock()
-	defer ms.mtx.Unlock()
-	tx, err := ms.dbConn.Begin()
+	tx, err := ms.beginRead()
 	if err != nil {
 		return nil, err
 	}
-	rsp, err := ms.loadUnmangledResponse(tx, rspid)
-	if err != nil {
-		tx.Rollback()
-		return nil, err
-	}
-	tx.Commit()
-	return rsp, nil
+	defer ms.endRead(tx)
+	return ms.loadUnmangledResponse(tx, rspid)
 }
 
 func (ms *SQLiteStorage) loadUnmangledResponse(tx *sql.Tx, rspid string) (*ProxyResponse, error) {
@@ -949,8 +1256,10 @@ func (ms *SQLiteStorage) deleteResponse(tx *sql.Tx, rspid string) error {
 
 	// Get IDs
 	var db_unmangled_id sql.NullInt64
-	err = tx.QueryRow("SELECT unmangled_id FROM responses WHERE id=?", dbId).Scan(
+	var db_body_hash sql.NullString
+	err = tx.QueryRow("SELECT unmangled_id, body_hash FROM responses WHERE id=?", dbId).Scan(
 		&db_unmangled_id,
+		&db_body_hash,
 	)
 
 	// Delete unmangled
@@ -974,26 +1283,17 @@ func (ms *SQLiteStorage) deleteResponse(tx *sql.Tx, rspid string) error {
 		return fmt.Errorf("error deleting response from database: %s", err.Error())
 	}
 
-	return nil
+	return releaseMessageBody(tx, db_body_hash)
 }
 
 func (ms *SQLiteStorage) SaveNewWSMessage(req *ProxyRequest, wsm *ProxyWSMessage) error {
-	ms.mtx.Lock()
-	defer ms.mtx.Unlock()
-	tx, err := ms.dbConn.Begin()
-	if err != nil {
-		return err
-	}
-	err = ms.saveNewWSMessage(tx, req, wsm)
-	if err != nil {
-		tx.Rollback()
-		return err
-	}
-	tx.Commit()
-	for _, watcher := range ms.storageWatchers {
-		watcher.NewWSMessageSaved(ms, req, wsm)
-	}
-	return nil
+	return ms.batchWrite(func(tx *sql.Tx) error {
+		return ms.saveNewWSMessage(tx, req, wsm)
+	}, func() {
+		for _, watcher := range ms.storageWatchers {
+			watcher.NewWSMessageSaved(ms, req, wsm)
+		}
+	})
 }
 
 func (ms *SQLiteStorage) saveNewWSMessage(tx *sql.Tx, req *ProxyRequest, wsm *ProxyWSMessage) error {
@@ -1038,13 +1338,18 @@ func (ms *SQLiteStorage) saveNewWSMessage(tx *sql.Tx, req *ProxyRequest, wsm *Pr
 		}
 	}
 
+	contents, err := ms.crypt.seal(wsm.Message)
+	if err != nil {
+		return err
+	}
+
 	res, err := stmt.Exec(
 		parent_id,
 		unmangledId,
 		isBinary,
 		wsm.Direction,
 		wsm.Timestamp.UnixNano(),
-		wsm.Message,
+		contents,
 	)
 	if err != nil {
 		return fmt.Errorf("error inserting websocket message into database: %s", err.Error())
@@ -1058,22 +1363,13 @@ func (ms *SQLiteStorage) saveNewWSMessage(tx *sql.Tx, req *ProxyRequest, wsm *Pr
 }
 
 func (ms *SQLiteStorage) UpdateWSMessage(req *ProxyRequest, wsm *ProxyWSMessage) error {
-	ms.mtx.Lock()
-	defer ms.mtx.Unlock()
-	tx, err := ms.dbConn.Begin()
-	if err != nil {
-		return err
-	}
-	err = ms.updateWSMessage(tx, req, wsm)
-	if err != nil {
-		tx.Rollback()
-		return err
-	}
-	tx.Commit()
-	for _, watcher := range ms.storageWatchers {
-		watcher.WSMessageUpdated(ms, req, wsm)
-	}
-	return nil
+	return ms.batchWrite(func(tx *sql.Tx) error {
+		return ms.updateWSMessage(tx, req, wsm)
+	}, func() {
+		for _, watcher := range ms.storageWatchers {
+			watcher.WSMessageUpdated(ms, req, wsm)
+		}
+	})
 }
 
 func (ms *SQLiteStorage) updateWSMessage(tx *sql.Tx, req *ProxyRequest, wsm *ProxyWSMessage) error {
@@ -1122,13 +1418,18 @@ func (ms *SQLiteStorage) updateWSMessage(tx *sql.Tx, req *ProxyRequest, wsm *Pro
 		}
 	}
 
+	contents, err := ms.crypt.seal(wsm.Message)
+	if err != nil {
+		return err
+	}
+
 	_, err = stmt.Exec(
 		parent_id,
 		unmangledId,
 		isBinary,
 		wsm.Direction,
 		wsm.Timestamp.UnixNano(),
-		wsm.Message,
+		contents,
 		wsm.DbId,
 	)
 	if err != nil {
@@ -1139,19 +1440,12 @@ func (ms *SQLiteStorage) updateWSMessage(tx *sql.Tx, req *ProxyRequest, wsm *Pro
 }
 
 func (ms *SQLiteStorage) LoadWSMessage(wsmid string) (*ProxyWSMessage, error) {
-	ms.mtx.Lock()
-	defer ms.mtx.Unlock()
-	tx, err := ms.dbConn.Begin()
-	if err != nil {
-		return nil, err
-	}
-	wsm, err := ms.loadWSMessage(tx, wsmid)
+	tx, err := ms.beginRead()
 	if err != nil {
-		tx.Rollback()
 		return nil, err
 	}
-	tx.Commit()
-	return wsm, nil
+	defer ms.endRead(tx)
+	return ms.loadWSMessage(tx, wsmid)
 }
 
 func (ms *SQLiteStorage) loadWSMessage(tx *sql.Tx, wsmid string) (*ProxyWSMessage, error) {
@@ -1201,19 +1495,12 @@ func (ms *SQLiteStorage) loadWSMessage(tx *sql.Tx, wsmid string) (*ProxyWSMessag
 }
 
 func (ms *SQLiteStorage) LoadUnmangledWSMessage(wsmid string) (*ProxyWSMessage, error) {
-	ms.mtx.Lock()
-	defer ms.mtx.Unlock()
-	tx, err := ms.dbConn.Begin()
+	tx, err := ms.beginRead()
 	if err != nil {
 		return nil, err
 	}
-	wsm, err := ms.loadUnmangledWSMessage(tx, wsmid)
-	if err != nil {
-		tx.Rollback()
-		return nil, err
-	}
-	tx.Commit()
-	return wsm, nil
+	defer ms.endRead(tx)
+	return ms.loadUnmangledWSMessage(tx, wsmid)
 }
 
 func (ms *SQLiteStorage) loadUnmangledWSMessage(tx *sql.Tx, wsmid string) (*ProxyWSMessage, error) {
@@ -1300,19 +1587,12 @@ func (ms *SQLiteStorage) deleteWSMessage(tx *sql.Tx, wsmid string) error {
 }
 
 func (ms *SQLiteStorage) RequestKeys() ([]string, error) {
-	ms.mtx.Lock()
-	defer ms.mtx.Unlock()
-	tx, err := ms.dbConn.Begin()
+	tx, err := ms.beginRead()
 	if err != nil {
 		return nil, err
 	}
-	strs, err := ms.requestKeys(tx)
-	if err != nil {
-		tx.Rollback()
-		return nil, err
-	}
-	tx.Commit()
-	return strs, nil
+	defer ms.endRead(tx)
+	return ms.requestKeys(tx)
 }
 
 func (ms *SQLiteStorage) requestKeys(tx *sql.Tx) ([]string, error) {
@@ -1342,14 +1622,33 @@ func (ms *SQLiteStorage) requestKeys(tx *sql.Tx) ([]string, error) {
 }
 
 func (ms *SQLiteStorage) reqSearchHelper(tx *sql.Tx, limit int64, checker RequestChecker, sqlTail string) ([]*ProxyRequest, error) {
+	results := make([]*ProxyRequest, 0)
+	err := ms.scanRequests(tx, sqlTail, func(req *ProxyRequest) bool {
+		if checker(req) {
+			results = append(results, req)
+			if limit > 0 && int64(len(results)) >= limit {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Loads the requests selected by sqlTail one at a time, newest first, and passes them to f. Stops early if f returns false.
+func (ms *SQLiteStorage) scanRequests(tx *sql.Tx, sqlTail string, f func(req *ProxyRequest) bool) error {
 	rows, err := tx.Query(request_select + sqlTail + " ORDER BY start_datetime DESC;")
 	if err != nil {
-		return nil, errors.New("error with sql query: " + err.Error())
+		return errors.New("error with sql query: " + err.Error())
 	}
 	defer rows.Close()
 
 	var db_id sql.NullInt64
 	var db_full_request []byte
+	var db_body []byte
 	var db_response_id sql.NullInt64
 	var db_unmangled_id sql.NullInt64
 	var db_port sql.NullInt64
@@ -1357,12 +1656,16 @@ func (ms *SQLiteStorage) reqSearchHelper(tx *sql.Tx, limit int64, checker Reques
 	var db_host sql.NullString
 	var db_start_datetime sql.NullInt64
 	var db_end_datetime sql.NullInt64
+	var db_note []byte
+	var db_highlight sql.NullString
+	var db_reviewed sql.NullBool
+	var db_timings sql.NullString
 
-	results := make([]*ProxyRequest, 0)
 	for rows.Next() {
 		err := rows.Scan(
 			&db_id,
 			&db_full_request,
+			&db_body,
 			&db_response_id,
 			&db_unmangled_id,
 			&db_port,
@@ -1370,47 +1673,47 @@ func (ms *SQLiteStorage) reqSearchHelper(tx *sql.Tx, limit int64, checker Reques
 			&db_host,
 			&db_start_datetime,
 			&db_end_datetime,
+			&db_note,
+			&db_highlight,
+			&db_reviewed,
+			&db_timings,
 		)
 		if err != nil {
-			return nil, errors.New("error loading row from database: " + err.Error())
+			return errors.New("error loading row from database: " + err.Error())
 		}
-		req, err := reqFromRow(tx, ms, db_id, db_full_request, db_response_id, db_unmangled_id,
-			db_port, db_is_ssl, db_host, db_start_datetime, db_end_datetime)
+		req, err := reqFromRow(tx, ms, db_id, db_full_request, db_body, db_response_id, db_unmangled_id,
+			db_port, db_is_ssl, db_host, db_start_datetime, db_end_datetime, db_note, db_highlight, db_reviewed, db_timings)
 		if err != nil {
-			return nil, errors.New("error creating request: " + err.Error())
+			return errors.New("error creating request: " + err.Error())
 		}
 
-		if checker(req) {
-			results = append(results, req)
-			if limit > 0 && int64(len(results)) >= limit {
-				break
-			}
+		if !f(req) {
+			break
 		}
 	}
 	err = rows.Err()
 	if err != nil {
-		return nil, fmt.Errorf("error loading requests: " + err.Error())
+		return fmt.Errorf("error loading requests: " + err.Error())
 	}
-	return results, nil
+	return nil
 }
 
 func (ms *SQLiteStorage) Search(limit int64, args ...interface{}) ([]*ProxyRequest, error) {
-	ms.mtx.Lock()
-	defer ms.mtx.Unlock()
-	tx, err := ms.dbConn.Begin()
+	// Create the checker before starting the transaction since it may need to load saved queries
+	checker, err := NewStorageRequestChecker(ms, args...)
 	if err != nil {
 		return nil, err
 	}
-	reqs, err := ms.search(tx, limit, args...)
+
+	tx, err := ms.beginRead()
 	if err != nil {
-		tx.Rollback()
 		return nil, err
 	}
-	tx.Commit()
-	return reqs, nil
+	defer ms.endRead(tx)
+	return ms.search(tx, limit, checker, args...)
 }
 
-func (ms *SQLiteStorage) search(tx *sql.Tx, limit int64, args ...interface{}) ([]*ProxyRequest, error) {
+func (ms *SQLiteStorage) search(tx *sql.Tx, limit int64, checker RequestChecker, args ...interface{}) ([]*ProxyRequest, error) {
 	tail := ""
 
 	// Check for `id is`
@@ -1433,77 +1736,382 @@ func (ms *SQLiteStorage) search(tx *sql.Tx, limit int64, args ...interface{}) ([
 		}
 	}
 
-	// Can't optimize, just make a checker and do a naive implementation
-	checker, err := NewRequestChecker(args...)
-	if err != nil {
-		return nil, err
+	// Check for `modified is true/false` and use the unmangled_id columns to filter rows
+	if len(args) == 3 {
+		tail = modifiedSQLTail(args)
 	}
+
+	// Use the checker to do a naive implementation on the remaining rows
 	return ms.reqSearchHelper(tx, limit, checker, tail)
 }
 
-func (ms *SQLiteStorage) CheckRequests(limit int64, checker RequestChecker) ([]*ProxyRequest, error) {
-	ms.mtx.Lock()
-	defer ms.mtx.Unlock()
-	tx, err := ms.dbConn.Begin()
+// Returns a WHERE clause that only selects requests matching a search on one of the modified fields or a blank string if the search can't be done in SQL
+func modifiedSQLTail(args []interface{}) string {
+	field, ok := args[0].(SearchField)
+	if !ok {
+		return ""
+	}
+	comparer, ok := args[1].(StrComparer)
+	if !ok || comparer != StrIs {
+		return ""
+	}
+	val, ok := args[2].(string)
+	if !ok {
+		return ""
+	}
+	modified, err := strconv.ParseBool(val)
 	if err != nil {
-		return nil, err
+		return ""
+	}
+
+	cond, ok := modifiedSQLCondition(field, modified)
+	if !ok {
+		return ""
 	}
-	reqs, err := ms.checkRequests(tx, limit, checker)
+	return " WHERE " + cond
+}
+
+// Returns an SQL condition that selects requests where the modified field has the given value
+func modifiedSQLCondition(field SearchField, modified bool) (string, bool) {
+	reqCond := "requests.unmangled_id IS NOT NULL"
+	rspCond := "EXISTS (SELECT 1 FROM responses WHERE responses.id=requests.response_id AND responses.unmangled_id IS NOT NULL)"
+	wsCond := "EXISTS (SELECT 1 FROM websocket_messages WHERE websocket_messages.parent_request=requests.id AND websocket_messages.unmangled_id IS NOT NULL)"
+
+	var cond string
+	switch field {
+	case FieldRequestModified:
+		cond = reqCond
+	case FieldResponseModified:
+		cond = rspCond
+	case FieldWSModified:
+		cond = wsCond
+	case FieldModified:
+		cond = fmt.Sprintf("(%s OR %s OR %s)", reqCond, rspCond, wsCond)
+	default:
+		return "", false
+	}
+
+	if !modified {
+		cond = "NOT " + cond
+	}
+	return cond, true
+}
+
+func (ms *SQLiteStorage) CheckRequests(limit int64, checker RequestChecker) ([]*ProxyRequest, error) {
+	tx, err := ms.beginRead()
 	if err != nil {
-		tx.Rollback()
 		return nil, err
 	}
-	tx.Commit()
-	return reqs, err
+	defer ms.endRead(tx)
+	return ms.checkRequests(tx, limit, checker)
 }
 
 func (ms *SQLiteStorage) checkRequests(tx *sql.Tx, limit int64, checker RequestChecker) ([]*ProxyRequest, error) {
 	return ms.reqSearchHelper(tx, limit, checker, "")
 }
 
+/*
+Request statistics
+*/
+
+// Selects requests that are not only stored as the unmangled version of another request
+const sqlNotUnmangledCopy = "requests.id NOT IN (SELECT unmangled_id FROM requests WHERE unmangled_id IS NOT NULL)"
+
+// Selects requests whose metadata columns were filled in when they were saved
+const sqlHasStatsMetadata = "requests.method IS NOT NULL AND (requests.response_id IS NULL OR EXISTS (SELECT 1 FROM responses WHERE responses.id=requests.response_id AND responses.status_code IS NOT NULL))"
+
+func (ms *SQLiteStorage) RequestStats(query MessageQuery, group StatsGroup) ([]*RequestStats, error) {
+	agg, err := newStatsAggregator(group)
+	if err != nil {
+		return nil, err
+	}
+	checker, err := StorageCheckerFromMessageQuery(ms, query)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := ms.beginRead()
+	if err != nil {
+		return nil, err
+	}
+	defer ms.endRead(tx)
+
+	addChecked := func(req *ProxyRequest) bool {
+		if checker(req) {
+			agg.add(req)
+		}
+		return true
+	}
+
+	cond, params, ok := queryToSQL(query)
+	if !ok {
+		// The query can't be run in SQL so every request has to be loaded and checked
+		if err := ms.scanRequests(tx, " WHERE "+sqlNotUnmangledCopy, addChecked); err != nil {
+			return nil, err
+		}
+		return agg.results(), nil
+	}
+
+	if err := ms.sqlRequestStats(tx, agg, cond, params); err != nil {
+		return nil, err
+	}
+
+	// Requests saved without metadata are loaded and checked
+	tail := " WHERE " + sqlNotUnmangledCopy + " AND NOT (" + sqlHasStatsMetadata + ")"
+	if err := ms.scanRequests(tx, tail, addChecked); err != nil {
+		return nil, err
+	}
+	return agg.results(), nil
+}
+
+// Aggregates the requests with metadata that match an SQL condition
+func (ms *SQLiteStorage) sqlRequestStats(tx *sql.Tx, agg *statsAggregator, cond string, params []interface{}) error {
+	var key string
+	switch agg.group {
+	case GroupNone:
+		key = "''"
+	case GroupHost:
+		key = "COALESCE(requests.host, '')"
+	case GroupMethod:
+		key = "requests.method"
+	case GroupPath:
+		key = "requests.path"
+	case GroupStatusCode:
+		key = "COALESCE(CAST(responses.status_code AS TEXT), '')"
+	case GroupEndpoint:
+		key = "requests.method || ' ' || COALESCE(requests.host, '') || requests.path"
+	default:
+		return fmt.Errorf("invalid stats group: %d", agg.group)
+	}
+	duration := "CASE WHEN requests.end_datetime > requests.start_datetime THEN requests.end_datetime - requests.start_datetime END"
+
+	rows, err := tx.Query(fmt.Sprintf(`
+    SELECT %s, COUNT(*), COUNT(responses.id), COUNT(%s), COALESCE(SUM(%s), 0),
+           COALESCE(SUM(requests.body_size), 0), COALESCE(SUM(responses.body_size), 0)
+    FROM requests LEFT JOIN responses ON requests.response_id=responses.id
+    WHERE %s AND %s AND %s
+    GROUP BY 1;
+    `, key, duration, duration, sqlNotUnmangledCopy, sqlHasStatsMetadata, cond), params...)
+	if err != nil {
+		return fmt.Errorf("error computing request statistics: %s", err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		stats := &RequestStats{}
+		var totalDuration int64
+		err := rows.Scan(&stats.Key, &stats.Count, &stats.Responses, &stats.Timed, &totalDuration,
+			&stats.RequestBytes, &stats.ResponseBytes)
+		if err != nil {
+			return fmt.Errorf("error loading request statistics: %s", err.Error())
+		}
+		stats.TotalDuration = time.Duration(totalDuration)
+		agg.addStats(stats)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error loading request statistics: %s", err.Error())
+	}
+	return nil
+}
+
+// Converts a MessageQuery into an SQL condition on the requests and responses tables. Returns false if the query uses searches that can't be done in SQL.
+func queryToSQL(query MessageQuery) (string, []interface{}, bool) {
+	if len(query) == 0 {
+		return "1", nil, true
+	}
+
+	params := make([]interface{}, 0)
+	phraseConds := make([]string, 0, len(query))
+	for _, phrase := range query {
+		if len(phrase) == 0 {
+			phraseConds = append(phraseConds, "0")
+			continue
+		}
+		termConds := make([]string, 0, len(phrase))
+		for _, args := range phrase {
+			cond, termParams, ok := searchToSQL(args)
+			if !ok {
+				return "", nil, false
+			}
+			termConds = append(termConds, cond)
+			params = append(params, termParams...)
+		}
+		phraseConds = append(phraseConds, "("+strings.Join(termConds, " OR ")+")")
+	}
+	return strings.Join(phraseConds, " AND "), params, true
+}
+
+// Converts a single search into an SQL condition that is always 0 or 1. Only the fields that have columns are supported.
+func searchToSQL(args []interface{}) (string, []interface{}, bool) {
+	if len(args) == 0 {
+		return "", nil, false
+	}
+	field, ok := args[0].(SearchField)
+	if !ok {
+		return "", nil, false
+	}
+
+	var cond string
+	var params []interface{}
+	switch field {
+	case FieldInvert:
+		inner, innerParams, ok := searchToSQL(args[1:])
+		if !ok {
+			return "", nil, false
+		}
+		return "NOT " + inner, innerParams, true
+
+	case FieldMethod, FieldPath, FieldStatusCode:
+		if len(args) != 3 {
+			return "", nil, false
+		}
+		comparer, ok := args[1].(StrComparer)
+		if !ok {
+			return "", nil, false
+		}
+		val, ok := args[2].(string)
+		if !ok {
+			return "", nil, false
+		}
+
+		column := "requests.method"
+		if field == FieldPath {
+			column = "requests.path"
+		} else if field == FieldStatusCode {
+			column = "CAST(responses.status_code AS TEXT)"
+		}
+
+		switch comparer {
+		case StrIs:
+			cond = column + "=?"
+		case StrContains:
+			cond = "instr(" + column + ", ?)>0"
+		default:
+			return "", nil, false
+		}
+		params = []interface{}{val}
+
+	case FieldAfter, FieldBefore:
+		if len(args) != 2 {
+			return "", nil, false
+		}
+		val, ok := args[1].(time.Time)
+		if !ok {
+			return "", nil, false
+		}
+		if field == FieldAfter {
+			cond = "requests.start_datetime>?"
+		} else {
+			cond = "requests.start_datetime<?"
+		}
+		params = []interface{}{val.UnixNano()}
+
+	case FieldTimeRange:
+		if len(args) != 3 {
+			return "", nil, false
+		}
+		begin, ok := args[1].(time.Time)
+		if !ok {
+			return "", nil, false
+		}
+		end, ok := args[2].(time.Time)
+		if !ok {
+			return "", nil, false
+		}
+		cond = "requests.start_datetime>? AND requests.start_datetime<?"
+		params = []interface{}{begin.UnixNano(), end.UnixNano()}
+
+	case FieldRequestModified, FieldResponseModified, FieldWSModified, FieldModified:
+		if len(args) != 3 {
+			return "", nil, false
+		}
+		comparer, ok := args[1].(StrComparer)
+		if !ok || comparer != StrIs {
+			return "", nil, false
+		}
+		val, ok := args[2].(string)
+		if !ok || (val != "true" && val != "false") {
+			return "", nil, false
+		}
+		cond, _ = modifiedSQLCondition(field, val == "true")
+
+	default:
+		return "", nil, false
+	}
+	return "COALESCE((" + cond + "), 0)", params, true
+}
+
 func (ms *SQLiteStorage) SaveQuery(name string, query MessageQuery) error {
+	return ms.SaveSavedQuery(&SavedQuery{Name: name, Query: query})
+}
+
+func (ms *SQLiteStorage) SaveQueryExpr(name string, expr *QueryExpr) error {
+	if expr == nil {
+		return errors.New("query expression is required")
+	}
+	return ms.SaveSavedQuery(&SavedQuery{Name: name, Expr: expr})
+}
+
+func (ms *SQLiteStorage) SaveSavedQuery(sq *SavedQuery) error {
+	strQuery, strExpr, err := savedQueryForSaving(sq)
+	if err != nil {
+		return err
+	}
+
 	ms.mtx.Lock()
 	defer ms.mtx.Unlock()
 	tx, err := ms.dbConn.Begin()
 	if err != nil {
 		return err
 	}
-	err = ms.saveQuery(tx, name, query)
+	err = ms.saveQuery(tx, sq, strQuery, strExpr)
 	if err != nil {
 		tx.Rollback()
 		return err
 	}
 	tx.Commit()
+	notifyQueryWatchers(ms.storageWatchers, ms, sq.Name, false)
 	return nil
 }
 
-func (ms *SQLiteStorage) saveQuery(tx *sql.Tx, name string, query MessageQuery) error {
-	strQuery, err := MsgQueryToStrQuery(query)
-	if err != nil {
-		return fmt.Errorf("error creating string version of query: %s", err.Error())
-	}
-
+func (ms *SQLiteStorage) saveQuery(tx *sql.Tx, sq *SavedQuery, strQuery StrMessageQuery, strExpr *StrQueryExpr) error {
 	jsonQuery, err := json.Marshal(strQuery)
 	if err != nil {
 		return fmt.Errorf("error marshaling query to json: %s", err.Error())
 	}
 
-	if err := ms.deleteQuery(tx, name); err != nil {
+	var jsonExpr []byte = nil
+	if strExpr != nil {
+		jsonExpr, err = json.Marshal(strExpr)
+		if err != nil {
+			return fmt.Errorf("error marshaling query expression to json: %s", err.Error())
+		}
+	}
+
+	if _, err := ms.deleteQuery(tx, sq.Name); err != nil {
 		return err
 	}
 
 	stmt, err := tx.Prepare(`
     INSERT INTO saved_contexts (
             context_name,
-            filter_strings
-    ) VALUES (?, ?);
+            filter_strings,
+            expression,
+            description,
+            folder
+    ) VALUES (?, ?, ?, ?, ?);
     `)
 	if err != nil {
 		return fmt.Errorf("error preparing statement to insert request into database: %s", err.Error())
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(name, jsonQuery)
+	var dbExpr sql.NullString
+	if jsonExpr != nil {
+		dbExpr = sql.NullString{String: string(jsonExpr), Valid: true}
+	}
+
+	_, err = stmt.Exec(sq.Name, jsonQuery, dbExpr, sq.Description, sq.Folder)
 	if err != nil {
 		return fmt.Errorf("error inserting request into database: %s", err.Error())
 	}
@@ -1512,25 +2120,40 @@ func (ms *SQLiteStorage) saveQuery(tx *sql.Tx, name string, query MessageQuery)
 }
 
 func (ms *SQLiteStorage) LoadQuery(name string) (MessageQuery, error) {
-	ms.mtx.Lock()
-	defer ms.mtx.Unlock()
-	tx, err := ms.dbConn.Begin()
+	sq, err := ms.LoadSavedQuery(name)
 	if err != nil {
 		return nil, err
 	}
-	query, err := ms.loadQuery(tx, name)
+	return savedMessageQuery(sq)
+}
+
+func (ms *SQLiteStorage) LoadQueryExpr(name string) (*QueryExpr, error) {
+	sq, err := ms.LoadSavedQuery(name)
 	if err != nil {
-		tx.Rollback()
 		return nil, err
 	}
-	tx.Commit()
-	return query, nil
+	return sq.Expr, nil
 }
 
-func (ms *SQLiteStorage) loadQuery(tx *sql.Tx, name string) (MessageQuery, error) {
+func (ms *SQLiteStorage) LoadSavedQuery(name string) (*SavedQuery, error) {
+	tx, err := ms.beginRead()
+	if err != nil {
+		return nil, err
+	}
+	defer ms.endRead(tx)
+	return ms.loadSavedQuery(tx, name)
+}
+
+func (ms *SQLiteStorage) loadSavedQuery(tx *sql.Tx, name string) (*SavedQuery, error) {
 	var queryStr sql.NullString
-	err := tx.QueryRow(`SELECT filter_strings FROM saved_contexts WHERE context_name=?`, name).Scan(
+	var exprStr sql.NullString
+	var description sql.NullString
+	var folder sql.NullString
+	err := tx.QueryRow(`SELECT filter_strings, expression, description, folder FROM saved_contexts WHERE context_name=?`, name).Scan(
 		&queryStr,
+		&exprStr,
+		&description,
+		&folder,
 	)
 	if err == sql.ErrNoRows || !queryStr.Valid {
 		return nil, fmt.Errorf("context with name %s does not exist", name)
@@ -1538,18 +2161,31 @@ func (ms *SQLiteStorage) loadQuery(tx *sql.Tx, name string) (MessageQuery, error
 		return nil, fmt.Errorf("error loading data from datafile: %s", err.Error())
 	}
 
-	var strRetQuery StrMessageQuery
-	err = json.Unmarshal([]byte(queryStr.String), &strRetQuery)
-	if err != nil {
+	return savedQueryFromDb(name, queryStr, exprStr, description, folder)
+}
+
+// Parses the JSON versions of a saved query and its expression from the database
+func savedQueryFromDb(name string, queryStr sql.NullString, exprStr sql.NullString, description sql.NullString, folder sql.NullString) (*SavedQuery, error) {
+	var strQuery StrMessageQuery
+	if err := json.Unmarshal([]byte(queryStr.String), &strQuery); err != nil {
 		return nil, err
 	}
 
-	retQuery, err := StrQueryToMsgQuery(strRetQuery)
+	var strExpr *StrQueryExpr = nil
+	if exprStr.Valid {
+		strExpr = &StrQueryExpr{}
+		if err := json.Unmarshal([]byte(exprStr.String), strExpr); err != nil {
+			return nil, err
+		}
+	}
+
+	sq, err := savedQueryFromStr(name, strQuery, strExpr)
 	if err != nil {
 		return nil, err
 	}
-
-	return retQuery, nil
+	sq.Description = description.String
+	sq.Folder = folder.String
+	return sq, nil
 }
 
 func (ms *SQLiteStorage) DeleteQuery(name string) error {
@@ -1559,48 +2195,49 @@ func (ms *SQLiteStorage) DeleteQuery(name string) error {
 	if err != nil {
 		return err
 	}
-	err = ms.deleteQuery(tx, name)
+	deleted, err := ms.deleteQuery(tx, name)
 	if err != nil {
 		tx.Rollback()
 		return err
 	}
 	tx.Commit()
+	if deleted {
+		notifyQueryWatchers(ms.storageWatchers, ms, name, true)
+	}
 	return nil
 }
 
-func (ms *SQLiteStorage) deleteQuery(tx *sql.Tx, name string) error {
+// Deletes a query and returns whether it existed
+func (ms *SQLiteStorage) deleteQuery(tx *sql.Tx, name string) (bool, error) {
 	stmt, err := tx.Prepare(`DELETE FROM saved_contexts WHERE context_name=?;`)
 	if err != nil {
-		return fmt.Errorf("error preparing statement to insert request into database: %s", err.Error())
+		return false, fmt.Errorf("error preparing statement to insert request into database: %s", err.Error())
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(name)
+	result, err := stmt.Exec(name)
+	if err != nil {
+		return false, fmt.Errorf("error deleting query: %s", err.Error())
+	}
+	affected, err := result.RowsAffected()
 	if err != nil {
-		return fmt.Errorf("error deleting query: %s", err.Error())
+		return false, fmt.Errorf("error deleting query: %s", err.Error())
 	}
 
-	return nil
+	return affected > 0, nil
 }
 
 func (ms *SQLiteStorage) AllSavedQueries() ([]*SavedQuery, error) {
-	ms.mtx.Lock()
-	defer ms.mtx.Unlock()
-	tx, err := ms.dbConn.Begin()
+	tx, err := ms.beginRead()
 	if err != nil {
 		return nil, err
 	}
-	queries, err := ms.allSavedQueries(tx)
-	if err != nil {
-		tx.Rollback()
-		return nil, err
-	}
-	tx.Commit()
-	return queries, nil
+	defer ms.endRead(tx)
+	return ms.allSavedQueries(tx)
 }
 
 func (ms *SQLiteStorage) allSavedQueries(tx *sql.Tx) ([]*SavedQuery, error) {
-	rows, err := tx.Query("SELECT context_name, filter_strings FROM saved_contexts;")
+	rows, err := tx.Query("SELECT context_name, filter_strings, expression, description, folder FROM saved_contexts;")
 	if err != nil {
 		return nil, fmt.Errorf("could not get context names from datafile: %s", err.Error())
 	}
@@ -1608,21 +2245,21 @@ func (ms *SQLiteStorage) allSavedQueries(tx *sql.Tx) ([]*SavedQuery, error) {
 
 	var name sql.NullString
 	var queryStr sql.NullString
+	var exprStr sql.NullString
+	var description sql.NullString
+	var folder sql.NullString
 	savedQueries := make([]*SavedQuery, 0)
 	for rows.Next() {
-		err := rows.Scan(&name, &queryStr)
+		err := rows.Scan(&name, &queryStr, &exprStr, &description, &folder)
 		if err != nil {
 			return nil, fmt.Errorf("could not get context names from datafile: %s", err.Error())
 		}
 		if name.Valid && queryStr.Valid {
-			var strQuery StrMessageQuery
-			err = json.Unmarshal([]byte(queryStr.String), &strQuery)
-
-			goQuery, err := StrQueryToMsgQuery(strQuery)
+			sq, err := savedQueryFromDb(name.String, queryStr, exprStr, description, folder)
 			if err != nil {
 				return nil, err
 			}
-			savedQueries = append(savedQueries, &SavedQuery{Name: name.String, Query: goQuery})
+			savedQueries = append(savedQueries, sq)
 		}
 	}
 	err = rows.Err()
@@ -1680,7 +2317,12 @@ func (ms *SQLiteStorage) setPluginValue(tx *sql.Tx, key string, value string) er
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(key, value)
+	sealed, err := ms.crypt.sealString(value)
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(key, sealed)
 	if err != nil {
 		return fmt.Errorf("error inserting plugin data into database: %s", err.Error())
 	}
@@ -1689,19 +2331,12 @@ func (ms *SQLiteStorage) setPluginValue(tx *sql.Tx, key string, value string) er
 }
 
 func (ms *SQLiteStorage) GetPluginValue(key string) (string, error) {
-	ms.mtx.Lock()
-	defer ms.mtx.Unlock()
-	tx, err := ms.dbConn.Begin()
+	tx, err := ms.beginRead()
 	if err != nil {
 		return "", err
 	}
-	value, err := ms.getPluginValue(tx, key)
-	if err != nil {
-		tx.Rollback()
-		return "", err
-	}
-	tx.Commit()
-	return value, nil
+	defer ms.endRead(tx)
+	return ms.getPluginValue(tx, key)
 }
 
 func (ms *SQLiteStorage) getPluginValue(tx *sql.Tx, key string) (string, error) {
@@ -1714,5 +2349,5 @@ func (ms *SQLiteStorage) getPluginValue(tx *sql.Tx, key string) (string, error)
 	} else if err != nil {
 		return "", fmt.Errorf("error loading data from datafile: %s", err.Error())
 	}
-	return value.String, nil
+	return ms.crypt.openString(value.String)
 }
@@ -1,7 +1,12 @@
 package puppy
 
 import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"runtime"
+	"sync"
 	"testing"
 	"time"
 )
@@ -78,3 +83,383 @@ func TestTime(t *testing.T) {
 		t.Errorf("End time not saved properly. Expected 1234567, got %d", tend)
 	}
 }
+
+func TestCopyRequests(t *testing.T) {
+	src := testStorage()
+	defer src.Close()
+	dest := testStorage()
+	defer dest.Close()
+
+	req := testReq()
+	req.AddTag("finding")
+	req.StartDatetime = time.Unix(0, 1234567)
+	unmangled := testReq()
+	unmangled.ServerResponse = nil
+	req.Unmangled = unmangled
+	err := SaveNewRequest(src, req)
+	testErr(t, err)
+
+	other := testReq()
+	other.ServerResponse = nil
+	err = SaveNewRequest(src, other)
+	testErr(t, err)
+
+	query := MessageQuery{QueryPhrase{{FieldTag, StrIs, "finding"}}}
+	var lastCopied, lastTotal int
+	idMap, err := CopyRequests(src, query, dest, func(copied int, total int) {
+		lastCopied = copied
+		lastTotal = total
+	})
+	testErr(t, err)
+
+	if len(idMap) != 1 || lastCopied != 1 || lastTotal != 1 {
+		t.Fatalf("expected exactly one request to be copied, got %d", len(idMap))
+	}
+
+	copied, err := dest.LoadRequest(idMap[req.DbId])
+	testErr(t, err)
+	checkTags(t, copied.Tags(), []string{"finding"})
+	if copied.StartDatetime.UnixNano() != 1234567 {
+		t.Errorf("start time was not copied")
+	}
+	if copied.ServerResponse == nil || copied.Unmangled == nil {
+		t.Errorf("dependent messages were not copied")
+	}
+
+	// The original should be untouched
+	orig, err := src.LoadRequest(req.DbId)
+	testErr(t, err)
+	if orig.Unmangled == nil || orig.Unmangled.DbId != unmangled.DbId {
+		t.Errorf("source request was modified")
+	}
+}
+
+func TestRetentionPolicy(t *testing.T) {
+	storage := testStorage()
+	defer storage.Close()
+
+	ids := make([]string, 0)
+	for i := 0; i < 5; i++ {
+		req := testReq()
+		req.StartDatetime = time.Now().Add(time.Duration(i-5) * time.Hour)
+		if i == 0 {
+			req.AddTag("keep")
+		}
+		err := SaveNewRequest(storage, req)
+		testErr(t, err)
+		ids = append(ids, req.DbId)
+	}
+
+	// Keep the 2 newest requests and anything tagged "keep"
+	result, err := storage.ApplyRetentionPolicy(&RetentionPolicy{
+		MaxRequests:   2,
+		ProtectedTags: []string{"keep"},
+	})
+	testErr(t, err)
+	if len(result.DeletedRequests) != 2 {
+		t.Fatalf("expected 2 requests to be deleted, got %d", len(result.DeletedRequests))
+	}
+
+	keys, err := storage.RequestKeys()
+	testErr(t, err)
+	checkTags(t, keys, []string{ids[0], ids[3], ids[4]})
+
+	// Drop response bodies for anything older than 90 minutes
+	result, err = storage.ApplyRetentionPolicy(&RetentionPolicy{
+		MaxBodySize: 3,
+		BodyAge:     90 * time.Minute,
+	})
+	testErr(t, err)
+	if result.DroppedBodies != 4 {
+		t.Errorf("expected 4 bodies to be dropped, got %d", result.DroppedBodies)
+	}
+
+	req, err := storage.LoadRequest(ids[3])
+	testErr(t, err)
+	if len(req.BodyBytes()) != 0 || len(req.ServerResponse.BodyBytes()) != 0 {
+		t.Errorf("bodies were not dropped")
+	}
+
+	req, err = storage.LoadRequest(ids[4])
+	testErr(t, err)
+	if len(req.ServerResponse.BodyBytes()) == 0 {
+		t.Errorf("body was dropped from a recent request")
+	}
+}
+
+func TestRetentionPolicyProtectedCount(t *testing.T) {
+	storage := testStorage()
+	defer storage.Close()
+
+	ids := make([]string, 0)
+	for i := 0; i < 4; i++ {
+		req := testReq()
+		req.StartDatetime = time.Now().Add(time.Duration(i-4) * time.Hour)
+		if i == 3 {
+			req.AddTag("keep")
+		}
+		testErr(t, SaveNewRequest(storage, req))
+		ids = append(ids, req.DbId)
+	}
+
+	// The newest request is protected so the 2 newest requests after it are kept
+	result, err := storage.ApplyRetentionPolicy(&RetentionPolicy{
+		MaxRequests:   2,
+		ProtectedTags: []string{"keep"},
+	})
+	testErr(t, err)
+	checkTags(t, result.DeletedRequests, []string{ids[0]})
+
+	keys, err := storage.RequestKeys()
+	testErr(t, err)
+	checkTags(t, keys, []string{ids[1], ids[2], ids[3]})
+}
+
+func TestBodyDedup(t *testing.T) {
+	storage := testStorage()
+	defer storage.Close()
+
+	countBodies := func() int {
+		var n int
+		err := storage.dbConn.QueryRow("SELECT COUNT(*) FROM message_bodies;").Scan(&n)
+		testErr(t, err)
+		return n
+	}
+
+	req1 := testReq()
+	req1.SetBodyBytes([]byte("AAAA"))
+	testErr(t, SaveNewRequest(storage, req1))
+	req2 := testReq()
+	req2.SetBodyBytes([]byte("AAAA"))
+	testErr(t, SaveNewRequest(storage, req2))
+
+	// One shared request body and one shared response body
+	if n := countBodies(); n != 2 {
+		t.Errorf("expected 2 stored bodies, got %d", n)
+	}
+
+	req, err := storage.LoadRequest(req2.DbId)
+	testErr(t, err)
+	if string(req.BodyBytes()) != "AAAA" || string(req.ServerResponse.BodyBytes()) != string(req2.ServerResponse.BodyBytes()) {
+		t.Errorf("bodies were not loaded correctly")
+	}
+
+	testErr(t, storage.DeleteRequest(req1.DbId))
+	if n := countBodies(); n != 2 {
+		t.Errorf("shared bodies were deleted while still referenced, got %d", n)
+	}
+
+	testErr(t, storage.DeleteRequest(req2.DbId))
+	if n := countBodies(); n != 0 {
+		t.Errorf("expected bodies to be deleted, got %d", n)
+	}
+}
+
+func TestConcurrentReads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "puppytest")
+	testErr(t, err)
+	defer os.RemoveAll(dir)
+
+	storage, err := OpenSQLiteStorage(filepath.Join(dir, "test.db"), NullLogger())
+	testErr(t, err)
+	defer storage.Close()
+
+	req := testReq()
+	testErr(t, SaveNewRequest(storage, req))
+
+	// Hold the write lock like a long running write would and make sure reads still complete
+	storage.mtx.Lock()
+	done := make(chan error, 1)
+	go func() {
+		_, err := storage.LoadRequest(req.DbId)
+		if err == nil {
+			_, err = storage.Search(0, FieldAll, StrContains, "foo")
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		testErr(t, err)
+	case <-time.After(5 * time.Second):
+		t.Errorf("read was blocked by a write")
+	}
+	storage.mtx.Unlock()
+}
+
+func TestBatchedWrites(t *testing.T) {
+	storage := testStorage()
+	defer storage.Close()
+
+	var wg sync.WaitGroup
+	reqs := make([]*ProxyRequest, 50)
+	errs := make([]error, len(reqs))
+	for i := range reqs {
+		reqs[i] = testReq()
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = SaveNewRequest(storage, reqs[i])
+		}(i)
+	}
+	wg.Wait()
+
+	ids := make(map[string]bool)
+	for i, req := range reqs {
+		testErr(t, errs[i])
+		ids[req.DbId] = true
+	}
+	if len(ids) != len(reqs) {
+		t.Errorf("expected %d unique ids, got %d", len(reqs), len(ids))
+	}
+
+	keys, err := storage.RequestKeys()
+	testErr(t, err)
+	if len(keys) != len(reqs) {
+		t.Errorf("expected %d saved requests, got %d", len(reqs), len(keys))
+	}
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "puppytest")
+	testErr(t, err)
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "test.db")
+
+	storage, err := OpenEncryptedSQLiteStorage(fname, "hunter2", NullLogger())
+	testErr(t, err)
+
+	req, err := ProxyRequestFromBytes(
+		[]byte("POST / HTTP/1.1\r\nCookie: session=secretsession\r\nContent-Length: 23\r\n\r\npassword=secretpassword"),
+		"foobaz",
+		80,
+		false,
+	)
+	testErr(t, err)
+	testErr(t, SaveNewRequest(storage, req))
+	testErr(t, storage.SetPluginValue("token", "secrettoken"))
+	storage.Close()
+
+	data, err := ioutil.ReadFile(fname)
+	testErr(t, err)
+	for _, secret := range []string{"secretsession", "secretpassword", "secrettoken"} {
+		if bytes.Contains(data, []byte(secret)) {
+			t.Errorf("%s was stored in plaintext", secret)
+		}
+	}
+
+	if _, err := OpenSQLiteStorage(fname, NullLogger()); err != ErrStorageEncrypted {
+		t.Errorf("expected encrypted storage error, got %v", err)
+	}
+	if _, err := OpenEncryptedSQLiteStorage(fname, "wrong", NullLogger()); err != ErrIncorrectPassphrase {
+		t.Errorf("expected incorrect passphrase error, got %v", err)
+	}
+
+	storage, err = OpenEncryptedSQLiteStorage(fname, "hunter2", NullLogger())
+	testErr(t, err)
+	testErr(t, storage.Rekey("correct horse"))
+	storage.Close()
+
+	storage, err = OpenEncryptedSQLiteStorage(fname, "correct horse", NullLogger())
+	testErr(t, err)
+	defer storage.Close()
+
+	req2, err := storage.LoadRequest(req.DbId)
+	testErr(t, err)
+	if string(req2.BodyBytes()) != "password=secretpassword" || req2.Header.Get("Cookie") != "session=secretsession" {
+		t.Errorf("request was not decrypted correctly")
+	}
+	value, err := storage.GetPluginValue("token")
+	testErr(t, err)
+	if value != "secrettoken" {
+		t.Errorf("plugin value was not decrypted correctly")
+	}
+
+	// Metadata columns are not stored in encrypted datafiles but stats can still be computed
+	var n int
+	testErr(t, storage.dbConn.QueryRow("SELECT COUNT(*) FROM requests WHERE method IS NOT NULL OR path IS NOT NULL;").Scan(&n))
+	if n != 0 {
+		t.Errorf("request metadata was stored in plaintext")
+	}
+	stats, err := storage.RequestStats(MessageQuery{{{FieldMethod, StrIs, "POST"}}}, GroupPath)
+	testErr(t, err)
+	if len(stats) != 1 || stats[0].Key != "/" || stats[0].Count != 1 || stats[0].RequestBytes != 23 {
+		t.Errorf("unexpected stats for encrypted storage: %v", stats)
+	}
+}
+
+func TestEncryptPlaintextStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "puppytest")
+	testErr(t, err)
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "test.db")
+
+	storage, err := OpenSQLiteStorage(fname, NullLogger())
+	testErr(t, err)
+	req := testReq()
+	testErr(t, SaveNewRequest(storage, req))
+	storage.Close()
+
+	// Encrypting the datafile clears the metadata saved while it was unencrypted
+	storage, err = OpenEncryptedSQLiteStorage(fname, "hunter2", NullLogger())
+	testErr(t, err)
+	defer storage.Close()
+
+	// The plaintext contents are scrubbed from the datafile and its write-ahead log
+	for _, f := range []string{fname, fname + "-wal"} {
+		data, err := ioutil.ReadFile(f)
+		if os.IsNotExist(err) {
+			continue
+		}
+		testErr(t, err)
+		if bytes.Contains(data, []byte("cookie=choco")) {
+			t.Errorf("plaintext request was left in %s after encrypting", filepath.Base(f))
+		}
+	}
+
+	var n int
+	testErr(t, storage.dbConn.QueryRow("SELECT COUNT(*) FROM requests WHERE method IS NOT NULL OR path IS NOT NULL OR body_size IS NOT NULL;").Scan(&n))
+	if n != 0 {
+		t.Errorf("request metadata was left in plaintext after encrypting")
+	}
+	testErr(t, storage.dbConn.QueryRow("SELECT COUNT(*) FROM responses WHERE status_code IS NOT NULL OR body_size IS NOT NULL;").Scan(&n))
+	if n != 0 {
+		t.Errorf("response metadata was left in plaintext after encrypting")
+	}
+
+	stats, err := storage.RequestStats(nil, GroupMethod)
+	testErr(t, err)
+	if len(stats) != 1 || stats[0].Key != req.Method || stats[0].Count != 1 {
+		t.Errorf("unexpected stats after encrypting: %v", stats)
+	}
+}
+
+func TestStatsWithoutMetadata(t *testing.T) {
+	storage := testStorage()
+	defer storage.Close()
+
+	req1 := testReq()
+	testErr(t, SaveNewRequest(storage, req1))
+	req2 := testReq()
+	testErr(t, SaveNewRequest(storage, req2))
+
+	// Simulate a request saved before the metadata columns were added
+	_, err := storage.dbConn.Exec("UPDATE requests SET method=NULL, path=NULL, body_size=NULL WHERE id=?;", req2.DbId)
+	testErr(t, err)
+	_, err = storage.dbConn.Exec("UPDATE responses SET status_code=NULL, body_size=NULL WHERE id=?;", req2.ServerResponse.DbId)
+	testErr(t, err)
+
+	queries := []MessageQuery{
+		nil,
+		{{{FieldMethod, StrIs, "POST"}}},
+		{{{FieldRequestBody, StrContains, "foo"}}},
+	}
+	for _, query := range queries {
+		stats, err := storage.RequestStats(query, GroupStatusCode)
+		testErr(t, err)
+		expected := RequestStats{Key: "200", Count: 2, Responses: 2, RequestBytes: 14, ResponseBytes: 8}
+		if len(stats) != 1 || *stats[0] != expected {
+			t.Errorf("expected %+v, got %v", expected, stats)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package puppy
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/*
+Request statistics
+
+Storages can summarize the requests matching a query, optionally grouped by a field of the
+requests. Requests that are only stored as the unmangled version of another request are not
+counted since they were never sent.
+*/
+
+// A field that request statistics can be grouped by
+type StatsGroup int
+
+// Fields that request statistics can be grouped by
+const (
+	// All matching requests are counted in a single group with a blank key
+	GroupNone StatsGroup = iota
+	// Group by the host the request was sent to
+	GroupHost
+	// Group by the request method
+	GroupMethod
+	// Group by the path of the request URL
+	GroupPath
+	// Group by the status code of the response. Requests without a response have a blank key
+	GroupStatusCode
+	// Group by the method, host and path of the request in the form "GET example.com/path"
+	GroupEndpoint
+)
+
+// Aggregated statistics for a group of requests
+type RequestStats struct {
+	// The value of the grouped field shared by the requests in the group
+	Key string
+	// The number of requests in the group
+	Count int64
+	// The number of requests in the group that received a response
+	Responses int64
+	// The number of requests in the group that finished and have a duration
+	Timed int64
+	// The total duration of the requests that finished
+	TotalDuration time.Duration
+	// The total size of the request bodies in bytes
+	RequestBytes int64
+	// The total size of the response bodies in bytes
+	ResponseBytes int64
+}
+
+// Returns the average duration of the requests in the group that finished
+func (s *RequestStats) AverageDuration() time.Duration {
+	if s.Timed == 0 {
+		return 0
+	}
+	return s.TotalDuration / time.Duration(s.Timed)
+}
+
+func (s *RequestStats) merge(other *RequestStats) {
+	s.Count += other.Count
+	s.Responses += other.Responses
+	s.Timed += other.Timed
+	s.TotalDuration += other.TotalDuration
+	s.RequestBytes += other.RequestBytes
+	s.ResponseBytes += other.ResponseBytes
+}
+
+func statsGroupGoToStr(group StatsGroup) (string, error) {
+	switch group {
+	case GroupNone:
+		return "", nil
+	case GroupHost:
+		return "host", nil
+	case GroupMethod:
+		return "method", nil
+	case GroupPath:
+		return "path", nil
+	case GroupStatusCode:
+		return "statuscode", nil
+	case GroupEndpoint:
+		return "endpoint", nil
+	default:
+		return "", fmt.Errorf("invalid stats group: %d", group)
+	}
+}
+
+func statsGroupStrToGo(group string) (StatsGroup, error) {
+	switch group {
+	case "", "none":
+		return GroupNone, nil
+	case "host":
+		return GroupHost, nil
+	case "method":
+		return GroupMethod, nil
+	case "path":
+		return GroupPath, nil
+	case "statuscode", "status", "sc":
+		return GroupStatusCode, nil
+	case "endpoint":
+		return GroupEndpoint, nil
+	default:
+		return 0, fmt.Errorf("invalid stats group: %s", group)
+	}
+}
+
+// Returns the key of the group that a request belongs to
+func statsKey(req *ProxyRequest, group StatsGroup) string {
+	switch group {
+	case GroupHost:
+		return req.DestHost
+	case GroupMethod:
+		return req.Method
+	case GroupPath:
+		return req.URL.Path
+	case GroupStatusCode:
+		if req.ServerResponse == nil {
+			return ""
+		}
+		return strconv.Itoa(req.ServerResponse.StatusCode)
+	case GroupEndpoint:
+		return req.Method + " " + req.DestHost + req.URL.Path
+	default:
+		return ""
+	}
+}
+
+// Collects statistics for requests as they are added
+type statsAggregator struct {
+	group  StatsGroup
+	groups map[string]*RequestStats
+}
+
+func newStatsAggregator(group StatsGroup) (*statsAggregator, error) {
+	if _, err := statsGroupGoToStr(group); err != nil {
+		return nil, err
+	}
+	return &statsAggregator{group: group, groups: make(map[string]*RequestStats)}, nil
+}
+
+func (a *statsAggregator) stats(key string) *RequestStats {
+	stats, ok := a.groups[key]
+	if !ok {
+		stats = &RequestStats{Key: key}
+		a.groups[key] = stats
+	}
+	return stats
+}
+
+func (a *statsAggregator) add(req *ProxyRequest) {
+	stats := a.stats(statsKey(req, a.group))
+	stats.Count++
+	stats.RequestBytes += int64(len(req.BodyBytes()))
+	if req.ServerResponse != nil {
+		stats.Responses++
+		stats.ResponseBytes += int64(len(req.ServerResponse.BodyBytes()))
+	}
+	if req.EndDatetime.After(req.StartDatetime) {
+		stats.Timed++
+		stats.TotalDuration += req.EndDatetime.Sub(req.StartDatetime)
+	}
+}
+
+// Adds stats that were aggregated elsewhere
+func (a *statsAggregator) addStats(other *RequestStats) {
+	a.stats(other.Key).merge(other)
+}
+
+// Returns the groups sorted with the largest groups first
+func (a *statsAggregator) results() []*RequestStats {
+	results := make([]*RequestStats, 0, len(a.groups))
+	for _, stats := range a.groups {
+		results = append(results, stats)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Count != results[j].Count {
+			return results[i].Count > results[j].Count
+		}
+		return results[i].Key < results[j].Key
+	})
+	return results
+}
+
+// Computes statistics by checking every request in the storage. Used by storages that keep their requests in memory.
+func checkRequestStats(ms MessageStorage, query MessageQuery, group StatsGroup) ([]*RequestStats, error) {
+	checker, err := StorageCheckerFromMessageQuery(ms, query)
+	if err != nil {
+		return nil, err
+	}
+	agg, err := newStatsAggregator(group)
+	if err != nil {
+		return nil, err
+	}
+
+	reqs, err := ms.CheckRequests(0, func(req *ProxyRequest) bool { return true })
+	if err != nil {
+		return nil, err
+	}
+	unmangled := make(map[string]bool)
+	for _, req := range reqs {
+		if req.Unmangled != nil {
+			unmangled[req.Unmangled.DbId] = true
+		}
+	}
+
+	for _, req := range reqs {
+		if !unmangled[req.DbId] && checker(req) {
+			agg.add(req)
+		}
+	}
+	return agg.results(), nil
+}
@@ -53,12 +53,23 @@ type MessageStorage interface {
 	// A function to naively check every function in storage with the given function and return the ones that match
 	CheckRequests(limit int64, checker RequestChecker) ([]*ProxyRequest, error)
 
+	// Compute statistics for the requests matching a query, grouped by a field of the requests. Results are sorted with the largest groups first
+	RequestStats(query MessageQuery, group StatsGroup) ([]*RequestStats, error)
+
 	// Return a list of all the queries stored in the MessageStorage
 	AllSavedQueries() ([]*SavedQuery, error)
     // Save a query in the storage with a given name. If the name is already in storage, it should be overwritten
 	SaveQuery(name string, query MessageQuery) error
-    // Load a query by name from the storage
+    // Load a query by name from the storage. Returns an error if the query was saved as an expression that is too complex to be converted into a MessageQuery
 	LoadQuery(name string) (MessageQuery, error)
+	// Save a query expression in the storage with a given name. If the name is already in storage, it should be overwritten
+	SaveQueryExpr(name string, expr *QueryExpr) error
+	// Load a query by name from the storage as an expression. Queries saved with SaveQuery are returned as an AND of ORs
+	LoadQueryExpr(name string) (*QueryExpr, error)
+	// Save a query along with its description and folder. The query is saved from Expr, or from Query if Expr is nil. If the name is already in storage, it should be overwritten
+	SaveSavedQuery(sq *SavedQuery) error
+	// Load a query by name from the storage along with its description and folder
+	LoadSavedQuery(name string) (*SavedQuery, error)
     // Delete a query by name from the storage
 	DeleteQuery(name string) error
 
@@ -95,13 +106,26 @@ type StorageWatcher interface {
 	WSMessageDeleted(ms MessageStorage, DbId string)
 }
 
+// An optional interface for StorageWatchers that also want callbacks when saved queries change
+type QueryWatcher interface {
+	// Callback for when a query is saved
+	QuerySaved(ms MessageStorage, name string)
+	// Callback for when a query is deleted
+	QueryDeleted(ms MessageStorage, name string)
+}
+
 // An error to be returned if a query is not supported
 const QueryNotSupported = ConstErr("custom query not supported")
 
-// A type representing a search query that is stored in a MessageStorage
+// A type representing a search query that is stored in a MessageStorage. Query is nil if the query was saved as an expression that is too complex to be converted into a MessageQuery
 type SavedQuery struct {
 	Name  string
 	Query MessageQuery
+	Expr  *QueryExpr
+	// A description of what the query is for
+	Description string
+	// The folder the query is listed under. Folders are separated with slashes, such as "api/admin". A blank folder is the top level
+	Folder string
 }
 
 /*
@@ -237,3 +261,72 @@ func UpdateWSMessage(ms MessageStorage, req *ProxyRequest, wsm *ProxyWSMessage)
 		return ms.UpdateWSMessage(req, wsm)
 	}
 }
+
+// CopyProgressFunc is called after each request is copied by CopyRequests with the number of requests copied so far and the total number of requests that will be copied
+type CopyProgressFunc func(copied int, total int)
+
+// Returns a deep clone of a request with its tags and timestamps but with all of the DbIds cleared so that it can be saved as a new request
+func cloneForNewStorage(req *ProxyRequest) *ProxyRequest {
+	newReq := req.Clone()
+	newReq.StartDatetime = req.StartDatetime
+	newReq.EndDatetime = req.EndDatetime
+	newReq.Note = req.Note
+	newReq.Highlight = req.Highlight
+	newReq.Reviewed = req.Reviewed
+	newReq.Timings = req.Timings
+	for _, tag := range req.Tags() {
+		newReq.AddTag(tag)
+	}
+
+	if req.Unmangled != nil {
+		newReq.Unmangled = cloneForNewStorage(req.Unmangled)
+	}
+
+	if req.ServerResponse != nil {
+		newReq.ServerResponse = req.ServerResponse.DeepClone()
+		for rsp := newReq.ServerResponse; rsp != nil; rsp = rsp.Unmangled {
+			rsp.DbId = ""
+		}
+	}
+
+	for _, wsm := range req.WSMessages {
+		newWsm := wsm.DeepClone()
+		for m := newWsm; m != nil; m = m.Unmangled {
+			m.DbId = ""
+		}
+		newReq.WSMessages = append(newReq.WSMessages, newWsm)
+	}
+
+	return newReq
+}
+
+// CopyRequests copies every request in src that matches the query into dest along with its response, unmangled versions, websocket messages, tags and annotations. If query is nil, every request is copied. Returns a map of the DbIds of the original requests to the DbIds of the copies in dest. If progress is not nil, it will be called after each request is copied.
+func CopyRequests(src MessageStorage, query MessageQuery, dest MessageStorage, progress CopyProgressFunc) (map[string]string, error) {
+	if src == dest {
+		return nil, errors.New("source and destination storage must be different")
+	}
+
+	checker, err := StorageCheckerFromMessageQuery(src, query)
+	if err != nil {
+		return nil, fmt.Errorf("error with query: %s", err.Error())
+	}
+
+	reqs, err := src.CheckRequests(0, checker)
+	if err != nil {
+		return nil, fmt.Errorf("error loading requests from source storage: %s", err.Error())
+	}
+
+	idMap := make(map[string]string)
+	for i, req := range reqs {
+		newReq := cloneForNewStorage(req)
+		if err := SaveNewRequest(dest, newReq); err != nil {
+			return idMap, fmt.Errorf("error copying request %s: %s", req.DbId, err.Error())
+		}
+		idMap[req.DbId] = newReq.DbId
+
+		if progress != nil {
+			progress(i+1, len(reqs))
+		}
+	}
+	return idMap, nil
+}
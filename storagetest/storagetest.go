@@ -0,0 +1,1065 @@
+// Package storagetest provides a conformance test suite for implementations of puppy.MessageStorage.
+//
+// To test an implementation, call Run from a test with a function which returns a new, empty instance of the storage:
+//
+//	func TestMyStorage(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T) puppy.MessageStorage {
+//			return NewMyStorage()
+//		})
+//	}
+package storagetest
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"puppy"
+)
+
+// Factory returns a new, empty storage to run a test against. The storage is closed at the end of the test.
+type Factory func(t *testing.T) puppy.MessageStorage
+
+type conformanceTest struct {
+	name string
+	f    func(t *testing.T, ms puppy.MessageStorage)
+}
+
+var conformanceTests = []conformanceTest{
+	{"RequestRoundTrip", testRequestRoundTrip},
+	{"ResponseRoundTrip", testResponseRoundTrip},
+	{"WSMessageRoundTrip", testWSMessageRoundTrip},
+	{"UpdateRequest", testUpdateRequest},
+	{"UnmangledChains", testUnmangledChains},
+	{"TagPersistence", testTagPersistence},
+	{"AnnotationPersistence", testAnnotationPersistence},
+	{"DeleteRequestCascade", testDeleteRequestCascade},
+	{"DeleteResponseCascade", testDeleteResponseCascade},
+	{"DeleteWSMessageCascade", testDeleteWSMessageCascade},
+	{"RequestKeys", testRequestKeys},
+	{"Search", testSearch},
+	{"ModifiedSearch", testModifiedSearch},
+	{"RequestStats", testRequestStats},
+	{"Watchers", testWatchers},
+	{"SavedQueries", testSavedQueries},
+	{"SavedQueryExprs", testSavedQueryExprs},
+	{"SavedQueryInfo", testSavedQueryInfo},
+	{"SavedQueryReferences", testSavedQueryReferences},
+	{"PluginValues", testPluginValues},
+}
+
+// Run runs every conformance test as a subtest of t. Each subtest gets a new storage from newStorage.
+func Run(t *testing.T, newStorage Factory) {
+	for _, ct := range conformanceTests {
+		f := ct.f
+		t.Run(ct.name, func(t *testing.T) {
+			ms := newStorage(t)
+			defer ms.Close()
+			f(t, ms)
+		})
+	}
+}
+
+/*
+Helpers
+*/
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newRequest(t *testing.T, body string, start time.Time) *puppy.ProxyRequest {
+	t.Helper()
+	msg := fmt.Sprintf("POST /path?foo=bar HTTP/1.1\r\nHost: example.com\r\nFoo: Bar\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+	req, err := puppy.ProxyRequestFromBytes([]byte(msg), "example.com", 443, true)
+	check(t, err)
+	req.StartDatetime = start
+	req.EndDatetime = start.Add(time.Second)
+	return req
+}
+
+func newResponse(t *testing.T, body string) *puppy.ProxyResponse {
+	t.Helper()
+	msg := fmt.Sprintf("HTTP/1.1 200 OK\r\nSet-Cookie: foo=bar\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+	rsp, err := puppy.ProxyResponseFromBytes([]byte(msg))
+	check(t, err)
+	return rsp
+}
+
+func newWSMessage(t *testing.T, msg string, direction int, ts time.Time) *puppy.ProxyWSMessage {
+	t.Helper()
+	wsm, err := puppy.NewProxyWSMessage(websocket.TextMessage, []byte(msg), direction)
+	check(t, err)
+	wsm.Timestamp = ts
+	return wsm
+}
+
+func sortedTags(req *puppy.ProxyRequest) []string {
+	tags := req.Tags()
+	sort.Strings(tags)
+	return tags
+}
+
+func checkRequest(t *testing.T, got *puppy.ProxyRequest, want *puppy.ProxyRequest) {
+	t.Helper()
+	if got.DbId != want.DbId {
+		t.Errorf("incorrect DbId: got %s, want %s", got.DbId, want.DbId)
+	}
+	if !bytes.Equal(got.FullMessage(), want.FullMessage()) {
+		t.Errorf("request message does not match:\ngot  %q\nwant %q", got.FullMessage(), want.FullMessage())
+	}
+	if got.DestHost != want.DestHost || got.DestPort != want.DestPort || got.DestUseTLS != want.DestUseTLS {
+		t.Errorf("incorrect destination: got %s:%d (tls=%t), want %s:%d (tls=%t)",
+			got.DestHost, got.DestPort, got.DestUseTLS, want.DestHost, want.DestPort, want.DestUseTLS)
+	}
+	if got.StartDatetime.UnixNano() != want.StartDatetime.UnixNano() || got.EndDatetime.UnixNano() != want.EndDatetime.UnixNano() {
+		t.Errorf("incorrect times: got %s-%s, want %s-%s", got.StartDatetime, got.EndDatetime, want.StartDatetime, want.EndDatetime)
+	}
+	if !reflect.DeepEqual(sortedTags(got), sortedTags(want)) {
+		t.Errorf("incorrect tags: got %v, want %v", sortedTags(got), sortedTags(want))
+	}
+}
+
+func checkResponse(t *testing.T, got *puppy.ProxyResponse, want *puppy.ProxyResponse) {
+	t.Helper()
+	if got == nil {
+		t.Errorf("missing response")
+		return
+	}
+	if got.DbId != want.DbId {
+		t.Errorf("incorrect response DbId: got %s, want %s", got.DbId, want.DbId)
+	}
+	if !bytes.Equal(got.FullMessage(), want.FullMessage()) {
+		t.Errorf("response message does not match:\ngot  %q\nwant %q", got.FullMessage(), want.FullMessage())
+	}
+}
+
+func checkWSMessage(t *testing.T, got *puppy.ProxyWSMessage, want *puppy.ProxyWSMessage) {
+	t.Helper()
+	if got.DbId != want.DbId {
+		t.Errorf("incorrect websocket message DbId: got %s, want %s", got.DbId, want.DbId)
+	}
+	if !bytes.Equal(got.Message, want.Message) || got.Type != want.Type || got.Direction != want.Direction {
+		t.Errorf("websocket message does not match: got %q, want %q", got.Message, want.Message)
+	}
+	if got.Timestamp.UnixNano() != want.Timestamp.UnixNano() {
+		t.Errorf("incorrect websocket message timestamp: got %s, want %s", got.Timestamp, want.Timestamp)
+	}
+}
+
+/*
+Round trips
+*/
+
+func testRequestRoundTrip(t *testing.T, ms puppy.MessageStorage) {
+	req := newRequest(t, "foo=bar", time.Unix(0, 1500000000123456789))
+	req.ServerResponse = newResponse(t, "hello world")
+	req.Timings = puppy.RequestTimings{
+		DNS:             time.Millisecond,
+		Connect:         2 * time.Millisecond,
+		TLSHandshake:    3 * time.Millisecond,
+		TimeToFirstByte: 4 * time.Millisecond,
+		Transfer:        5 * time.Millisecond,
+	}
+	check(t, puppy.SaveNewRequest(ms, req))
+	if req.DbId == "" || req.ServerResponse.DbId == "" {
+		t.Fatalf("DbIds were not set after saving")
+	}
+
+	got, err := ms.LoadRequest(req.DbId)
+	check(t, err)
+	checkRequest(t, got, req)
+	if got.Timings != req.Timings {
+		t.Errorf("incorrect timings: got %+v, want %+v", got.Timings, req.Timings)
+	}
+	checkResponse(t, got.ServerResponse, req.ServerResponse)
+	if got.Unmangled != nil {
+		t.Errorf("loaded request has an unmangled version")
+	}
+
+	// Saving the same request again creates a new copy
+	oldId := req.DbId
+	check(t, puppy.SaveNewRequest(ms, req))
+	if req.DbId == oldId {
+		t.Errorf("saving a new request reused DbId %s", oldId)
+	}
+
+	if _, err := ms.LoadRequest("999999"); err == nil {
+		t.Errorf("loading a request that does not exist did not return an error")
+	}
+}
+
+func testResponseRoundTrip(t *testing.T, ms puppy.MessageStorage) {
+	rsp := newResponse(t, "hello world")
+	check(t, puppy.SaveNewResponse(ms, rsp))
+
+	got, err := ms.LoadResponse(rsp.DbId)
+	check(t, err)
+	checkResponse(t, got, rsp)
+
+	rsp.SetBodyBytes([]byte("goodbye"))
+	check(t, ms.UpdateResponse(rsp))
+	got, err = ms.LoadResponse(rsp.DbId)
+	check(t, err)
+	checkResponse(t, got, rsp)
+
+	if _, err := ms.LoadResponse("999999"); err == nil {
+		t.Errorf("loading a response that does not exist did not return an error")
+	}
+}
+
+func testWSMessageRoundTrip(t *testing.T, ms puppy.MessageStorage) {
+	start := time.Unix(0, 1500000000000000000)
+	req := newRequest(t, "", start)
+	wsm1 := newWSMessage(t, "first", puppy.ToServer, start.Add(time.Second))
+	wsm2 := newWSMessage(t, "second", puppy.ToClient, start.Add(2*time.Second))
+	req.WSMessages = []*puppy.ProxyWSMessage{wsm2, wsm1}
+	check(t, puppy.SaveNewRequest(ms, req))
+
+	got, err := ms.LoadWSMessage(wsm1.DbId)
+	check(t, err)
+	checkWSMessage(t, got, wsm1)
+
+	gotReq, err := ms.LoadRequest(req.DbId)
+	check(t, err)
+	if len(gotReq.WSMessages) != 2 {
+		t.Fatalf("expected 2 websocket messages, got %d", len(gotReq.WSMessages))
+	}
+	// Messages are loaded in the order they were sent
+	checkWSMessage(t, gotReq.WSMessages[0], wsm1)
+	checkWSMessage(t, gotReq.WSMessages[1], wsm2)
+
+	wsm1.Message = []byte("updated")
+	check(t, ms.UpdateWSMessage(req, wsm1))
+	got, err = ms.LoadWSMessage(wsm1.DbId)
+	check(t, err)
+	checkWSMessage(t, got, wsm1)
+
+	if _, err := ms.LoadWSMessage("999999"); err == nil {
+		t.Errorf("loading a websocket message that does not exist did not return an error")
+	}
+}
+
+func testUpdateRequest(t *testing.T, ms puppy.MessageStorage) {
+	req := newRequest(t, "foo=bar", time.Unix(0, 1500000000000000000))
+	check(t, puppy.SaveNewRequest(ms, req))
+	reqid := req.DbId
+
+	req.SetBodyBytes([]byte("bar=baz"))
+	req.ServerResponse = newResponse(t, "new response")
+	check(t, puppy.UpdateRequest(ms, req))
+	if req.DbId != reqid {
+		t.Errorf("updating a request changed its DbId from %s to %s", reqid, req.DbId)
+	}
+
+	got, err := ms.LoadRequest(reqid)
+	check(t, err)
+	checkRequest(t, got, req)
+	checkResponse(t, got.ServerResponse, req.ServerResponse)
+
+	unsaved := newRequest(t, "", time.Now())
+	if err := ms.UpdateRequest(unsaved); err == nil {
+		t.Errorf("updating a request that was never saved did not return an error")
+	}
+}
+
+func testUnmangledChains(t *testing.T, ms puppy.MessageStorage) {
+	start := time.Unix(0, 1500000000000000000)
+
+	req := newRequest(t, "mangled", start)
+	req.Unmangled = newRequest(t, "unmangled", start)
+	req.ServerResponse = newResponse(t, "mangled")
+	req.ServerResponse.Unmangled = newResponse(t, "unmangled")
+	req.ServerResponse.Unmangled.Unmangled = newResponse(t, "original")
+	wsm := newWSMessage(t, "mangled", puppy.ToServer, start)
+	wsm.Unmangled = newWSMessage(t, "unmangled", puppy.ToServer, start)
+	req.WSMessages = []*puppy.ProxyWSMessage{wsm}
+	check(t, puppy.SaveNewRequest(ms, req))
+
+	got, err := ms.LoadRequest(req.DbId)
+	check(t, err)
+	if got.Unmangled == nil {
+		t.Fatalf("unmangled request was not loaded")
+	}
+	checkRequest(t, got.Unmangled, req.Unmangled)
+
+	rsp := got.ServerResponse
+	if rsp == nil || rsp.Unmangled == nil || rsp.Unmangled.Unmangled == nil {
+		t.Fatalf("unmangled response chain was not loaded")
+	}
+	checkResponse(t, rsp.Unmangled, req.ServerResponse.Unmangled)
+	checkResponse(t, rsp.Unmangled.Unmangled, req.ServerResponse.Unmangled.Unmangled)
+
+	if len(got.WSMessages) != 1 || got.WSMessages[0].Unmangled == nil {
+		t.Fatalf("unmangled websocket message was not loaded")
+	}
+	checkWSMessage(t, got.WSMessages[0].Unmangled, wsm.Unmangled)
+
+	unmangledReq, err := ms.LoadUnmangledRequest(req.DbId)
+	check(t, err)
+	checkRequest(t, unmangledReq, req.Unmangled)
+
+	unmangledRsp, err := ms.LoadUnmangledResponse(req.ServerResponse.DbId)
+	check(t, err)
+	checkResponse(t, unmangledRsp, req.ServerResponse.Unmangled)
+
+	unmangledWSM, err := ms.LoadUnmangledWSMessage(wsm.DbId)
+	check(t, err)
+	checkWSMessage(t, unmangledWSM, wsm.Unmangled)
+
+	if _, err := ms.LoadUnmangledRequest(req.Unmangled.DbId); err == nil {
+		t.Errorf("loading the unmangled version of a request without one did not return an error")
+	}
+	if _, err := ms.LoadUnmangledResponse(req.ServerResponse.Unmangled.Unmangled.DbId); err == nil {
+		t.Errorf("loading the unmangled version of a response without one did not return an error")
+	}
+	if _, err := ms.LoadUnmangledWSMessage(wsm.Unmangled.DbId); err == nil {
+		t.Errorf("loading the unmangled version of a websocket message without one did not return an error")
+	}
+}
+
+func testTagPersistence(t *testing.T, ms puppy.MessageStorage) {
+	req := newRequest(t, "", time.Unix(0, 1500000000000000000))
+	req.AddTag("foo")
+	req.AddTag("bar")
+	check(t, puppy.SaveNewRequest(ms, req))
+
+	got, err := ms.LoadRequest(req.DbId)
+	check(t, err)
+	checkRequest(t, got, req)
+
+	req.RemoveTag("foo")
+	req.AddTag("baz")
+	check(t, ms.UpdateRequest(req))
+	got, err = ms.LoadRequest(req.DbId)
+	check(t, err)
+	if !reflect.DeepEqual(sortedTags(got), []string{"bar", "baz"}) {
+		t.Errorf("incorrect tags after update: %v", sortedTags(got))
+	}
+
+	// Tags on one request don't affect other requests
+	other := newRequest(t, "", time.Unix(0, 1500000000000000000))
+	other.AddTag("bar")
+	check(t, puppy.SaveNewRequest(ms, other))
+	check(t, ms.DeleteRequest(other.DbId))
+	got, err = ms.LoadRequest(req.DbId)
+	check(t, err)
+	if !reflect.DeepEqual(sortedTags(got), []string{"bar", "baz"}) {
+		t.Errorf("deleting another request changed tags: %v", sortedTags(got))
+	}
+}
+
+func testAnnotationPersistence(t *testing.T, ms puppy.MessageStorage) {
+	req := newRequest(t, "", time.Unix(0, 1500000000000000000))
+	req.Note = "possible sqli in foo\nneeds a second look"
+	req.Highlight = "#ff0000"
+	req.Reviewed = true
+	check(t, puppy.SaveNewRequest(ms, req))
+
+	got, err := ms.LoadRequest(req.DbId)
+	check(t, err)
+	if got.Note != req.Note || got.Highlight != req.Highlight || got.Reviewed != req.Reviewed {
+		t.Errorf("incorrect annotations after save: %q %q %v", got.Note, got.Highlight, got.Reviewed)
+	}
+
+	req.Note = ""
+	req.Highlight = "green"
+	req.Reviewed = false
+	check(t, ms.UpdateRequest(req))
+	got, err = ms.LoadRequest(req.DbId)
+	check(t, err)
+	if got.Note != "" || got.Highlight != "green" || got.Reviewed {
+		t.Errorf("incorrect annotations after update: %q %q %v", got.Note, got.Highlight, got.Reviewed)
+	}
+
+	results, err := ms.Search(0, puppy.FieldHighlight, puppy.StrIs, "green")
+	check(t, err)
+	if len(results) != 1 || results[0].DbId != req.DbId {
+		t.Errorf("searching by highlight returned %d results", len(results))
+	}
+}
+
+/*
+Deletion
+*/
+
+func testDeleteRequestCascade(t *testing.T, ms puppy.MessageStorage) {
+	start := time.Unix(0, 1500000000000000000)
+	req := newRequest(t, "mangled", start)
+	req.Unmangled = newRequest(t, "unmangled", start)
+	req.ServerResponse = newResponse(t, "mangled")
+	req.ServerResponse.Unmangled = newResponse(t, "unmangled")
+	wsm := newWSMessage(t, "message", puppy.ToServer, start)
+	req.WSMessages = []*puppy.ProxyWSMessage{wsm}
+	check(t, puppy.SaveNewRequest(ms, req))
+
+	keep := newRequest(t, "keep", start)
+	check(t, puppy.SaveNewRequest(ms, keep))
+
+	check(t, ms.DeleteRequest(req.DbId))
+
+	if _, err := ms.LoadRequest(req.DbId); err == nil {
+		t.Errorf("request was not deleted")
+	}
+	if _, err := ms.LoadRequest(req.Unmangled.DbId); err == nil {
+		t.Errorf("unmangled request was not deleted")
+	}
+	if _, err := ms.LoadResponse(req.ServerResponse.DbId); err == nil {
+		t.Errorf("response was not deleted")
+	}
+	if _, err := ms.LoadResponse(req.ServerResponse.Unmangled.DbId); err == nil {
+		t.Errorf("unmangled response was not deleted")
+	}
+	if _, err := ms.LoadWSMessage(wsm.DbId); err == nil {
+		t.Errorf("websocket message was not deleted")
+	}
+
+	keys, err := ms.RequestKeys()
+	check(t, err)
+	if !reflect.DeepEqual(keys, []string{keep.DbId}) {
+		t.Errorf("incorrect keys after delete: %v", keys)
+	}
+
+	// Deleting a request that doesn't exist is not an error
+	check(t, ms.DeleteRequest(req.DbId))
+}
+
+func testDeleteResponseCascade(t *testing.T, ms puppy.MessageStorage) {
+	rsp := newResponse(t, "mangled")
+	rsp.Unmangled = newResponse(t, "unmangled")
+	check(t, puppy.SaveNewResponse(ms, rsp))
+
+	check(t, ms.DeleteResponse(rsp.DbId))
+	if _, err := ms.LoadResponse(rsp.DbId); err == nil {
+		t.Errorf("response was not deleted")
+	}
+	if _, err := ms.LoadResponse(rsp.Unmangled.DbId); err == nil {
+		t.Errorf("unmangled response was not deleted")
+	}
+}
+
+func testDeleteWSMessageCascade(t *testing.T, ms puppy.MessageStorage) {
+	start := time.Unix(0, 1500000000000000000)
+	req := newRequest(t, "", start)
+	wsm := newWSMessage(t, "mangled", puppy.ToServer, start)
+	wsm.Unmangled = newWSMessage(t, "unmangled", puppy.ToServer, start)
+	other := newWSMessage(t, "other", puppy.ToClient, start.Add(time.Second))
+	req.WSMessages = []*puppy.ProxyWSMessage{wsm, other}
+	check(t, puppy.SaveNewRequest(ms, req))
+
+	check(t, ms.DeleteWSMessage(wsm.DbId))
+	if _, err := ms.LoadWSMessage(wsm.DbId); err == nil {
+		t.Errorf("websocket message was not deleted")
+	}
+	if _, err := ms.LoadWSMessage(wsm.Unmangled.DbId); err == nil {
+		t.Errorf("unmangled websocket message was not deleted")
+	}
+
+	got, err := ms.LoadRequest(req.DbId)
+	check(t, err)
+	if len(got.WSMessages) != 1 {
+		t.Fatalf("expected 1 websocket message, got %d", len(got.WSMessages))
+	}
+	checkWSMessage(t, got.WSMessages[0], other)
+}
+
+/*
+Searching
+*/
+
+func testRequestKeys(t *testing.T, ms puppy.MessageStorage) {
+	keys, err := ms.RequestKeys()
+	check(t, err)
+	if len(keys) != 0 {
+		t.Errorf("new storage has keys: %v", keys)
+	}
+
+	expected := make([]string, 0)
+	for i := 0; i < 3; i++ {
+		req := newRequest(t, "", time.Unix(0, 1500000000000000000))
+		check(t, puppy.SaveNewRequest(ms, req))
+		expected = append(expected, req.DbId)
+	}
+
+	keys, err = ms.RequestKeys()
+	check(t, err)
+	sort.Strings(keys)
+	sort.Strings(expected)
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("incorrect keys: got %v, want %v", keys, expected)
+	}
+}
+
+func testSearch(t *testing.T, ms puppy.MessageStorage) {
+	start := time.Unix(0, 1500000000000000000)
+	reqs := make([]*puppy.ProxyRequest, 0)
+	for i := 0; i < 4; i++ {
+		req := newRequest(t, fmt.Sprintf("body%d", i), start.Add(time.Duration(i)*time.Hour))
+		check(t, puppy.SaveNewRequest(ms, req))
+		reqs = append(reqs, req)
+	}
+
+	results, err := ms.Search(0, puppy.FieldId, puppy.StrIs, reqs[1].DbId)
+	check(t, err)
+	if len(results) != 1 || results[0].DbId != reqs[1].DbId {
+		t.Errorf("id search did not return request %s", reqs[1].DbId)
+	}
+
+	results, err = ms.Search(0, puppy.FieldRequestBody, puppy.StrContains, "body2")
+	check(t, err)
+	if len(results) != 1 || results[0].DbId != reqs[2].DbId {
+		t.Errorf("body search did not return request %s", reqs[2].DbId)
+	}
+
+	// Results are returned newest first and limited
+	results, err = ms.CheckRequests(2, func(req *puppy.ProxyRequest) bool { return true })
+	check(t, err)
+	if len(results) != 2 || results[0].DbId != reqs[3].DbId || results[1].DbId != reqs[2].DbId {
+		ids := make([]string, 0)
+		for _, req := range results {
+			ids = append(ids, req.DbId)
+		}
+		t.Errorf("expected the two newest requests [%s %s], got %v", reqs[3].DbId, reqs[2].DbId, ids)
+	}
+}
+
+func searchIds(t *testing.T, ms puppy.MessageStorage, args ...interface{}) map[string]bool {
+	t.Helper()
+	results, err := ms.Search(0, args...)
+	check(t, err)
+	ids := make(map[string]bool)
+	for _, req := range results {
+		ids[req.DbId] = true
+	}
+	return ids
+}
+
+func testModifiedSearch(t *testing.T, ms puppy.MessageStorage) {
+	start := time.Unix(0, 1500000000000000000)
+
+	plain := newRequest(t, "plain", start)
+	plain.ServerResponse = newResponse(t, "plain")
+	check(t, puppy.SaveNewRequest(ms, plain))
+
+	reqMod := newRequest(t, "mangled", start.Add(time.Hour))
+	reqMod.Unmangled = newRequest(t, "original", start.Add(time.Hour))
+	check(t, puppy.SaveNewRequest(ms, reqMod))
+
+	rspMod := newRequest(t, "plain", start.Add(2*time.Hour))
+	rspMod.ServerResponse = newResponse(t, "mangled")
+	rspMod.ServerResponse.Unmangled = newResponse(t, "original")
+	check(t, puppy.SaveNewRequest(ms, rspMod))
+
+	wsMod := newRequest(t, "plain", start.Add(3*time.Hour))
+	wsm := newWSMessage(t, "mangled", puppy.ToServer, start)
+	wsm.Unmangled = newWSMessage(t, "original", puppy.ToServer, start)
+	wsMod.WSMessages = []*puppy.ProxyWSMessage{wsm}
+	check(t, puppy.SaveNewRequest(ms, wsMod))
+
+	tests := []struct {
+		field    puppy.SearchField
+		expected *puppy.ProxyRequest
+	}{
+		{puppy.FieldRequestModified, reqMod},
+		{puppy.FieldResponseModified, rspMod},
+		{puppy.FieldWSModified, wsMod},
+	}
+	for _, test := range tests {
+		ids := searchIds(t, ms, test.field, puppy.StrIs, "true")
+		if len(ids) != 1 || !ids[test.expected.DbId] {
+			t.Errorf("search on field %d returned %v, expected only %s", test.field, ids, test.expected.DbId)
+		}
+		ids = searchIds(t, ms, test.field, puppy.StrIs, "false")
+		if ids[test.expected.DbId] || !ids[plain.DbId] {
+			t.Errorf("inverse search on field %d returned %v", test.field, ids)
+		}
+	}
+
+	ids := searchIds(t, ms, puppy.FieldModified, puppy.StrIs, "true")
+	if len(ids) != 3 || ids[plain.DbId] {
+		t.Errorf("modified search returned %v", ids)
+	}
+
+	// The unmangled request is also stored as a request of its own and matches too
+	ids = searchIds(t, ms, puppy.FieldUnmangled, puppy.FieldRequestBody, puppy.StrIs, "original")
+	if !ids[reqMod.DbId] || ids[plain.DbId] || ids[rspMod.DbId] {
+		t.Errorf("unmangled request search returned %v", ids)
+	}
+	ids = searchIds(t, ms, puppy.FieldUnmangled, puppy.FieldResponseBody, puppy.StrIs, "original")
+	if len(ids) != 1 || !ids[rspMod.DbId] {
+		t.Errorf("unmangled response search returned %v", ids)
+	}
+	ids = searchIds(t, ms, puppy.FieldUnmangled, puppy.FieldWSMessage, puppy.StrIs, "original")
+	if len(ids) != 1 || !ids[wsMod.DbId] {
+		t.Errorf("unmangled websocket search returned %v", ids)
+	}
+}
+
+func newStatsRequest(t *testing.T, method string, host string, path string, body string, status int, start time.Time, duration time.Duration) *puppy.ProxyRequest {
+	t.Helper()
+	msg := fmt.Sprintf("%s %s HTTP/1.1\r\nHost: %s\r\nContent-Length: %d\r\n\r\n%s", method, path, host, len(body), body)
+	req, err := puppy.ProxyRequestFromBytes([]byte(msg), host, 443, true)
+	check(t, err)
+	req.StartDatetime = start
+	req.EndDatetime = start.Add(duration)
+	if status != 0 {
+		rspMsg := fmt.Sprintf("HTTP/1.1 %d Status\r\nContent-Length: 4\r\n\r\nbody", status)
+		req.ServerResponse, err = puppy.ProxyResponseFromBytes([]byte(rspMsg))
+		check(t, err)
+	}
+	return req
+}
+
+func checkStats(t *testing.T, got []*puppy.RequestStats, want []puppy.RequestStats) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("expected %d groups, got %d", len(want), len(got))
+		return
+	}
+	for i := range want {
+		if *got[i] != want[i] {
+			t.Errorf("group %d: expected %+v, got %+v", i, want[i], *got[i])
+		}
+	}
+}
+
+func testRequestStats(t *testing.T, ms puppy.MessageStorage) {
+	start := time.Unix(0, 1500000000000000000)
+
+	reqs := []*puppy.ProxyRequest{
+		newStatsRequest(t, "GET", "a.com", "/", "", 200, start, time.Second),
+		newStatsRequest(t, "GET", "a.com", "/login", "", 302, start.Add(time.Hour), 3*time.Second),
+		newStatsRequest(t, "POST", "a.com", "/login", "user=admin", 200, start.Add(2*time.Hour), time.Second),
+		newStatsRequest(t, "GET", "b.com", "/", "", 0, start.Add(3*time.Hour), 0),
+	}
+	// Unmangled versions of requests are not counted
+	reqs[2].Unmangled = newStatsRequest(t, "POST", "a.com", "/login", "user=guest", 0, start.Add(2*time.Hour), 0)
+	for _, req := range reqs {
+		check(t, puppy.SaveNewRequest(ms, req))
+	}
+
+	stats, err := ms.RequestStats(nil, puppy.GroupNone)
+	check(t, err)
+	checkStats(t, stats, []puppy.RequestStats{
+		{Key: "", Count: 4, Responses: 3, Timed: 3, TotalDuration: 5 * time.Second, RequestBytes: 10, ResponseBytes: 12},
+	})
+	if stats[0].AverageDuration() != 5*time.Second/3 {
+		t.Errorf("unexpected average duration %s", stats[0].AverageDuration())
+	}
+
+	stats, err = ms.RequestStats(nil, puppy.GroupHost)
+	check(t, err)
+	checkStats(t, stats, []puppy.RequestStats{
+		{Key: "a.com", Count: 3, Responses: 3, Timed: 3, TotalDuration: 5 * time.Second, RequestBytes: 10, ResponseBytes: 12},
+		{Key: "b.com", Count: 1},
+	})
+
+	stats, err = ms.RequestStats(nil, puppy.GroupStatusCode)
+	check(t, err)
+	checkStats(t, stats, []puppy.RequestStats{
+		{Key: "200", Count: 2, Responses: 2, Timed: 2, TotalDuration: 2 * time.Second, RequestBytes: 10, ResponseBytes: 8},
+		{Key: "", Count: 1},
+		{Key: "302", Count: 1, Responses: 1, Timed: 1, TotalDuration: 3 * time.Second, ResponseBytes: 4},
+	})
+
+	query := puppy.MessageQuery{
+		puppy.QueryPhrase{{puppy.FieldPath, puppy.StrIs, "/login"}},
+	}
+	stats, err = ms.RequestStats(query, puppy.GroupEndpoint)
+	check(t, err)
+	checkStats(t, stats, []puppy.RequestStats{
+		{Key: "GET a.com/login", Count: 1, Responses: 1, Timed: 1, TotalDuration: 3 * time.Second, ResponseBytes: 4},
+		{Key: "POST a.com/login", Count: 1, Responses: 1, Timed: 1, TotalDuration: time.Second, RequestBytes: 10, ResponseBytes: 4},
+	})
+
+	// Searches on fields that are not stored in columns
+	query = puppy.MessageQuery{
+		puppy.QueryPhrase{{puppy.FieldAllBody, puppy.StrContains, "admin"}, {puppy.FieldInvert, puppy.FieldStatusCode, puppy.StrIs, "200"}},
+	}
+	stats, err = ms.RequestStats(query, puppy.GroupMethod)
+	check(t, err)
+	checkStats(t, stats, []puppy.RequestStats{
+		{Key: "GET", Count: 2, Responses: 1, Timed: 1, TotalDuration: 3 * time.Second, ResponseBytes: 4},
+		{Key: "POST", Count: 1, Responses: 1, Timed: 1, TotalDuration: time.Second, RequestBytes: 10, ResponseBytes: 4},
+	})
+
+	if _, err := ms.RequestStats(nil, puppy.StatsGroup(-1)); err == nil {
+		t.Errorf("invalid stats group did not return an error")
+	}
+}
+
+/*
+Watchers
+*/
+
+type recordingWatcher struct {
+	mtx    sync.Mutex
+	events []string
+}
+
+func (w *recordingWatcher) record(format string, args ...interface{}) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	w.events = append(w.events, fmt.Sprintf(format, args...))
+}
+
+func (w *recordingWatcher) take() []string {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	events := w.events
+	w.events = nil
+	return events
+}
+
+func (w *recordingWatcher) NewRequestSaved(ms puppy.MessageStorage, req *puppy.ProxyRequest) {
+	w.record("NewRequestSaved %s", req.DbId)
+}
+
+func (w *recordingWatcher) RequestUpdated(ms puppy.MessageStorage, req *puppy.ProxyRequest) {
+	w.record("RequestUpdated %s", req.DbId)
+}
+
+func (w *recordingWatcher) RequestDeleted(ms puppy.MessageStorage, DbId string) {
+	w.record("RequestDeleted %s", DbId)
+}
+
+func (w *recordingWatcher) NewResponseSaved(ms puppy.MessageStorage, rsp *puppy.ProxyResponse) {
+	w.record("NewResponseSaved %s", rsp.DbId)
+}
+
+func (w *recordingWatcher) ResponseUpdated(ms puppy.MessageStorage, rsp *puppy.ProxyResponse) {
+	w.record("ResponseUpdated %s", rsp.DbId)
+}
+
+func (w *recordingWatcher) ResponseDeleted(ms puppy.MessageStorage, DbId string) {
+	w.record("ResponseDeleted %s", DbId)
+}
+
+func (w *recordingWatcher) NewWSMessageSaved(ms puppy.MessageStorage, req *puppy.ProxyRequest, wsm *puppy.ProxyWSMessage) {
+	w.record("NewWSMessageSaved %s", wsm.DbId)
+}
+
+func (w *recordingWatcher) WSMessageUpdated(ms puppy.MessageStorage, req *puppy.ProxyRequest, wsm *puppy.ProxyWSMessage) {
+	w.record("WSMessageUpdated %s", wsm.DbId)
+}
+
+func (w *recordingWatcher) WSMessageDeleted(ms puppy.MessageStorage, DbId string) {
+	w.record("WSMessageDeleted %s", DbId)
+}
+
+func checkEvents(t *testing.T, w *recordingWatcher, expected ...string) {
+	t.Helper()
+	events := w.take()
+	if len(events) == 0 && len(expected) == 0 {
+		return
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("incorrect watcher callbacks:\ngot  %v\nwant %v", events, expected)
+	}
+}
+
+func testWatchers(t *testing.T, ms puppy.MessageStorage) {
+	w := &recordingWatcher{}
+	check(t, ms.Watch(w))
+
+	start := time.Unix(0, 1500000000000000000)
+	req := newRequest(t, "", start)
+	req.ServerResponse = newResponse(t, "")
+	check(t, puppy.SaveNewRequest(ms, req))
+	checkEvents(t, w,
+		"NewResponseSaved "+req.ServerResponse.DbId,
+		"NewRequestSaved "+req.DbId,
+	)
+
+	check(t, ms.UpdateRequest(req))
+	checkEvents(t, w, "RequestUpdated "+req.DbId)
+
+	check(t, ms.UpdateResponse(req.ServerResponse))
+	checkEvents(t, w, "ResponseUpdated "+req.ServerResponse.DbId)
+
+	wsm := newWSMessage(t, "message", puppy.ToServer, start)
+	check(t, ms.SaveNewWSMessage(req, wsm))
+	checkEvents(t, w, "NewWSMessageSaved "+wsm.DbId)
+
+	check(t, ms.UpdateWSMessage(req, wsm))
+	checkEvents(t, w, "WSMessageUpdated "+wsm.DbId)
+
+	check(t, ms.DeleteWSMessage(wsm.DbId))
+	checkEvents(t, w, "WSMessageDeleted "+wsm.DbId)
+
+	rsp := newResponse(t, "")
+	check(t, ms.SaveNewResponse(rsp))
+	checkEvents(t, w, "NewResponseSaved "+rsp.DbId)
+	check(t, ms.DeleteResponse(rsp.DbId))
+	checkEvents(t, w, "ResponseDeleted "+rsp.DbId)
+
+	check(t, ms.DeleteRequest(req.DbId))
+	checkEvents(t, w, "RequestDeleted "+req.DbId)
+
+	check(t, ms.EndWatch(w))
+	check(t, puppy.SaveNewRequest(ms, newRequest(t, "", start)))
+	checkEvents(t, w)
+}
+
+/*
+Saved queries and plugin values
+*/
+
+func testSavedQueries(t *testing.T, ms puppy.MessageStorage) {
+	strQuery := puppy.StrMessageQuery{
+		puppy.StrQueryPhrase{
+			[]string{"host", "is", "example.com"},
+			[]string{"path", "contains", "foo"},
+		},
+		puppy.StrQueryPhrase{
+			[]string{"method", "is", "POST"},
+		},
+	}
+	query, err := puppy.StrQueryToMsgQuery(strQuery)
+	check(t, err)
+
+	check(t, ms.SaveQuery("foo", query))
+	got, err := ms.LoadQuery("foo")
+	check(t, err)
+	gotStr, err := puppy.MsgQueryToStrQuery(got)
+	check(t, err)
+	if !reflect.DeepEqual(gotStr, strQuery) {
+		t.Errorf("incorrect query: got %v, want %v", gotStr, strQuery)
+	}
+
+	// Saving with the same name overwrites the query
+	newStrQuery := puppy.StrMessageQuery{puppy.StrQueryPhrase{[]string{"method", "is", "GET"}}}
+	newQuery, err := puppy.StrQueryToMsgQuery(newStrQuery)
+	check(t, err)
+	check(t, ms.SaveQuery("foo", newQuery))
+	check(t, ms.SaveQuery("bar", query))
+
+	// Storages may include their own saved queries so only look at the ones saved by the test
+	all, err := ms.AllSavedQueries()
+	check(t, err)
+	names := make([]string, 0)
+	for _, q := range all {
+		if q.Name != "foo" && q.Name != "bar" {
+			continue
+		}
+		names = append(names, q.Name)
+		if q.Name == "foo" {
+			qStr, err := puppy.MsgQueryToStrQuery(q.Query)
+			check(t, err)
+			if !reflect.DeepEqual(qStr, newStrQuery) {
+				t.Errorf("query was not overwritten: got %v, want %v", qStr, newStrQuery)
+			}
+		}
+	}
+	sort.Strings(names)
+	if !reflect.DeepEqual(names, []string{"bar", "foo"}) {
+		t.Errorf("incorrect saved queries: %v", names)
+	}
+
+	check(t, ms.DeleteQuery("foo"))
+	if _, err := ms.LoadQuery("foo"); err == nil {
+		t.Errorf("query was not deleted")
+	}
+	if _, err := ms.LoadQuery("bar"); err != nil {
+		t.Errorf("deleting a query deleted another query: %s", err)
+	}
+}
+
+func testSavedQueryExprs(t *testing.T, ms puppy.MessageStorage) {
+	strExpr := &puppy.StrQueryExpr{Op: "or", Children: []*puppy.StrQueryExpr{
+		{Op: "and", Children: []*puppy.StrQueryExpr{
+			{Op: "term", Args: []string{"host", "is", "example.com"}},
+			{Op: "not", Children: []*puppy.StrQueryExpr{
+				{Op: "term", Args: []string{"path", "contains", "foo"}},
+			}},
+		}},
+		{Op: "term", Args: []string{"method", "is", "POST"}},
+	}}
+	expr, err := puppy.StrExprToQueryExpr(strExpr)
+	check(t, err)
+
+	check(t, ms.SaveQueryExpr("foo", expr))
+	got, err := ms.LoadQueryExpr("foo")
+	check(t, err)
+	gotStr, err := puppy.QueryExprToStrExpr(got)
+	check(t, err)
+	if !reflect.DeepEqual(gotStr, strExpr) {
+		t.Errorf("incorrect query expression: got %v, want %v", gotStr, strExpr)
+	}
+
+	// Expressions can also be loaded as an equivalent MessageQuery
+	query, err := ms.LoadQuery("foo")
+	check(t, err)
+	strQuery, err := puppy.MsgQueryToStrQuery(query)
+	check(t, err)
+	wantQuery := puppy.StrMessageQuery{
+		puppy.StrQueryPhrase{[]string{"host", "is", "example.com"}, []string{"method", "is", "POST"}},
+		puppy.StrQueryPhrase{[]string{"invert", "path", "contains", "foo"}, []string{"method", "is", "POST"}},
+	}
+	if !reflect.DeepEqual(strQuery, wantQuery) {
+		t.Errorf("incorrect query: got %v, want %v", strQuery, wantQuery)
+	}
+
+	// Queries saved with SaveQuery can be loaded as an expression
+	check(t, ms.SaveQuery("bar", query))
+	barExpr, err := ms.LoadQueryExpr("bar")
+	check(t, err)
+	barQuery, err := puppy.MessageQueryFromExpr(barExpr)
+	check(t, err)
+	barStr, err := puppy.MsgQueryToStrQuery(barQuery)
+	check(t, err)
+	if !reflect.DeepEqual(barStr, wantQuery) {
+		t.Errorf("incorrect query from expression: got %v, want %v", barStr, wantQuery)
+	}
+
+	all, err := ms.AllSavedQueries()
+	check(t, err)
+	found := false
+	for _, q := range all {
+		if q.Name == "foo" {
+			found = true
+			qStr, err := puppy.QueryExprToStrExpr(q.Expr)
+			check(t, err)
+			if !reflect.DeepEqual(qStr, strExpr) {
+				t.Errorf("incorrect saved expression: got %v, want %v", qStr, strExpr)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("saved expression was not listed")
+	}
+
+	check(t, ms.DeleteQuery("foo"))
+	if _, err := ms.LoadQueryExpr("foo"); err == nil {
+		t.Errorf("query expression was not deleted")
+	}
+}
+
+func testSavedQueryInfo(t *testing.T, ms puppy.MessageStorage) {
+	expr := puppy.TermExpr(puppy.FieldHost, puppy.StrIs, "api.example.com")
+	check(t, ms.SaveSavedQuery(&puppy.SavedQuery{
+		Name:        "api",
+		Expr:        expr,
+		Description: "Requests to the API",
+		Folder:      "targets/api",
+	}))
+
+	sq, err := ms.LoadSavedQuery("api")
+	check(t, err)
+	if sq.Name != "api" || sq.Description != "Requests to the API" || sq.Folder != "targets/api" {
+		t.Errorf("incorrect saved query info: %+v", sq)
+	}
+	gotStr, err := puppy.QueryExprToStrExpr(sq.Expr)
+	check(t, err)
+	if !reflect.DeepEqual(gotStr, &puppy.StrQueryExpr{Op: "term", Args: []string{"host", "is", "api.example.com"}}) {
+		t.Errorf("incorrect saved expression: %v", gotStr)
+	}
+	if _, err := ms.LoadSavedQuery("missing"); err == nil {
+		t.Errorf("loading a query that does not exist did not return an error")
+	}
+
+	// Queries saved as a MessageQuery keep their info too
+	query := puppy.MessageQuery{puppy.QueryPhrase{{puppy.FieldMethod, puppy.StrIs, "GET"}}}
+	check(t, ms.SaveSavedQuery(&puppy.SavedQuery{Name: "gets", Query: query, Folder: "methods"}))
+	all, err := ms.AllSavedQueries()
+	check(t, err)
+	folders := make(map[string]string)
+	for _, q := range all {
+		folders[q.Name] = q.Folder
+	}
+	if folders["api"] != "targets/api" || folders["gets"] != "methods" {
+		t.Errorf("incorrect folders in saved queries: %v", folders)
+	}
+
+	// Saving with SaveQuery overwrites the info
+	check(t, ms.SaveQueryExpr("api", expr))
+	sq, err = ms.LoadSavedQuery("api")
+	check(t, err)
+	if sq.Description != "" || sq.Folder != "" {
+		t.Errorf("saved query info was not overwritten: %+v", sq)
+	}
+}
+
+// A recordingWatcher that also records changes to saved queries
+type queryRecordingWatcher struct {
+	recordingWatcher
+}
+
+func (w *queryRecordingWatcher) QuerySaved(ms puppy.MessageStorage, name string) {
+	w.record("QuerySaved %s", name)
+}
+
+func (w *queryRecordingWatcher) QueryDeleted(ms puppy.MessageStorage, name string) {
+	w.record("QueryDeleted %s", name)
+}
+
+func testSavedQueryReferences(t *testing.T, ms puppy.MessageStorage) {
+	start := time.Unix(0, 1500000000000000000)
+	get := newRequest(t, "", start)
+	get.Method = "GET"
+	check(t, puppy.SaveNewRequest(ms, get))
+	post := newRequest(t, "", start.Add(time.Second))
+	check(t, puppy.SaveNewRequest(ms, post))
+
+	w := &queryRecordingWatcher{}
+	check(t, ms.Watch(w))
+	check(t, ms.SaveQueryExpr("gets", puppy.TermExpr(puppy.FieldMethod, puppy.StrIs, "GET")))
+	check(t, ms.SaveQueryExpr("not-gets", puppy.NotExpr(puppy.TermExpr(puppy.FieldSavedQuery, puppy.StrIs, "gets"))))
+	checkEvents(t, &w.recordingWatcher, "QuerySaved gets", "QuerySaved not-gets")
+
+	if ids := searchIds(t, ms, puppy.FieldSavedQuery, puppy.StrIs, "gets"); len(ids) != 1 || !ids[get.DbId] {
+		t.Errorf("incorrect results for a saved query: %v", ids)
+	}
+	// References are resolved recursively
+	if ids := searchIds(t, ms, puppy.FieldSavedQuery, puppy.StrIs, "not-gets"); len(ids) != 1 || !ids[post.DbId] {
+		t.Errorf("incorrect results for a query referencing a saved query: %v", ids)
+	}
+	if ids := searchIds(t, ms, puppy.FieldInvert, puppy.FieldSavedQuery, puppy.StrIs, "not-gets"); len(ids) != 1 || !ids[get.DbId] {
+		t.Errorf("incorrect results for an inverted saved query: %v", ids)
+	}
+	if _, err := ms.Search(0, puppy.FieldSavedQuery, puppy.StrIs, "missing"); err == nil {
+		t.Errorf("searching for a saved query that does not exist did not return an error")
+	}
+
+	// Queries that would reference themselves are rejected
+	cyclic := puppy.TermExpr(puppy.FieldSavedQuery, puppy.StrIs, "not-gets")
+	if err := puppy.ValidateSavedQuery(ms, "gets", cyclic); err == nil {
+		t.Errorf("a saved query cycle was not detected")
+	}
+	check(t, puppy.ValidateSavedQuery(ms, "other", cyclic))
+
+	// Cycles that were saved anyway are detected when searching
+	check(t, ms.SaveQueryExpr("gets", cyclic))
+	if _, err := ms.Search(0, puppy.FieldSavedQuery, puppy.StrIs, "gets"); err == nil {
+		t.Errorf("searching for a saved query cycle did not return an error")
+	}
+
+	check(t, ms.DeleteQuery("gets"))
+	check(t, ms.DeleteQuery("gets"))
+	checkEvents(t, &w.recordingWatcher, "QuerySaved gets", "QueryDeleted gets")
+	check(t, ms.EndWatch(w))
+}
+
+func testPluginValues(t *testing.T, ms puppy.MessageStorage) {
+	if _, err := ms.GetPluginValue("foo"); err == nil {
+		t.Errorf("getting a plugin value that does not exist did not return an error")
+	}
+
+	check(t, ms.SetPluginValue("foo", "bar"))
+	check(t, ms.SetPluginValue("foo", "baz"))
+	check(t, ms.SetPluginValue("other", "value"))
+
+	value, err := ms.GetPluginValue("foo")
+	check(t, err)
+	if value != "baz" {
+		t.Errorf("incorrect plugin value: got %s, want baz", value)
+	}
+}
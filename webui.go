@@ -2,6 +2,7 @@ package puppy
 
 import (
 	"encoding/pem"
+	"errors"
 	"html/template"
 	"net/http"
 	"strings"
@@ -37,6 +38,8 @@ func CreateWebUIHandler() ProxyWebUIHandler {
 		<p>Welcome to Puppy<p>
 		<ul>
 		<li><a href="/certs">Download CA certificate</a></li>
+		<li><a href="/stats">Traffic statistics</a></li>
+		<li><a href="/sitemap">Site map</a></li>
 		</ul>
 	{{end}}
 	`
@@ -68,6 +71,47 @@ func CreateWebUIHandler() ProxyWebUIHandler {
 	`
 	var rspviewTpl *template.Template
 
+	var statsSrc string = `
+	{{define "title"}}Traffic Statistics{{end}}
+	{{define "body"}}
+		<form method="get" action="/stats">
+		<input type="text" name="q" size="60" value="{{.Query}}"></input>
+		<select name="group">
+		{{range .Groups}}<option value="{{.}}"{{if eq . $.Group}} selected{{end}}>{{if .}}{{.}}{{else}}none{{end}}</option>{{end}}
+		</select>
+		<input type="submit" value="Go!"></input>
+		</form>
+		{{if .Error}}<p>{{.Error}}</p>{{end}}
+		<table>
+		<tr><th>Key</th><th>Requests</th><th>Responses</th><th>Average duration</th><th>Request bytes</th><th>Response bytes</th></tr>
+		{{range .Stats}}
+		<tr><td>{{.Key}}</td><td>{{.Count}}</td><td>{{.Responses}}</td><td>{{.AverageDuration}}</td><td>{{.RequestBytes}}</td><td>{{.ResponseBytes}}</td></tr>
+		{{end}}
+		</table>
+	{{end}}
+	`
+	var statsTpl *template.Template
+
+	var sitemapSrc string = `
+	{{define "title"}}Site Map{{end}}
+	{{define "node"}}
+		<li>{{.Name}} ({{.Total}})
+		{{if .Count}}<small>{{range $k, $v := .Methods}} {{$k}}:{{$v}}{{end}}{{range $k, $v := .StatusCodes}} [{{$k}}:{{$v}}]{{end}}{{if .Params}} params:{{range $k, $v := .Params}} {{$k}}{{end}}{{end}}</small>{{end}}
+		{{if .Children}}<ul>{{range .SortedChildren}}{{template "node" .}}{{end}}</ul>{{end}}
+		</li>
+	{{end}}
+	{{define "body"}}
+		<form method="get" action="/sitemap">
+		<input type="text" name="q" size="60" value="{{.Query}}"></input>
+		<label><input type="checkbox" name="scope" value="1"{{if .InScope}} checked{{end}}></input>In scope</label>
+		<input type="submit" value="Go!"></input>
+		</form>
+		{{if .Error}}<p>{{.Error}}</p>{{end}}
+		{{if .Root}}<ul>{{range .Root.SortedChildren}}{{template "node" .}}{{end}}</ul>{{end}}
+	{{end}}
+	`
+	var sitemapTpl *template.Template
+
 	var err error
 	masterTpl, err = template.New("master").Parse(masterSrc)
 	if err != nil {
@@ -89,6 +133,16 @@ func CreateWebUIHandler() ProxyWebUIHandler {
 		panic(err)
 	}
 
+	statsTpl, err = template.Must(masterTpl.Clone()).Parse(statsSrc)
+	if err != nil {
+		panic(err)
+	}
+
+	sitemapTpl, err = template.Must(masterTpl.Clone()).Parse(sitemapSrc)
+	if err != nil {
+		panic(err)
+	}
+
 	var WebUIRootHandler = func(w http.ResponseWriter, r *http.Request, iproxy *InterceptingProxy) {
 		err := homeTpl.Execute(w, nil)
 		if err != nil {
@@ -154,6 +208,60 @@ func CreateWebUIHandler() ProxyWebUIHandler {
 		}
 	}
 
+	type statsPage struct {
+		Query  string
+		Group  string
+		Groups []string
+		Error  string
+		Stats  []*RequestStats
+	}
+
+	var WebUIStatsHandler = func(w http.ResponseWriter, r *http.Request, iproxy *InterceptingProxy) {
+		page := &statsPage{
+			Query:  r.URL.Query().Get("q"),
+			Group:  r.URL.Query().Get("group"),
+			Groups: []string{"", "host", "method", "path", "statuscode", "endpoint"},
+		}
+
+		stats, err := webUIStats(iproxy, page.Query, page.Group)
+		if err != nil {
+			page.Error = err.Error()
+		}
+		page.Stats = stats
+
+		err = statsTpl.Execute(w, page)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	type sitemapPage struct {
+		Query   string
+		InScope bool
+		Error   string
+		Root    *SiteMapNode
+	}
+
+	var WebUISiteMapHandler = func(w http.ResponseWriter, r *http.Request, iproxy *InterceptingProxy) {
+		page := &sitemapPage{
+			Query:   r.URL.Query().Get("q"),
+			InScope: r.URL.Query().Get("scope") != "",
+		}
+
+		root, err := webUISiteMap(iproxy, page.Query, page.InScope)
+		if err != nil {
+			page.Error = err.Error()
+		}
+		page.Root = root
+
+		err = sitemapTpl.Execute(w, page)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
 	return func(w http.ResponseWriter, r *http.Request, iproxy *InterceptingProxy) {
 	    responseHeaders(w)
 	    parts := strings.Split(r.URL.Path, "/")
@@ -164,7 +272,45 @@ func CreateWebUIHandler() ProxyWebUIHandler {
 	        WebUICertsHandler(w, r, iproxy, parts[2:])
 	    case "rsp":
 	        WebUIRspHandler(w, r, iproxy, parts[2:])
+	    case "stats":
+	        WebUIStatsHandler(w, r, iproxy)
+	    case "sitemap":
+	        WebUISiteMapHandler(w, r, iproxy)
 	    }
 	}
 
 }
+
+// Computes the statistics shown on the stats page for the storage used by the proxy
+func webUIStats(iproxy *InterceptingProxy, text string, groupStr string) ([]*RequestStats, error) {
+	ms := iproxy.GetProxyStorage()
+	if ms == nil {
+		return nil, errors.New("the proxy does not have a storage")
+	}
+	query, err := ParseQuery(text)
+	if err != nil {
+		return nil, err
+	}
+	group, err := statsGroupStrToGo(groupStr)
+	if err != nil {
+		return nil, err
+	}
+	return ms.RequestStats(query, group)
+}
+
+// Returns the site map shown on the site map page for the storage used by the proxy
+func webUISiteMap(iproxy *InterceptingProxy, text string, inScope bool) (*SiteMapNode, error) {
+	storageId := iproxy.proxyStorageId()
+	if ms, _ := iproxy.GetMessageStorage(storageId); ms == nil {
+		return nil, errors.New("the proxy does not have a storage")
+	}
+	query, err := ParseQuery(text)
+	if err != nil {
+		return nil, err
+	}
+	sm, err := iproxy.GetSiteMap(storageId, query, inScope)
+	if err != nil {
+		return nil, err
+	}
+	return sm.Tree(0), nil
+}